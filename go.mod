@@ -23,6 +23,7 @@ require (
 	github.com/hashicorp/mdns v1.0.5
 	github.com/influxdata/influxdb1-client v0.0.0-20220302092344-a9ab5670611c
 	github.com/itchyny/volume-go v0.2.2
+	github.com/jonaz/astrotime v0.0.0-20150127084258-5d2b676e5047
 	github.com/jonaz/cron v0.0.0-20190121203350-e9ab53dd31db
 	github.com/jonaz/ginlogrus v0.0.0-20191118094232-2f4da50f5dd6
 	github.com/jonaz/goenocean v0.0.0-20190218201525-96fde8f44745
@@ -45,8 +46,10 @@ require (
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
 	github.com/urfave/cli/v2 v2.25.5
 	github.com/vapourismo/knx-go v0.0.0-20230307194121-5fc424ba6886
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.9.0
 	google.golang.org/genproto/googleapis/api v0.0.0-20230530153820-e85fd2cbaebc
+	nhooyr.io/websocket v1.8.7
 	software.sslmate.com/src/go-pkcs12 v0.2.0
 )
 
@@ -75,7 +78,6 @@ require (
 	github.com/gorilla/sessions v1.2.1 // indirect
 	github.com/hajimehoshi/go-mp3 v0.3.4 // indirect
 	github.com/hajimehoshi/oto v1.0.1 // indirect
-	github.com/jonaz/astrotime v0.0.0-20150127084258-5d2b676e5047 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/klauspost/compress v1.13.6 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.5 // indirect
@@ -113,7 +115,6 @@ require (
 	google.golang.org/protobuf v1.30.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
-	nhooyr.io/websocket v1.8.7 // indirect
 )
 
 replace github.com/hashicorp/mdns => github.com/jonaz/mdns v0.0.0-20220225212800-0d33a91f9c6b
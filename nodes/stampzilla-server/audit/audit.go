@@ -0,0 +1,270 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/* Layout on disk:
+auditlog/
+	2023-10-18.jsonl one entry per line, never rewritten
+
+Each line looks like:
+	{"time":"2023-10-18T12:00:00Z","type":"update-rules","origin":"user","person":"uuid","connection":"conn","diff":[{"path":"uuid/enabled","old":true,"new":false}]}
+*/
+
+const (
+	dayFormat = "2006-01-02"
+	suffix    = ".jsonl"
+)
+
+// DefaultLength is the number of recent entries kept in memory and sent to subscribers.
+const DefaultLength = 200
+
+// Origin is what made the change.
+type Origin string
+
+const (
+	OriginUser Origin = "user"
+	// OriginIntegration is a node that requests a state change on other devices, like google-assistant or alexa.
+	OriginIntegration Origin = "integration"
+	OriginRule        Origin = "rule"
+	OriginSchedule    Origin = "schedule"
+	OriginOverride    Origin = "override"
+)
+
+// Entry is one action in the audit log.
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Type is the message type, like update-rules or state-change.
+	Type   string `json:"type"`
+	Origin Origin `json:"origin"`
+	// Source is the uuid of the rule, scheduled task, override or node that made the change.
+	Source     string          `json:"source,omitempty"`
+	Person     string          `json:"person,omitempty"`
+	Connection string          `json:"connection,omitempty"`
+	Diff       []Change        `json:"diff,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Log is an append-only log on disk. The latest entries are also kept in memory.
+type Log struct {
+	path      string
+	retention time.Duration
+	length    int
+	recent    []Entry
+	sync.Mutex
+}
+
+// New returns a log that stores its files in path. Days older than retention are removed. Zero keeps everything.
+func New(path string, retention time.Duration, length int) *Log {
+	return &Log{
+		path:      path,
+		retention: retention,
+		length:    length,
+		recent:    make([]Entry, 0),
+	}
+}
+
+// Add appends the entry to the log.
+func (l *Log) Add(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("audit: error encoding entry: %w", err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.recent = append(l.recent, e)
+	if len(l.recent) > l.length {
+		l.recent = append([]Entry(nil), l.recent[len(l.recent)-l.length:]...)
+	}
+
+	if err := os.MkdirAll(l.path, 0755); err != nil {
+		return fmt.Errorf("audit: error creating %s: %w", l.path, err)
+	}
+	filename := filepath.Join(l.path, e.Time.Format(dayFormat)+suffix)
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("audit: error opening %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// Recent returns the latest entries, oldest first.
+func (l *Log) Recent() []Entry {
+	l.Lock()
+	defer l.Unlock()
+	list := make([]Entry, len(l.recent))
+	copy(list, l.recent)
+	return list
+}
+
+// Load reads the latest entries from disk into memory.
+func (l *Log) Load() error {
+	days, err := l.days()
+	if err != nil {
+		return err
+	}
+
+	recent := make([]Entry, 0)
+	// Read from the newest day until we have enough entries
+	for i := len(days) - 1; i >= 0 && len(recent) < l.length; i-- {
+		entries, err := readEntries(filepath.Join(l.path, days[i].Format(dayFormat)+suffix))
+		if err != nil {
+			return err
+		}
+		recent = append(entries, recent...)
+	}
+	if len(recent) > l.length {
+		recent = recent[len(recent)-l.length:]
+	}
+
+	l.Lock()
+	l.recent = recent
+	l.Unlock()
+	return nil
+}
+
+// Query returns all entries between from and to, oldest first.
+func (l *Log) Query(from, to time.Time) ([]Entry, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	days, err := l.days()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Entry, 0)
+	firstDay := from.UTC().Truncate(24 * time.Hour)
+	for _, day := range days {
+		if day.Before(firstDay) || day.After(to) {
+			continue
+		}
+		entries, err := readEntries(filepath.Join(l.path, day.Format(dayFormat)+suffix))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Time.Before(from) || e.Time.After(to) {
+				continue
+			}
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+// Start removes days older than the retention once every hour until ctx is canceled.
+func (l *Log) Start(ctx context.Context) {
+	if l.retention <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			if err := l.Maintain(time.Now()); err != nil {
+				logrus.Error(err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Maintain removes days older than the retention.
+func (l *Log) Maintain(now time.Time) error {
+	if l.retention <= 0 {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	days, err := l.days()
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		if !day.Add(24 * time.Hour).Before(now.Add(-l.retention)) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(l.path, day.Format(dayFormat)+suffix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// days returns the days that have a file sorted oldest first.
+func (l *Log) days() ([]time.Time, error) {
+	files, err := ioutil.ReadDir(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	days := make([]time.Time, 0, len(files))
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), suffix) {
+			continue
+		}
+		day, err := time.Parse(dayFormat, strings.TrimSuffix(f.Name(), suffix))
+		if err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Before(days[j])
+	})
+	return days, nil
+}
+
+func readEntries(filename string) ([]Entry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]Entry, 0)
+	decoder := json.NewDecoder(f)
+	for decoder.More() {
+		var e Entry
+		if err := decoder.Decode(&e); err != nil {
+			// A crash can leave a half written last line. Keep what we have.
+			logrus.Warnf("audit: error reading %s: %s", filename, err)
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddRecentAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	l := New(dir, 0, 2)
+	now := time.Now().UTC()
+
+	assert.NoError(t, l.Add(Entry{Time: now.Add(-48 * time.Hour), Type: "update-rules", Origin: OriginUser, Person: "p1"}))
+	assert.NoError(t, l.Add(Entry{Time: now.Add(-time.Hour), Type: "state-change", Origin: OriginRule, Source: "rule"}))
+	assert.NoError(t, l.Add(Entry{Time: now, Type: "update-persons", Origin: OriginUser, Person: "p2"}))
+
+	recent := l.Recent()
+	if assert.Len(t, recent, 2) {
+		assert.Equal(t, "state-change", recent[0].Type)
+		assert.Equal(t, "update-persons", recent[1].Type)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	// A half written last line is ignored
+	f, err := os.OpenFile(filepath.Join(dir, now.Format(dayFormat)+suffix), os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`{"time":"`)
+	assert.NoError(t, err)
+	f.Close()
+
+	l = New(dir, 0, 2)
+	assert.NoError(t, l.Load())
+	recent = l.Recent()
+	if assert.Len(t, recent, 2) {
+		assert.Equal(t, "rule", recent[0].Source)
+		assert.Equal(t, "p2", recent[1].Person)
+	}
+}
+
+func TestQueryAndMaintain(t *testing.T) {
+	dir := t.TempDir()
+	l := New(dir, 24*time.Hour, DefaultLength)
+	now := time.Now().UTC()
+
+	assert.NoError(t, l.Add(Entry{Time: now.Add(-72 * time.Hour), Type: "old"}))
+	assert.NoError(t, l.Add(Entry{Time: now.Add(-2 * time.Hour), Type: "a"}))
+	assert.NoError(t, l.Add(Entry{Time: now, Type: "b"}))
+
+	entries, err := l.Query(now.Add(-3*time.Hour), now)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "a", entries[0].Type)
+		assert.Equal(t, "b", entries[1].Type)
+	}
+
+	assert.NoError(t, l.Maintain(now))
+	entries, err = l.Query(now.Add(-96*time.Hour), now)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestDiff(t *testing.T) {
+	type person struct {
+		Name     string            `json:"name"`
+		Password string            `json:"password,omitempty"`
+		Tags     []string          `json:"tags"`
+		Extra    map[string]string `json:"extra,omitempty"`
+	}
+
+	old := map[string]person{
+		"1": {Name: "a", Tags: []string{"x"}},
+		"2": {Name: "b"},
+	}
+	new := map[string]person{
+		"1": {Name: "a", Password: "secret", Tags: []string{"x", "y"}, Extra: map[string]string{"k": "v"}},
+		"3": {Name: "c"},
+	}
+
+	changes, err := Diff(old, new)
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Path: "1/extra", New: map[string]interface{}{"k": "v"}},
+		{Path: "1/password", New: redacted},
+		{Path: "1/tags", Old: []interface{}{"x"}, New: []interface{}{"x", "y"}},
+		{Path: "2", Old: map[string]interface{}{"name": "b", "tags": nil}},
+		{Path: "3", New: map[string]interface{}{"name": "c", "tags": nil}},
+	}, changes)
+
+	changes, err = Diff(old, old)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 0)
+}
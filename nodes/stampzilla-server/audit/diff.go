@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change is a changed value in an object. Path is the json keys joined by /.
+// Old is missing if the value was added and New is missing if it was removed.
+type Change struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// redacted replaces the values of keys that contain a password.
+const redacted = "[redacted]"
+
+// Diff returns the changes between the json representation of old and new, sorted by path.
+// Lists are compared as one value.
+func Diff(old, new interface{}) ([]Change, error) {
+	a, err := normalize(old)
+	if err != nil {
+		return nil, err
+	}
+	b, err := normalize(new)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, 0)
+	diff("", a, b, &changes)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func normalize(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var n interface{}
+	err = json.Unmarshal(data, &n)
+	return n, err
+}
+
+func diff(path string, a, b interface{}, changes *[]Change) {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if aok && bok {
+		for k, av := range am {
+			diff(join(path, k), av, bm[k], changes)
+		}
+		for k, bv := range bm {
+			if _, ok := am[k]; !ok {
+				diff(join(path, k), nil, bv, changes)
+			}
+		}
+		return
+	}
+
+	if reflect.DeepEqual(a, b) {
+		return
+	}
+	if strings.Contains(strings.ToLower(path), "password") {
+		a, b = redact(a), redact(b)
+	}
+	*changes = append(*changes, Change{Path: path, Old: a, New: b})
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "/" + key
+}
+
+func redact(v interface{}) interface{} {
+	if v == nil || v == "" {
+		return v
+	}
+	return redacted
+}
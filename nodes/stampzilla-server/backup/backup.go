@@ -0,0 +1,346 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+	"github.com/stampzilla/stampzilla-go/v2/pkg/build"
+)
+
+// FormatVersion is the version of the archive format. Archives with a newer version can not be imported.
+const FormatVersion = 1
+
+const manifestName = "manifest.json"
+
+// Documents are the configuration documents in the storage backend. Folders are included with all their documents.
+var Documents = []string{
+	"rules.json",
+	"blueprints.json",
+	"savedstate.json",
+	"scenes.json",
+	"schedule.json",
+	"computeddevices.json",
+	"virtualdevices.json",
+	"destinations.json",
+	"senders.json",
+	"persons.json",
+}
+
+// DocumentFolders are the folders of configuration documents in the storage backend.
+var DocumentFolders = []string{
+	"configs",
+}
+
+// Files are the configuration files and directories that are always stored on disk.
+var Files = []string{
+	"config.json",
+	"certificates",
+}
+
+// Merge returns the content to import for a file from the existing and the imported content.
+type Merge func(existing, imported []byte) ([]byte, error)
+
+// merges are the files that are merged with the existing file when they are imported.
+var merges = make(map[string]Merge)
+
+// RegisterMerge makes imports merge the file with the existing one instead of replacing it. It is used for state
+// that must not be rolled back by a restore, like revoked certificates.
+func RegisterMerge(name string, merge Merge) {
+	merges[name] = merge
+}
+
+// Manifest is stored first in each archive and describes its content.
+type Manifest struct {
+	Version int        `json:"version"`
+	Created time.Time  `json:"created"`
+	Server  build.Data `json:"server"`
+	Files   []string   `json:"files"`
+}
+
+type file struct {
+	name string
+	mode os.FileMode
+	data []byte
+}
+
+func inList(name string, list []string) bool {
+	for _, p := range list {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isDocument returns true if name is stored in the storage backend.
+func isDocument(name string) bool {
+	return inList(name, Documents) || inList(path.Dir(name), DocumentFolders)
+}
+
+// allowed returns true if name is a document or one of the files.
+func allowed(name string) bool {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "..") {
+		return false
+	}
+	return isDocument(name) || inList(name, Files)
+}
+
+// documents returns the configuration documents that exists in the backend.
+func documents(b persist.Backend) ([]string, error) {
+	list := []string{}
+	for _, name := range Documents {
+		if _, err := b.Get(name); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		list = append(list, name)
+	}
+	for _, folder := range DocumentFolders {
+		names, err := b.List(folder)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, names...)
+	}
+	return list, nil
+}
+
+// files returns the configuration files that exists in dir.
+func files(dir string) ([]string, error) {
+	list := []string{}
+	for _, p := range Files {
+		err := filepath.Walk(filepath.Join(dir, p), func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// The previous versions and temporary files of persist are not configuration
+			if !info.Mode().IsRegular() || strings.HasSuffix(name, persist.BackupSuffix) || strings.HasPrefix(info.Name(), persist.TempPrefix) {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, name)
+			if err != nil {
+				return err
+			}
+			list = append(list, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// Export writes a tar.gz archive with the configuration documents in b and the configuration files in dir to w.
+func Export(w io.Writer, b persist.Backend, dir string) (*Manifest, error) {
+	docs, err := documents(b)
+	if err != nil {
+		return nil, fmt.Errorf("backup: error listing documents: %s", err)
+	}
+	names, err := files(dir)
+	if err != nil {
+		return nil, fmt.Errorf("backup: error listing files: %s", err)
+	}
+
+	manifest := &Manifest{
+		Version: FormatVersion,
+		Created: time.Now(),
+		Server: build.Data{
+			Version:   build.Version,
+			BuildTime: build.BuildTime,
+			Commit:    build.Commit,
+		},
+		Files: append(docs, names...),
+	}
+	m, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	write := func(name string, mode os.FileMode, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    int64(mode.Perm()),
+			Size:    int64(len(data)),
+			ModTime: manifest.Created,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+
+	if err := write(manifestName, 0644, m); err != nil {
+		return nil, fmt.Errorf("backup: error writing manifest: %s", err)
+	}
+	for _, name := range docs {
+		data, err := b.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("backup: error reading %s: %s", name, err)
+		}
+		if err := write(name, 0644, data); err != nil {
+			return nil, fmt.Errorf("backup: error writing %s: %s", name, err)
+		}
+	}
+	for _, name := range names {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("backup: error reading %s: %s", name, err)
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("backup: error reading %s: %s", name, err)
+		}
+		if err := write(name, info.Mode(), data); err != nil {
+			return nil, fmt.Errorf("backup: error writing %s: %s", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, gw.Close()
+}
+
+// read reads and validates a whole archive.
+func read(r io.Reader) (*Manifest, []file, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("backup: not a valid archive: %s", err)
+	}
+	defer gr.Close()
+
+	var manifest *Manifest
+	list := []file{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("backup: not a valid archive: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("backup: error reading %s: %s", hdr.Name, err)
+		}
+
+		if hdr.Name == manifestName {
+			manifest = &Manifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, nil, fmt.Errorf("backup: invalid manifest: %s", err)
+			}
+			continue
+		}
+		if !allowed(hdr.Name) {
+			return nil, nil, fmt.Errorf("backup: file %s is not allowed in a backup", hdr.Name)
+		}
+		list = append(list, file{name: hdr.Name, mode: os.FileMode(hdr.Mode).Perm(), data: data})
+	}
+
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("backup: manifest is missing")
+	}
+	if manifest.Version > FormatVersion {
+		return nil, nil, fmt.Errorf("backup: archive version %d is newer than supported version %d", manifest.Version, FormatVersion)
+	}
+	return manifest, list, nil
+}
+
+// Verify reads the whole archive and returns its manifest if it can be imported.
+func Verify(r io.Reader) (*Manifest, error) {
+	manifest, _, err := read(r)
+	return manifest, err
+}
+
+// Import stores the documents in the archive in b, in one transaction if b supports it, and writes the files to dir.
+// Nothing is written if the archive is invalid. Existing documents and files that are not in the archive are kept,
+// and files with a registered Merge are merged with the existing file.
+func Import(r io.Reader, b persist.Backend, dir string) (*Manifest, error) {
+	manifest, list, err := read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make(map[string][]byte)
+	for i, f := range list {
+		if isDocument(f.name) {
+			docs[f.name] = f.data
+			continue
+		}
+		merge, ok := merges[f.name]
+		if !ok {
+			continue
+		}
+		existing, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(f.name)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("backup: error reading %s: %s", f.name, err)
+		}
+		if list[i].data, err = merge(existing, f.data); err != nil {
+			return nil, fmt.Errorf("backup: error merging %s: %s", f.name, err)
+		}
+	}
+	if err := b.Put(docs); err != nil {
+		return nil, fmt.Errorf("backup: error importing documents: %s", err)
+	}
+
+	for _, f := range list {
+		if isDocument(f.name) {
+			continue
+		}
+		p := filepath.Join(dir, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, fmt.Errorf("backup: error importing %s: %s", f.name, err)
+		}
+		if err := persist.WriteFile(p, f.data, f.mode); err != nil {
+			return nil, fmt.Errorf("backup: error importing %s: %s", f.name, err)
+		}
+	}
+	return manifest, nil
+}
+
+// MigrateFiles copies the documents from the json files in dir to b if b has no documents yet.
+// It is used the first time the server starts with a database as storage. It returns the number of copied documents.
+func MigrateFiles(dir string, b persist.Backend) (int, error) {
+	existing, err := documents(b)
+	if err != nil {
+		return 0, err
+	}
+	if len(existing) > 0 {
+		return 0, nil
+	}
+
+	from := persist.NewFileBackend(dir)
+	names, err := documents(from)
+	if err != nil {
+		return 0, err
+	}
+	if len(names) == 0 {
+		return 0, nil
+	}
+	return len(names), persist.Migrate(from, b, names)
+}
@@ -0,0 +1,206 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist/boltdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(name)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestExportImport(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"rules.json":            `{"rule":{}}`,
+		"config.json":           `{"port":"8080"}`,
+		"configs/node.json":     `{"uuid":"node"}`,
+		"certificates/ca.crt":   "cert",
+		"devicehistory/1.json":  "not included",
+		"someotherfile.json":    "not included",
+		"backups/snapshot.json": "not included",
+	})
+
+	var buf bytes.Buffer
+	manifest, err := Export(&buf, persist.NewFileBackend(src), src)
+	assert.NoError(t, err)
+	assert.Equal(t, FormatVersion, manifest.Version)
+	assert.Equal(t, []string{"rules.json", "configs/node.json", "config.json", "certificates/ca.crt"}, manifest.Files)
+
+	dst := t.TempDir()
+	writeFiles(t, dst, map[string]string{
+		"rules.json":        `{}`,
+		"configs/keep.json": `{"uuid":"keep"}`,
+	})
+	manifest, err = Import(bytes.NewReader(buf.Bytes()), persist.NewFileBackend(dst), dst)
+	assert.NoError(t, err)
+	assert.Len(t, manifest.Files, 4)
+	assert.Equal(t, `{"rule":{}}`, readFile(t, filepath.Join(dst, "rules.json")))
+	assert.Equal(t, `{"uuid":"node"}`, readFile(t, filepath.Join(dst, "configs", "node.json")))
+	assert.Equal(t, "cert", readFile(t, filepath.Join(dst, "certificates", "ca.crt")))
+	// Files that are not in the archive are kept
+	assert.Equal(t, `{"uuid":"keep"}`, readFile(t, filepath.Join(dst, "configs", "keep.json")))
+
+	// With a database the documents are stored in it and the files on disk
+	dst = t.TempDir()
+	db, err := boltdb.New(filepath.Join(dst, "stampzilla.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+	_, err = Import(bytes.NewReader(buf.Bytes()), db, dst)
+	assert.NoError(t, err)
+	data, err := db.Get("configs/node.json")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"uuid":"node"}`, string(data))
+	assert.Equal(t, `{"port":"8080"}`, readFile(t, filepath.Join(dst, "config.json")))
+	_, err = os.Stat(filepath.Join(dst, "rules.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestImportMerge(t *testing.T) {
+	RegisterMerge("certificates/merged.json", func(existing, imported []byte) ([]byte, error) {
+		return append(existing, imported...), nil
+	})
+	defer delete(merges, "certificates/merged.json")
+
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"certificates/merged.json": "old",
+		"certificates/ca.crt":      "old cert",
+	})
+	var buf bytes.Buffer
+	_, err := Export(&buf, persist.NewFileBackend(src), src)
+	assert.NoError(t, err)
+
+	dst := t.TempDir()
+	writeFiles(t, dst, map[string]string{
+		"certificates/merged.json": "new",
+		"certificates/ca.crt":      "new cert",
+	})
+	_, err = Import(bytes.NewReader(buf.Bytes()), persist.NewFileBackend(dst), dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "newold", readFile(t, filepath.Join(dst, "certificates", "merged.json")))
+	assert.Equal(t, "old cert", readFile(t, filepath.Join(dst, "certificates", "ca.crt")))
+
+	// The file is imported as it is if there is no existing file
+	dst = t.TempDir()
+	_, err = Import(bytes.NewReader(buf.Bytes()), persist.NewFileBackend(dst), dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "old", readFile(t, filepath.Join(dst, "certificates", "merged.json")))
+}
+
+func TestImportRejectsInvalidArchives(t *testing.T) {
+	archive := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for name, content := range files {
+			assert.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+			_, err := tw.Write([]byte(content))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, tw.Close())
+		assert.NoError(t, gw.Close())
+		return buf.Bytes()
+	}
+
+	dst := t.TempDir()
+	b := persist.NewFileBackend(dst)
+	_, err := Import(bytes.NewReader(archive(map[string]string{"rules.json": "{}"})), b, dst)
+	assert.EqualError(t, err, "backup: manifest is missing")
+
+	_, err = Import(bytes.NewReader(archive(map[string]string{manifestName: `{"version":1}`, "../rules.json": "{}"})), b, dst)
+	assert.EqualError(t, err, "backup: file ../rules.json is not allowed in a backup")
+
+	_, err = Import(bytes.NewReader(archive(map[string]string{manifestName: `{"version":2}`, "rules.json": "{}"})), b, dst)
+	assert.EqualError(t, err, "backup: archive version 2 is newer than supported version 1")
+
+	_, err = Import(bytes.NewReader([]byte("not an archive")), b, dst)
+	assert.Error(t, err)
+
+	// Nothing is written when the archive is rejected
+	_, err = os.Stat(filepath.Join(dst, "rules.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSnapshotsRotateAndRestore(t *testing.T) {
+	src := t.TempDir()
+	dir := filepath.Join(src, DefaultDir)
+	s := NewSnapshots(dir, src, persist.NewFileBackend(src), 2)
+
+	for _, content := range []string{"1", "2", "3"} {
+		writeFiles(t, src, map[string]string{"rules.json": content})
+		_, err := s.Create()
+		assert.NoError(t, err)
+	}
+	list, err := s.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+
+	// Restore the oldest snapshot that is left, which has the second version
+	_, err = s.SetPendingSnapshot(list[1].Name)
+	assert.NoError(t, err)
+	applied, err := s.ApplyPending()
+	assert.NoError(t, err)
+	assert.True(t, applied)
+	assert.Equal(t, "2", readFile(t, filepath.Join(src, "rules.json")))
+
+	// A snapshot of the configuration before the import was taken
+	list, err = s.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	_, err = os.Stat(filepath.Join(dir, pendingName))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = s.Path("../rules.json")
+	assert.EqualError(t, err, "backup: invalid snapshot name ../rules.json")
+}
+
+func TestMigrateFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"rules.json":         `{}`,
+		"configs/node.json":  `{"uuid":"node"}`,
+		"config.json":        `{}`,
+		"someotherfile.json": `{}`,
+	})
+	db, err := boltdb.New(filepath.Join(dir, "stampzilla.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	n, err := MigrateFiles(dir, db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	data, err := db.Get("configs/node.json")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"uuid":"node"}`, string(data))
+	_, err = db.Get("config.json")
+	assert.True(t, os.IsNotExist(err))
+
+	// Nothing is copied once the database has documents
+	writeFiles(t, dir, map[string]string{"rules.json": `{"rule":{}}`})
+	n, err = MigrateFiles(dir, db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	data, err = db.Get("rules.json")
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(data))
+}
@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+)
+
+const usage = `usage: stampzilla-server backup <command>
+
+commands:
+  export <file>    write all configuration to a tar.gz archive
+  import <file>    replace the configuration with the content of an archive
+  list             list the automatic snapshots
+  restore <name>   replace the configuration with a snapshot
+
+import and restore must be run while the server is stopped. A snapshot of the current configuration is taken first.`
+
+// Command runs the backup command line tool from the server directory.
+func Command(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	b := persist.CurrentBackend()
+	snapshots := NewSnapshots(DefaultDir, ".", b, 0)
+
+	arg := func() (string, error) {
+		if len(args) != 2 {
+			return "", errors.New(usage)
+		}
+		return args[1], nil
+	}
+
+	importFile := func(name string) error {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := Verify(f); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		snapshot, err := snapshots.Create()
+		if err != nil {
+			return err
+		}
+		manifest, err := Import(f, b, ".")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "imported %d files from backup created %s\n", len(manifest.Files), manifest.Created.Format(time.RFC3339))
+		fmt.Fprintf(stdout, "the previous configuration is saved in snapshot %s\n", snapshot)
+		return nil
+	}
+
+	switch args[0] {
+	case "export":
+		name, err := arg()
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		manifest, err := Export(f, b, ".")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "exported %d files to %s\n", len(manifest.Files), name)
+		return nil
+	case "import":
+		name, err := arg()
+		if err != nil {
+			return err
+		}
+		return importFile(name)
+	case "restore":
+		name, err := arg()
+		if err != nil {
+			return err
+		}
+		p, err := snapshots.Path(name)
+		if err != nil {
+			return err
+		}
+		return importFile(p)
+	case "list":
+		list, err := snapshots.List()
+		if err != nil {
+			return err
+		}
+		for _, s := range list {
+			fmt.Fprintf(stdout, "%s\t%s\t%d\n", s.Name, s.Created.Format(time.RFC3339), s.Size)
+		}
+		return nil
+	}
+	return errors.New(usage)
+}
+
+// ApplyPending imports an archive that was imported over the websocket while the server was running.
+// It returns true if config.json might have changed and has to be loaded again.
+func ApplyPending() (bool, error) {
+	return NewSnapshots(DefaultDir, ".", persist.CurrentBackend(), 0).ApplyPending()
+}
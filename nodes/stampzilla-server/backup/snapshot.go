@@ -0,0 +1,217 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+)
+
+// DefaultDir is where snapshots and pending imports are stored.
+const DefaultDir = "backups"
+
+const (
+	snapshotSuffix = ".tar.gz"
+	// pendingName is an archive that is imported on the next start of the server.
+	pendingName = "pending-import" + snapshotSuffix
+	// snapshotDelay is how long to wait after a save before the snapshot is taken so a burst of saves only gives one snapshot.
+	snapshotDelay = 5 * time.Second
+)
+
+// Snapshot is a backup archive that was taken automatically.
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+}
+
+// Snapshots keeps a rotating list of archives of the configuration in a directory.
+type Snapshots struct {
+	dir     string
+	source  string
+	backend persist.Backend
+	keep    int
+	delay   time.Duration
+	timer   *time.Timer
+	onNew   func()
+	sync.Mutex
+}
+
+// NewSnapshots returns snapshots of the configuration in the backend b and the files in source that are stored in dir.
+// Only the keep latest snapshots are kept. Automatic snapshots are disabled and nothing is removed if keep is 0.
+func NewSnapshots(dir, source string, b persist.Backend, keep int) *Snapshots {
+	return &Snapshots{
+		dir:     dir,
+		source:  source,
+		backend: b,
+		keep:    keep,
+		delay:   snapshotDelay,
+		onNew:   func() {},
+	}
+}
+
+// OnNew is called when a snapshot has been taken.
+func (s *Snapshots) OnNew(callback func()) {
+	s.onNew = callback
+}
+
+// Trigger takes a snapshot when nothing has been saved for a while.
+func (s *Snapshots) Trigger() {
+	if s.keep <= 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(s.delay, func() {
+		if _, err := s.Create(); err != nil {
+			logrus.Error(err)
+		}
+	})
+}
+
+// Create takes a snapshot now and removes the oldest ones. It returns the name of the new snapshot.
+func (s *Snapshots) Create() (string, error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return "", fmt.Errorf("backup: error creating %s: %s", s.dir, err)
+	}
+
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + snapshotSuffix
+	tmp, err := ioutil.TempFile(s.dir, ".snapshot")
+	if err != nil {
+		return "", fmt.Errorf("backup: error creating snapshot: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = Export(tmp, s.backend, s.source)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return "", fmt.Errorf("backup: error creating snapshot: %s", err)
+	}
+	logrus.Debugf("backup: created snapshot %s", name)
+
+	if err := s.prune(); err != nil {
+		return name, err
+	}
+	s.onNew()
+	return name, nil
+}
+
+func (s *Snapshots) prune() error {
+	if s.keep <= 0 {
+		return nil
+	}
+	list, err := s.List()
+	if err != nil {
+		return err
+	}
+	for i := s.keep; i < len(list); i++ {
+		if err := os.Remove(filepath.Join(s.dir, list[i].Name)); err != nil {
+			return fmt.Errorf("backup: error removing snapshot %s: %s", list[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// List returns all snapshots with the newest first.
+func (s *Snapshots) List() ([]Snapshot, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Snapshot{}, nil
+		}
+		return nil, fmt.Errorf("backup: error listing snapshots: %s", err)
+	}
+
+	list := []Snapshot{}
+	for _, f := range files {
+		if !f.Mode().IsRegular() || !strings.HasSuffix(f.Name(), snapshotSuffix) || f.Name() == pendingName {
+			continue
+		}
+		list = append(list, Snapshot{Name: f.Name(), Created: f.ModTime(), Size: f.Size()})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name > list[j].Name
+	})
+	return list, nil
+}
+
+// Path returns the path to the snapshot or an error if it does not exist.
+func (s *Snapshots) Path(name string) (string, error) {
+	if filepath.Base(name) != name || !strings.HasSuffix(name, snapshotSuffix) || name == pendingName {
+		return "", fmt.Errorf("backup: invalid snapshot name %s", name)
+	}
+	p := filepath.Join(s.dir, name)
+	if _, err := os.Stat(p); err != nil {
+		return "", fmt.Errorf("backup: snapshot %s does not exist", name)
+	}
+	return p, nil
+}
+
+// SetPending verifies the archive and stores it to be imported on the next start with ApplyPending.
+// The running server would otherwise overwrite the imported files with its own state when it saves.
+func (s *Snapshots) SetPending(data []byte) (*Manifest, error) {
+	manifest, err := Verify(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, fmt.Errorf("backup: error creating %s: %s", s.dir, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.dir, pendingName), data, 0600); err != nil {
+		return nil, fmt.Errorf("backup: error saving pending import: %s", err)
+	}
+	return manifest, nil
+}
+
+// SetPendingSnapshot schedules a snapshot to be imported on the next start.
+func (s *Snapshots) SetPendingSnapshot(name string) (*Manifest, error) {
+	p, err := s.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("backup: error reading snapshot %s: %s", name, err)
+	}
+	return s.SetPending(data)
+}
+
+// ApplyPending imports a pending archive and returns true if there was one. A snapshot of the current configuration is taken first.
+// It must be run before any configuration is loaded.
+func (s *Snapshots) ApplyPending() (bool, error) {
+	p := filepath.Join(s.dir, pendingName)
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("backup: error opening pending import: %s", err)
+	}
+	defer f.Close()
+
+	if _, err := s.Create(); err != nil {
+		return false, err
+	}
+	manifest, err := Import(f, s.backend, s.source)
+	if err != nil {
+		return false, err
+	}
+	logrus.Infof("backup: imported backup created %s", manifest.Created.Format(time.RFC3339))
+	return true, os.Remove(p)
+}
@@ -38,13 +38,30 @@ type CA struct {
 
 	Store *store.Store
 
+	// Validity is how long issued node and user certificates are valid.
+	Validity time.Duration
+	// RenewBefore is how long before expiry nodes are asked to renew their certificate.
+	RenewBefore time.Duration
+	// WarnBefore is how long before expiry a warning is sent to WarnDestinations.
+	WarnBefore       time.Duration
+	WarnDestinations []string
+	// MaxPendingRequests is the number of certificate requests that can wait for approval at the same time and
+	// MaxPendingRequestsPerIP the number from one ip address. 0 is no limit.
+	MaxPendingRequests      int
+	MaxPendingRequestsPerIP int
+
+	revocations revocations
+	warned      map[string]bool
+
 	sync.Mutex
 }
 
 func New() *CA {
 	return &CA{
-		X509: make(map[string]*x509.Certificate),
-		TLS:  make(map[string]*tls.Certificate),
+		X509:     make(map[string]*x509.Certificate),
+		TLS:      make(map[string]*tls.Certificate),
+		Validity: 10 * 365 * 24 * time.Hour,
+		warned:   make(map[string]bool),
 	}
 }
 
@@ -88,7 +105,12 @@ func (ca *CA) Load(name string) error {
 		ca.CATLS = &certTLS
 		ca.CAX509 = certX509
 		ca.Unlock()
-		return nil
+
+		if err := ca.loadRevocations(); err != nil {
+			return err
+		}
+		ca.recordExisting()
+		return ca.publishCRL()
 	}
 	ca.Lock()
 	ca.TLS[name] = &certTLS
@@ -116,7 +138,7 @@ func (ca *CA) CreateCA() error {
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().AddDate(10, 0, 0), // 10 years
 		IsCA:                  true,
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 	}
 
@@ -195,11 +217,25 @@ func (ca *CA) CreateCertificateFromRequest(wr io.Writer, c string, r models.Requ
 		return err
 	}
 
-	approved := <-ca.WaitForApproval(clientCSR.Subject, c, r)
+	wait, err := ca.WaitForApproval(clientCSR.Subject, c, r)
+	if err != nil {
+		return err
+	}
+	approved := <-wait
 	if approved != true {
 		return fmt.Errorf("Request was not approved")
 	}
 
+	certBytes, err := ca.signRequest(clientCSR)
+	if err != nil {
+		return err
+	}
+
+	return pem.Encode(wr, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+}
+
+// signRequest issues a client certificate for a verified CSR and saves it as <common name>.crt.
+func (ca *CA) signRequest(clientCSR *x509.CertificateRequest) ([]byte, error) {
 	// create client certificate template
 	clientCRTTemplate := x509.Certificate{
 		Signature:          clientCSR.Signature,
@@ -212,7 +248,7 @@ func (ca *CA) CreateCertificateFromRequest(wr io.Writer, c string, r models.Requ
 		Issuer:       ca.CAX509.Subject,
 		Subject:      clientCSR.Subject,
 		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(10, 0, 0), // 10 years
+		NotAfter:     time.Now().Add(ca.Validity),
 		KeyUsage:     x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
@@ -220,24 +256,33 @@ func (ca *CA) CreateCertificateFromRequest(wr io.Writer, c string, r models.Requ
 	// create client certificate from template and CA public key
 	certBytes, err := x509.CreateCertificate(rand.Reader, &clientCRTTemplate, ca.CAX509, clientCRTTemplate.PublicKey, ca.CATLS.PrivateKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Save the issued certificate to file
 	certOut, err := os.Create(path.Join(storagePath, clientCSR.Subject.CommonName+".crt"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	certOut.Close()
 	logrus.Info("Wrote " + clientCSR.Subject.CommonName + ".crt\n")
 
+	err = ca.recordIssued(Issued{
+		Serial:     clientCRTTemplate.SerialNumber.String(),
+		CommonName: clientCSR.Subject.CommonName,
+		Expires:    clientCRTTemplate.NotAfter,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	ca.Store.UpdateCertificates(ca.GetCertificates())
 
-	return pem.Encode(wr, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	return certBytes, nil
 }
 
 func (ca *CA) CreateClientCertificate(uuid string) ([]byte, error) {
@@ -255,7 +300,7 @@ func (ca *CA) CreateClientCertificate(uuid string) ([]byte, error) {
 			CommonName:         uuid,
 		},
 		NotBefore:   time.Now(),
-		NotAfter:    time.Now().AddDate(10, 0, 0), // 10 years
+		NotAfter:    time.Now().Add(ca.Validity),
 		KeyUsage:    x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
@@ -279,6 +324,15 @@ func (ca *CA) CreateClientCertificate(uuid string) ([]byte, error) {
 	certOut.Close()
 	logrus.Info("Wrote " + recipe.Subject.CommonName + ".crt\n")
 
+	err = ca.recordIssued(Issued{
+		Serial:     recipe.SerialNumber.String(),
+		CommonName: recipe.Subject.CommonName,
+		Expires:    recipe.NotAfter,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	ca.Store.UpdateCertificates(ca.GetCertificates())
 
 	certX509, err := x509.ParseCertificate(certBytes)
@@ -330,10 +384,14 @@ func (ca *CA) ExportToDisk(name string, certBytes []byte, privateKey *rsa.Privat
 	return nil
 }
 
+// GetNextSerial returns a random serial. Serials have to be unique since certificates are revoked by serial, and
+// renewed certificates replace the file of the old one.
 func (ca *CA) GetNextSerial() *big.Int {
-	// TODO: Make something more sofisticated than counting the amount of certs :)
-	certificates := ca.GetCertificates()
-	return big.NewInt(int64(1000 + len(certificates)))
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return serial
 }
 
 func (ca *CA) GetCertificates() []store.Certificate {
@@ -382,10 +440,9 @@ func (ca *CA) GetCertificates() []store.Certificate {
 			},
 			CommonName: crt.Subject.CommonName,
 			IsCA:       crt.IsCA,
-			// Usage      []string
-			// Revoked    bool
-			Issued:  crt.NotBefore,
-			Expires: crt.NotAfter,
+			Revoked:    ca.IsRevoked(crt.SerialNumber),
+			Issued:     crt.NotBefore,
+			Expires:    crt.NotAfter,
 
 			Fingerprints: map[string]string{
 				"sha1":   hex.EncodeToString(sh1[:]),
@@ -412,7 +469,12 @@ func (ca *CA) GetCertificates() []store.Certificate {
 	return certs
 }
 
-func (ca *CA) WaitForApproval(s pkix.Name, c string, r models.Request) chan bool {
+func (ca *CA) WaitForApproval(s pkix.Name, c string, r models.Request) (chan bool, error) {
+	remoteAddr := ""
+	if conn := ca.Store.Connection(c); conn != nil {
+		remoteAddr = conn.RemoteAddr
+	}
+
 	req := store.Request{
 		Identity: s.CommonName,
 		Subject: store.RequestSubject{
@@ -427,6 +489,7 @@ func (ca *CA) WaitForApproval(s pkix.Name, c string, r models.Request) chan bool
 			PostalCode:         s.PostalCode,
 		},
 		Connection: c,
+		RemoteAddr: remoteAddr,
 
 		Type:    r.Type,
 		Version: r.Version,
@@ -434,9 +497,11 @@ func (ca *CA) WaitForApproval(s pkix.Name, c string, r models.Request) chan bool
 		Approved: make(chan bool),
 	}
 
-	ca.Store.AddRequest(req)
+	if err := ca.Store.AddRequest(req, ca.MaxPendingRequests, ca.MaxPendingRequestsPerIP); err != nil {
+		return nil, err
+	}
 
-	return req.Approved
+	return req.Approved, nil
 }
 
 // Dynamic TLS server config.
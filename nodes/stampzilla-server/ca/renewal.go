@@ -0,0 +1,141 @@
+package ca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
+)
+
+// checkInterval is how often certificates are checked for expiry and the CRL is published again.
+const checkInterval = 12 * time.Hour
+
+// NeedsRenewal returns true if the client certificate of the common name expires within RenewBefore.
+func (ca *CA) NeedsRenewal(commonName string, now time.Time) bool {
+	if ca.RenewBefore <= 0 {
+		return false
+	}
+	for _, c := range ca.GetCertificates() {
+		if c.CommonName != commonName || c.IsCA || c.Revoked || !hasUsage(c.Usage, "client") {
+			continue
+		}
+		return c.Expires.Sub(now) < ca.RenewBefore
+	}
+	return false
+}
+
+// RenewCertificate issues a new certificate for a CSR from a node that is connected with its current certificate.
+// The CSR must be for the same identity and the current certificate must be due for renewal. The previous
+// certificates of the identity are revoked, the connection that uses one is kept until the node reconnects.
+func (ca *CA) RenewCertificate(identity string, csr string) ([]byte, error) {
+	pemBlock, _ := pem.Decode([]byte(csr))
+	if pemBlock == nil {
+		return nil, fmt.Errorf("ca: invalid CSR")
+	}
+	clientCSR, err := x509.ParseCertificateRequest(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = clientCSR.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	if clientCSR.Subject.CommonName != identity {
+		return nil, fmt.Errorf("ca: CSR for %s does not match the identity %s", clientCSR.Subject.CommonName, identity)
+	}
+	if !ca.NeedsRenewal(identity, time.Now()) {
+		return nil, fmt.Errorf("ca: certificate for %s does not need renewal", identity)
+	}
+
+	certBytes, err := ca.signRequest(clientCSR)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Renewed certificate for %s", identity)
+	ca.revokePrevious(identity, crt.SerialNumber.String())
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), nil
+}
+
+// RequestRenewals asks all nodes that are connected with a certificate that is due for renewal to send a new CSR.
+func (ca *CA) RequestRenewals(sender websocket.Sender, now time.Time) {
+	for id, c := range ca.Store.GetConnections() {
+		if c.Type != "node" || c.Attributes["secure"] != "cert" {
+			continue
+		}
+		identity, _ := c.Attributes["identity"].(string)
+		if !ca.NeedsRenewal(identity, now) {
+			continue
+		}
+		if err := sender.SendToID(id, "renew-certificate", nil); err != nil {
+			logrus.Error("ca: ", err)
+		}
+	}
+}
+
+// CheckExpiry sends a warning to the WarnDestinations for each certificate that expires within WarnBefore.
+// Each certificate is only warned about once.
+func (ca *CA) CheckExpiry(now time.Time) {
+	if ca.WarnBefore <= 0 {
+		return
+	}
+	for _, c := range ca.GetCertificates() {
+		if c.Revoked || c.Expires.Sub(now) >= ca.WarnBefore {
+			continue
+		}
+
+		ca.Lock()
+		warned := ca.warned[c.Serial]
+		ca.warned[c.Serial] = true
+		ca.Unlock()
+		if warned {
+			continue
+		}
+
+		verb := "expires"
+		if c.Expires.Before(now) {
+			verb = "expired"
+		}
+		body := fmt.Sprintf("Certificate for %s (serial %s) %s %s", c.CommonName, c.Serial, verb, c.Expires.Format(time.RFC3339))
+		logrus.Warn(body)
+		for _, dest := range ca.WarnDestinations {
+			if err := ca.Store.TriggerDestination(dest, body); err != nil {
+				logrus.Errorf("ca: error sending expiry warning to %s: %s", dest, err)
+			}
+		}
+	}
+}
+
+// Start checks the certificates for expiry, asks nodes to renew and publishes the CRL every checkInterval until ctx is done.
+func (ca *CA) Start(ctx context.Context, sender websocket.Sender) {
+	check := func() {
+		now := time.Now()
+		if err := ca.publishCRL(); err != nil {
+			logrus.Error(err)
+		}
+		ca.CheckExpiry(now)
+		ca.RequestRenewals(sender, now)
+	}
+
+	go func() {
+		check()
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
@@ -0,0 +1,280 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/backup"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+)
+
+const (
+	revocationsFile = "revoked.json"
+	crlFile         = "ca.crl"
+	// crlValidity is how long a published CRL is valid. It is published again on start and on every revocation.
+	crlValidity = 7 * 24 * time.Hour
+)
+
+// Revocation is a revoked certificate.
+type Revocation struct {
+	Serial     string    `json:"serial"`
+	CommonName string    `json:"commonName"`
+	Time       time.Time `json:"time"`
+}
+
+// Issued is a client certificate that has been issued by the CA. Renewed certificates replace the file of the
+// previous one, so this is the only record of the previous serials.
+type Issued struct {
+	Serial     string    `json:"serial"`
+	CommonName string    `json:"commonName"`
+	Expires    time.Time `json:"expires"`
+}
+
+type revocations struct {
+	// Number is the number of the last published CRL.
+	Number  int64                 `json:"number"`
+	Revoked map[string]Revocation `json:"revoked"`
+	Issued  map[string]Issued     `json:"issued"`
+}
+
+func init() {
+	// Restoring a backup must not make revoked certificates valid again
+	backup.RegisterMerge(path.Join(storagePath, revocationsFile), mergeRevocations)
+}
+
+// mergeRevocations keeps all revocations and issued certificates in both existing and imported.
+func mergeRevocations(existing, imported []byte) ([]byte, error) {
+	r := revocations{}
+	if err := json.Unmarshal(existing, &r); err != nil {
+		return nil, err
+	}
+	i := revocations{}
+	if err := json.Unmarshal(imported, &i); err != nil {
+		return nil, err
+	}
+
+	if i.Number > r.Number {
+		r.Number = i.Number
+	}
+	if r.Revoked == nil {
+		r.Revoked = make(map[string]Revocation)
+	}
+	for serial, revocation := range i.Revoked {
+		if _, ok := r.Revoked[serial]; !ok {
+			r.Revoked[serial] = revocation
+		}
+	}
+	if r.Issued == nil {
+		r.Issued = make(map[string]Issued)
+	}
+	for serial, issued := range i.Issued {
+		if _, ok := r.Issued[serial]; !ok {
+			r.Issued[serial] = issued
+		}
+	}
+	return json.MarshalIndent(r, "", "\t")
+}
+
+func (ca *CA) loadRevocations() error {
+	filename := path.Join(storagePath, revocationsFile)
+	if err := persist.Repair(filename); err != nil {
+		logrus.Error(err)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r := revocations{}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("ca: error loading %s: %w", revocationsFile, err)
+	}
+
+	ca.Lock()
+	ca.revocations = r
+	ca.Unlock()
+	return nil
+}
+
+// recordIssued adds client certificates to the issued certificates and saves them. Certificates that were issued
+// before the record was kept are added when the CA is loaded.
+func (ca *CA) recordIssued(certs ...Issued) error {
+	ca.Lock()
+	defer ca.Unlock()
+	if ca.revocations.Issued == nil {
+		ca.revocations.Issued = make(map[string]Issued)
+	}
+	for _, c := range certs {
+		ca.revocations.Issued[c.Serial] = c
+	}
+	return ca.saveRevocations()
+}
+
+// recordExisting adds the client certificates in the certificates folder to the issued certificates.
+func (ca *CA) recordExisting() {
+	existing := []Issued{}
+	for _, c := range ca.GetCertificates() {
+		if !c.IsCA && hasUsage(c.Usage, "client") {
+			existing = append(existing, Issued{Serial: c.Serial, CommonName: c.CommonName, Expires: c.Expires})
+		}
+	}
+	if err := ca.recordIssued(existing...); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// IsRevoked returns true if the certificate with the serial has been revoked.
+func (ca *CA) IsRevoked(serial *big.Int) bool {
+	ca.Lock()
+	defer ca.Unlock()
+	_, ok := ca.revocations.Revoked[serial.String()]
+	return ok
+}
+
+// Revoke revokes a client certificate. It is rejected in the TLS handshake from now on, and a new CRL is published.
+// Certificates that have been replaced by a renewed one can also be revoked.
+func (ca *CA) Revoke(serial string) error {
+	for _, c := range ca.GetCertificates() {
+		if c.Serial == serial && (c.IsCA || !hasUsage(c.Usage, "client")) {
+			return fmt.Errorf("certificate %s is not a client certificate", serial)
+		}
+	}
+
+	ca.Lock()
+	cert, ok := ca.revocations.Issued[serial]
+	ca.Unlock()
+	if !ok {
+		return fmt.Errorf("certificate %s not found", serial)
+	}
+
+	ca.revoke(cert)
+	return nil
+}
+
+// revokePrevious revokes the certificates that were issued for the common name before the certificate with serial.
+func (ca *CA) revokePrevious(commonName, serial string) {
+	ca.Lock()
+	previous := []Issued{}
+	for _, c := range ca.revocations.Issued {
+		if _, revoked := ca.revocations.Revoked[c.Serial]; !revoked && c.CommonName == commonName && c.Serial != serial {
+			previous = append(previous, c)
+		}
+	}
+	ca.Unlock()
+	if len(previous) > 0 {
+		ca.revoke(previous...)
+	}
+}
+
+// revoke adds the certificates to the revocations, publishes a new CRL and updates the certificates in the store.
+func (ca *CA) revoke(certs ...Issued) {
+	ca.Lock()
+	if ca.revocations.Revoked == nil {
+		ca.revocations.Revoked = make(map[string]Revocation)
+	}
+	for _, c := range certs {
+		ca.revocations.Revoked[c.Serial] = Revocation{Serial: c.Serial, CommonName: c.CommonName, Time: time.Now()}
+	}
+	ca.Unlock()
+
+	for _, c := range certs {
+		logrus.Warnf("Revoked certificate %s for %s", c.Serial, c.CommonName)
+	}
+
+	if err := ca.publishCRL(); err != nil {
+		logrus.Error(err)
+	}
+	if ca.Store != nil {
+		ca.Store.UpdateCertificates(ca.GetCertificates())
+	}
+}
+
+// publishCRL writes a new CRL with all revoked certificates to certificates/ca.crl and saves the revocations.
+// Old CAs that were created without the CRL signing key usage can not sign a CRL, the revocations are still
+// enforced by the server.
+func (ca *CA) publishCRL() error {
+	ca.Lock()
+	defer ca.Unlock()
+
+	canSign := ca.CAX509 != nil && ca.CAX509.KeyUsage&x509.KeyUsageCRLSign != 0
+	if canSign {
+		ca.revocations.Number++
+	}
+	if err := ca.saveRevocations(); err != nil {
+		return err
+	}
+	if !canSign {
+		return nil
+	}
+
+	signer, ok := ca.CATLS.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("ca: the CA key can not sign a CRL")
+	}
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(ca.revocations.Number),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(crlValidity),
+	}
+	for _, r := range ca.revocations.Revoked {
+		serial, ok := new(big.Int).SetString(r.Serial, 10)
+		if !ok {
+			continue
+		}
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: r.Time,
+		})
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, template, ca.CAX509, signer)
+	if err != nil {
+		return fmt.Errorf("ca: error creating CRL: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+	return persist.WriteFile(path.Join(storagePath, crlFile), data, 0644)
+}
+
+// saveRevocations saves the revocations and the issued certificates. The CA must be locked.
+func (ca *CA) saveRevocations() error {
+	if err := persist.SaveFile(path.Join(storagePath, revocationsFile), ca.revocations); err != nil {
+		return fmt.Errorf("ca: error saving %s: %w", revocationsFile, err)
+	}
+	return nil
+}
+
+// VerifyConnection rejects client certificates that have been revoked. It is used in the TLS config of the server.
+func (ca *CA) VerifyConnection(cs tls.ConnectionState) error {
+	for _, cert := range cs.PeerCertificates {
+		if ca.IsRevoked(cert.SerialNumber) {
+			return fmt.Errorf("certificate %s for %s has been revoked", cert.SerialNumber, cert.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+func hasUsage(usages []string, usage string) bool {
+	for _, u := range usages {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
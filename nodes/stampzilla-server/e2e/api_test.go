@@ -0,0 +1,177 @@
+package e2e
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/logic"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/persons"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/servermain"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// apiRequest makes a request to the TLS server as if it was made with a client certificate for identity.
+func apiRequest(main *servermain.Main, method, url string, body io.Reader, identity string) *http.Response {
+	req := httptest.NewRequest(method, url, body)
+	if identity != "" {
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: identity}}},
+		}
+	}
+	w := httptest.NewRecorder()
+	main.TLSServer.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestAPI(t *testing.T) {
+	main, cleanup := setupServer(t)
+	defer cleanup()
+
+	for _, id := range []string{"1", "2"} {
+		main.Store.Devices.Add(&devices.Device{
+			ID:    devices.ID{Node: "node", ID: id},
+			State: devices.State{"on": false},
+		})
+	}
+	err := main.Store.AddOrUpdatePerson(persons.PersonWithPasswords{
+		PersonWithPassword: persons.PersonWithPassword{
+			Person: persons.Person{UUID: "child", Devices: []string{"node.1"}},
+		},
+	})
+	assert.NoError(t, err)
+
+	resp := apiRequest(main, "GET", "/api/v1/devices", nil, "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = apiRequest(main, "GET", "/api/v1/openapi.yaml", nil, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Persons only see their own devices
+	resp = apiRequest(main, "GET", "/api/v1/devices", nil, "child")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	list := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	assert.Len(t, list, 1)
+	assert.Contains(t, list, "node.1")
+
+	resp = apiRequest(main, "GET", "/api/v1/devices/node.2", nil, "child")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = apiRequest(main, "GET", "/api/v1/devices/node.1", nil, "child")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = apiRequest(main, "GET", "/api/v1/rules", nil, "child")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Certificates that do not belong to a person are trusted
+	resp = apiRequest(main, "GET", "/api/v1/rules", nil, "somenode")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = apiRequest(main, "GET", "/api/v1/schedules/missing", nil, "somenode")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = apiRequest(main, "PATCH", "/api/v1/devices/node.1", strings.NewReader(`{"on":true}`), "child")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	resp = apiRequest(main, "PATCH", "/api/v1/devices/node.1", strings.NewReader(`{}`), "child")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	entries := main.Store.GetAuditLog()
+	if assert.NotEmpty(t, entries) {
+		e := entries[len(entries)-1]
+		assert.Equal(t, "state-change", e.Type)
+		assert.Equal(t, "child", e.Person)
+		if assert.Len(t, e.Diff, 1) {
+			assert.Equal(t, "node.1/on", e.Diff[0].Path)
+			assert.Equal(t, true, e.Diff[0].New)
+		}
+	}
+
+	// Keys forced by an override are not changed
+	err = main.Store.AddOverride(&logic.Override{
+		UUID:   "forced",
+		Type:   logic.OverrideDevice,
+		Target: "node.1",
+		State:  devices.State{"on": false},
+		For:    stypes.Duration(time.Hour),
+	})
+	assert.NoError(t, err)
+	count := len(main.Store.GetAuditLog())
+	resp = apiRequest(main, "PATCH", "/api/v1/devices/node.1", strings.NewReader(`{"on":true}`), "child")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Len(t, main.Store.GetAuditLog(), count)
+}
+
+func TestAPIToken(t *testing.T) {
+	main, cleanup := setupServer(t)
+	defer cleanup()
+
+	main.Store.Devices.Add(&devices.Device{
+		ID:    devices.ID{Node: "node", ID: "1"},
+		State: devices.State{"on": false},
+	})
+	err := main.Store.AddOrUpdatePerson(persons.PersonWithPasswords{
+		PersonWithPassword: persons.PersonWithPassword{
+			Person: persons.Person{UUID: "admin", IsAdmin: true, AllowLogin: true},
+		},
+	})
+	assert.NoError(t, err)
+
+	_, secret, err := main.Store.CreateToken("admin", "script", []persons.Permission{persons.PermissionControlDevices})
+	assert.NoError(t, err)
+
+	request := func(method, url, token string) *http.Response {
+		req := httptest.NewRequest(method, url, strings.NewReader(`{"on":true}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		main.TLSServer.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := request("GET", "/api/v1/devices/node.1", "wrong.token")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = request("GET", "/api/v1/devices/node.1", secret)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.False(t, main.Store.GetPerson("admin").Tokens[0].LastUsed.IsZero())
+
+	// The token is limited to its scopes even if the person is an admin
+	resp = request("GET", "/api/v1/rules", secret)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = request("PATCH", "/api/v1/devices/node.1", secret)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	entries := main.Store.GetAuditLog()
+	if assert.NotEmpty(t, entries) {
+		e := entries[len(entries)-1]
+		assert.Equal(t, "admin", e.Person)
+		assert.Equal(t, "token "+main.Store.GetPerson("admin").Tokens[0].ID, e.Source)
+	}
+
+	// The token stops working when the person is not allowed to login
+	err = main.Store.AddOrUpdatePerson(persons.PersonWithPasswords{
+		PersonWithPassword: persons.PersonWithPassword{
+			Person: persons.Person{UUID: "admin", IsAdmin: true},
+		},
+	})
+	assert.NoError(t, err)
+	resp = request("GET", "/api/v1/devices/node.1", secret)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	err = main.Store.AddOrUpdatePerson(persons.PersonWithPasswords{
+		PersonWithPassword: persons.PersonWithPassword{
+			Person: persons.Person{UUID: "admin", IsAdmin: true, AllowLogin: true},
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, main.Store.RevokeToken("admin", main.Store.GetPerson("admin").Tokens[0].ID))
+	resp = request("GET", "/api/v1/devices/node.1", secret)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,124 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/backup"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/ca"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func readCertificate(t *testing.T, filename string) *x509.Certificate {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+func TestCertificateRenewalAndRevocation(t *testing.T) {
+	main, node, cleanup := SetupWebsocketTest(t)
+	defer cleanup()
+
+	AcceptCertificateRequest(t, main)
+	err := node.Connect()
+	assert.NoError(t, err)
+	defer func() {
+		node.Stop()
+		node.Wait()
+	}()
+
+	WaitFor(t, time.Second, "node should be connected", func() bool {
+		return len(main.Store.GetConnections()) == 1
+	})
+	first := readCertificate(t, "crt.crt")
+	assert.False(t, main.CA.NeedsRenewal(node.UUID, time.Now()))
+
+	// Every certificate expires within 100 years
+	main.CA.RenewBefore = 100 * 365 * 24 * time.Hour
+	assert.True(t, main.CA.NeedsRenewal(node.UUID, time.Now()))
+	main.CA.RequestRenewals(websocket.NewWebsocketSender(main.TLSServer.Melody), time.Now())
+
+	WaitFor(t, 2*time.Second, "node should save the renewed certificate", func() bool {
+		return readCertificate(t, "crt.crt").SerialNumber.Cmp(first.SerialNumber) != 0
+	})
+	renewed := readCertificate(t, "crt.crt")
+	assert.Equal(t, node.UUID, renewed.Subject.CommonName)
+
+	// The previous certificate is revoked on renewal
+	assert.True(t, main.CA.IsRevoked(first.SerialNumber))
+	assert.False(t, main.CA.IsRevoked(renewed.SerialNumber))
+	err = main.CA.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{first}})
+	assert.Error(t, err)
+	err = main.CA.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{renewed}})
+	assert.NoError(t, err)
+	// The file of the previous certificate is replaced but it is still known by its serial
+	assert.NoError(t, main.CA.Revoke(first.SerialNumber.String()))
+
+	// The renewed certificate is revoked
+	assert.Error(t, main.CA.Revoke("1"))
+	assert.NoError(t, main.CA.Revoke(renewed.SerialNumber.String()))
+	assert.True(t, main.CA.IsRevoked(renewed.SerialNumber))
+	for _, c := range main.Store.GetCertificates() {
+		assert.Equal(t, c.Serial == renewed.SerialNumber.String(), c.Revoked, c.CommonName)
+	}
+	err = main.CA.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{renewed}})
+	assert.Error(t, err)
+
+	resp := apiRequest(main, "GET", "/ca.crl", nil, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	block, _ := pem.Decode(data)
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if assert.NoError(t, err) {
+		assert.NoError(t, crl.CheckSignatureFrom(main.CA.CAX509))
+		revoked := []string{}
+		for _, r := range crl.RevokedCertificates {
+			revoked = append(revoked, r.SerialNumber.String())
+		}
+		assert.ElementsMatch(t, []string{first.SerialNumber.String(), renewed.SerialNumber.String()}, revoked)
+	}
+}
+
+func TestRestoreKeepsRevocations(t *testing.T) {
+	main, cleanup := setupServer(t)
+	defer cleanup()
+
+	_, err := main.CA.CreateClientCertificate("person")
+	assert.NoError(t, err)
+	serial := ""
+	for _, c := range main.CA.GetCertificates() {
+		if c.CommonName == "person" {
+			serial = c.Serial
+		}
+	}
+
+	var buf bytes.Buffer
+	_, err = backup.Export(&buf, persist.CurrentBackend(), ".")
+	assert.NoError(t, err)
+
+	assert.NoError(t, main.CA.Revoke(serial))
+	_, err = backup.Import(bytes.NewReader(buf.Bytes()), persist.CurrentBackend(), ".")
+	assert.NoError(t, err)
+
+	restored, err := ca.LoadOrCreate()
+	assert.NoError(t, err)
+	serialNumber, _ := new(big.Int).SetString(serial, 10)
+	assert.True(t, restored.IsRevoked(serialNumber))
+}
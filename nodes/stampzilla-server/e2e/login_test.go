@@ -0,0 +1,107 @@
+package e2e
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/persons"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/ratelimit"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/servermain"
+	"github.com/stretchr/testify/assert"
+)
+
+func login(main *servermain.Main, remoteAddr, username, password string) *http.Response {
+	return loginForwarded(main, remoteAddr, "", username, password)
+}
+
+func loginForwarded(main *servermain.Main, remoteAddr, forwardedFor, username, password string) *http.Response {
+	form := url.Values{"username": {username}, "password": {password}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	main.TLSServer.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestLoginLockout(t *testing.T) {
+	main, cleanup := setupServer(t)
+	defer cleanup()
+
+	main.TLSServer.SetLoginLimits(ratelimit.Settings{
+		Free:         1,
+		Delay:        time.Minute,
+		LockoutAfter: 3,
+		Lockout:      time.Hour,
+	}, nil)
+
+	user := persons.PersonWithPasswords{
+		NewPassword:    "password1",
+		RepeatPassword: "password1",
+		PersonWithPassword: persons.PersonWithPassword{
+			Person: persons.Person{UUID: "admin", Username: "admin", IsAdmin: true, AllowLogin: true},
+		},
+	}
+	assert.NoError(t, user.UpdatePassword())
+	assert.NoError(t, main.Store.AddOrUpdatePerson(user))
+
+	resp := login(main, "127.0.0.1:1234", "admin", "password1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = login(main, "127.0.0.1:1234", "admin", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = login(main, "127.0.0.1:1234", "admin", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The right password has to wait too
+	resp = login(main, "127.0.0.1:1234", "admin", "password1")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+
+	// Both the ip address and the username are throttled
+	resp = login(main, "10.0.0.2:1234", "admin", "password1")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	resp = login(main, "127.0.0.1:1234", "other", "wrong")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	resp = login(main, "10.0.0.3:1234", "other", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestLoginLockoutBehindProxy(t *testing.T) {
+	main, cleanup := setupServer(t)
+	defer cleanup()
+
+	main.TLSServer.SetLoginLimits(ratelimit.Settings{
+		Free:    1,
+		Delay:   time.Minute,
+		Lockout: time.Hour,
+	}, nil)
+	assert.NoError(t, main.TLSServer.SetTrustedProxies([]string{"127.0.0.1"}))
+
+	// Clients behind the proxy are throttled one by one
+	resp := loginForwarded(main, "127.0.0.1:1234", "10.0.0.5", "user1", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = loginForwarded(main, "127.0.0.1:1234", "10.0.0.5", "user2", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = loginForwarded(main, "127.0.0.1:1234", "10.0.0.5", "user3", "wrong")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	resp = loginForwarded(main, "127.0.0.1:1234", "10.0.0.6", "user3", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// A forged header from an untrusted address is ignored
+	resp = loginForwarded(main, "10.0.0.9:1234", "10.0.0.7", "user4", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = loginForwarded(main, "10.0.0.9:1234", "10.0.0.8", "user5", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = login(main, "10.0.0.9:1234", "user6", "wrong")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	assert.Error(t, main.TLSServer.SetTrustedProxies([]string{"not an address"}))
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/posener/wstest"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/persons"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -247,3 +248,55 @@ func TestSecureUnknownRequest(t *testing.T) {
 		return atomic.LoadUint64(&cnt) > 0
 	})
 }
+
+func TestSecureGuiWithCertificateIsNotTrusted(t *testing.T) {
+	main, node, cleanup := SetupWebsocketTest(t)
+	defer cleanup()
+	AcceptCertificateRequest(t, main)
+
+	node.Protocol = "gui"
+
+	err := node.Connect()
+	assert.NoError(t, err)
+
+	main.Store.AddOrUpdatePerson(persons.PersonWithPasswords{
+		PersonWithPassword: persons.PersonWithPassword{
+			Person: persons.Person{
+				UUID:       node.UUID,
+				AllowLogin: true,
+				Devices:    []string{"othernode.2"},
+			},
+		},
+	})
+
+	var subscribed, failures uint64
+	for _, area := range []string{"persons", "connections", "auditlog"} {
+		node.On(area, func(data json.RawMessage) error {
+			atomic.AddUint64(&subscribed, 1)
+			return nil
+		})
+	}
+	node.On("failure", func(data json.RawMessage) error {
+		assert.Equal(t, `"access denied to device othernode.1"`, string(data))
+		atomic.AddUint64(&failures, 1)
+		return nil
+	})
+
+	err = node.Subscribe("persons", "connections", "auditlog")
+	assert.NoError(t, err)
+
+	b := []byte(`{
+			"request":"1",
+			"type": "state-change",
+			"body": {"othernode.1": {"id": "othernode.1", "state": {"on": true}}}
+		}
+	`)
+	err = node.Client.WriteMessage(websocket.TextMessage, b)
+	assert.NoError(t, err)
+
+	WaitFor(t, 1*time.Second, "we should have got 1 failure callback", func() bool {
+		return atomic.LoadUint64(&failures) > 0
+	})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&subscribed))
+}
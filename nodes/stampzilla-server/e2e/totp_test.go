@@ -0,0 +1,107 @@
+package e2e
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/persons"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+// totpCode returns the current code of an authenticator app with the secret.
+func totpCode(t *testing.T, secret string) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestSecureTOTPIsThrottled(t *testing.T) {
+	main, node, cleanup := SetupWebsocketTest(t)
+	defer cleanup()
+	AcceptCertificateRequest(t, main)
+
+	main.TLSServer.SetLoginLimits(ratelimit.Settings{
+		Free:         1,
+		Delay:        time.Minute,
+		LockoutAfter: 3,
+		Lockout:      time.Hour,
+	}, nil)
+
+	user := persons.PersonWithPasswords{
+		NewPassword:    "password1",
+		RepeatPassword: "password1",
+		PersonWithPassword: persons.PersonWithPassword{
+			Person: persons.Person{Username: "user", AllowLogin: true},
+		},
+	}
+	err := user.UpdatePassword()
+	assert.NoError(t, err)
+
+	// The person connects with a certificate for its uuid
+	node.Protocol = "gui"
+	err = node.Connect()
+	assert.NoError(t, err)
+	user.UUID = node.UUID
+	assert.NoError(t, main.Store.AddOrUpdatePerson(user))
+
+	secret, err := main.Store.StartTOTP(node.UUID)
+	assert.NoError(t, err)
+	_, err = main.Store.ConfirmTOTP(node.UUID, totpCode(t, secret))
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	failures := []string{}
+	node.On("failure", func(data json.RawMessage) error {
+		mu.Lock()
+		failures = append(failures, string(data))
+		mu.Unlock()
+		return nil
+	})
+	// request sends a message and returns its failure. Messages are handled concurrently so wait for each one.
+	request := func(msgType, body string) string {
+		mu.Lock()
+		n := len(failures)
+		mu.Unlock()
+		b := []byte(fmt.Sprintf(`{"request":"1","type":%q,"body":%s}`, msgType, body))
+		assert.NoError(t, node.Client.WriteMessage(websocket.TextMessage, b))
+		WaitFor(t, time.Second, "we should have got a failure callback", func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(failures) > n
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		return failures[n]
+	}
+
+	// The secret and recovery codes can not be replaced without a code
+	assert.Equal(t, `"two-factor authentication is already enabled, disable it first"`, request("totp-enrol", "null"))
+	assert.Equal(t, `"wrong two-factor code"`, request("totp-disable", `{"code":"000000"}`))
+	assert.Equal(t, `"wrong two-factor code"`, request("totp-recovery-codes", `{"code":"000000"}`))
+	// The right code has to wait after too many failures
+	code := fmt.Sprintf(`{"code":%q}`, totpCode(t, secret))
+	assert.Equal(t, `"too many failed attempts, try again in 60 seconds"`, request("totp-disable", code))
+	assert.True(t, main.Store.GetPerson(node.UUID).TOTPEnabled)
+
+	// The failures count against logins too
+	resp := login(main, "127.0.0.1:1234", "user", "password1")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
@@ -47,6 +47,7 @@ func (wsh *insecureWebsocketHandler) Message(s interfaces.MelodySession, msg *mo
 		go func() {
 			err := wsh.ca.CreateCertificateFromRequest(cert, id.(string), body)
 			if err != nil {
+				logrus.Warnf("certificate request from connection %s: %s", id, err)
 				return
 			}
 
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/persons"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/store"
+)
+
+// adminOnly is used for areas and messages that only admins have access to.
+const adminOnly persons.Permission = "admin"
+
+// areaPermissions are the permissions needed to subscribe to an area.
+// Areas that are not listed, like devices and server, are open to all persons. Devices are filtered per person.
+var areaPermissions = map[string]persons.Permission{
+	"connections":     adminOnly,
+	"certificates":    persons.PermissionManageNodes,
+	"requests":        persons.PermissionManageNodes,
+	"nodes":           persons.PermissionManageNodes,
+	"virtualdevices":  persons.PermissionManageNodes,
+	"rules":           persons.PermissionManageRules,
+	"rulehistory":     persons.PermissionManageRules,
+	"savedstates":     persons.PermissionManageRules,
+	"scenes":          persons.PermissionManageRules,
+	"blueprints":      persons.PermissionManageRules,
+	"overrides":       persons.PermissionManageRules,
+	"keyowners":       persons.PermissionManageRules,
+	"computeddevices": persons.PermissionManageRules,
+	"schedules":       persons.PermissionManageRules,
+	"snapshots":       adminOnly,
+	"destinations":    adminOnly,
+	"senders":         adminOnly,
+	"persons":         adminOnly,
+	"auditlog":        adminOnly,
+}
+
+// messagePermissions are the permissions needed to send a message as a user.
+// Messages that are not listed are only for admins. An empty permission is open to all persons.
+var messagePermissions = map[string]persons.Permission{
+	"setup-node":              persons.PermissionManageNodes,
+	"setup-device":            persons.PermissionManageNodes,
+	"accept-request":          persons.PermissionManageNodes,
+	"revoke":                  persons.PermissionManageNodes,
+	"update-virtual-devices":  persons.PermissionManageNodes,
+	"update-rules":            persons.PermissionManageRules,
+	"update-blueprints":       persons.PermissionManageRules,
+	"explain-rule":            persons.PermissionManageRules,
+	"update-schedules":        persons.PermissionManageRules,
+	"update-savedstates":      persons.PermissionManageRules,
+	"update-scenes":           persons.PermissionManageRules,
+	"apply-scene":             persons.PermissionManageRules,
+	"restore-scene":           persons.PermissionManageRules,
+	"update-computed-devices": persons.PermissionManageRules,
+	"add-override":            persons.PermissionManageRules,
+	"remove-override":         persons.PermissionManageRules,
+	// Checked against the device in the handler
+	"device-history": "",
+	// Persons manage their own tokens, checked in the handler
+	"create-token": "",
+	"revoke-token": "",
+	"list-tokens":  "",
+	// Persons manage their own two-factor authentication, checked in the handler
+	"totp-enrol":          "",
+	"totp-confirm":        "",
+	"totp-disable":        "",
+	"totp-recovery-codes": "",
+}
+
+// enrolmentMessages are the only messages allowed before a person that must use two-factor authentication has enabled it.
+var enrolmentMessages = map[string]bool{
+	"totp-enrol":   true,
+	"totp-confirm": true,
+}
+
+type session interface {
+	Get(string) (interface{}, bool)
+}
+
+func sessionIdentity(s session) (string, string) {
+	proto, _ := s.Get("protocol")
+	identity, _ := s.Get("identity")
+	p, _ := proto.(string)
+	i, _ := identity.(string)
+	return p, i
+}
+
+// sessionPerson returns true if the session is trusted, which only nodes that connect with a certificate are.
+// Otherwise it returns the person that is logged in, if any. Persons can download a certificate with their uuid,
+// so a gui that connects with a certificate gets the access of that person.
+func sessionPerson(store *store.Store, s session) (bool, *persons.Person) {
+	proto, identity := sessionIdentity(s)
+	if secure, _ := s.Get("secure"); secure == "cert" && proto == "node" {
+		return store.GetPerson(identity) == nil, nil
+	}
+	if proto != "gui" || identity == "" {
+		return false, nil
+	}
+	p := tokenPerson(s, store.GetPerson(identity))
+	if needsEnrolment(store, s, p) {
+		return false, nil
+	}
+	return false, p
+}
+
+// needsEnrolment returns true if the person logged in with a password and must enable two-factor authentication first.
+func needsEnrolment(store *store.Store, s session, p *persons.Person) bool {
+	secure, _ := s.Get("secure")
+	return secure == "session" && store.TOTPEnrolmentRequired(p)
+}
+
+// tokenPerson limits the person to the scopes of the API token that the session uses, if any.
+// It returns nil if the token has been revoked.
+func tokenPerson(s session, p *persons.Person) *persons.Person {
+	id, ok := s.Get("token")
+	if !ok || p == nil {
+		return p
+	}
+	tokenID, _ := id.(string)
+	t := p.Token(tokenID)
+	if t == nil || !p.AllowLogin {
+		return nil
+	}
+	return p.WithToken(t)
+}
+
+// canSubscribe returns true if the session has access to the area. Trusted sessions have access to all areas.
+func canSubscribe(store *store.Store, s session, area string) bool {
+	trusted, p := sessionPerson(store, s)
+	if trusted {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	permission, ok := areaPermissions[area]
+	if !ok || p.IsAdmin {
+		return true
+	}
+	return permission != adminOnly && p.Can(permission)
+}
+
+func canSend(p *persons.Person, msgType string) bool {
+	if p.IsAdmin {
+		return true
+	}
+	permission, ok := messagePermissions[msgType]
+	if !ok {
+		return false
+	}
+	return permission == "" || p.Can(permission)
+}
+
+// credentialOwner returns the uuid of the person whose tokens or two-factor authentication a message manages.
+// Persons manage their own and admins those of all persons. Connections that use a token can not manage them.
+func credentialOwner(s session, p *persons.Person, owner, what string) (string, error) {
+	if _, ok := s.Get("token"); ok {
+		return "", fmt.Errorf("%s can not be managed with a token", what)
+	}
+	if owner == "" || owner == p.UUID {
+		return p.UUID, nil
+	}
+	if !p.IsAdmin {
+		return "", fmt.Errorf("access denied to the %s of %s", what, owner)
+	}
+	return owner, nil
+}
+
+// accessibleDevices returns the devices the person has access to.
+func accessibleDevices(list *devices.List, p *persons.Person) *devices.List {
+	filtered := devices.NewList()
+	for _, dev := range list.All() {
+		if p.CanAccessDevice(dev) {
+			filtered.Add(dev)
+		}
+	}
+	return filtered
+}
@@ -1,12 +1,17 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/lesismal/melody"
 	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/audit"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/ca"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/interfaces"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/logic"
@@ -14,6 +19,7 @@ import (
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/notification"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/persons"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/virtual"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/store"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
 	"github.com/stampzilla/stampzilla-go/v2/pkg/build"
@@ -37,27 +43,58 @@ func NewSecureWebsockerHandler(store *store.Store, config *models.Config, ws web
 }
 
 func BroadcastUpdate(sender websocket.Sender) func(string, *store.Store) error {
-	send := func(area string, data interface{}) error {
-		return sender.BroadcastWithFilter(area, data, func(s *melody.Session) bool {
-			v, exists := s.Get("subscriptions")
-			if !exists {
-				return false
-			}
-			if v, ok := v.([]string); ok {
-				for _, topic := range v {
-					if topic == area {
-						return true
-					}
+	subscribed := func(s *melody.Session, area string) bool {
+		v, exists := s.Get("subscriptions")
+		if !exists {
+			return false
+		}
+		if v, ok := v.([]string); ok {
+			for _, topic := range v {
+				if topic == area {
+					return true
 				}
 			}
-			return false
-		})
+		}
+		return false
 	}
 
 	return func(area string, store *store.Store) error {
+		// Permissions are checked on every send since they can change after the subscription
+		send := func(area string, data interface{}) error {
+			return sender.BroadcastWithFilter(area, data, func(s *melody.Session) bool {
+				return subscribed(s, area) && canSubscribe(store, s, area)
+			})
+		}
+
 		switch area {
 		case "devices":
-			return send(area, store.GetDevices())
+			all := store.GetDevices()
+			err := sender.BroadcastWithFilter(area, all, func(s *melody.Session) bool {
+				if !subscribed(s, area) {
+					return false
+				}
+				trusted, p := sessionPerson(store, s)
+				return trusted || (p != nil && !p.Restricted())
+			})
+			if err != nil {
+				return err
+			}
+
+			// Persons that only have access to some devices get their own list
+			for _, p := range store.GetPersons() {
+				if !p.Restricted() {
+					continue
+				}
+				p := p
+				err := sender.BroadcastWithFilter(area, accessibleDevices(all, p), func(s *melody.Session) bool {
+					trusted, sp := sessionPerson(store, s)
+					return !trusted && sp != nil && sp.UUID == p.UUID && subscribed(s, area)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
 		case "connections":
 			return send(area, store.GetConnections())
 		case "nodes":
@@ -68,8 +105,28 @@ func BroadcastUpdate(sender websocket.Sender) func(string, *store.Store) error {
 			return send(area, store.GetRequests())
 		case "rules":
 			return send(area, store.GetRules())
+		case "rulehistory":
+			return send(area, store.GetRuleHistory())
 		case "savedstates":
 			return send(area, store.GetSavedStates())
+		case "scenes":
+			return send(area, store.GetScenes())
+		case "blueprints":
+			return send(area, store.GetBlueprints())
+		case "overrides":
+			return send(area, store.GetOverrides())
+		case "keyowners":
+			return send(area, store.GetKeyOwners())
+		case "snapshots":
+			snapshots, err := store.GetSnapshots()
+			if err != nil {
+				return err
+			}
+			return send(area, snapshots)
+		case "virtualdevices":
+			return send(area, store.GetVirtualDevices())
+		case "computeddevices":
+			return send(area, store.GetComputedDevices())
 		case "schedules":
 			return send(area, store.GetScheduledTasks())
 		case "server":
@@ -80,11 +137,41 @@ func BroadcastUpdate(sender websocket.Sender) func(string, *store.Store) error {
 			return send(area, store.GetSenders())
 		case "persons":
 			return send(area, store.GetPersons())
+		case "auditlog":
+			return send(area, store.GetAuditLog())
 		}
 		return nil
 	}
 }
 
+// SendStateChange sends the requested state of the devices to their nodes and adds it to the audit log.
+// Keys forced by an override are not sent since the device would be forced back when it reports the new state.
+func SendStateChange(store *store.Store, sender websocket.Sender, devs *devices.List, e audit.Entry) {
+	requested := make(map[devices.ID]devices.State)
+	for id, dev := range devs.All() {
+		requested[id] = dev.State
+	}
+	states := store.WithoutOverridden(requested)
+	if len(states) == 0 {
+		return
+	}
+
+	byNode := make(map[string]map[devices.ID]devices.State)
+	for id, state := range states {
+		if byNode[id.Node] == nil {
+			byNode[id.Node] = make(map[devices.ID]devices.State)
+		}
+		byNode[id.Node][id] = state
+	}
+	for node, devices := range byNode {
+		logrus.WithFields(logrus.Fields{
+			"to": node,
+		}).Debug("Send state change request to node")
+		sender.SendToID(node, "state-change", devices)
+	}
+	store.AuditStateChange(e, states)
+}
+
 func sliceHas(s []string, val string) bool {
 	for _, v := range s {
 		if v == val {
@@ -104,6 +191,17 @@ func (wsh *secureWebsocketHandler) Message(s interfaces.MelodySession, msg *mode
 			return nil, err
 		}
 
+		// Leave out areas the person does not have access to
+		allowed := []string{}
+		for _, area := range subscribeTo {
+			if !canSubscribe(wsh.Store, s, area) {
+				logrus.Debugf("Access denied to subscription %s", area)
+				continue
+			}
+			allowed = append(allowed, area)
+		}
+		subscribeTo = allowed
+
 		v, exists := s.Get("subscriptions")
 		if !exists {
 			s.Set("subscriptions", subscribeTo)
@@ -141,13 +239,19 @@ func (wsh *secureWebsocketHandler) Message(s interfaces.MelodySession, msg *mode
 			"devices": devs,
 		}).Debug("Received state change request")
 
-		for node, devices := range devs.StateGroupedByNode() {
-			logrus.WithFields(logrus.Fields{
-				"to": node,
-			}).Debug("Send state change request to node")
-			wsh.WebsocketSender.SendToID(node, "state-change", devices)
+		if trusted, p := sessionPerson(wsh.Store, s); !trusted {
+			if p == nil {
+				return nil, fmt.Errorf("access denied")
+			}
+			for id := range devs.All() {
+				if !p.CanControlDevice(wsh.Store.GetDevices().Get(id)) {
+					return nil, fmt.Errorf("access denied to device %s", id)
+				}
+			}
 		}
 
+		SendStateChange(wsh.Store, wsh.WebsocketSender, devs, wsh.auditEntry(s))
+
 	// If not a common message type, then it its probably a client specific one
 	default:
 		p, exists := s.Get("protocol")
@@ -173,11 +277,14 @@ func (wsh *secureWebsocketHandler) Message(s interfaces.MelodySession, msg *mode
 
 			return wsh.MessageFromNode(s, msg, n)
 		case "gui":
-			p := wsh.Store.GetPerson(identity)
+			p := tokenPerson(s, wsh.Store.GetPerson(identity))
 			if p == nil {
 				s.CloseWithMsg(melody.FormatCloseMessage(4001, "unauthorized"))
 				return nil, fmt.Errorf("user not found for connection identity")
 			}
+			if needsEnrolment(wsh.Store, s, p) && !enrolmentMessages[msg.Type] {
+				return nil, fmt.Errorf("two-factor authentication must be enabled first")
+			}
 
 			return wsh.MessageFromUser(s, msg, p)
 		}
@@ -221,6 +328,25 @@ func (wsh *secureWebsocketHandler) MessageFromNode(s interfaces.MelodySession, m
 			}
 			wsh.Store.AddOrUpdateDevice(dev)
 		}
+	case "certificate-signing-request":
+		// A node renews its certificate over the secure connection, no approval is needed
+		if secure, _ := s.Get("secure"); secure != "cert" {
+			return nil, fmt.Errorf("renewal requires a certificate")
+		}
+
+		var body models.Request
+		err := json.Unmarshal(msg.Body, &body)
+		if err != nil {
+			return nil, err
+		}
+
+		_, identity := sessionIdentity(s)
+		cert, err := wsh.CA.RenewCertificate(identity, body.CSR)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, wsh.WebsocketSender.SendToID(msg.FromUUID, "approved-certificate-signing-request", string(cert))
 	default:
 		logrus.WithFields(logrus.Fields{
 			"type":   msg.Type,
@@ -233,11 +359,103 @@ func (wsh *secureWebsocketHandler) MessageFromNode(s interfaces.MelodySession, m
 	return nil, nil
 }
 
+// auditedMessages are the user messages that are added to the audit log. The function returns the object
+// that the message changes so a diff can be logged. Messages without a function are logged with their body.
+var auditedMessages = map[string]func(*store.Store) interface{}{
+	"setup-node":              func(s *store.Store) interface{} { return s.GetNodes() },
+	"setup-device":            func(s *store.Store) interface{} { return s.GetNodes() },
+	"accept-request":          func(s *store.Store) interface{} { return s.GetRequests() },
+	"update-rules":            func(s *store.Store) interface{} { return s.GetRules() },
+	"update-blueprints":       func(s *store.Store) interface{} { return s.GetBlueprints() },
+	"update-persons":          func(s *store.Store) interface{} { return s.GetPersons() },
+	"update-destinations":     func(s *store.Store) interface{} { return s.GetDestinations() },
+	"update-senders":          func(s *store.Store) interface{} { return s.GetSenders() },
+	"update-schedules":        func(s *store.Store) interface{} { return s.GetScheduledTasks() },
+	"update-savedstates":      func(s *store.Store) interface{} { return s.GetSavedStates() },
+	"update-scenes":           func(s *store.Store) interface{} { return s.GetScenes() },
+	"update-virtual-devices":  func(s *store.Store) interface{} { return s.GetVirtualDevices() },
+	"update-computed-devices": func(s *store.Store) interface{} { return s.GetComputedDevices() },
+	"add-override":            func(s *store.Store) interface{} { return s.GetOverrides() },
+	"remove-override":         func(s *store.Store) interface{} { return s.GetOverrides() },
+	"trigger-destination":     nil,
+	"apply-scene":             nil,
+	"restore-scene":           nil,
+	"export-backup":           nil,
+	"import-backup":           nil,
+	"restore-snapshot":        nil,
+	"revoke":                  func(s *store.Store) interface{} { return s.GetCertificates() },
+	"create-token":            nil,
+	"revoke-token":            nil,
+	// The codes are secret so only the change of the person is logged
+	"totp-confirm":        func(s *store.Store) interface{} { return s.GetPersons() },
+	"totp-disable":        func(s *store.Store) interface{} { return s.GetPersons() },
+	"totp-recovery-codes": func(s *store.Store) interface{} { return s.GetPersons() },
+}
+
+// auditEntry returns an audit entry with the origin, person and connection of the session.
+func (wsh *secureWebsocketHandler) auditEntry(s interfaces.MelodySession) audit.Entry {
+	e := audit.Entry{}
+	if id, ok := s.Get(websocket.KeyID.String()); ok {
+		e.Connection, _ = id.(string)
+	}
+	proto, _ := s.Get("protocol")
+	identity, _ := s.Get("identity")
+	e.Origin = audit.OriginUser
+	if proto == "node" {
+		e.Origin = audit.OriginIntegration
+		e.Source, _ = identity.(string)
+	} else {
+		e.Person, _ = identity.(string)
+		if token, ok := s.Get("token"); ok {
+			e.Source = "token " + token.(string)
+		}
+	}
+	return e
+}
+
 func (wsh *secureWebsocketHandler) MessageFromUser(s interfaces.MelodySession, msg *models.Message, p *persons.Person) (json.RawMessage, error) {
-	if !p.IsAdmin {
-		return nil, fmt.Errorf("access denied, not admin")
+	if !canSend(p, msg.Type) {
+		return nil, fmt.Errorf("access denied to %s", msg.Type)
+	}
+
+	get, audited := auditedMessages[msg.Type]
+	if !audited {
+		return wsh.messageFromUser(s, msg, p)
+	}
+
+	// The object is encoded before the change since the store changes it in place
+	var before json.RawMessage
+	if get != nil {
+		var err error
+		if before, err = json.Marshal(get(wsh.Store)); err != nil {
+			return nil, err
+		}
 	}
 
+	resp, err := wsh.messageFromUser(s, msg, p)
+
+	e := wsh.auditEntry(s)
+	e.Type = msg.Type
+	if err != nil {
+		e.Error = err.Error()
+	}
+	switch {
+	case get != nil:
+		diff, derr := audit.Diff(before, get(wsh.Store))
+		if derr != nil {
+			logrus.Error("audit: ", derr)
+		}
+		e.Diff = diff
+	case msg.Type != "import-backup":
+		// An imported backup is too large to keep in the log
+		e.Body = msg.Body
+	}
+	wsh.Store.AddAuditEntry(e)
+
+	return resp, err
+}
+
+func (wsh *secureWebsocketHandler) messageFromUser(s interfaces.MelodySession, msg *models.Message, p *persons.Person) (json.RawMessage, error) {
 	switch msg.Type {
 	case "setup-node":
 		node := &models.Node{}
@@ -276,6 +494,7 @@ func (wsh *secureWebsocketHandler) MessageFromUser(s interfaces.MelodySession, m
 		}
 
 		node.SetAlias(device.ID, device.Alias)
+		node.SetLabels(device.ID, device.Labels)
 		err = wsh.Store.SaveNode(node)
 		if err != nil {
 			return nil, err
@@ -285,6 +504,7 @@ func (wsh *secureWebsocketHandler) MessageFromUser(s interfaces.MelodySession, m
 		dev := wsh.Store.GetDevices().Get(device.ID)
 		dev.Lock()
 		dev.Alias = device.Alias
+		dev.Labels = device.Labels
 		dev.Unlock()
 		BroadcastUpdate(wsh.WebsocketSender)("devices", wsh.Store)
 	case "accept-request":
@@ -308,6 +528,37 @@ func (wsh *secureWebsocketHandler) MessageFromUser(s interfaces.MelodySession, m
 		}).Debug("Received new rules")
 
 		wsh.Store.AddOrUpdateRules(rules)
+	case "update-blueprints":
+		blueprints := logic.Blueprints{}
+		err := json.Unmarshal(msg.Body, &blueprints)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":       msg.FromUUID,
+			"blueprints": blueprints,
+		}).Debug("Received new blueprints")
+
+		wsh.Store.AddOrUpdateBlueprints(blueprints)
+	case "explain-rule":
+		// The body is a rule that is not saved yet or only the uuid of an existing rule
+		rule := &logic.Rule{}
+		err := json.Unmarshal(msg.Body, rule)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from": msg.FromUUID,
+			"rule": rule.Uuid(),
+		}).Debug("Explain rule")
+
+		if existing, ok := wsh.Store.GetRules()[rule.Uuid()]; ok && rule.Expression() == "" {
+			rule = existing
+		}
+
+		return json.Marshal(wsh.Store.ExplainRule(rule))
 	case "update-persons":
 		persons := map[string]persons.PersonWithPasswords{}
 		err := json.Unmarshal(msg.Body, &persons)
@@ -419,6 +670,43 @@ func (wsh *secureWebsocketHandler) MessageFromUser(s interfaces.MelodySession, m
 		}).Debug("Received new schedules")
 
 		wsh.Store.AddOrUpdateScheduledTasks(tasks)
+	case "device-history":
+		type RequestBody struct {
+			Device devices.ID `json:"device"`
+			Key    string     `json:"key"`
+			From   time.Time  `json:"from"`
+			To     time.Time  `json:"to"`
+		}
+
+		var req RequestBody
+		err := json.Unmarshal(msg.Body, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.To.IsZero() {
+			req.To = time.Now()
+		}
+		if req.From.IsZero() {
+			req.From = req.To.Add(-24 * time.Hour)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":   msg.FromUUID,
+			"device": req.Device,
+			"key":    req.Key,
+		}).Debug("Get device history")
+
+		if !p.CanAccessDevice(wsh.Store.GetDevices().Get(req.Device)) {
+			return nil, fmt.Errorf("access denied to device %s", req.Device)
+		}
+
+		points, err := wsh.Store.GetDeviceHistory(req.Device, req.Key, req.From, req.To)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(points)
 	case "update-savedstates":
 		ss := logic.SavedStates{}
 		err := json.Unmarshal(msg.Body, &ss)
@@ -432,6 +720,375 @@ func (wsh *secureWebsocketHandler) MessageFromUser(s interfaces.MelodySession, m
 		}).Debug("Received new savedstates")
 
 		wsh.Store.AddOrUpdateSavedStates(ss)
+	case "update-scenes":
+		scenes := logic.Scenes{}
+		err := json.Unmarshal(msg.Body, &scenes)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":   msg.FromUUID,
+			"scenes": scenes,
+		}).Debug("Received new scenes")
+
+		wsh.Store.AddOrUpdateScenes(scenes)
+	case "apply-scene", "restore-scene":
+		type RequestBody struct {
+			UUID string `json:"uuid"`
+		}
+
+		var req RequestBody
+		err := json.Unmarshal(msg.Body, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":  msg.FromUUID,
+			"scene": req.UUID,
+		}).Debugf("Received %s", msg.Type)
+
+		if msg.Type == "restore-scene" {
+			return nil, wsh.Store.RestoreScene(req.UUID)
+		}
+		return nil, wsh.Store.ApplyScene(req.UUID)
+	case "update-virtual-devices":
+		virtualDevices := virtual.Devices{}
+		err := json.Unmarshal(msg.Body, &virtualDevices)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":           msg.FromUUID,
+			"virtualDevices": virtualDevices,
+		}).Debug("Received new virtual devices")
+
+		return nil, wsh.Store.AddOrUpdateVirtualDevices(virtualDevices)
+	case "update-computed-devices":
+		computedDevices := logic.ComputedDevices{}
+		err := json.Unmarshal(msg.Body, &computedDevices)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":            msg.FromUUID,
+			"computedDevices": computedDevices,
+		}).Debug("Received new computed devices")
+
+		return nil, wsh.Store.AddOrUpdateComputedDevices(computedDevices)
+	case "add-override":
+		override := &logic.Override{}
+		err := json.Unmarshal(msg.Body, override)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":     msg.FromUUID,
+			"override": override,
+		}).Debug("Received new override")
+
+		if err := wsh.Store.AddOverride(override); err != nil {
+			return nil, err
+		}
+		return json.Marshal(override)
+	case "remove-override":
+		type RequestBody struct {
+			UUID string `json:"uuid"`
+		}
+
+		var req RequestBody
+		err := json.Unmarshal(msg.Body, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":     msg.FromUUID,
+			"override": req.UUID,
+		}).Debug("Received remove override")
+
+		return nil, wsh.Store.RemoveOverride(req.UUID)
+	case "audit-log":
+		type RequestBody struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+		}
+
+		var req RequestBody
+		err := json.Unmarshal(msg.Body, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.To.IsZero() {
+			req.To = time.Now()
+		}
+		if req.From.IsZero() {
+			req.From = req.To.Add(-24 * time.Hour)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from": msg.FromUUID,
+		}).Debug("Get audit log")
+
+		entries, err := wsh.Store.QueryAuditLog(req.From, req.To)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(entries)
+	case "revoke":
+		var serial string
+		err := json.Unmarshal(msg.Body, &serial)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":   msg.FromUUID,
+			"serial": serial,
+		}).Info("Revoke certificate")
+
+		if err := wsh.CA.Revoke(serial); err != nil {
+			return nil, err
+		}
+
+		// Connections that were made with the certificate are closed, it can not be used to connect again
+		for _, c := range wsh.Store.GetConnections() {
+			if c.Attributes["serial"] == serial && c.Session != nil {
+				c.Session.CloseWithMsg(melody.FormatCloseMessage(4001, "unauthorized"))
+			}
+		}
+	case "create-token":
+		type RequestBody struct {
+			Person string               `json:"person"`
+			Name   string               `json:"name"`
+			Scopes []persons.Permission `json:"scopes"`
+		}
+
+		var req RequestBody
+		err := json.Unmarshal(msg.Body, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		owner, err := credentialOwner(s, p, req.Person, "tokens")
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":   msg.FromUUID,
+			"person": owner,
+			"name":   req.Name,
+		}).Info("Create token")
+
+		t, secret, err := wsh.Store.CreateToken(owner, req.Name, req.Scopes)
+		if err != nil {
+			return nil, err
+		}
+
+		// The secret is only sent in this response
+		return json.Marshal(struct {
+			*persons.Token
+			Secret string `json:"token"`
+		}{t, secret})
+	case "revoke-token":
+		type RequestBody struct {
+			Person string `json:"person"`
+			ID     string `json:"id"`
+		}
+
+		var req RequestBody
+		err := json.Unmarshal(msg.Body, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		owner, err := credentialOwner(s, p, req.Person, "tokens")
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":   msg.FromUUID,
+			"person": owner,
+			"token":  req.ID,
+		}).Info("Revoke token")
+
+		return nil, wsh.Store.RevokeToken(owner, req.ID)
+	case "list-tokens":
+		type RequestBody struct {
+			Person string `json:"person"`
+		}
+
+		var req RequestBody
+		if len(msg.Body) > 0 {
+			if err := json.Unmarshal(msg.Body, &req); err != nil {
+				return nil, err
+			}
+		}
+
+		owner, err := credentialOwner(s, p, req.Person, "tokens")
+		if err != nil {
+			return nil, err
+		}
+
+		person := wsh.Store.GetPerson(owner)
+		if person == nil {
+			return nil, fmt.Errorf("person %s not found", owner)
+		}
+		tokens := person.Tokens
+		if tokens == nil {
+			tokens = []persons.Token{}
+		}
+		return json.Marshal(tokens)
+	case "totp-enrol":
+		if _, err := credentialOwner(s, p, "", "two-factor authentication"); err != nil {
+			return nil, err
+		}
+		// Enrolling again would replace the secret and the recovery codes without a code
+		if p.TOTPEnabled {
+			return nil, fmt.Errorf("two-factor authentication is already enabled, disable it first")
+		}
+
+		secret, err := wsh.Store.StartTOTP(p.UUID)
+		if err != nil {
+			return nil, err
+		}
+
+		issuer := wsh.Config.Name
+		if issuer == "" {
+			issuer = "stampzilla"
+		}
+		account := p.Username
+		if account == "" {
+			account = p.Name
+		}
+
+		return json.Marshal(map[string]string{
+			"secret": secret,
+			"uri":    persons.TOTPURI(secret, account, issuer),
+		})
+	case "totp-confirm", "totp-recovery-codes":
+		type RequestBody struct {
+			Code string `json:"code"`
+		}
+
+		var req RequestBody
+		err := json.Unmarshal(msg.Body, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := credentialOwner(s, p, "", "two-factor authentication"); err != nil {
+			return nil, err
+		}
+
+		var codes []string
+		if msg.Type == "totp-confirm" {
+			codes, err = wsh.Store.ConfirmTOTP(p.UUID, req.Code)
+		} else {
+			// New recovery codes need a valid code, so a stolen session can not take over the account
+			if !p.TOTPEnabled {
+				return nil, fmt.Errorf("two-factor authentication is not enabled")
+			}
+			if err = wsh.checkSecondFactor(p, req.Code); err == nil {
+				codes, err = wsh.Store.NewRecoveryCodes(p.UUID)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":   msg.FromUUID,
+			"person": p.UUID,
+		}).Info("Two-factor authentication recovery codes created")
+
+		// The recovery codes are only sent in this response
+		return json.Marshal(map[string][]string{"recovery_codes": codes})
+	case "totp-disable":
+		type RequestBody struct {
+			Person string `json:"person"`
+			Code   string `json:"code"`
+		}
+
+		var req RequestBody
+		err := json.Unmarshal(msg.Body, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		owner, err := credentialOwner(s, p, req.Person, "two-factor authentication")
+		if err != nil {
+			return nil, err
+		}
+
+		// Admins reset it for persons that lost their authenticator, persons need a code to disable their own
+		if owner == p.UUID {
+			if err := wsh.checkSecondFactor(p, req.Code); err != nil {
+				return nil, err
+			}
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"from":   msg.FromUUID,
+			"person": owner,
+		}).Info("Disable two-factor authentication")
+
+		return nil, wsh.Store.DisableTOTP(owner)
+	case "export-backup":
+		logrus.WithFields(logrus.Fields{
+			"from": msg.FromUUID,
+		}).Info("Exporting backup")
+
+		var buf bytes.Buffer
+		if _, err := wsh.Store.ExportBackup(&buf); err != nil {
+			return nil, err
+		}
+		// The archive is base64 encoded as a json string
+		return json.Marshal(buf.Bytes())
+	case "import-backup":
+		var data []byte
+		err := json.Unmarshal(msg.Body, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest, err := wsh.Store.ImportBackup(data)
+		if err != nil {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"from":    msg.FromUUID,
+			"created": manifest.Created,
+		}).Warn("Backup imported. It is applied when the server is restarted")
+		return json.Marshal(manifest)
+	case "restore-snapshot":
+		type RequestBody struct {
+			Name string `json:"name"`
+		}
+
+		var req RequestBody
+		err := json.Unmarshal(msg.Body, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest, err := wsh.Store.RestoreSnapshot(req.Name)
+		if err != nil {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"from":     msg.FromUUID,
+			"snapshot": req.Name,
+		}).Warn("Snapshot restored. It is applied when the server is restarted")
+		return json.Marshal(manifest)
 	default:
 		logrus.WithFields(logrus.Fields{
 			"type":   msg.Type,
@@ -444,6 +1101,37 @@ func (wsh *secureWebsocketHandler) MessageFromUser(s interfaces.MelodySession, m
 	return nil, nil
 }
 
+// checkSecondFactor checks a two-factor code of the person. Failures are throttled per username together with the
+// failed logins, so a stolen session can not be used to guess the codes.
+func (wsh *secureWebsocketHandler) checkSecondFactor(p *persons.Person, code string) error {
+	limiter := wsh.Store.LoginUsers
+	key := strings.ToLower(p.Username)
+	if key == "" {
+		key = p.UUID
+	}
+
+	now := time.Now()
+	if limiter != nil {
+		if wait := limiter.Allow(key, now); wait > 0 {
+			return fmt.Errorf("too many failed attempts, try again in %d seconds", int(math.Ceil(wait.Seconds())))
+		}
+	}
+
+	err := wsh.Store.CheckSecondFactor(p.UUID, code)
+	if err != nil && limiter != nil && limiter.Fail(key, now) {
+		body := fmt.Sprintf("Two-factor codes for user %s are locked out after too many failed attempts", key)
+		logrus.Warn(body)
+		go func() {
+			for _, dest := range wsh.Config.LoginLockoutDestinations {
+				if err := wsh.Store.TriggerDestination(dest, body); err != nil {
+					logrus.Errorf("handlers: error sending lockout alert to %s: %s", dest, err)
+				}
+			}
+		}()
+	}
+	return err
+}
+
 func (wsh *secureWebsocketHandler) Connect(s interfaces.MelodySession, r *http.Request, keys map[string]interface{}) error {
 	proto, _ := s.Get(websocket.KeyProtocol.String())
 	id, _ := s.Get(websocket.KeyID.String())
@@ -477,6 +1165,18 @@ func (wsh *secureWebsocketHandler) Connect(s interfaces.MelodySession, r *http.R
 			return err
 		}
 		msg.WriteTo(s)
+
+		// Ask the node for a new CSR if its certificate expires soon
+		if secure, _ := s.Get("secure"); secure == "cert" {
+			_, identity := sessionIdentity(s)
+			if wsh.CA.NeedsRenewal(identity, time.Now()) {
+				msg, err := models.NewMessage("renew-certificate", nil)
+				if err != nil {
+					return err
+				}
+				msg.WriteTo(s)
+			}
+		}
 	}
 
 	return nil
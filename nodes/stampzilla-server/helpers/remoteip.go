@@ -0,0 +1,78 @@
+package helpers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RemoteIP returns the ip address of a host:port address. The address is returned as it is if it has no port.
+func RemoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// ParseProxies parses ip addresses and CIDR ranges of trusted reverse proxies.
+func ParseProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, block, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, block)
+	}
+	return nets, nil
+}
+
+func trusted(proxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, block := range proxies {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the address of the client that made the request. Requests from a trusted proxy are from the
+// last address in X-Forwarded-For that is not a trusted proxy, or from X-Real-IP. Other requests are from RemoteAddr.
+func ClientAddr(r *http.Request, proxies []*net.IPNet) string {
+	if !trusted(proxies, RemoteIP(r.RemoteAddr)) {
+		return r.RemoteAddr
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		addrs := strings.Split(strings.Join(forwarded, ","), ",")
+		client := r.RemoteAddr
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if net.ParseIP(addr) == nil {
+				break
+			}
+			client = addr
+			if !trusted(proxies, addr) {
+				break
+			}
+		}
+		return client
+	}
+
+	if addr := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(addr) != nil {
+		return addr
+	}
+	return r.RemoteAddr
+}
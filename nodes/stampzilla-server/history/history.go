@@ -0,0 +1,350 @@
+package history
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+)
+
+/* Layout on disk:
+devicehistory/
+	nodeuuid.deviceid/
+		2023-10-18.jsonl             raw values, one json object per line
+		2023-10-01.downsampled.jsonl values aggregated into Settings.DownsampleInterval buckets
+
+Each line looks like:
+	{"time":"2023-10-18T12:00:00Z","state":{"on":true,"brightness":0.5}}
+*/
+
+const (
+	dayFormat        = "2006-01-02"
+	rawSuffix        = ".jsonl"
+	downsampleSuffix = ".downsampled.jsonl"
+)
+
+// Settings controls how long history is kept and when it is downsampled.
+type Settings struct {
+	// Retention is how long values are kept. Zero disables the history.
+	Retention time.Duration
+	// DownsampleAfter is the age when raw values are aggregated. Zero disables downsampling.
+	DownsampleAfter time.Duration
+	// DownsampleInterval is the bucket size used when downsampling.
+	DownsampleInterval time.Duration
+}
+
+// ParseSettings parses the duration strings from the server config. An empty retention disables the history.
+func ParseSettings(retention, downsampleAfter, downsampleInterval string) (Settings, error) {
+	s := Settings{}
+	var err error
+	for _, v := range []struct {
+		str string
+		dst *time.Duration
+	}{
+		{retention, &s.Retention},
+		{downsampleAfter, &s.DownsampleAfter},
+		{downsampleInterval, &s.DownsampleInterval},
+	} {
+		if v.str == "" {
+			continue
+		}
+		*v.dst, err = time.ParseDuration(v.str)
+		if err != nil {
+			return s, fmt.Errorf("history: invalid duration %s: %w", v.str, err)
+		}
+	}
+	return s, nil
+}
+
+// Point is a single value of a state key at a point in time.
+type Point struct {
+	Time  time.Time   `json:"time"`
+	Value interface{} `json:"value"`
+}
+
+type entry struct {
+	Time  time.Time     `json:"time"`
+	State devices.State `json:"state"`
+}
+
+// History is an on-disk store of device state changes.
+type History struct {
+	path     string
+	settings Settings
+	sync.Mutex
+}
+
+// New returns a history that stores its files in path.
+func New(path string, settings Settings) *History {
+	return &History{
+		path:     path,
+		settings: settings,
+	}
+}
+
+// Enabled returns true if the history has a retention.
+func (h *History) Enabled() bool {
+	return h.settings.Retention > 0
+}
+
+// Add records the changed state of a device.
+func (h *History) Add(id devices.ID, state devices.State) error {
+	return h.add(time.Now(), id, state)
+}
+
+func (h *History) add(t time.Time, id devices.ID, state devices.State) error {
+	if !h.Enabled() || len(state) == 0 {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	dir := h.deviceDir(id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("history: error creating %s: %w", dir, err)
+	}
+
+	b, err := json.Marshal(entry{Time: t.UTC(), State: state})
+	if err != nil {
+		return fmt.Errorf("history: error encoding state for %s: %w", id, err)
+	}
+
+	filename := filepath.Join(dir, t.UTC().Format(dayFormat)+rawSuffix)
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("history: error opening %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// Query returns all values of key for device id between from and to sorted by time.
+func (h *History) Query(id devices.ID, key string, from, to time.Time) ([]Point, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	points := make([]Point, 0)
+	dir := h.deviceDir(id)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return points, nil
+		}
+		return nil, err
+	}
+
+	firstDay := from.UTC().Truncate(24 * time.Hour)
+	for _, f := range files {
+		day, ok := parseDay(f.Name())
+		if !ok || day.Before(firstDay) || day.After(to) {
+			continue
+		}
+
+		entries, err := readEntries(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Time.Before(from) || e.Time.After(to) {
+				continue
+			}
+			if v, ok := e.State[key]; ok {
+				points = append(points, Point{Time: e.Time, Value: v})
+			}
+		}
+	}
+
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+	return points, nil
+}
+
+// Start runs the retention and downsampling maintenance once every hour until ctx is canceled.
+func (h *History) Start(ctx context.Context) {
+	if !h.Enabled() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			if err := h.Maintain(time.Now()); err != nil {
+				logrus.Error(err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Maintain removes days older than the retention and downsamples days older than DownsampleAfter.
+func (h *History) Maintain(now time.Time) error {
+	h.Lock()
+	defer h.Unlock()
+
+	dirs, err := ioutil.ReadDir(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(h.path, d.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			day, ok := parseDay(f.Name())
+			if !ok {
+				continue
+			}
+			filename := filepath.Join(dir, f.Name())
+
+			// Compare with the end of the day so we never remove values that are still inside the retention
+			if day.Add(24 * time.Hour).Before(now.Add(-h.settings.Retention)) {
+				if err := os.Remove(filename); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if h.settings.DownsampleAfter <= 0 || h.settings.DownsampleInterval <= 0 {
+				continue
+			}
+			if strings.HasSuffix(f.Name(), downsampleSuffix) || !day.Before(today) {
+				continue
+			}
+			if day.Add(24 * time.Hour).After(now.Add(-h.settings.DownsampleAfter)) {
+				continue
+			}
+			if err := h.downsample(filename, day); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *History) downsample(filename string, day time.Time) error {
+	entries, err := readEntries(filename)
+	if err != nil {
+		return err
+	}
+
+	type bucket struct {
+		sum   map[string]float64
+		count map[string]int
+		last  devices.State
+	}
+	buckets := make(map[time.Time]*bucket)
+	for _, e := range entries {
+		t := e.Time.Truncate(h.settings.DownsampleInterval)
+		b, ok := buckets[t]
+		if !ok {
+			b = &bucket{
+				sum:   make(map[string]float64),
+				count: make(map[string]int),
+				last:  make(devices.State),
+			}
+			buckets[t] = b
+		}
+		for k, v := range e.State {
+			if f, ok := v.(float64); ok {
+				b.sum[k] += f
+				b.count[k]++
+				continue
+			}
+			b.last[k] = v
+		}
+	}
+
+	downsampled := make([]entry, 0, len(buckets))
+	for t, b := range buckets {
+		state := b.last
+		for k, sum := range b.sum {
+			state[k] = sum / float64(b.count[k])
+		}
+		downsampled = append(downsampled, entry{Time: t, State: state})
+	}
+	sort.Slice(downsampled, func(i, j int) bool {
+		return downsampled[i].Time.Before(downsampled[j].Time)
+	})
+
+	target := filepath.Join(filepath.Dir(filename), day.Format(dayFormat)+downsampleSuffix)
+	f, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("history: error opening %s: %w", target, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, e := range downsampled {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return os.Remove(filename)
+}
+
+func (h *History) deviceDir(id devices.ID) string {
+	return filepath.Join(h.path, url.PathEscape(id.String()))
+}
+
+func parseDay(name string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, downsampleSuffix)
+	name = strings.TrimSuffix(name, rawSuffix)
+	day, err := time.Parse(dayFormat, name)
+	return day, err == nil
+}
+
+func readEntries(filename string) ([]entry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]entry, 0)
+	decoder := json.NewDecoder(f)
+	for decoder.More() {
+		var e entry
+		if err := decoder.Decode(&e); err != nil {
+			// A crash can leave a half written last line. Keep what we have.
+			logrus.Warnf("history: error reading %s: %s", filename, err)
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
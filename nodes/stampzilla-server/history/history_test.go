@@ -0,0 +1,113 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHistory(t *testing.T, s Settings) (*History, string) {
+	dir, err := ioutil.TempDir("", "historytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return New(dir, s), dir
+}
+
+func TestParseSettings(t *testing.T) {
+	s, err := ParseSettings("720h", "", "5m")
+	assert.NoError(t, err)
+	assert.Equal(t, 720*time.Hour, s.Retention)
+	assert.Equal(t, time.Duration(0), s.DownsampleAfter)
+	assert.Equal(t, 5*time.Minute, s.DownsampleInterval)
+
+	_, err = ParseSettings("a while", "", "")
+	assert.Error(t, err)
+}
+
+func TestAddAndQuery(t *testing.T) {
+	h, _ := newTestHistory(t, Settings{Retention: 24 * time.Hour})
+	id := devices.ID{Node: "node", ID: "id"}
+	now := time.Now().UTC()
+
+	assert.NoError(t, h.add(now.Add(-2*time.Hour), id, devices.State{"temperature": 20.0}))
+	assert.NoError(t, h.add(now.Add(-time.Hour), id, devices.State{"on": true}))
+	assert.NoError(t, h.add(now, id, devices.State{"temperature": 22.5}))
+
+	points, err := h.Query(id, "temperature", now.Add(-3*time.Hour), now)
+	assert.NoError(t, err)
+	if assert.Len(t, points, 2) {
+		assert.Equal(t, 20.0, points[0].Value)
+		assert.Equal(t, 22.5, points[1].Value)
+	}
+
+	points, err = h.Query(id, "temperature", now.Add(-90*time.Minute), now)
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+
+	points, err = h.Query(devices.ID{Node: "node", ID: "other"}, "temperature", now.Add(-3*time.Hour), now)
+	assert.NoError(t, err)
+	assert.Len(t, points, 0)
+}
+
+func TestDisabledHistory(t *testing.T) {
+	h, dir := newTestHistory(t, Settings{})
+	assert.NoError(t, h.Add(devices.ID{Node: "node", ID: "id"}, devices.State{"on": true}))
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 0)
+}
+
+func TestMaintain(t *testing.T) {
+	h, dir := newTestHistory(t, Settings{
+		Retention:          10 * 24 * time.Hour,
+		DownsampleAfter:    2 * 24 * time.Hour,
+		DownsampleInterval: time.Hour,
+	})
+	id := devices.ID{Node: "node", ID: "id"}
+	now := time.Date(2023, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	old := now.Add(-20 * 24 * time.Hour)
+	assert.NoError(t, h.add(old, id, devices.State{"temperature": 10.0}))
+
+	day := time.Date(2023, 10, 14, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, h.add(day, id, devices.State{"temperature": 20.0, "on": false}))
+	assert.NoError(t, h.add(day.Add(10*time.Minute), id, devices.State{"temperature": 22.0}))
+	assert.NoError(t, h.add(day.Add(20*time.Minute), id, devices.State{"on": true}))
+	assert.NoError(t, h.add(day.Add(2*time.Hour), id, devices.State{"temperature": 30.0}))
+
+	assert.NoError(t, h.add(now, id, devices.State{"temperature": 25.0}))
+
+	assert.NoError(t, h.Maintain(now))
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "node.id"))
+	assert.NoError(t, err)
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.Equal(t, []string{"2023-10-14.downsampled.jsonl", "2023-10-18.jsonl"}, names)
+
+	points, err := h.Query(id, "temperature", day.Add(-time.Hour), now)
+	assert.NoError(t, err)
+	if assert.Len(t, points, 3) {
+		assert.Equal(t, 21.0, points[0].Value)
+		assert.Equal(t, 30.0, points[1].Value)
+		assert.Equal(t, 25.0, points[2].Value)
+	}
+
+	points, err = h.Query(id, "on", day.Add(-time.Hour), now)
+	assert.NoError(t, err)
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, true, points[0].Value)
+	}
+}
@@ -0,0 +1,266 @@
+package logic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+)
+
+/* Actions in rules.json can be written in the old string form or as objects:
+"actions": [
+	"1m", // sleep
+	"c7d352bb-23f4-468c-b476-f76599c09a0d", // saved state
+	{"type": "set", "device": "node.1", "key": "on", "value": true},
+	{"type": "set", "device": "node.1", "key": "brightness", "expression": "devices['node.2'].brightness"},
+	{"type": "toggle", "device": "node.1", "key": "on"},
+	{"type": "increment", "device": "node.1", "key": "brightness", "step": 0.1, "max": 1},
+	{"type": "decrement", "device": "node.1", "key": "brightness", "step": 0.1, "min": 0},
+	{"type": "destination", "uuid": "destination uuid", "body": "{{.Rule}} is {{index .Devices \"node.1.temperature\"}}"},
+	{"type": "enable-rule", "uuid": "rule uuid"},
+	{"type": "disable-rule", "uuid": "rule uuid"},
+	{"type": "scene", "uuid": "scene uuid"},
+	{"type": "restore-scene", "uuid": "scene uuid"}
+]
+*/
+
+// ActionType is the kind of action.
+type ActionType string
+
+const (
+	ActionSleep       ActionType = "sleep"
+	ActionSavedState  ActionType = "savedstate"
+	ActionSet         ActionType = "set"
+	ActionToggle      ActionType = "toggle"
+	ActionIncrement   ActionType = "increment"
+	ActionDecrement   ActionType = "decrement"
+	ActionDestination ActionType = "destination"
+	ActionEnableRule  ActionType = "enable-rule"
+	ActionDisableRule ActionType = "disable-rule"
+	// ActionScene applies a scene and ActionRestoreScene restores the devices to the state they had before.
+	ActionScene        ActionType = "scene"
+	ActionRestoreScene ActionType = "restore-scene"
+)
+
+// Action is one step that is run when a rule becomes active.
+type Action struct {
+	Type ActionType `json:"type"`
+
+	// Duration is used by sleep.
+	Duration stypes.Duration `json:"duration,omitempty"`
+	// UUID is the saved state, destination, rule or scene the action refers to.
+	UUID string `json:"uuid,omitempty"`
+
+	// Device and Key are the state key that set, toggle, increment and decrement changes.
+	Device string `json:"device,omitempty"`
+	Key    string `json:"key,omitempty"`
+	// Value is used by set. If Expression is set the value is computed with CEL instead.
+	Value      interface{} `json:"value,omitempty"`
+	Expression string      `json:"expression,omitempty"`
+	// Step, Min and Max are used by increment and decrement.
+	Step float64  `json:"step,omitempty"`
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+
+	// Body is a text/template used as the body when triggering a destination.
+	Body string `json:"body,omitempty"`
+}
+
+// ParseAction parses the old string form of an action. It is either a duration or a saved state uuid.
+func ParseAction(s string) Action {
+	if duration, err := time.ParseDuration(s); err == nil {
+		return Action{Type: ActionSleep, Duration: stypes.Duration(duration)}
+	}
+	return Action{Type: ActionSavedState, UUID: s}
+}
+
+func (a Action) MarshalJSON() ([]byte, error) {
+	// Keep the old string form so older versions can still read rules.json
+	switch a.Type {
+	case ActionSleep:
+		return json.Marshal(a.Duration.String())
+	case ActionSavedState:
+		return json.Marshal(a.UUID)
+	}
+
+	type localAction Action
+	return json.Marshal(localAction(a))
+}
+
+func (a *Action) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = ParseAction(s)
+		return nil
+	}
+
+	type localAction Action
+	la := localAction{}
+	if err := json.Unmarshal(b, &la); err != nil {
+		return err
+	}
+	*a = Action(la)
+	return nil
+}
+
+func (a Action) String() string {
+	switch a.Type {
+	case ActionSleep:
+		return a.Duration.String()
+	case ActionSavedState:
+		return a.UUID
+	case ActionDestination, ActionEnableRule, ActionDisableRule, ActionScene, ActionRestoreScene:
+		return fmt.Sprintf("%s %s", a.Type, a.UUID)
+	}
+	return fmt.Sprintf("%s %s.%s", a.Type, a.Device, a.Key)
+}
+
+// Run runs the action. Sleep actions returns ctx.Err() if they are canceled.
+func (a Action) Run(ctx context.Context, l *Logic, r *Rule) error {
+	switch a.Type {
+	case ActionSleep:
+		logrus.Debugf("logic: sleep action: %s", a.Duration)
+		return sleepContext(ctx, time.Duration(a.Duration))
+	case ActionSavedState:
+		stateList := l.StateStore.Get(a.UUID)
+		if stateList == nil {
+			return fmt.Errorf("SavedState %s does not exist", a.UUID)
+		}
+		l.recordStateChange(r, l.changeState(r, stateList.State))
+		return nil
+	case ActionSet, ActionToggle, ActionIncrement, ActionDecrement:
+		id, err := devices.NewIDFromString(a.Device)
+		if err != nil {
+			return fmt.Errorf("action %s: %w", a, err)
+		}
+		value, err := a.value(l, l.deviceValue(id, a.Key))
+		if err != nil {
+			return fmt.Errorf("action %s: %w", a, err)
+		}
+		l.recordStateChange(r, l.changeState(r, map[devices.ID]devices.State{
+			id: {a.Key: value},
+		}))
+		return nil
+	case ActionDestination:
+		body, err := a.body(l, r)
+		if err != nil {
+			return fmt.Errorf("action %s: %w", a, err)
+		}
+		return l.onTriggerDestination(a.UUID, body)
+	case ActionEnableRule:
+		return l.SetRuleEnabled(a.UUID, true)
+	case ActionDisableRule:
+		return l.SetRuleEnabled(a.UUID, false)
+	case ActionScene:
+		return l.ApplyScene(ctx, a.UUID, r)
+	case ActionRestoreScene:
+		return l.RestoreScene(ctx, a.UUID, r)
+	}
+
+	return fmt.Errorf("unknown action type: %s", a.Type)
+}
+
+// value calculates the new value of the state key.
+func (a Action) value(l *Logic, current interface{}) (interface{}, error) {
+	switch a.Type {
+	case ActionSet:
+		if a.Expression == "" {
+			return a.Value, nil
+		}
+		val, err := evalValue(a.Expression, l.devices, l.rulesActive(), l.evalState(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return val.Value(), nil
+	case ActionToggle:
+		b, _ := current.(bool)
+		return !b, nil
+	case ActionIncrement, ActionDecrement:
+		f, _ := toFloat(current)
+		step := a.Step
+		if step == 0 {
+			step = 1
+		}
+		if a.Type == ActionDecrement {
+			step = -step
+		}
+		f += step
+		if a.Min != nil && f < *a.Min {
+			f = *a.Min
+		}
+		if a.Max != nil && f > *a.Max {
+			f = *a.Max
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("action %s has no value", a.Type)
+}
+
+func (a Action) body(l *Logic, r *Rule) (string, error) {
+	if a.Body == "" {
+		return r.Name(), nil
+	}
+
+	tmpl, err := template.New("body").Parse(a.Body)
+	if err != nil {
+		return "", err
+	}
+
+	body := &strings.Builder{}
+	err = tmpl.Execute(body, struct {
+		Rule    string
+		UUID    string
+		Devices map[string]interface{}
+	}{
+		Rule:    r.Name(),
+		UUID:    r.Uuid(),
+		Devices: l.devices.Flatten(),
+	})
+	return body.String(), err
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// sendStateChange groups the states by node and sends a state-change to each node.
+// Returns the nodes that got a state-change and the error if sending failed.
+func sendStateChange(sender websocket.Sender, states map[devices.ID]devices.State) map[string]error {
+	devicesByNode := make(map[string]map[devices.ID]devices.State)
+	for id, state := range states {
+		if devicesByNode[id.Node] == nil {
+			devicesByNode[id.Node] = make(map[devices.ID]devices.State)
+		}
+		devicesByNode[id.Node][id] = state
+	}
+	result := make(map[string]error)
+	for nodeID, devs := range devicesByNode {
+		logrus.WithFields(logrus.Fields{
+			"to": nodeID,
+		}).Debug("Send state change request to node")
+		err := sender.SendToID(nodeID, "state-change", devs)
+		result[nodeID] = err
+		if err != nil {
+			logrus.Error("logic: error sending state-change to node: ", err)
+			continue
+		}
+	}
+	return result
+}
@@ -0,0 +1,100 @@
+package logic
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActionJSON(t *testing.T) {
+	data := `["1m0s","c7d352bb-23f4-468c-b476-f76599c09a0d",{"type":"toggle","device":"node.1","key":"on"}]`
+
+	actions := []Action{}
+	err := json.Unmarshal([]byte(data), &actions)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Action{
+		{Type: ActionSleep, Duration: stypes.Duration(time.Minute)},
+		{Type: ActionSavedState, UUID: "c7d352bb-23f4-468c-b476-f76599c09a0d"},
+		{Type: ActionToggle, Device: "node.1", Key: "on"},
+	}, actions)
+
+	b, err := json.Marshal(actions)
+	assert.NoError(t, err)
+	assert.Equal(t, data, string(b))
+}
+
+func TestRunTypedActions(t *testing.T) {
+	syncer := NewMockSender()
+	l := New(NewSavedStateStore(), syncer)
+	l.updateDevice(&devices.Device{
+		ID: devices.ID{Node: "node", ID: "1"},
+		State: devices.State{
+			"on": true,
+		},
+	})
+	l.updateDevice(&devices.Device{
+		ID: devices.ID{Node: "node", ID: "4"},
+		State: devices.State{
+			"brightness": 0.95,
+		},
+	})
+	l.updateDevice(&devices.Device{
+		ID: devices.ID{Node: "node", ID: "2"},
+		State: devices.State{
+			"brightness": 0.5,
+		},
+	})
+
+	other := l.AddRule("other")
+	destinations := map[string]string{}
+	l.OnTriggerDestination(func(dest, body string) error {
+		destinations[dest] = body
+		return nil
+	})
+	changed := 0
+	l.OnRulesChanged(func() {
+		changed++
+	})
+
+	max := 1.0
+	r := l.AddRule("test")
+	r.Actions_ = []Action{
+		{Type: ActionToggle, Device: "node.1", Key: "on"},
+		{Type: ActionIncrement, Device: "node.4", Key: "brightness", Step: 0.1, Max: &max},
+		{Type: ActionSet, Device: "node.3", Key: "color", Value: "red"},
+		{Type: ActionDestination, UUID: "dest", Body: `{{.Rule}} {{index .Devices "node.2.brightness"}}`},
+		{Type: ActionEnableRule, UUID: other.Uuid()},
+	}
+	r.Run(l)
+
+	assert.Equal(t, false, syncer.Devices.Get(devices.ID{Node: "node", ID: "1"}).State["on"])
+	assert.Equal(t, 1.0, syncer.Devices.Get(devices.ID{Node: "node", ID: "4"}).State["brightness"])
+	assert.Equal(t, "red", syncer.Devices.Get(devices.ID{Node: "node", ID: "3"}).State["color"])
+	assert.Equal(t, "test 0.5", destinations["dest"])
+	assert.True(t, other.Enabled)
+	assert.Equal(t, 1, changed)
+}
+
+func TestRunTypedActionComputed(t *testing.T) {
+	syncer := NewMockSender()
+	l := New(NewSavedStateStore(), syncer)
+	l.updateDevice(&devices.Device{
+		ID: devices.ID{Node: "node", ID: "2"},
+		State: devices.State{
+			"brightness": 0.25,
+		},
+	})
+
+	r := l.AddRule("test")
+	r.Actions_ = []Action{
+		{Type: ActionSet, Device: "node.3", Key: "brightness", Expression: `devices["node.2"].brightness * 2.0`},
+	}
+	r.Run(l)
+
+	assert.Equal(t, 0.5, syncer.Devices.Get(devices.ID{Node: "node", ID: "3"}).State["brightness"])
+}
@@ -0,0 +1,313 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+)
+
+/* blueprints.json example
+{
+    "4f8d1b9e-6a3c-4c1e-9b1f-2f1d5c7a9e10": {
+        "name": "Motion light",
+        "uuid": "4f8d1b9e-6a3c-4c1e-9b1f-2f1d5c7a9e10",
+        "parameters": [
+            {"name": "motion", "type": "device"},
+            {"name": "light", "type": "device"},
+            {"name": "delay", "type": "duration", "default": "5m"}
+        ],
+        "template": {
+            "expression": "devices['${motion}'].motion == true",
+            "actions": [
+                {"type": "set", "device": "${light}", "key": "on", "value": true}
+            ],
+            "releaseFor": "${delay}",
+            "releaseActions": [
+                {"type": "set", "device": "${light}", "key": "on", "value": false}
+            ]
+        }
+    }
+}
+
+A rule in rules.json that uses the blueprint:
+{
+    "name": "Hallway motion light",
+    "uuid": "a0c6f0f2-8b0e-4b8e-8f4e-0d6a3e1b2c3d",
+    "enabled": true,
+    "blueprint": "4f8d1b9e-6a3c-4c1e-9b1f-2f1d5c7a9e10",
+    "parameters": {
+        "motion": "nodeuuid.1",
+        "light": "nodeuuid.2"
+    }
+}
+*/
+
+// BlueprintParameterType is the type of a blueprint parameter.
+type BlueprintParameterType string
+
+const (
+	ParameterDevice     BlueprintParameterType = "device"
+	ParameterDuration   BlueprintParameterType = "duration"
+	ParameterSavedState BlueprintParameterType = "savedstate"
+	ParameterString     BlueprintParameterType = "string"
+	ParameterNumber     BlueprintParameterType = "number"
+	ParameterBool       BlueprintParameterType = "bool"
+)
+
+var blueprintPlaceholder = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// BlueprintParameter is a parameter that is written as ${name} in the template.
+type BlueprintParameter struct {
+	Name        string                 `json:"name"`
+	Type        BlueprintParameterType `json:"type"`
+	Description string                 `json:"description,omitempty"`
+	// Default is used if the rule does not set the parameter. A parameter without default is required.
+	Default interface{} `json:"default,omitempty"`
+}
+
+// Blueprint is a rule template. Rules that use it get their expression, for, actions and destinations from it.
+type Blueprint struct {
+	Name        string               `json:"name"`
+	UUID        string               `json:"uuid"`
+	Description string               `json:"description,omitempty"`
+	Parameters  []BlueprintParameter `json:"parameters"`
+	// Template is the part of a rule that is generated. Parameters are substituted before it is parsed.
+	Template json.RawMessage `json:"template"`
+}
+
+type Blueprints map[string]*Blueprint
+
+// blueprintTemplate is the fields of a rule that a blueprint defines.
+type blueprintTemplate struct {
+	Expression     string          `json:"expression"`
+	For            stypes.Duration `json:"for"`
+	Actions        []Action        `json:"actions"`
+	Destinations   []string        `json:"destinations"`
+	ReleaseActions []Action        `json:"releaseActions"`
+	ReleaseFor     stypes.Duration `json:"releaseFor"`
+}
+
+// instantiate substitutes the parameters in the template and returns the resulting rule fields.
+func (b *Blueprint) instantiate(params map[string]interface{}) (*blueprintTemplate, error) {
+	values := make(map[string]string)
+	for _, p := range b.Parameters {
+		v, ok := params[p.Name]
+		if !ok {
+			v = p.Default
+		}
+		if v == nil {
+			return nil, fmt.Errorf("blueprint %s: parameter %s is missing", b.Name, p.Name)
+		}
+		s, err := p.format(v)
+		if err != nil {
+			return nil, fmt.Errorf("blueprint %s: parameter %s: %s", b.Name, p.Name, err)
+		}
+		values[p.Name] = s
+	}
+	for name := range params {
+		if _, ok := values[name]; !ok {
+			return nil, fmt.Errorf("blueprint %s: unknown parameter %s", b.Name, name)
+		}
+	}
+
+	var unknown []string
+	substitute := func(escape func(string) string) string {
+		return blueprintPlaceholder.ReplaceAllStringFunc(string(b.Template), func(s string) string {
+			name := s[2 : len(s)-1]
+			v, ok := values[name]
+			if !ok {
+				unknown = append(unknown, name)
+			}
+			return escape(v)
+		})
+	}
+	text := substitute(jsonEscape)
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("blueprint %s: template uses undefined parameter %s", b.Name, strings.Join(unknown, ", "))
+	}
+
+	t := &blueprintTemplate{}
+	if err := json.Unmarshal([]byte(text), t); err != nil {
+		return nil, fmt.Errorf("blueprint %s: error parsing template: %s", b.Name, err)
+	}
+
+	// The values in the expression are escaped for a cel string literal as well so they can not change the expression
+	expression := struct {
+		Expression string `json:"expression"`
+	}{}
+	text = substitute(func(v string) string { return jsonEscape(celEscape(v)) })
+	if err := json.Unmarshal([]byte(text), &expression); err != nil {
+		return nil, fmt.Errorf("blueprint %s: error parsing template: %s", b.Name, err)
+	}
+	t.Expression = expression.Expression
+	return t, nil
+}
+
+// jsonEscape escapes s so it can be written inside a json string.
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+// celEscape escapes s so it can be written inside a single or double quoted cel string.
+func celEscape(s string) string {
+	q := strconv.Quote(s)
+	return strings.ReplaceAll(q[1:len(q)-1], "'", `\'`)
+}
+
+// format validates v and returns it as a string. It is escaped before it is written in the template.
+func (p BlueprintParameter) format(v interface{}) (string, error) {
+	switch p.Type {
+	case ParameterNumber:
+		f, ok := toFloat(v)
+		if !ok {
+			return "", fmt.Errorf("%v is not a number", v)
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	case ParameterBool:
+		b, ok := v.(bool)
+		if !ok {
+			return "", fmt.Errorf("%v is not a bool", v)
+		}
+		return strconv.FormatBool(b), nil
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%v is not a string", v)
+	}
+	switch p.Type {
+	case ParameterDevice:
+		if _, err := devices.NewIDFromString(s); err != nil {
+			return "", err
+		}
+	case ParameterDuration:
+		if _, err := time.ParseDuration(s); err != nil {
+			return "", err
+		}
+	case ParameterSavedState:
+		if s == "" {
+			return "", fmt.Errorf("saved state is empty")
+		}
+	case ParameterString:
+	default:
+		return "", fmt.Errorf("unknown type %s", p.Type)
+	}
+	return s, nil
+}
+
+type BlueprintStore struct {
+	Blueprints Blueprints
+	sync.RWMutex
+}
+
+func NewBlueprintStore() *BlueprintStore {
+	return &BlueprintStore{
+		Blueprints: make(Blueprints),
+	}
+}
+
+func (bs *BlueprintStore) Get(uuid string) *Blueprint {
+	bs.RLock()
+	defer bs.RUnlock()
+	return bs.Blueprints[uuid]
+}
+
+func (bs *BlueprintStore) All() Blueprints {
+	bs.RLock()
+	defer bs.RUnlock()
+	return bs.Blueprints
+}
+
+func (bs *BlueprintStore) SetBlueprints(b Blueprints) {
+	bs.Lock()
+	bs.Blueprints = b
+	bs.Unlock()
+}
+
+func (bs *BlueprintStore) Save() error {
+	b := persist.Batch{}
+	if err := bs.AddTo(b); err != nil {
+		return err
+	}
+	if err := b.Save(); err != nil {
+		return fmt.Errorf("blueprints: error saving blueprints.json: %s", err.Error())
+	}
+	return nil
+}
+
+// AddTo adds blueprints.json to the batch so it can be saved together with other documents.
+func (bs *BlueprintStore) AddTo(b persist.Batch) error {
+	bs.Lock()
+	defer bs.Unlock()
+	if err := b.Add("blueprints.json", bs.Blueprints); err != nil {
+		return fmt.Errorf("blueprints: error encoding blueprints.json: %s", err.Error())
+	}
+	return nil
+}
+
+func (bs *BlueprintStore) Load() error {
+	bs.Lock()
+	defer bs.Unlock()
+	if err := persist.Load("blueprints.json", &bs.Blueprints); err != nil {
+		if os.IsNotExist(err) {
+			return nil // We dont want to error our if the file does not exist when we start the server
+		}
+		return fmt.Errorf("blueprints: error loading blueprints.json: %s", err.Error())
+	}
+	return nil
+}
+
+// ApplyBlueprints generates the expression, actions and destinations of all rules that use a blueprint.
+func (l *Logic) ApplyBlueprints() {
+	l.RLock()
+	defer l.RUnlock()
+	for _, r := range l.Rules {
+		if err := l.applyBlueprint(r); err != nil {
+			logrus.Errorf("logic: rule %s: %s", r.Uuid(), err)
+		}
+	}
+}
+
+// applyBlueprint updates the rule from its blueprint. It does nothing if the rule does not use a blueprint.
+func (l *Logic) applyBlueprint(r *Rule) error {
+	r.RLock()
+	uuid := r.Blueprint_
+	params := r.Parameters_
+	r.RUnlock()
+	if uuid == "" {
+		return nil
+	}
+
+	var t *blueprintTemplate
+	var err error
+	if b := l.BlueprintStore.Get(uuid); b == nil {
+		err = fmt.Errorf("blueprint %s does not exist", uuid)
+	} else {
+		t, err = b.instantiate(params)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.blueprintErr = err
+	if err != nil {
+		return err
+	}
+	r.Expression_ = t.Expression
+	r.For_ = t.For
+	r.Actions_ = t.Actions
+	r.Destinations_ = t.Destinations
+	r.ReleaseActions_ = t.ReleaseActions
+	r.ReleaseFor_ = t.ReleaseFor
+	return nil
+}
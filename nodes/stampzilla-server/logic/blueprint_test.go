@@ -0,0 +1,123 @@
+package logic
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMotionBlueprint() *Blueprint {
+	return &Blueprint{
+		Name: "motion light",
+		UUID: "blueprint",
+		Parameters: []BlueprintParameter{
+			{Name: "motion", Type: ParameterDevice},
+			{Name: "light", Type: ParameterDevice},
+			{Name: "delay", Type: ParameterDuration, Default: "5m"},
+			{Name: "level", Type: ParameterNumber, Default: 0.5},
+		},
+		Template: json.RawMessage(`{
+			"expression": "devices['${motion}'].motion == true",
+			"actions": [
+				{"type": "set", "device": "${light}", "key": "brightness", "value": ${level}}
+			],
+			"releaseFor": "${delay}",
+			"releaseActions": [
+				{"type": "set", "device": "${light}", "key": "on", "value": false}
+			]
+		}`),
+	}
+}
+
+func TestBlueprintInstantiate(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	l.BlueprintStore.SetBlueprints(Blueprints{"blueprint": newMotionBlueprint()})
+
+	r := l.AddRule("hallway")
+	r.Blueprint_ = "blueprint"
+	r.Parameters_ = map[string]interface{}{
+		"motion": "node.motion",
+		"light":  "node.light",
+		"delay":  "1m",
+	}
+
+	assert.NoError(t, l.applyBlueprint(r))
+	assert.Equal(t, `devices['node.motion'].motion == true`, r.Expression_)
+	assert.Equal(t, stypes.Duration(time.Minute), r.ReleaseFor_)
+	assert.Equal(t, []Action{{Type: ActionSet, Device: "node.light", Key: "brightness", Value: 0.5}}, r.Actions_)
+	assert.Equal(t, "node.light", r.ReleaseActions_[0].Device)
+
+	// Changing the blueprint updates the rule
+	b := newMotionBlueprint()
+	b.Template = json.RawMessage(`{"expression": "devices['${motion}'].motion == false"}`)
+	l.BlueprintStore.SetBlueprints(Blueprints{"blueprint": b})
+	l.ApplyBlueprints()
+	assert.Equal(t, `devices['node.motion'].motion == false`, r.Expression())
+	assert.Len(t, r.Actions_, 0)
+}
+
+func TestBlueprintParameterErrors(t *testing.T) {
+	b := newMotionBlueprint()
+
+	_, err := b.instantiate(map[string]interface{}{"motion": "node.motion"})
+	assert.EqualError(t, err, "blueprint motion light: parameter light is missing")
+
+	_, err = b.instantiate(map[string]interface{}{"motion": "node.motion", "light": "light"})
+	assert.EqualError(t, err, "blueprint motion light: parameter light: wrong ID format. Expected nodeuuid.deviceid")
+
+	_, err = b.instantiate(map[string]interface{}{"motion": "node.motion", "light": "node.light", "delay": "soon"})
+	assert.EqualError(t, err, `blueprint motion light: parameter delay: time: invalid duration "soon"`)
+
+	_, err = b.instantiate(map[string]interface{}{"motion": "node.motion", "light": "node.light", "room": "hall"})
+	assert.EqualError(t, err, "blueprint motion light: unknown parameter room")
+
+	b.Template = json.RawMessage(`{"expression": "devices['${sensor}'].on"}`)
+	_, err = b.instantiate(map[string]interface{}{"motion": "node.motion", "light": "node.light"})
+	assert.EqualError(t, err, "blueprint motion light: template uses undefined parameter sensor")
+}
+
+func TestBlueprintStringParameterIsEscaped(t *testing.T) {
+	b := &Blueprint{
+		Name:       "test",
+		Parameters: []BlueprintParameter{{Name: "text", Type: ParameterString}},
+		Template:   json.RawMessage(`{"expression": "\"${text}\" == \"\""}`),
+	}
+	tmpl, err := b.instantiate(map[string]interface{}{"text": `a"b`})
+	assert.NoError(t, err)
+	assert.Equal(t, `"a\"b" == ""`, tmpl.Expression)
+
+	// A quote in the value can not change the expression
+	b.Template = json.RawMessage(`{"expression": "'${text}' == 'x'", "destinations": ["${text}"]}`)
+	tmpl, err = b.instantiate(map[string]interface{}{"text": `x' || true || '`})
+	assert.NoError(t, err)
+	assert.Equal(t, `'x\' || true || \'' == 'x'`, tmpl.Expression)
+	assert.Equal(t, []string{`x' || true || '`}, tmpl.Destinations)
+	_, issues := celEnv.Compile(tmpl.Expression)
+	assert.NoError(t, issues.Err())
+}
+
+func TestEvaluateRulesWithMissingBlueprint(t *testing.T) {
+	syncer := NewMockSender()
+	l := New(NewSavedStateStore(), syncer)
+	var reported string
+	l.OnReportState(func(uuid string, state devices.State) {
+		if v, ok := state["error"].(string); ok {
+			reported = v
+		}
+	})
+
+	r := l.AddRule("test")
+	r.Enabled = true
+	r.Expression_ = "true"
+	r.Blueprint_ = "missing"
+	l.ApplyBlueprints()
+	l.EvaluateRules(context.Background())
+
+	assert.Equal(t, false, r.Active())
+	assert.Equal(t, "blueprint missing does not exist", reported)
+}
@@ -0,0 +1,220 @@
+package logic
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	"github.com/jonaz/astrotime"
+)
+
+const (
+	holidayFormat          = "2006-01-02"
+	recurringHolidayFormat = "01-02"
+)
+
+// Calendar contains the location and holidays used by the sun and calendar functions in rules and scheduled tasks.
+type Calendar struct {
+	Latitude  float64
+	Longitude float64
+	// holidays contains dates as 2006-01-02 and recurring dates as 01-02
+	holidays map[string]bool
+}
+
+// NewCalendar returns a calendar for the location. Holidays are dates like 2023-12-24 or 12-24 to repeat every year.
+func NewCalendar(latitude, longitude float64, holidays []string) (*Calendar, error) {
+	c := &Calendar{
+		Latitude:  latitude,
+		Longitude: longitude,
+		holidays:  make(map[string]bool),
+	}
+	for _, h := range holidays {
+		h = strings.TrimSpace(h)
+		_, err := time.Parse(holidayFormat, h)
+		if err != nil {
+			if _, err := time.Parse(recurringHolidayFormat, h); err != nil {
+				return nil, fmt.Errorf("calendar: invalid holiday %s. Use 2006-01-02 or 01-02", h)
+			}
+		}
+		c.holidays[h] = true
+	}
+	return c, nil
+}
+
+// HasLocation returns true if a latitude or longitude is configured.
+func (c *Calendar) HasLocation() bool {
+	return c != nil && (c.Latitude != 0 || c.Longitude != 0)
+}
+
+// Sunrise returns the sunrise on the day of t.
+func (c *Calendar) Sunrise(t time.Time) time.Time {
+	return astrotime.CalcSunrise(t, c.Latitude, c.Longitude)
+}
+
+// Sunset returns the sunset on the day of t.
+func (c *Calendar) Sunset(t time.Time) time.Time {
+	return astrotime.CalcSunset(t, c.Latitude, c.Longitude)
+}
+
+// IsDark returns true if t is after sunset+offset or before sunrise-offset.
+// A negative offset makes it dark earlier in the evening and longer in the morning.
+func (c *Calendar) IsDark(t time.Time, offset time.Duration) bool {
+	return t.After(c.Sunset(t).Add(offset)) || t.Before(c.Sunrise(t).Add(-offset))
+}
+
+// IsHoliday returns true if the day of t is in the holiday list.
+func (c *Calendar) IsHoliday(t time.Time) bool {
+	if c == nil {
+		return false
+	}
+	return c.holidays[t.Format(holidayFormat)] || c.holidays[t.Format(recurringHolidayFormat)]
+}
+
+// IsWeekend returns true if t is a saturday or sunday.
+func IsWeekend(t time.Time) bool {
+	return t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+}
+
+// celFunctions returns the cel implementations of the sun and calendar functions. c can be nil if no calendar is configured.
+func (c *Calendar) celFunctions() []*functions.Overload {
+	errNoLocation := types.NewErr("no latitude and longitude configured in the server config")
+	offset := func(v ref.Val) (time.Duration, ref.Val) {
+		d, ok := v.Value().(time.Duration)
+		if !ok {
+			return 0, types.NewErr("invalid offset: %v", v)
+		}
+		return d, nil
+	}
+	sun := func(f func(*Calendar, time.Time) time.Time) func(ref.Val) ref.Val {
+		return func(v ref.Val) ref.Val {
+			if !c.HasLocation() {
+				return errNoLocation
+			}
+			d, err := offset(v)
+			if err != nil {
+				return err
+			}
+			return types.Timestamp{Time: f(c, time.Now()).Add(d)}
+		}
+	}
+
+	return []*functions.Overload{
+		{
+			Operator: "sunrise",
+			Function: func(...ref.Val) ref.Val {
+				return sun((*Calendar).Sunrise)(types.Duration{})
+			},
+		},
+		{
+			Operator: "sunrise_duration",
+			Unary:    sun((*Calendar).Sunrise),
+		},
+		{
+			Operator: "sunset",
+			Function: func(...ref.Val) ref.Val {
+				return sun((*Calendar).Sunset)(types.Duration{})
+			},
+		},
+		{
+			Operator: "sunset_duration",
+			Unary:    sun((*Calendar).Sunset),
+		},
+		{
+			Operator: "isDark",
+			Function: func(...ref.Val) ref.Val {
+				if !c.HasLocation() {
+					return errNoLocation
+				}
+				return types.Bool(c.IsDark(time.Now(), 0))
+			},
+		},
+		{
+			Operator: "isDark_duration",
+			Unary: func(v ref.Val) ref.Val {
+				if !c.HasLocation() {
+					return errNoLocation
+				}
+				d, err := offset(v)
+				if err != nil {
+					return err
+				}
+				return types.Bool(c.IsDark(time.Now(), d))
+			},
+		},
+		{
+			Operator: "weekday",
+			Function: func(...ref.Val) ref.Val {
+				return types.Int(time.Now().Weekday())
+			},
+		},
+		{
+			Operator: "isWeekend",
+			Function: func(...ref.Val) ref.Val {
+				return types.Bool(IsWeekend(time.Now()))
+			},
+		},
+		{
+			Operator: "isHoliday",
+			Function: func(...ref.Val) ref.Val {
+				return types.Bool(c.IsHoliday(time.Now()))
+			},
+		},
+	}
+}
+
+// sunSchedule is a cron schedule that runs at sunrise or sunset with an offset. Used for When like "sunset-15m".
+type sunSchedule struct {
+	sunset   bool
+	offset   time.Duration
+	calendar *Calendar
+}
+
+// parseSunSchedule parses sunrise, sunset, sunrise+30m and sunset-15m. Returns false if spec is not a sun schedule.
+func parseSunSchedule(spec string, calendar *Calendar) (*sunSchedule, bool, error) {
+	spec = strings.TrimSpace(spec)
+	s := &sunSchedule{calendar: calendar}
+	switch {
+	case strings.HasPrefix(spec, "sunrise"):
+		spec = strings.TrimPrefix(spec, "sunrise")
+	case strings.HasPrefix(spec, "sunset"):
+		s.sunset = true
+		spec = strings.TrimPrefix(spec, "sunset")
+	default:
+		return nil, false, nil
+	}
+
+	if !calendar.HasLocation() {
+		return nil, true, fmt.Errorf("scheduler: no latitude and longitude configured in the server config")
+	}
+
+	if spec != "" {
+		offset, err := time.ParseDuration(strings.TrimPrefix(spec, "+"))
+		if err != nil {
+			return nil, true, fmt.Errorf("scheduler: invalid sun offset %s: %w", spec, err)
+		}
+		s.offset = offset
+	}
+	return s, true, nil
+}
+
+// Next returns the first sunrise or sunset plus offset after t.
+func (s *sunSchedule) Next(t time.Time) time.Time {
+	// Start one day back to handle offsets that moves the event to the day before
+	day := t.AddDate(0, 0, -1)
+	for i := 0; i < 3; i++ {
+		var next time.Time
+		if s.sunset {
+			next = s.calendar.Sunset(day).Add(s.offset)
+		} else {
+			next = s.calendar.Sunrise(day).Add(s.offset)
+		}
+		if next.After(t) {
+			return next
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
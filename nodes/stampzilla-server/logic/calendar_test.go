@@ -0,0 +1,109 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCalendar(t *testing.T) {
+	c, err := NewCalendar(56.87, 14.8, []string{"2023-06-23", "12-24"})
+	assert.NoError(t, err)
+	assert.True(t, c.HasLocation())
+	assert.True(t, c.IsHoliday(time.Date(2023, 6, 23, 12, 0, 0, 0, time.Local)))
+	assert.False(t, c.IsHoliday(time.Date(2024, 6, 23, 12, 0, 0, 0, time.Local)))
+	assert.True(t, c.IsHoliday(time.Date(2030, 12, 24, 12, 0, 0, 0, time.Local)))
+
+	_, err = NewCalendar(0, 0, []string{"christmas"})
+	assert.Error(t, err)
+
+	c, err = NewCalendar(0, 0, nil)
+	assert.NoError(t, err)
+	assert.False(t, c.HasLocation())
+}
+
+func TestCalendarSun(t *testing.T) {
+	loc := time.FixedZone("CET", 3600)
+	c, _ := NewCalendar(56.87, 14.8, nil)
+
+	day := time.Date(2023, 1, 10, 12, 0, 0, 0, loc)
+	sunrise := c.Sunrise(day)
+	sunset := c.Sunset(day)
+	assert.Equal(t, 8, sunrise.Hour())
+	assert.Equal(t, 15, sunset.Hour())
+
+	assert.False(t, c.IsDark(day, 0))
+	assert.True(t, c.IsDark(time.Date(2023, 1, 10, 22, 0, 0, 0, loc), 0))
+	assert.True(t, c.IsDark(time.Date(2023, 1, 10, 6, 0, 0, 0, loc), 0))
+
+	// Negative offset makes it dark before sunset
+	assert.False(t, c.IsDark(sunset.Add(-10*time.Minute), 0))
+	assert.True(t, c.IsDark(sunset.Add(-10*time.Minute), -30*time.Minute))
+	assert.True(t, c.IsDark(sunrise.Add(10*time.Minute), -30*time.Minute))
+}
+
+func TestCalendarCelFunctions(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	c, _ := NewCalendar(56.87, 14.8, []string{time.Now().Format("2006-01-02")})
+	l.SetCalendar(c)
+
+	tests := []struct {
+		Expression string
+		Expected   bool
+	}{
+		{`sunrise() < sunset()`, true},
+		{`sunset(duration("-15m")) < sunset()`, true},
+		{`sunrise(duration("1h")) - sunrise() == duration("1h")`, true},
+		{`isDark() || !isDark()`, true},
+		{`isDark(duration("-30m")) || !isDark(duration("-30m"))`, true},
+		{`weekday() >= 0 && weekday() <= 6`, true},
+		{`isWeekend() == (weekday() == 0 || weekday() == 6)`, true},
+		{`isHoliday()`, true},
+	}
+	for _, v := range tests {
+		result, err := eval(v.Expression, l.devices, nil, l.evalState(), nil)
+		assert.NoError(t, err, v.Expression)
+		assert.Equal(t, v.Expected, result, v.Expression)
+	}
+
+	// Sun functions needs a location but the calendar functions works anyway
+	l.SetCalendar(nil)
+	_, err := eval(`isDark()`, l.devices, nil, l.evalState(), nil)
+	assert.Error(t, err)
+	result, err := eval(`isHoliday()`, l.devices, nil, l.evalState(), nil)
+	assert.NoError(t, err)
+	assert.False(t, result)
+}
+
+func TestSunSchedule(t *testing.T) {
+	loc := time.FixedZone("CET", 3600)
+	c, _ := NewCalendar(56.87, 14.8, nil)
+
+	_, ok, err := parseSunSchedule("0 * * * * *", c)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, ok, err = parseSunSchedule("sunset", nil)
+	assert.True(t, ok)
+	assert.Error(t, err)
+
+	_, ok, err = parseSunSchedule("sunset-15x", c)
+	assert.True(t, ok)
+	assert.Error(t, err)
+
+	s, ok, err := parseSunSchedule("sunset-15m", c)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	noon := time.Date(2023, 1, 10, 12, 0, 0, 0, loc)
+	assert.Equal(t, c.Sunset(noon).Add(-15*time.Minute), s.Next(noon))
+
+	// After todays sunset the next one is tomorrow
+	evening := time.Date(2023, 1, 10, 20, 0, 0, 0, loc)
+	assert.Equal(t, c.Sunset(evening.AddDate(0, 0, 1)).Add(-15*time.Minute), s.Next(evening))
+
+	s, _, err = parseSunSchedule("sunrise+30m", c)
+	assert.NoError(t, err)
+	assert.Equal(t, c.Sunrise(evening.AddDate(0, 0, 1)).Add(30*time.Minute), s.Next(evening))
+}
@@ -0,0 +1,170 @@
+package logic
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+)
+
+/* computeddevices.json example
+{
+    "dewpoint": {
+        "id": "dewpoint",
+        "name": "Dew point",
+        "type": "sensor",
+        "state": {
+            "temperature": "devices['node.1'].temperature - (100.0 - devices['node.1'].humidity) / 5.0"
+        }
+    },
+    "windows": {
+        "id": "windows",
+        "name": "Any window open",
+        "type": "sensor",
+        "state": {
+            "open": "devices['spc.1'].open || devices['spc.2'].open"
+        }
+    }
+}
+*/
+
+// ComputedDevice is a device hosted by the server where each state key is a cel expression over devices.
+type ComputedDevice struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Traits []string `json:"traits,omitempty"`
+	// State is the expression of each state key.
+	State map[string]string `json:"state"`
+}
+
+type ComputedDevices map[string]*ComputedDevice
+
+type ComputedStore struct {
+	Devices ComputedDevices
+	sync.RWMutex
+}
+
+func NewComputedStore() *ComputedStore {
+	return &ComputedStore{
+		Devices: make(ComputedDevices),
+	}
+}
+
+func (cs *ComputedStore) All() ComputedDevices {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.Devices
+}
+
+func (cs *ComputedStore) Save() error {
+	cs.Lock()
+	defer cs.Unlock()
+	if err := persist.Save("computeddevices.json", cs.Devices); err != nil {
+		return fmt.Errorf("computed: error saving computeddevices.json: %s", err.Error())
+	}
+	return nil
+}
+
+func (cs *ComputedStore) Load() error {
+	cs.Lock()
+	defer cs.Unlock()
+	if err := persist.Load("computeddevices.json", &cs.Devices); err != nil {
+		if os.IsNotExist(err) {
+			return nil // We dont want to error our if the file does not exist when we start the server
+		}
+		return fmt.Errorf("computed: error loading computeddevices.json: %s", err.Error())
+	}
+	for id, d := range cs.Devices {
+		d.ID = id
+	}
+	return nil
+}
+
+// SetNodeUUID sets the uuid of the server. Computed devices are hosted under it.
+func (l *Logic) SetNodeUUID(uuid string) {
+	l.Lock()
+	l.nodeUUID = uuid
+	l.Unlock()
+}
+
+// NodeUUID returns the uuid of the server.
+func (l *Logic) NodeUUID() string {
+	l.RLock()
+	defer l.RUnlock()
+	return l.nodeUUID
+}
+
+// OnComputedDevice is called from the worker when the state of a computed device has changed.
+func (l *Logic) OnComputedDevice(callback func(*devices.Device)) {
+	l.onComputedDevice = callback
+}
+
+// SetComputedDevices validates the expressions and replaces all computed devices. Removed devices are removed from logic.
+func (l *Logic) SetComputedDevices(list ComputedDevices) error {
+	for id, d := range list {
+		d.ID = id
+		for key, exp := range d.State {
+			ast, iss := celEnv.Parse(exp)
+			if iss.Err() == nil {
+				_, iss = celEnv.Check(ast)
+			}
+			if iss.Err() != nil {
+				return fmt.Errorf("computed device %s key %s: %s", id, key, iss.Err())
+			}
+		}
+	}
+
+	node := l.NodeUUID()
+	for id := range l.Computed.All() {
+		if _, ok := list[id]; !ok {
+			l.devices.Remove(devices.ID{Node: node, ID: id})
+		}
+	}
+
+	l.Computed.Lock()
+	l.Computed.Devices = list
+	l.Computed.Unlock()
+	return nil
+}
+
+// updateComputed calculates the state of all computed devices and updates the ones that changed.
+// It is run in the worker after each update so the rules see the new values in the same evaluation.
+func (l *Logic) updateComputed() {
+	node := l.NodeUUID()
+	for _, d := range l.Computed.All() {
+		id := devices.ID{Node: node, ID: d.ID}
+		state := make(devices.State)
+		for key, exp := range d.State {
+			result, err := evalValue(exp, l.devices, l.rulesActive(), l.evalState(), nil)
+			if err != nil {
+				logrus.Debugf("logic: error computing %s.%s: %s", id, key, err)
+				continue
+			}
+			state[key] = explainValue(result)
+		}
+
+		if old := l.devices.Get(id); old != nil {
+			old.RLock()
+			diff := old.State.Diff(state)
+			old.RUnlock()
+			if len(diff) == 0 {
+				continue
+			}
+		}
+
+		dev := &devices.Device{
+			Type:   d.Type,
+			ID:     id,
+			Name:   d.Name,
+			Online: true,
+			State:  state,
+			Traits: d.Traits,
+		}
+		l.updateDevice(dev.Copy())
+		l.onComputedDevice(dev)
+	}
+}
@@ -0,0 +1,63 @@
+package logic
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputedDevices(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	l.SetNodeUUID("server")
+	computed := []*devices.Device{}
+	l.OnComputedDevice(func(dev *devices.Device) {
+		computed = append(computed, dev)
+	})
+
+	err := l.SetComputedDevices(ComputedDevices{
+		"power": {
+			Name: "Total power",
+			Type: "sensor",
+			State: map[string]string{
+				"power": `devices["mbus.1"].power + devices["mbus.2"].power`,
+				"high":  `devices["mbus.1"].power + devices["mbus.2"].power > 2000.0`,
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	r := l.AddRule("test")
+	r.Enabled = true
+	r.Expression_ = `devices["server.power"].high == true`
+
+	l.updateDevice(&devices.Device{ID: devices.ID{Node: "mbus", ID: "1"}, State: devices.State{"power": 1500.0}})
+	l.updateDevice(&devices.Device{ID: devices.ID{Node: "mbus", ID: "2"}, State: devices.State{"power": 1000.0}})
+	l.updateComputed()
+	l.EvaluateRules(context.Background())
+	l.Wait()
+
+	assert.Len(t, computed, 1)
+	assert.Equal(t, devices.ID{Node: "server", ID: "power"}, computed[0].ID)
+	assert.Equal(t, devices.State{"power": 2500.0, "high": true}, computed[0].State)
+	assert.Equal(t, true, r.Active())
+
+	// Nothing is reported if the computed state did not change
+	l.updateDevice(&devices.Device{ID: devices.ID{Node: "mbus", ID: "3"}, State: devices.State{"power": 1000.0}})
+	l.updateComputed()
+	assert.Len(t, computed, 1)
+
+	assert.NoError(t, l.SetComputedDevices(ComputedDevices{}))
+	assert.Nil(t, l.devices.Get(devices.ID{Node: "server", ID: "power"}))
+}
+
+func TestSetComputedDevicesInvalidExpression(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	err := l.SetComputedDevices(ComputedDevices{
+		"bad": {State: map[string]string{"value": `devices["node.1"].power +`}},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "computed device bad key value")
+	assert.Len(t, l.Computed.All(), 0)
+}
@@ -0,0 +1,206 @@
+package logic
+
+import (
+	"sort"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/parser"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Issue is a compile error in an expression. Line starts at 1 and Column at 0.
+type Issue struct {
+	Message string `json:"message"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+}
+
+// SubExpression is the value of one part of an evaluated expression.
+type SubExpression struct {
+	Expression string      `json:"expression"`
+	Value      interface{} `json:"value,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// Explanation is the result of a dry-run of a rule.
+type Explanation struct {
+	Valid          bool            `json:"valid"`
+	Issues         []Issue         `json:"issues,omitempty"`
+	Result         interface{}     `json:"result,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	SubExpressions []SubExpression `json:"subExpressions,omitempty"`
+
+	MissingSavedStates  []string `json:"missingSavedStates,omitempty"`
+	MissingDestinations []string `json:"missingDestinations,omitempty"`
+	MissingRules        []string `json:"missingRules,omitempty"`
+	MissingScenes       []string `json:"missingScenes,omitempty"`
+}
+
+// Explain compiles the expression of the rule and evaluates it against the current devices without running any actions.
+// destinationExists is used to check the destinations referenced by the rule.
+func (l *Logic) Explain(r *Rule, destinationExists func(uuid string) bool) *Explanation {
+	e := &Explanation{}
+
+	if err := l.applyBlueprint(r); err != nil {
+		e.Issues = append(e.Issues, Issue{Message: err.Error()})
+		return e
+	}
+
+	exp := r.Expression()
+	ast, iss := celEnv.Parse(exp)
+	if iss.Err() == nil {
+		ast, iss = celEnv.Check(ast)
+	}
+	if iss.Err() != nil {
+		for _, v := range iss.Errors() {
+			e.Issues = append(e.Issues, Issue{
+				Message: v.Message,
+				Line:    v.Location.Line(),
+				Column:  v.Location.Column(),
+			})
+		}
+	} else {
+		e.Valid = true
+		l.explainExpression(e, exp, ast)
+	}
+
+	l.explainReferences(e, r, destinationExists)
+	return e
+}
+
+func (l *Logic) explainExpression(e *Explanation, exp string, ast *cel.Ast) {
+	result, details, err := evalDetails(exp, l.devices, l.rulesActive(), l.evalState(), ast, cel.OptTrackState)
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		if result.Type() != types.BoolType {
+			e.Error = ErrExpressionNotBool.Error()
+		}
+		e.Result = explainValue(result)
+	}
+
+	if details == nil {
+		return
+	}
+
+	state := details.State()
+	walkExpr(ast.Expr(), func(expr *exprpb.Expr) {
+		// Constants are not interesting to show
+		if expr.GetConstExpr() != nil {
+			return
+		}
+		val, ok := state.Value(expr.GetId())
+		if !ok {
+			return
+		}
+		str, err := parser.Unparse(expr, ast.SourceInfo())
+		if err != nil {
+			return
+		}
+		sub := SubExpression{Expression: str}
+		if types.IsError(val) {
+			sub.Error = val.(*types.Err).Error()
+		} else {
+			sub.Value = explainValue(val)
+		}
+		e.SubExpressions = append(e.SubExpressions, sub)
+	})
+}
+
+func (l *Logic) explainReferences(e *Explanation, r *Rule, destinationExists func(uuid string) bool) {
+	missingSavedStates := make(map[string]bool)
+	missingDestinations := make(map[string]bool)
+	missingRules := make(map[string]bool)
+	missingScenes := make(map[string]bool)
+
+	checkDestination := func(uuid string) {
+		if destinationExists == nil || !destinationExists(uuid) {
+			missingDestinations[uuid] = true
+		}
+	}
+
+	r.RLock()
+	for _, a := range append(append([]Action{}, r.Actions_...), r.ReleaseActions_...) {
+		switch a.Type {
+		case ActionSavedState:
+			if l.StateStore.Get(a.UUID) == nil {
+				missingSavedStates[a.UUID] = true
+			}
+		case ActionDestination:
+			checkDestination(a.UUID)
+		case ActionEnableRule, ActionDisableRule:
+			l.RLock()
+			_, ok := l.Rules[a.UUID]
+			l.RUnlock()
+			if !ok {
+				missingRules[a.UUID] = true
+			}
+		case ActionScene, ActionRestoreScene:
+			if l.SceneStore.Get(a.UUID) == nil {
+				missingScenes[a.UUID] = true
+			}
+		}
+	}
+	for _, dest := range r.Destinations_ {
+		checkDestination(dest)
+	}
+	r.RUnlock()
+
+	e.MissingSavedStates = sortedKeys(missingSavedStates)
+	e.MissingDestinations = sortedKeys(missingDestinations)
+	e.MissingRules = sortedKeys(missingRules)
+	e.MissingScenes = sortedKeys(missingScenes)
+}
+
+// walkExpr calls f for expr and all its sub-expressions except the internals of comprehensions.
+func walkExpr(expr *exprpb.Expr, f func(*exprpb.Expr)) {
+	if expr == nil {
+		return
+	}
+	f(expr)
+	switch e := expr.GetExprKind().(type) {
+	case *exprpb.Expr_SelectExpr:
+		walkExpr(e.SelectExpr.GetOperand(), f)
+	case *exprpb.Expr_CallExpr:
+		walkExpr(e.CallExpr.GetTarget(), f)
+		for _, arg := range e.CallExpr.GetArgs() {
+			walkExpr(arg, f)
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, elem := range e.ListExpr.GetElements() {
+			walkExpr(elem, f)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range e.StructExpr.GetEntries() {
+			walkExpr(entry.GetMapKey(), f)
+			walkExpr(entry.GetValue(), f)
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		walkExpr(e.ComprehensionExpr.GetIterRange(), f)
+	}
+}
+
+// explainValue converts a cel value to something that is readable as json.
+func explainValue(val ref.Val) interface{} {
+	switch v := val.(type) {
+	case types.Duration:
+		return v.Duration.String()
+	case types.Timestamp:
+		return v.Time
+	}
+	return val.Value()
+}
+
+func sortedKeys(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
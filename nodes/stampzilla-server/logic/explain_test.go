@@ -0,0 +1,64 @@
+package logic
+
+import (
+	"testing"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplain(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	l.updateDevice(&devices.Device{
+		ID: devices.ID{Node: "node", ID: "1"},
+		State: devices.State{
+			"on":          true,
+			"temperature": 18.5,
+		},
+	})
+
+	r := &Rule{
+		Expression_: `devices["node.1"].on == true && devices["node.1"].temperature > 20.0`,
+		Actions_: []Action{
+			ParseAction("1s"),
+			ParseAction("missing-savedstate"),
+			{Type: ActionDestination, UUID: "dest1"},
+			{Type: ActionEnableRule, UUID: "missing-rule"},
+		},
+		Destinations_: []string{"dest2"},
+	}
+
+	e := l.Explain(r, func(uuid string) bool {
+		return uuid == "dest1"
+	})
+
+	assert.True(t, e.Valid)
+	assert.Empty(t, e.Issues)
+	assert.Equal(t, false, e.Result)
+	assert.Equal(t, []string{"missing-savedstate"}, e.MissingSavedStates)
+	assert.Equal(t, []string{"dest2"}, e.MissingDestinations)
+	assert.Equal(t, []string{"missing-rule"}, e.MissingRules)
+
+	subs := make(map[string]interface{})
+	for _, v := range e.SubExpressions {
+		subs[v.Expression] = v.Value
+	}
+	assert.Equal(t, true, subs[`devices["node.1"].on == true`])
+	assert.Equal(t, 18.5, subs[`devices["node.1"].temperature`])
+	assert.Equal(t, false, subs[`devices["node.1"].temperature > 20.0`])
+}
+
+func TestExplainIssues(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+
+	e := l.Explain(&Rule{Expression_: "devices[\"node.1\"].on == true &&\n  unknown(1)"}, nil)
+	assert.False(t, e.Valid)
+	assert.Len(t, e.Issues, 1)
+	assert.Equal(t, 2, e.Issues[0].Line)
+	assert.Equal(t, 9, e.Issues[0].Column)
+	assert.Contains(t, e.Issues[0].Message, "undeclared reference to 'unknown'")
+
+	e = l.Explain(&Rule{Expression_: `devices["node.1"].on == true`}, nil)
+	assert.True(t, e.Valid)
+	assert.Contains(t, e.Error, "no such key")
+}
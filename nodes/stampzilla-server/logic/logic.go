@@ -2,7 +2,6 @@ package logic
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"sync"
@@ -10,7 +9,9 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/audit"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
 )
 
@@ -19,6 +20,7 @@ import (
     "e8092b86-1261-44cd-ab64-38121df58a79": {
         "name": "All off",
         "enabled": true,
+        "priority": 10,
         "active": false,
         "uuid": "e8092b86-1261-44cd-ab64-38121df58a79",
         "expression": "devices['fd230f30-6d84-4507-8ace-c1ec715be51e.1'].on == true",
@@ -38,6 +40,10 @@ import (
         "actions": [
             "1m",
             "c7d352bb-23f4-468c-b476-f76599c09a0d"
+        ],
+        "releaseFor": "1m",
+        "releaseActions": [
+            {"type": "set", "device": "asdf.123", "key": "on", "value": false}
         ],
 		"labels": [
 			"livingroom",
@@ -53,10 +59,28 @@ type Rules map[string]*Rule
 // Logic is the main struct.
 type Logic struct {
 	StateStore           *SavedStateStore
+	SceneStore           *SceneStore
+	BlueprintStore       *BlueprintStore
+	Computed             *ComputedStore
+	RuleHistory          *RuleHistory
+	Overrides            *OverrideStore
 	Rules                map[string]*Rule
 	devices              *devices.List
+	tracker              *stateTracker
+	stats                *deviceStats
+	owners               *keyOwners
+	calendar             *Calendar
 	onReportState        func(string, devices.State)
 	onTriggerDestination func(string, string) error
+	onReleaseDestination func(string, string) error
+	onRulesChanged       func()
+	onRuleEvent          func(string, RuleEvent)
+	onOverridesChanged   func()
+	onScenesCaptured     func()
+	onComputedDevice     func(*devices.Device)
+	onKeyOwnersChanged   func()
+	onStateChange        func(audit.Origin, string, map[devices.ID]devices.State)
+	nodeUUID             string
 	// ActionProgressChan chan ActionProgress
 	sync.RWMutex
 	sync.WaitGroup
@@ -76,11 +100,27 @@ type ActionProgress struct {
 func New(sss *SavedStateStore, websocketSender websocket.Sender) *Logic {
 	l := &Logic{
 		devices: devices.NewList(),
+		tracker: newStateTracker(),
+		stats:   newDeviceStats(),
+		owners:  newKeyOwners(),
 		// ActionProgressChan: make(chan ActionProgress, 100),
 		Rules:                make(map[string]*Rule),
 		StateStore:           sss,
+		SceneStore:           NewSceneStore(),
+		BlueprintStore:       NewBlueprintStore(),
+		Computed:             NewComputedStore(),
+		RuleHistory:          NewRuleHistory(DefaultRuleHistoryLength),
+		Overrides:            NewOverrideStore(),
 		onReportState:        func(string, devices.State) {},
 		onTriggerDestination: func(string, string) error { return nil },
+		onReleaseDestination: func(string, string) error { return nil },
+		onRulesChanged:       func() {},
+		onRuleEvent:          func(string, RuleEvent) {},
+		onOverridesChanged:   func() {},
+		onScenesCaptured:     func() {},
+		onComputedDevice:     func(*devices.Device) {},
+		onKeyOwnersChanged:   func() {},
+		onStateChange:        func(audit.Origin, string, map[devices.ID]devices.State) {},
 		c:                    make(chan func()),
 		WebsocketSender:      websocketSender,
 	}
@@ -108,8 +148,27 @@ func (l *Logic) SetRules(rules Rules) {
 	l.Lock()
 	l.Rules = rules
 	l.Unlock()
+	l.ApplyBlueprints()
+
+	for uuid := range l.RuleHistory.All() {
+		if _, ok := rules[uuid]; !ok {
+			l.RuleHistory.Remove(uuid)
+		}
+	}
+	for _, keys := range l.KeyOwners() {
+		for _, uuid := range keys {
+			if _, ok := rules[uuid]; !ok {
+				l.releaseKeys(uuid)
+			}
+		}
+	}
 
 	// Trigger an evaluation of the new rules
+	l.Evaluate()
+}
+
+// Evaluate triggers an evaluation of all rules in the worker.
+func (l *Logic) Evaluate() {
 	l.c <- func() {}
 }
 
@@ -121,6 +180,92 @@ func (l *Logic) OnTriggerDestination(callback func(string, string) error) {
 	l.onTriggerDestination = callback
 }
 
+func (l *Logic) OnReleaseDestination(callback func(string, string) error) {
+	l.onReleaseDestination = callback
+}
+
+// OnRulesChanged is called when an action has changed a rule and the rules needs to be saved.
+func (l *Logic) OnRulesChanged(callback func()) {
+	l.onRulesChanged = callback
+}
+
+// OnScenesCaptured is called when a scene captures the state of its devices or is restored and the captures needs to be saved.
+func (l *Logic) OnScenesCaptured(callback func()) {
+	l.onScenesCaptured = callback
+}
+
+// OnStateChange is called with the origin and source of every state-change sent by the logic.
+func (l *Logic) OnStateChange(callback func(audit.Origin, string, map[devices.ID]devices.State)) {
+	l.onStateChange = callback
+}
+
+func (l *Logic) sendStateChange(origin audit.Origin, source string, states map[devices.ID]devices.State) map[string]error {
+	if l.onStateChange != nil {
+		l.onStateChange(origin, source, states)
+	}
+	return sendStateChange(l.WebsocketSender, states)
+}
+
+// SetCalendar sets the location and holidays used by the sun and calendar functions.
+func (l *Logic) SetCalendar(c *Calendar) {
+	l.Lock()
+	l.calendar = c
+	l.Unlock()
+}
+
+// Calendar returns the calendar or nil if none is set.
+func (l *Logic) Calendar() *Calendar {
+	l.RLock()
+	defer l.RUnlock()
+	return l.calendar
+}
+
+// OnRuleEvent is called when an event is added to the history of a rule.
+func (l *Logic) OnRuleEvent(callback func(string, RuleEvent)) {
+	l.onRuleEvent = callback
+}
+
+func (l *Logic) addRuleEvent(uuid string, e RuleEvent) {
+	e.Time = time.Now()
+	l.RuleHistory.Add(uuid, e)
+	l.onRuleEvent(uuid, e)
+}
+
+// recordStateChange adds the result of sendStateChange to the history of the rule.
+func (l *Logic) recordStateChange(r *Rule, result map[string]error) {
+	if r == nil {
+		return
+	}
+	for node, err := range result {
+		e := RuleEvent{Type: RuleEventStateChange, Node: node}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		l.addRuleEvent(r.Uuid(), e)
+	}
+}
+
+// SetRuleEnabled enables or disables a rule.
+func (l *Logic) SetRuleEnabled(uuid string, enabled bool) error {
+	l.RLock()
+	rule, ok := l.Rules[uuid]
+	l.RUnlock()
+	if !ok {
+		return fmt.Errorf("rule %s does not exist", uuid)
+	}
+
+	rule.Lock()
+	changed := rule.Enabled != enabled
+	rule.Enabled = enabled
+	rule.Unlock()
+
+	if changed {
+		logrus.Infof("logic: rule %s enabled: %t", uuid, enabled)
+		l.onRulesChanged()
+	}
+	return nil
+}
+
 // Start starts the logic worker.
 func (l *Logic) Start(ctx context.Context) {
 	l.Add(1)
@@ -130,11 +275,21 @@ func (l *Logic) Start(ctx context.Context) {
 
 func (l *Logic) worker(ctx context.Context) {
 	defer l.Done()
+	ticker := time.NewTicker(overrideCheckInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case f := <-l.c:
 			f()
+			l.updateComputed()
 			l.EvaluateRules(ctx)
+			l.tracker.clearChanged()
+		case now := <-ticker.C:
+			// Rules that use time functions like since or time_above can change without any device update
+			expired := l.expireOverrides(now)
+			if expired || l.usesTime() {
+				l.EvaluateRules(ctx)
+			}
 		case <-ctx.Done():
 			logrus.Info("logic: stopping worker")
 			return
@@ -142,6 +297,21 @@ func (l *Logic) worker(ctx context.Context) {
 	}
 }
 
+// usesTime returns true if an enabled rule calls a time function.
+func (l *Logic) usesTime() bool {
+	l.RLock()
+	expressions := make([]string, 0, len(l.Rules))
+	for _, r := range l.Rules {
+		r.RLock()
+		if r.Enabled {
+			expressions = append(expressions, r.Expression_)
+		}
+		r.RUnlock()
+	}
+	l.RUnlock()
+	return l.tracker.anyTimed(expressions)
+}
+
 // UpdateDevice update the state in the logic store with the new state from the device.
 func (l *Logic) UpdateDevice(dev *devices.Device) {
 	l.c <- func() {
@@ -150,21 +320,32 @@ func (l *Logic) UpdateDevice(dev *devices.Device) {
 }
 
 func (l *Logic) updateDevice(dev *devices.Device) {
+	dev.RLock()
+	l.stats.record(dev.ID, dev.State, time.Now(), l.statsKeys())
+	dev.RUnlock()
+
 	if oldDev := l.devices.Get(dev.ID); oldDev != nil {
+		oldDev.RLock()
+		l.tracker.update(dev.ID, oldDev.State.Clone(), dev.State, time.Now())
+		oldDev.RUnlock()
 		if diff := oldDev.State.Diff(dev.State); len(diff) > 0 {
 			oldDev.Lock()
 			oldDev.State.MergeWith(diff)
 			oldDev.Unlock()
 		}
+		l.enforceOverride(dev.ID)
 		return
 	}
+	l.tracker.update(dev.ID, nil, dev.State, time.Now())
 	l.devices.Add(dev)
+	l.enforceOverride(dev.ID)
 }
 
 // EvaluateRules loops over each rule and run evaluation on them.
+// Rules are evaluated after the rules they refer to so they see the new active state in the same evaluation.
 func (l *Logic) EvaluateRules(ctx context.Context) {
-	for _, rule := range l.Rules {
-		if !rule.Enabled {
+	for _, rule := range l.evaluationOrder() {
+		if l.Overrides.RuleSuspended(rule, time.Now()) {
 			continue
 		}
 		evaluation := l.evaluateRule(rule)
@@ -193,6 +374,7 @@ func (l *Logic) runFor(ctx context.Context, rule *Rule, evaluation bool) {
 
 	if evaluation {
 		rule.Stop()
+		rule.CancelRelease()
 		l.Add(1)
 		go func() {
 			defer l.Done()
@@ -200,6 +382,7 @@ func (l *Logic) runFor(ctx context.Context, rule *Rule, evaluation bool) {
 			l.onReportState(rule.Uuid(), map[string]interface{}{
 				"pending": true,
 			})
+			l.addRuleEvent(rule.Uuid(), RuleEvent{Type: RuleEventPending})
 			logrus.Debug("Rule: ", rule.Name(), " (", rule.Uuid(), ") - sleeping for: ", rule.For())
 
 			delay := time.NewTimer(time.Duration(rule.For()))
@@ -227,17 +410,26 @@ func (l *Logic) runFor(ctx context.Context, rule *Rule, evaluation bool) {
 				"active":  true,
 			})
 			rule.SetActive(true)
+			l.addRuleEvent(rule.Uuid(), RuleEvent{Type: RuleEventActive})
 			logrus.Info("Rule: ", rule.Name(), " (", rule.Uuid(), ") - running actions after for: ", rule.For())
-			rule.Run(l.StateStore, l.WebsocketSender, l.onTriggerDestination)
+			rule.Run(l)
 		}()
 		return
 	}
 
+	wasActive := rule.Active()
 	l.onReportState(rule.Uuid(), map[string]interface{}{
 		"pending": false,
 		"active":  false,
 	})
 	rule.SetActive(false)
+	// A pending rule that never became active has nothing to release
+	if wasActive {
+		l.addRuleEvent(rule.Uuid(), RuleEvent{Type: RuleEventInactive})
+		rule.Cancel()
+		l.releaseKeys(rule.Uuid())
+		l.runRelease(rule)
+	}
 }
 
 func (l *Logic) runNow(rule *Rule, evaluation bool) {
@@ -248,24 +440,81 @@ func (l *Logic) runNow(rule *Rule, evaluation bool) {
 		})
 		rule.SetActive(evaluation)
 		if evaluation {
+			l.addRuleEvent(rule.Uuid(), RuleEvent{Type: RuleEventActive})
+			rule.CancelRelease()
 			l.Add(1)
 			go func() {
 				logrus.Info("Rule: ", rule.Name(), " (", rule.Uuid(), ") - running actions")
-				rule.Run(l.StateStore, l.WebsocketSender, l.onTriggerDestination)
+				rule.Run(l)
 				l.Done()
 			}()
 		} else {
+			l.addRuleEvent(rule.Uuid(), RuleEvent{Type: RuleEventInactive})
 			rule.Cancel()
+			l.releaseKeys(rule.Uuid())
+			l.runRelease(rule)
 		}
 	}
 }
 
-func (l *Logic) evaluateRule(r *Rule) bool {
+// runRelease runs the release actions of a rule that became inactive.
+func (l *Logic) runRelease(rule *Rule) {
+	if !rule.HasRelease() {
+		return
+	}
+	// The context is created before the go routine so a CancelRelease right after this is not lost
+	ctx, cancel := rule.newRelease()
+	l.Add(1)
+	go func() {
+		defer l.Done()
+		defer cancel()
+		logrus.Info("Rule: ", rule.Name(), " (", rule.Uuid(), ") - running release actions")
+		rule.RunRelease(ctx, l)
+	}()
+}
+
+// rulesActive returns the active state of all rules.
+func (l *Logic) rulesActive() map[string]bool {
+	l.RLock()
+	defer l.RUnlock()
 	rules := make(map[string]bool)
 	for _, v := range l.Rules {
 		rules[v.Uuid()] = v.Active()
 	}
-	result, err := r.Eval(l.devices, rules)
+	return rules
+}
+
+// deviceValue returns the current value of a state key or nil if the device or key is not known.
+func (l *Logic) deviceValue(id devices.ID, key string) interface{} {
+	dev := l.devices.Get(id)
+	if dev == nil {
+		return nil
+	}
+	dev.RLock()
+	defer dev.RUnlock()
+	return dev.State[key]
+}
+
+func (l *Logic) evalState() evalState {
+	return evalState{
+		tracker:  l.tracker,
+		calendar: l.Calendar(),
+		stats:    l.stats,
+	}
+}
+
+func (l *Logic) evaluateRule(r *Rule) bool {
+	r.RLock()
+	blueprintErr := r.blueprintErr
+	r.RUnlock()
+	if blueprintErr != nil {
+		l.onReportState(r.Uuid(), map[string]interface{}{
+			"error": blueprintErr.Error(),
+		})
+		return false
+	}
+
+	result, err := eval(r.Expression(), l.devices, l.rulesActive(), l.evalState(), r.ast)
 	if err != nil {
 		l.onReportState(r.Uuid(), map[string]interface{}{
 			"error": err.Error(),
@@ -281,17 +530,22 @@ func (l *Logic) evaluateRule(r *Rule) bool {
 
 // Save saves the rules to rules.json.
 func (l *Logic) Save() error {
-	configFile, err := os.Create("rules.json")
-	if err != nil {
+	b := persist.Batch{}
+	if err := l.AddTo(b); err != nil {
+		return err
+	}
+	if err := b.Save(); err != nil {
 		return fmt.Errorf("logic: error saving rules: %s", err.Error())
 	}
-	encoder := json.NewEncoder(configFile)
-	encoder.SetIndent("", "\t")
+	return nil
+}
+
+// AddTo adds rules.json to the batch so it can be saved together with other documents.
+func (l *Logic) AddTo(b persist.Batch) error {
 	l.Lock()
 	defer l.Unlock()
-	err = encoder.Encode(l.Rules)
-	if err != nil {
-		return fmt.Errorf("logic: error saving rules: %s", err.Error())
+	if err := b.Add("rules.json", l.Rules); err != nil {
+		return fmt.Errorf("logic: error encoding rules: %s", err.Error())
 	}
 	return nil
 }
@@ -299,8 +553,9 @@ func (l *Logic) Save() error {
 // Load loads the rules from rules.json.
 func (l *Logic) Load() error {
 	logrus.Debug("logic: loading rules from rules.json")
-	configFile, err := os.Open("rules.json")
-	if err != nil {
+	l.Lock()
+	defer l.Unlock()
+	if err := persist.Load("rules.json", &l.Rules); err != nil {
 		if os.IsNotExist(err) {
 			logrus.Warn(err)
 			return nil // We dont want to error our if the file does not exist when we start the server
@@ -308,13 +563,6 @@ func (l *Logic) Load() error {
 		return fmt.Errorf("logic: error loading rules.json: %s", err.Error())
 	}
 
-	l.Lock()
-	defer l.Unlock()
-	jsonParser := json.NewDecoder(configFile)
-	if err = jsonParser.Decode(&l.Rules); err != nil {
-		return fmt.Errorf("logic: error loading rules.json: %s", err.Error())
-	}
-
 	// TODO loop over rules and generate UUIDs if needed. If it was needed save the rules again
 
 	return nil
@@ -120,6 +120,27 @@ func TestEvaluateRules(t *testing.T) {
 	assert.Equal(t, false, l.Rules[r.Uuid()].Active())
 }
 
+func TestEvaluateRulesWithTimeFunctionOnTick(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+
+	r := l.AddRule("test")
+	r.Expression_ = `devices["node.id"].on == true && since("node.id", "on") > duration("100ms")`
+	r.Enabled = true
+	assert.True(t, l.usesTime())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l.Start(ctx)
+	l.UpdateDevice(&devices.Device{
+		ID:    devices.ID{Node: "node", ID: "id"},
+		State: devices.State{"on": true},
+	})
+
+	// The device does not report again so only the tick can make the rule active
+	assert.Eventually(t, r.Active, 3*time.Second, 50*time.Millisecond)
+	cancel()
+	l.Wait()
+}
+
 func TestEvaluateBrokenRules(t *testing.T) {
 	syncer := NewMockSender()
 	savedState := NewSavedStateStore()
@@ -170,10 +191,10 @@ func TestEvaluateRulesCanceledIfNotActive(t *testing.T) {
 	r := l.AddRule("test")
 	r.Expression_ = `devices["node.id"].on == true`
 	r.Enabled = true
-	r.Actions_ = []string{
-		"uuid",
-		"50ms",
-		"uuid",
+	r.Actions_ = []Action{
+		ParseAction("uuid"),
+		ParseAction("50ms"),
+		ParseAction("uuid"),
 	}
 
 	l.updateDevice(&devices.Device{
@@ -208,6 +229,83 @@ func TestEvaluateRulesCanceledIfNotActive(t *testing.T) {
 	assert.Equal(t, int64(1), syncer.Count())
 }
 
+func TestEvaluateRulesRelease(t *testing.T) {
+	syncer := NewMockSender()
+	l := New(NewSavedStateStore(), syncer)
+	released := make(chan string, 1)
+	l.OnReleaseDestination(func(dest, body string) error {
+		released <- dest
+		return nil
+	})
+
+	r := l.AddRule("test")
+	r.Expression_ = `devices["node.id"].on == true`
+	r.Enabled = true
+	r.ReleaseFor_ = stypes.Duration(20 * time.Millisecond)
+	r.ReleaseActions_ = []Action{
+		{Type: ActionSet, Device: "node.light", Key: "on", Value: false},
+	}
+	r.Destinations_ = []string{"alarm"}
+
+	update := func(on bool) {
+		l.updateDevice(&devices.Device{
+			ID:    devices.ID{Node: "node", ID: "id"},
+			State: devices.State{"on": on},
+		})
+		l.EvaluateRules(context.Background())
+	}
+
+	update(true)
+	update(false)
+	assert.Equal(t, false, r.Active())
+
+	// Nothing is released during the hold time
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, syncer.Devices.Get(devices.ID{Node: "node", ID: "light"}))
+
+	l.Wait()
+	assert.Equal(t, false, syncer.Devices.Get(devices.ID{Node: "node", ID: "light"}).State["on"])
+	assert.Equal(t, "alarm", <-released)
+}
+
+func TestEvaluateRulesReleaseCanceledIfActiveAgain(t *testing.T) {
+	syncer := NewMockSender()
+	l := New(NewSavedStateStore(), syncer)
+
+	r := l.AddRule("test")
+	r.Expression_ = `devices["node.id"].on == true`
+	r.Enabled = true
+	r.ReleaseFor_ = stypes.Duration(50 * time.Millisecond)
+	r.ReleaseActions_ = []Action{
+		{Type: ActionSet, Device: "node.light", Key: "on", Value: false},
+	}
+
+	update := func(on bool) {
+		l.updateDevice(&devices.Device{
+			ID:    devices.ID{Node: "node", ID: "id"},
+			State: devices.State{"on": on},
+		})
+		l.EvaluateRules(context.Background())
+	}
+
+	update(true)
+	update(false)
+	time.Sleep(10 * time.Millisecond)
+	update(true)
+	l.Wait()
+
+	assert.Equal(t, true, r.Active())
+	assert.Equal(t, int64(0), syncer.Count())
+
+	// Active again before the release go routine has started
+	update(false)
+	update(true)
+	l.Wait()
+
+	assert.Equal(t, true, r.Active())
+	assert.Equal(t, int64(0), syncer.Count())
+}
+
 func TestEvaluateRulesWithFor(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 	syncer := NewMockSender()
@@ -230,8 +328,8 @@ func TestEvaluateRulesWithFor(t *testing.T) {
 	r.Expression_ = `devices["node.id"].on == true`
 	r.Enabled = true
 	r.For_ = stypes.Duration(time.Millisecond * 20)
-	r.Actions_ = []string{
-		"uuid",
+	r.Actions_ = []Action{
+		ParseAction("uuid"),
 	}
 
 	l.updateDevice(&devices.Device{
@@ -282,8 +380,8 @@ func TestEvaluateRulesWithForTimeout(t *testing.T) {
 	r.Expression_ = `devices["node.id"].on == true`
 	r.Enabled = true
 	r.For_ = stypes.Duration(time.Millisecond * 40)
-	r.Actions_ = []string{
-		"uuid",
+	r.Actions_ = []Action{
+		ParseAction("uuid"),
 	}
 
 	l.updateDevice(&devices.Device{
@@ -309,6 +407,11 @@ func TestEvaluateRulesWithForTimeout(t *testing.T) {
 
 	l.Wait()
 	assert.Equal(t, int64(0), syncer.Count())
+
+	// The rule never became active so it did not become inactive either
+	for _, e := range l.RuleHistory.Get(r.Uuid()) {
+		assert.NotEqual(t, RuleEventInactive, e.Type)
+	}
 }
 
 // TestEvaluateRulesWithForFlapping asserts that we do not run the rule if it goes inactive before the "for" timeout even it it goes true again multiple times during the for.
@@ -333,8 +436,8 @@ func TestEvaluateRulesWithForFlapping(t *testing.T) {
 	r.Expression_ = `devices["node.id"].on == true`
 	r.Enabled = true
 	r.For_ = stypes.Duration(time.Millisecond * 50)
-	r.Actions_ = []string{
-		"uuid",
+	r.Actions_ = []Action{
+		ParseAction("uuid"),
 	}
 
 	l.updateDevice(&devices.Device{
@@ -397,8 +500,8 @@ func TestEvaluateRulesWithForFlapping2(t *testing.T) {
 	r.Expression_ = `devices["node.id"].on == false`
 	r.Enabled = true
 	r.For_ = stypes.Duration(time.Millisecond * 100)
-	r.Actions_ = []string{
-		"uuid",
+	r.Actions_ = []Action{
+		ParseAction("uuid"),
 	}
 
 	l.updateDevice(&devices.Device{
@@ -454,8 +557,8 @@ func TestEvaluateRulesWithForTwoUpdatesSameStateStillPending(t *testing.T) {
 	r.Expression_ = `devices["node.id"].on == true`
 	r.Enabled = true
 	r.For_ = stypes.Duration(time.Millisecond * 60)
-	r.Actions_ = []string{
-		"uuid",
+	r.Actions_ = []Action{
+		ParseAction("uuid"),
 	}
 
 	l.updateDevice(&devices.Device{
@@ -0,0 +1,332 @@
+package logic
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/audit"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+)
+
+/* overrides.json example
+{
+    "2f7c2a3e-5d55-4a36-8f1e-3d3f1f0f7b7e": {
+        "uuid": "2f7c2a3e-5d55-4a36-8f1e-3d3f1f0f7b7e",
+        "type": "label",
+        "target": "room=guestroom",
+        "until": "2023-10-20T12:00:00Z",
+        "reason": "guests"
+    },
+    "8a1f0c0e-9c39-4a0b-9d8c-0f3c0c5b8f11": {
+        "uuid": "8a1f0c0e-9c39-4a0b-9d8c-0f3c0c5b8f11",
+        "type": "device",
+        "target": "nodeuuid.deviceid",
+        "state": {"on": false},
+        "until": "2023-10-18T18:00:00Z"
+    }
+}
+*/
+
+// OverrideType is what an override suspends or forces.
+type OverrideType string
+
+const (
+	// OverrideRule suspends the rule with uuid Target.
+	OverrideRule OverrideType = "rule"
+	// OverrideLabel suspends all rules with the label Target. Target is key=value or only key to match any value.
+	OverrideLabel OverrideType = "label"
+	// OverrideTask suspends the scheduled task with uuid Target.
+	OverrideTask OverrideType = "task"
+	// OverrideDevice forces the device with id Target to stay in State.
+	OverrideDevice OverrideType = "device"
+)
+
+// overrideCheckInterval is how often expired overrides are removed.
+const overrideCheckInterval = time.Second
+
+// Override temporarily suspends rules or tasks or forces the state of a device until a given time.
+type Override struct {
+	UUID   string        `json:"uuid"`
+	Type   OverrideType  `json:"type"`
+	Target string        `json:"target"`
+	State  devices.State `json:"state,omitempty"`
+	Until  time.Time     `json:"until"`
+	// For can be used instead of Until when the override is added.
+	For    stypes.Duration `json:"for,omitempty"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+type Overrides map[string]*Override
+
+type OverrideStore struct {
+	Overrides Overrides
+	sync.RWMutex
+}
+
+func NewOverrideStore() *OverrideStore {
+	return &OverrideStore{
+		Overrides: make(Overrides),
+	}
+}
+
+func (ovs *OverrideStore) All() Overrides {
+	ovs.RLock()
+	defer ovs.RUnlock()
+	all := make(Overrides, len(ovs.Overrides))
+	for k, v := range ovs.Overrides {
+		all[k] = v
+	}
+	return all
+}
+
+// active returns all overrides of type t that has not expired.
+func (ovs *OverrideStore) active(t OverrideType, now time.Time) []*Override {
+	ovs.RLock()
+	defer ovs.RUnlock()
+	list := make([]*Override, 0)
+	for _, o := range ovs.Overrides {
+		if o.Type == t && now.Before(o.Until) {
+			list = append(list, o)
+		}
+	}
+	return list
+}
+
+// RuleSuspended returns true if the rule or one of its labels is suspended.
+func (ovs *OverrideStore) RuleSuspended(r *Rule, now time.Time) bool {
+	for _, o := range ovs.active(OverrideRule, now) {
+		if o.Target == r.Uuid() {
+			return true
+		}
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+	for _, o := range ovs.active(OverrideLabel, now) {
+		key, value, hasValue := strings.Cut(o.Target, "=")
+		v, ok := r.Labels_[key]
+		if ok && (!hasValue || v == value) {
+			return true
+		}
+	}
+	return false
+}
+
+// TaskSuspended returns true if the task is suspended.
+func (ovs *OverrideStore) TaskSuspended(uuid string, now time.Time) bool {
+	for _, o := range ovs.active(OverrideTask, now) {
+		if o.Target == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// ForcedState returns the state the device is forced to or nil if it is not forced.
+func (ovs *OverrideStore) ForcedState(id devices.ID, now time.Time) devices.State {
+	var state devices.State
+	for _, o := range ovs.active(OverrideDevice, now) {
+		if o.Target != id.String() {
+			continue
+		}
+		if state == nil {
+			state = make(devices.State)
+		}
+		state.MergeWith(o.State)
+	}
+	return state
+}
+
+// WithoutForced returns the states without the keys that are forced by a device override.
+// Devices without any keys left are removed.
+func (ovs *OverrideStore) WithoutForced(states map[devices.ID]devices.State, now time.Time) map[devices.ID]devices.State {
+	allowed := make(map[devices.ID]devices.State)
+	for id, state := range states {
+		forced := ovs.ForcedState(id, now)
+		s := make(devices.State)
+		for k, v := range state {
+			if _, ok := forced[k]; ok {
+				logrus.Debugf("logic: skipping %s.%s since it is overridden", id, k)
+				continue
+			}
+			s[k] = v
+		}
+		if len(s) > 0 {
+			allowed[id] = s
+		}
+	}
+	return allowed
+}
+
+func (ovs *OverrideStore) add(o *Override) {
+	ovs.Lock()
+	ovs.Overrides[o.UUID] = o
+	ovs.Unlock()
+}
+
+func (ovs *OverrideStore) remove(uuid string) bool {
+	ovs.Lock()
+	defer ovs.Unlock()
+	_, ok := ovs.Overrides[uuid]
+	delete(ovs.Overrides, uuid)
+	return ok
+}
+
+// expire removes all overrides that expired before now.
+func (ovs *OverrideStore) expire(now time.Time) []*Override {
+	ovs.Lock()
+	defer ovs.Unlock()
+	expired := make([]*Override, 0)
+	for id, o := range ovs.Overrides {
+		if !now.Before(o.Until) {
+			expired = append(expired, o)
+			delete(ovs.Overrides, id)
+		}
+	}
+	return expired
+}
+
+func (ovs *OverrideStore) Save() error {
+	ovs.RLock()
+	defer ovs.RUnlock()
+	if err := persist.Save("overrides.json", ovs.Overrides); err != nil {
+		return fmt.Errorf("overrides: error saving overrides.json: %s", err.Error())
+	}
+	return nil
+}
+
+func (ovs *OverrideStore) Load() error {
+	ovs.Lock()
+	defer ovs.Unlock()
+	if err := persist.Load("overrides.json", &ovs.Overrides); err != nil {
+		if os.IsNotExist(err) {
+			return nil // We dont want to error our if the file does not exist when we start the server
+		}
+		return fmt.Errorf("overrides: error loading overrides.json: %s", err.Error())
+	}
+	return nil
+}
+
+// OnOverridesChanged is called when an override is added, removed or expired.
+func (l *Logic) OnOverridesChanged(callback func()) {
+	l.onOverridesChanged = callback
+}
+
+// AddOverride validates and adds an override. A device override sends the forced state to the device directly.
+func (l *Logic) AddOverride(o *Override) error {
+	now := time.Now()
+	if o.Until.IsZero() && o.For > 0 {
+		o.Until = now.Add(time.Duration(o.For))
+	}
+	o.For = 0
+	if !o.Until.After(now) {
+		return fmt.Errorf("override must end in the future")
+	}
+	if o.Target == "" {
+		return fmt.Errorf("override target is missing")
+	}
+
+	switch o.Type {
+	case OverrideRule, OverrideLabel, OverrideTask:
+	case OverrideDevice:
+		if _, err := devices.NewIDFromString(o.Target); err != nil {
+			return err
+		}
+		if len(o.State) == 0 {
+			return fmt.Errorf("override state is missing")
+		}
+	default:
+		return fmt.Errorf("unknown override type: %s", o.Type)
+	}
+
+	if o.UUID == "" {
+		o.UUID = uuid.New().String()
+	}
+	l.Overrides.add(o)
+	logrus.Infof("logic: added override %s on %s %s until %s", o.UUID, o.Type, o.Target, o.Until)
+	l.onOverridesChanged()
+
+	if o.Type == OverrideDevice {
+		id, _ := devices.NewIDFromString(o.Target)
+		l.sendStateChange(audit.OriginOverride, o.UUID, map[devices.ID]devices.State{id: o.State})
+	}
+	return nil
+}
+
+// RemoveOverride removes an override before it expires.
+func (l *Logic) RemoveOverride(uuid string) error {
+	if !l.Overrides.remove(uuid) {
+		return fmt.Errorf("override %s does not exist", uuid)
+	}
+	logrus.Infof("logic: removed override %s", uuid)
+	l.onOverridesChanged()
+	return nil
+}
+
+// expireOverrides removes expired overrides and returns true if any was removed.
+func (l *Logic) expireOverrides(now time.Time) bool {
+	expired := l.Overrides.expire(now)
+	for _, o := range expired {
+		logrus.Infof("logic: override %s on %s %s expired", o.UUID, o.Type, o.Target)
+	}
+	if len(expired) > 0 {
+		l.onOverridesChanged()
+	}
+	return len(expired) > 0
+}
+
+// enforceOverride sends the forced state to the device if the device has changed it.
+func (l *Logic) enforceOverride(id devices.ID) {
+	forced := l.Overrides.ForcedState(id, time.Now())
+	if forced == nil {
+		return
+	}
+	dev := l.devices.Get(id)
+	if dev == nil {
+		return
+	}
+	dev.RLock()
+	diff := dev.State.Diff(forced)
+	dev.RUnlock()
+	if len(diff) == 0 {
+		return
+	}
+	logrus.Debugf("logic: device %s is overridden. Sending back %v", id, diff)
+	// Not sent from the worker since a virtual device reports its new state back to the worker directly
+	l.Add(1)
+	go func() {
+		defer l.Done()
+		l.sendStateChange(audit.OriginOverride, "", map[devices.ID]devices.State{id: diff})
+	}()
+}
+
+// changeState sends a state-change to the devices but leaves out keys that are forced by an override
+// or owned by another active rule with higher priority than r. r is nil for changes not made by a rule.
+func (l *Logic) changeState(r *Rule, states map[devices.ID]devices.State) map[string]error {
+	if r != nil {
+		return l.changeStateFrom(audit.OriginRule, r.Uuid(), r, states)
+	}
+	return l.changeStateFrom(audit.OriginUser, "", nil, states)
+}
+
+// changeStateFrom is changeState with the origin and source reported to OnStateChange.
+func (l *Logic) changeStateFrom(origin audit.Origin, source string, r *Rule, states map[devices.ID]devices.State) map[string]error {
+	allowed := make(map[devices.ID]devices.State)
+	for id, s := range l.Overrides.WithoutForced(states, time.Now()) {
+		s = l.claimKeys(r, id, s)
+		if len(s) > 0 {
+			allowed[id] = s
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	return l.sendStateChange(origin, source, allowed)
+}
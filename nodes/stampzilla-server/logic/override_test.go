@@ -0,0 +1,124 @@
+package logic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/audit"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverrideSuspendsRulesByLabel(t *testing.T) {
+	syncer := NewMockSender()
+	l := New(NewSavedStateStore(), syncer)
+	changed := 0
+	l.OnOverridesChanged(func() {
+		changed++
+	})
+
+	r := l.AddRule("test")
+	r.Expression_ = `devices["node.id"].on == true`
+	r.Enabled = true
+	r.Labels_ = models.Labels{"room": "guestroom"}
+	r.Actions_ = []Action{
+		{Type: ActionSet, Device: "node.light", Key: "on", Value: true},
+	}
+
+	err := l.AddOverride(&Override{Type: OverrideLabel, Target: "room=guestroom", For: stypes.Duration(time.Hour)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, changed)
+
+	l.updateDevice(&devices.Device{
+		ID:    devices.ID{Node: "node", ID: "id"},
+		State: devices.State{"on": true},
+	})
+	l.EvaluateRules(context.Background())
+	l.Wait()
+	assert.Equal(t, false, r.Active())
+	assert.Equal(t, int64(0), syncer.Count())
+
+	// The rule runs again when the override has expired
+	assert.True(t, l.expireOverrides(time.Now().Add(2*time.Hour)))
+	assert.Equal(t, 2, changed)
+	assert.Len(t, l.Overrides.All(), 0)
+	l.EvaluateRules(context.Background())
+	l.Wait()
+	assert.Equal(t, true, r.Active())
+	assert.Equal(t, int64(1), syncer.Count())
+}
+
+func TestOverrideRuleAndTask(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	r := l.AddRule("test")
+	r.Labels_ = models.Labels{"room": "kitchen"}
+
+	until := time.Now().Add(time.Hour)
+	assert.NoError(t, l.AddOverride(&Override{Type: OverrideRule, Target: r.Uuid(), Until: until}))
+	assert.NoError(t, l.AddOverride(&Override{Type: OverrideTask, Target: "task", Until: until}))
+
+	assert.True(t, l.Overrides.RuleSuspended(r, time.Now()))
+	assert.True(t, l.Overrides.TaskSuspended("task", time.Now()))
+	assert.False(t, l.Overrides.TaskSuspended("other", time.Now()))
+	assert.False(t, l.Overrides.RuleSuspended(r, until))
+
+	// Only the key of the label is needed to match any value
+	assert.NoError(t, l.AddOverride(&Override{Type: OverrideLabel, Target: "room", Until: until.Add(time.Hour)}))
+	assert.True(t, l.Overrides.RuleSuspended(r, until))
+}
+
+func TestOverrideForcesDeviceState(t *testing.T) {
+	syncer := NewMockSender()
+	l := New(NewSavedStateStore(), syncer)
+	id := devices.ID{Node: "node", ID: "light"}
+	l.updateDevice(&devices.Device{
+		ID:    id,
+		State: devices.State{"on": true, "brightness": 1.0},
+	})
+
+	origins := []audit.Origin{}
+	l.OnStateChange(func(origin audit.Origin, source string, states map[devices.ID]devices.State) {
+		origins = append(origins, origin)
+	})
+
+	o := &Override{Type: OverrideDevice, Target: "node.light", State: devices.State{"on": false}, For: stypes.Duration(time.Hour)}
+	assert.NoError(t, l.AddOverride(o))
+	assert.NotEmpty(t, o.UUID)
+	assert.Equal(t, int64(1), syncer.Count())
+	assert.Equal(t, false, syncer.Devices.Get(id).State["on"])
+	assert.Equal(t, []audit.Origin{audit.OriginOverride}, origins)
+
+	// The forced key is left out of state changes from rules and scenes
+	l.changeState(nil, map[devices.ID]devices.State{id: {"on": true, "brightness": 0.5}})
+	assert.Equal(t, int64(2), syncer.Count())
+	assert.Equal(t, devices.State{"brightness": 0.5}, syncer.Devices.Get(id).State)
+	assert.Equal(t, audit.OriginUser, origins[1])
+
+	// If the device is changed anyway the forced state is sent back
+	l.updateDevice(&devices.Device{
+		ID:    id,
+		State: devices.State{"on": true},
+	})
+	l.Wait()
+	assert.Equal(t, int64(3), syncer.Count())
+	assert.Equal(t, devices.State{"on": false}, syncer.Devices.Get(id).State)
+
+	assert.NoError(t, l.RemoveOverride(o.UUID))
+	l.changeState(nil, map[devices.ID]devices.State{id: {"on": true}})
+	assert.Equal(t, true, syncer.Devices.Get(id).State["on"])
+}
+
+func TestAddOverrideValidation(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+
+	assert.EqualError(t, l.AddOverride(&Override{Type: OverrideRule, Target: "uuid"}), "override must end in the future")
+	assert.EqualError(t, l.AddOverride(&Override{Type: OverrideRule, For: stypes.Duration(time.Hour)}), "override target is missing")
+	assert.EqualError(t, l.AddOverride(&Override{Type: "unknown", Target: "uuid", For: stypes.Duration(time.Hour)}), "unknown override type: unknown")
+	assert.EqualError(t, l.AddOverride(&Override{Type: OverrideDevice, Target: "node.light", For: stypes.Duration(time.Hour)}), "override state is missing")
+	assert.Error(t, l.AddOverride(&Override{Type: OverrideDevice, Target: "light", State: devices.State{"on": true}, For: stypes.Duration(time.Hour)}))
+	assert.EqualError(t, l.RemoveOverride("missing"), "override missing does not exist")
+	assert.Len(t, l.Overrides.All(), 0)
+}
@@ -0,0 +1,229 @@
+package logic
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// keyOwners keeps track of which rule that last changed a device key.
+type keyOwners struct {
+	owners map[devices.ID]map[string]string
+	// dependencies caches the rules an expression refers to with rules["uuid"]. It only holds the expressions of
+	// the current rules, see ruleDependencies.
+	dependencies map[string][]string
+	sync.RWMutex
+}
+
+func newKeyOwners() *keyOwners {
+	return &keyOwners{
+		owners:       make(map[devices.ID]map[string]string),
+		dependencies: make(map[string][]string),
+	}
+}
+
+// OnKeyOwnersChanged is called when a rule takes or releases the ownership of a device key.
+func (l *Logic) OnKeyOwnersChanged(callback func()) {
+	l.onKeyOwnersChanged = callback
+}
+
+// KeyOwners returns the uuid of the rule that owns each device key.
+func (l *Logic) KeyOwners() map[string]map[string]string {
+	l.owners.RLock()
+	defer l.owners.RUnlock()
+	owners := make(map[string]map[string]string)
+	for id, keys := range l.owners.owners {
+		owners[id.String()] = make(map[string]string)
+		for k, uuid := range keys {
+			owners[id.String()][k] = uuid
+		}
+	}
+	return owners
+}
+
+// rulePrecedes returns true if a has precedence over b. Higher priority goes first, then name and uuid.
+func rulePrecedes(a, b *Rule) bool {
+	if a.Priority() != b.Priority() {
+		return a.Priority() > b.Priority()
+	}
+	if a.Name() != b.Name() {
+		return a.Name() < b.Name()
+	}
+	return a.Uuid() < b.Uuid()
+}
+
+// claimKeys removes the keys from state that are owned by an active rule with precedence over r and takes the ownership of the rest.
+// A nil rule is a manual change that does not take ownership.
+func (l *Logic) claimKeys(r *Rule, id devices.ID, state devices.State) devices.State {
+	if r == nil {
+		return state
+	}
+
+	l.RLock()
+	rules := l.Rules
+	l.RUnlock()
+
+	allowed := make(devices.State)
+	conflicts := []string{}
+	changed := false
+	l.owners.Lock()
+	for k, v := range state {
+		if uuid, ok := l.owners.owners[id][k]; ok && uuid != r.Uuid() {
+			if owner := rules[uuid]; owner != nil && owner.Active() && rulePrecedes(owner, r) {
+				conflicts = append(conflicts, fmt.Sprintf("%s.%s is owned by rule %s (%s)", id, k, owner.Name(), uuid))
+				continue
+			}
+		}
+		if l.owners.owners[id] == nil {
+			l.owners.owners[id] = make(map[string]string)
+		}
+		if l.owners.owners[id][k] != r.Uuid() {
+			l.owners.owners[id][k] = r.Uuid()
+			changed = true
+		}
+		allowed[k] = v
+	}
+	l.owners.Unlock()
+
+	for _, c := range conflicts {
+		logrus.Debugf("logic: rule %s: %s", r.Name(), c)
+		l.addRuleEvent(r.Uuid(), RuleEvent{Type: RuleEventConflict, Node: id.Node, Error: c})
+	}
+	if changed {
+		l.onKeyOwnersChanged()
+	}
+	return allowed
+}
+
+// releaseKeys releases all keys owned by the rule.
+func (l *Logic) releaseKeys(uuid string) {
+	changed := false
+	l.owners.Lock()
+	for id, keys := range l.owners.owners {
+		for k, owner := range keys {
+			if owner == uuid {
+				delete(keys, k)
+				changed = true
+			}
+		}
+		if len(keys) == 0 {
+			delete(l.owners.owners, id)
+		}
+	}
+	l.owners.Unlock()
+
+	if changed {
+		l.onKeyOwnersChanged()
+	}
+}
+
+// ruleDependencies returns the uuids of the rules that each rule refers to with rules["uuid"], by rule uuid.
+// The cache is replaced with the expressions of the rules so edited and removed rules are forgotten.
+func (ko *keyOwners) ruleDependencies(rules []*Rule) map[string][]string {
+	ko.Lock()
+	defer ko.Unlock()
+
+	cache := make(map[string][]string, len(rules))
+	deps := make(map[string][]string, len(rules))
+	for _, r := range rules {
+		exp := r.Expression()
+		d, ok := cache[exp]
+		if !ok {
+			if d, ok = ko.dependencies[exp]; !ok {
+				d = dependsOn(exp)
+			}
+			cache[exp] = d
+		}
+		deps[r.Uuid()] = d
+	}
+	ko.dependencies = cache
+	return deps
+}
+
+// dependsOn returns the uuids of the rules that the expression refers to with rules["uuid"].
+func dependsOn(exp string) []string {
+	deps := []string{}
+	if ast, iss := celEnv.Parse(exp); iss.Err() == nil {
+		walkExpr(ast.Expr(), func(expr *exprpb.Expr) {
+			call := expr.GetCallExpr()
+			if call == nil || call.GetFunction() != "_[_]" || len(call.GetArgs()) != 2 {
+				return
+			}
+			if call.GetArgs()[0].GetIdentExpr().GetName() != "rules" {
+				return
+			}
+			if uuid := call.GetArgs()[1].GetConstExpr().GetStringValue(); uuid != "" {
+				deps = append(deps, uuid)
+			}
+		})
+	}
+
+	return deps
+}
+
+// evaluationOrder returns the enabled rules sorted so that a rule is evaluated after the rules its expression refers to.
+// Rules without dependencies between them are sorted with rulePrecedes. Rules in a cycle are evaluated last.
+func (l *Logic) evaluationOrder() []*Rule {
+	l.RLock()
+	list := make([]*Rule, 0, len(l.Rules))
+	for _, r := range l.Rules {
+		if r.Enabled {
+			list = append(list, r)
+		}
+	}
+	l.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return rulePrecedes(list[i], list[j])
+	})
+
+	enabled := make(map[string]bool, len(list))
+	for _, r := range list {
+		enabled[r.Uuid()] = true
+	}
+	remaining := make(map[string]int, len(list))
+	dependents := make(map[string][]*Rule)
+	dependencies := l.owners.ruleDependencies(list)
+	for _, r := range list {
+		for _, dep := range dependencies[r.Uuid()] {
+			if !enabled[dep] || dep == r.Uuid() {
+				continue
+			}
+			remaining[r.Uuid()]++
+			dependents[dep] = append(dependents[dep], r)
+		}
+	}
+
+	order := make([]*Rule, 0, len(list))
+	done := make(map[string]bool, len(list))
+	for len(order) < len(list) {
+		progress := false
+		for _, r := range list {
+			if done[r.Uuid()] || remaining[r.Uuid()] > 0 {
+				continue
+			}
+			done[r.Uuid()] = true
+			order = append(order, r)
+			for _, d := range dependents[r.Uuid()] {
+				remaining[d.Uuid()]--
+			}
+			progress = true
+			break
+		}
+		if progress {
+			continue
+		}
+		for _, r := range list {
+			if !done[r.Uuid()] {
+				logrus.Warnf("logic: rule %s (%s) is part of a dependency cycle", r.Name(), r.Uuid())
+				done[r.Uuid()] = true
+				order = append(order, r)
+			}
+		}
+	}
+	return order
+}
@@ -0,0 +1,101 @@
+package logic
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluationOrder(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	a := l.AddRule("a")
+	a.Enabled = true
+	a.Uuid_ = "a"
+	a.Expression_ = `rules["c"]`
+	b := l.AddRule("b")
+	b.Enabled = true
+	b.Uuid_ = "b"
+	b.Expression_ = `true`
+	c := l.AddRule("c")
+	c.Enabled = true
+	c.Uuid_ = "c"
+	c.Priority_ = -1
+	c.Expression_ = `true`
+	l.Rules = Rules{"a": a, "b": b, "c": c}
+
+	names := func() []string {
+		list := []string{}
+		for _, r := range l.evaluationOrder() {
+			list = append(list, r.Name())
+		}
+		return list
+	}
+
+	// a depends on c even if it has higher priority
+	assert.Equal(t, []string{"b", "c", "a"}, names())
+
+	// Rules in a cycle are evaluated last
+	c.Expression_ = `rules["a"]`
+	b.Expression_ = `rules["b"]`
+	assert.Equal(t, []string{"b", "a", "c"}, names())
+
+	// Only the expressions of the current rules are cached
+	assert.Len(t, l.owners.dependencies, 3)
+	delete(l.Rules, "b")
+	names()
+	assert.Len(t, l.owners.dependencies, 2)
+}
+
+func TestDependentRuleActivatesInSameEvaluation(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	id := devices.ID{Node: "node", ID: "1"}
+	l.updateDevice(&devices.Device{ID: id, State: devices.State{"on": true}})
+
+	second := l.AddRule("a second")
+	second.Enabled = true
+	first := l.AddRule("b first")
+	first.Enabled = true
+	first.Expression_ = `devices["node.1"].on`
+	second.Expression_ = `rules["` + first.Uuid() + `"]`
+
+	l.EvaluateRules(context.Background())
+	l.Wait()
+	assert.True(t, first.Active())
+	assert.True(t, second.Active())
+}
+
+func TestKeyOwnership(t *testing.T) {
+	syncer := NewMockSender()
+	l := New(NewSavedStateStore(), syncer)
+	id := devices.ID{Node: "node", ID: "light"}
+	high := l.AddRule("high")
+	high.Priority_ = 10
+	high.Active_ = true
+	low := l.AddRule("low")
+	low.Active_ = true
+
+	l.changeState(high, map[devices.ID]devices.State{id: {"on": true}})
+	assert.Equal(t, map[string]map[string]string{"node.light": {"on": high.Uuid()}}, l.KeyOwners())
+
+	// The key owned by the rule with higher priority is left out
+	l.changeState(low, map[devices.ID]devices.State{id: {"on": false, "brightness": 0.5}})
+	assert.Equal(t, devices.State{"brightness": 0.5}, syncer.Devices.Get(id).State)
+	assert.Equal(t, RuleEventConflict, l.RuleHistory.Get(low.Uuid())[0].Type)
+
+	// Manual changes are always sent and does not change the owner
+	l.changeState(nil, map[devices.ID]devices.State{id: {"on": false}})
+	assert.Equal(t, false, syncer.Devices.Get(id).State["on"])
+	assert.Equal(t, high.Uuid(), l.KeyOwners()["node.light"]["on"])
+
+	// An inactive owner releases the key
+	l.runNow(high, false)
+	l.changeState(low, map[devices.ID]devices.State{id: {"on": true}})
+	assert.Equal(t, true, syncer.Devices.Get(id).State["on"])
+	assert.Equal(t, low.Uuid(), l.KeyOwners()["node.light"]["on"])
+
+	// A rule with higher priority takes over the key
+	l.changeState(high, map[devices.ID]devices.State{id: {"on": false}})
+	assert.Equal(t, high.Uuid(), l.KeyOwners()["node.light"]["on"])
+}
@@ -14,28 +14,37 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
-	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
 	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
 	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
 )
 
 type Rule struct {
-	Name_         string          `json:"name"`
-	Uuid_         string          `json:"uuid"`
-	Active_       bool            `json:"active"`
-	Pending_      bool            `json:"pending"`
-	Enabled       bool            `json:"enabled"`
+	Name_    string `json:"name"`
+	Uuid_    string `json:"uuid"`
+	Active_  bool   `json:"active"`
+	Pending_ bool   `json:"pending"`
+	Enabled  bool   `json:"enabled"`
+	// Priority_ decides which rule owns a device key when several active rules change it. Higher wins.
+	Priority_     int             `json:"priority,omitempty"`
 	Expression_   string          `json:"expression"`
 	Conditions_   map[string]bool `json:"conditions"`
-	Actions_      []string        `json:"actions"`
+	Actions_      []Action        `json:"actions"`
 	Labels_       models.Labels   `json:"labels"`
 	For_          stypes.Duration `json:"for"`
 	Type_         string          `json:"type"`
 	Destinations_ []string        `json:"destinations"`
-	ast           *cel.Ast
+	// ReleaseActions_ are run when the rule becomes inactive again, after the optional ReleaseFor_ hold time.
+	ReleaseActions_ []Action        `json:"releaseActions"`
+	ReleaseFor_     stypes.Duration `json:"releaseFor"`
+	// Blueprint_ is the uuid of a blueprint that generates the expression, for, actions and destinations of the rule.
+	Blueprint_   string                 `json:"blueprint,omitempty"`
+	Parameters_  map[string]interface{} `json:"parameters,omitempty"`
+	blueprintErr error
+	ast          *cel.Ast
 	sync.RWMutex
-	cancel context.CancelFunc
-	stop   chan struct{}
+	cancel        context.CancelFunc
+	cancelRelease context.CancelFunc
+	stop          chan struct{}
 }
 
 func (r *Rule) Expression() string {
@@ -44,6 +53,12 @@ func (r *Rule) Expression() string {
 	return r.Expression_
 }
 
+func (r *Rule) Priority() int {
+	r.RLock()
+	defer r.RUnlock()
+	return r.Priority_
+}
+
 func (r *Rule) Active() bool {
 	r.RLock()
 	defer r.RUnlock()
@@ -98,6 +113,19 @@ func (r *Rule) For() stypes.Duration {
 	return r.For_
 }
 
+func (r *Rule) ReleaseFor() stypes.Duration {
+	r.RLock()
+	defer r.RUnlock()
+	return r.ReleaseFor_
+}
+
+// HasRelease returns true if there is anything to run when the rule becomes inactive.
+func (r *Rule) HasRelease() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.ReleaseActions_) > 0 || len(r.Destinations_) > 0
+}
+
 func (r *Rule) Type() string {
 	r.RLock()
 	defer r.RUnlock()
@@ -120,65 +148,97 @@ func (r *Rule) Cancel() {
 	r.RUnlock()
 }
 
-func (r *Rule) Run(store *SavedStateStore, sender websocket.Sender, triggerDestination func(string, string) error) {
+func (r *Rule) CancelRelease() {
+	r.RLock()
+	if r.cancelRelease != nil {
+		r.cancelRelease()
+	}
+	r.RUnlock()
+}
+
+// Run runs all actions in order and triggers the destinations when done.
+func (r *Rule) Run(l *Logic) {
 	ctx, cancel := context.WithCancel(context.Background())
 	r.Lock()
 	r.cancel = cancel
 	r.Unlock()
 	defer cancel()
-	for k, v := range r.Actions_ {
-		duration, err := time.ParseDuration(v)
-		if err == nil { // its a duration. Do the sleep only
-			logrus.Debugf("logic: sleep action: %s", duration)
-
-			delay := time.NewTimer(duration)
-			select {
-			case <-delay.C:
-			case <-ctx.Done():
-				if !delay.Stop() {
-					<-delay.C
-				}
-				logrus.Debugf("logic: stopping action %d due to cancel", k)
-				return
-			}
-			continue
-		}
-		// assume its a saved state
-		if ctx.Err() == context.Canceled {
-			logrus.Debugf("logic: stopping action %d due to cancel", k)
-			return
+
+	if !r.runActions(ctx, l, r.Actions_) {
+		return
+	}
+
+	for _, dest := range r.Destinations_ {
+		logrus.Warnf("Send notification to %s", dest)
+		event := RuleEvent{Type: RuleEventDestination, Destination: dest}
+		if err := l.onTriggerDestination(dest, r.Name()); err != nil {
+			event.Error = err.Error()
 		}
+		l.addRuleEvent(r.Uuid(), event)
+	}
+}
 
-		stateList := store.Get(v)
-		if stateList == nil {
-			logrus.Errorf("SavedState %s does not exist", v)
+// newRelease returns the context of a new release. A release that is still running is canceled.
+func (r *Rule) newRelease() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Lock()
+	if r.cancelRelease != nil {
+		r.cancelRelease()
+	}
+	r.cancelRelease = cancel
+	r.Unlock()
+	return ctx, cancel
+}
+
+// RunRelease waits for the release hold time and then runs the release actions and releases the destinations.
+// ctx is created with newRelease and is canceled with CancelRelease if the rule becomes active again during the hold time or the actions.
+func (r *Rule) RunRelease(ctx context.Context, l *Logic) {
+	if hold := r.ReleaseFor(); hold > 0 {
+		sleep := Action{Type: ActionSleep, Duration: hold}
+		if err := sleep.Run(ctx, l, r); err != nil {
+			logrus.Debugf("logic: release of rule %s canceled during hold", r.Uuid())
 			return
 		}
-		devicesByNode := make(map[string]map[devices.ID]devices.State)
-		for id, state := range stateList.State {
-			if devicesByNode[id.Node] == nil {
-				devicesByNode[id.Node] = make(map[devices.ID]devices.State)
-			}
-			devicesByNode[id.Node][id] = state
-		}
-		for nodeID, devs := range devicesByNode {
-			logrus.WithFields(logrus.Fields{
-				"to": nodeID,
-			}).Debug("Send state change request to node")
-			err := sender.SendToID(nodeID, "state-change", devs)
-			if err != nil {
-				logrus.Error("logic: error sending state-change to node: ", err)
-				continue
-			}
-		}
+	}
+
+	l.addRuleEvent(r.Uuid(), RuleEvent{Type: RuleEventRelease})
+	if !r.runActions(ctx, l, r.ReleaseActions_) {
+		return
 	}
 
 	for _, dest := range r.Destinations_ {
-		logrus.Warnf("Send notification to %s", dest)
-		triggerDestination(dest, r.Name())
+		logrus.Infof("Release notification to %s", dest)
+		event := RuleEvent{Type: RuleEventDestination, Destination: dest}
+		if err := l.onReleaseDestination(dest, r.Name()); err != nil {
+			event.Error = err.Error()
+		}
+		l.addRuleEvent(r.Uuid(), event)
 	}
 }
 
+// runActions runs the actions in order. Returns false if it was canceled or an action failed.
+func (r *Rule) runActions(ctx context.Context, l *Logic, actions []Action) bool {
+	for k, action := range actions {
+		if ctx.Err() == context.Canceled {
+			logrus.Debugf("logic: stopping action %d due to cancel", k)
+			return false
+		}
+
+		l.addRuleEvent(r.Uuid(), RuleEvent{Type: RuleEventAction, Step: k + 1, Action: action.String()})
+		err := action.Run(ctx, l, r)
+		if err == context.Canceled {
+			logrus.Debugf("logic: stopping action %d due to cancel", k)
+			return false
+		}
+		if err != nil {
+			logrus.Errorf("logic: error running action %d in rule %s: %s", k, r.Uuid(), err)
+			l.addRuleEvent(r.Uuid(), RuleEvent{Type: RuleEventError, Step: k + 1, Action: action.String(), Error: err.Error()})
+			return false
+		}
+	}
+	return true
+}
+
 var celEnv *cel.Env
 
 func init() {
@@ -186,10 +246,95 @@ func init() {
 	celEnv, err = cel.NewEnv(cel.Declarations(
 		decls.NewVar("devices", decls.NewMapType(decls.String, decls.Dyn)),
 		decls.NewVar("rules", decls.NewMapType(decls.String, decls.Bool)),
+		decls.NewVar("previous", decls.NewMapType(decls.String, decls.Dyn)),
 		decls.NewFunction("daily",
 			decls.NewOverload("daily_string_string",
 				[]*exprpb.Type{decls.String, decls.String},
 				decls.Bool)),
+		// changed is true if the state key changed in the update that triggered the evaluation
+		decls.NewFunction("changed",
+			decls.NewOverload("changed_string_string",
+				[]*exprpb.Type{decls.String, decls.String},
+				decls.Bool)),
+		// previous returns the value the state key had before the last change
+		decls.NewFunction("previous",
+			decls.NewOverload("previous_string_string",
+				[]*exprpb.Type{decls.String, decls.String},
+				decls.Dyn)),
+		// since returns how long the state key has had its current value
+		decls.NewFunction("since",
+			decls.NewOverload("since_string_string",
+				[]*exprpb.Type{decls.String, decls.String},
+				decls.Duration)),
+		// sunrise and sunset returns todays sunrise and sunset with an optional offset
+		decls.NewFunction("sunrise",
+			decls.NewOverload("sunrise",
+				[]*exprpb.Type{},
+				decls.Timestamp),
+			decls.NewOverload("sunrise_duration",
+				[]*exprpb.Type{decls.Duration},
+				decls.Timestamp)),
+		decls.NewFunction("sunset",
+			decls.NewOverload("sunset",
+				[]*exprpb.Type{},
+				decls.Timestamp),
+			decls.NewOverload("sunset_duration",
+				[]*exprpb.Type{decls.Duration},
+				decls.Timestamp)),
+		// isDark is true between sunset+offset and sunrise-offset
+		decls.NewFunction("isDark",
+			decls.NewOverload("isDark",
+				[]*exprpb.Type{},
+				decls.Bool),
+			decls.NewOverload("isDark_duration",
+				[]*exprpb.Type{decls.Duration},
+				decls.Bool)),
+		// weekday returns the day of the week where 0 is sunday
+		decls.NewFunction("weekday",
+			decls.NewOverload("weekday",
+				[]*exprpb.Type{},
+				decls.Int)),
+		decls.NewFunction("isWeekend",
+			decls.NewOverload("isWeekend",
+				[]*exprpb.Type{},
+				decls.Bool)),
+		decls.NewFunction("isHoliday",
+			decls.NewOverload("isHoliday",
+				[]*exprpb.Type{},
+				decls.Bool)),
+		// The statistics functions look back over a window of recorded values, for example avg("node.1", "temperature", duration("30m"))
+		decls.NewFunction("avg",
+			decls.NewOverload("avg_string_string_duration",
+				[]*exprpb.Type{decls.String, decls.String, decls.Duration},
+				decls.Double)),
+		decls.NewFunction("min",
+			decls.NewOverload("min_string_string_duration",
+				[]*exprpb.Type{decls.String, decls.String, decls.Duration},
+				decls.Double)),
+		decls.NewFunction("max",
+			decls.NewOverload("max_string_string_duration",
+				[]*exprpb.Type{decls.String, decls.String, decls.Duration},
+				decls.Double)),
+		// delta is the change of the value since the start of the window
+		decls.NewFunction("delta",
+			decls.NewOverload("delta_string_string_duration",
+				[]*exprpb.Type{decls.String, decls.String, decls.Duration},
+				decls.Double)),
+		// count_true is how many times the key became true within the window
+		decls.NewFunction("count_true",
+			decls.NewOverload("count_true_string_string_duration",
+				[]*exprpb.Type{decls.String, decls.String, decls.Duration},
+				decls.Int)),
+		// time_true is how long the key was true within the window
+		decls.NewFunction("time_true",
+			decls.NewOverload("time_true_string_string_duration",
+				[]*exprpb.Type{decls.String, decls.String, decls.Duration},
+				decls.Duration)),
+		// time_above is how long the value was above the threshold within the window
+		decls.NewFunction("time_above",
+			decls.NewOverload("time_above_string_string_double_duration",
+				[]*exprpb.Type{decls.String, decls.String, decls.Double, decls.Duration},
+				decls.Duration)),
 	))
 	if err != nil {
 		logrus.Fatal(err)
@@ -198,7 +343,7 @@ func init() {
 
 // Eval evaluates the cel expression.
 func (r *Rule) Eval(devices *devices.List, rules map[string]bool) (bool, error) {
-	return eval(r.Expression(), devices, rules, r.ast)
+	return eval(r.Expression(), devices, rules, evalState{}, r.ast)
 }
 
 func getDailyCelFunc() *functions.Overload {
@@ -225,7 +370,37 @@ func getDailyCelFunc() *functions.Overload {
 	}
 }
 
-func eval(exp string, devices *devices.List, rules map[string]bool, ast *cel.Ast) (bool, error) {
+// evalState is the server state used by the functions in the cel environment. All fields are optional.
+type evalState struct {
+	// tracker is used by changed, previous and since
+	tracker *stateTracker
+	// calendar is used by the sun and calendar functions
+	calendar *Calendar
+	// stats is used by the statistics functions
+	stats *deviceStats
+}
+
+func eval(exp string, devices *devices.List, rules map[string]bool, state evalState, ast *cel.Ast) (bool, error) {
+	result, err := evalValue(exp, devices, rules, state, ast)
+	if err != nil {
+		return false, err
+	}
+
+	if result.Type() != types.BoolType {
+		return false, ErrExpressionNotBool
+	}
+
+	return result == types.True, nil
+}
+
+// evalValue evaluates the cel expression and returns the result of any type.
+func evalValue(exp string, devices *devices.List, rules map[string]bool, state evalState, ast *cel.Ast) (ref.Val, error) {
+	result, _, err := evalDetails(exp, devices, rules, state, ast, cel.OptOptimize)
+	return result, err
+}
+
+// evalDetails evaluates the cel expression with opts. The details are returned even if the evaluation fails.
+func evalDetails(exp string, devices *devices.List, rules map[string]bool, state evalState, ast *cel.Ast, opts ...cel.EvalOption) (ref.Val, *cel.EvalDetails, error) {
 	devicesState := make(map[string]map[string]interface{})
 	for devID, v := range devices.All() {
 		devicesState[devID.String()] = make(map[string]interface{})
@@ -240,36 +415,42 @@ func eval(exp string, devices *devices.List, rules map[string]bool, ast *cel.Ast
 		var iss *cel.Issues
 		ast, iss = celEnv.Parse(exp)
 		if iss.Err() != nil {
-			return false, iss.Err()
+			return nil, nil, iss.Err()
 		}
 
 		c, iss := celEnv.Check(ast)
 		if iss.Err() != nil {
-			return false, iss.Err()
+			return nil, nil, iss.Err()
 		}
 		ast = c
 	}
 
-	prg, err := celEnv.Program(ast, cel.EvalOptions(cel.OptOptimize), cel.Functions(getDailyCelFunc()))
+	previousState := make(map[string]map[string]interface{})
+	if state.tracker != nil {
+		previousState = state.tracker.previousState()
+	}
+
+	funcs := append([]*functions.Overload{getDailyCelFunc()}, state.tracker.celFunctions(devices)...)
+	funcs = append(funcs, state.calendar.celFunctions()...)
+	funcs = append(funcs, state.stats.celFunctions(devices)...)
+	prg, err := celEnv.Program(ast, cel.EvalOptions(opts...), cel.Functions(funcs...))
 	if err != nil {
-		return false, err
+		return nil, nil, err
 	}
-	result, _, err := prg.Eval(map[string]interface{}{
-		"devices": devicesState,
-		"rules":   rules,
+	result, details, err := prg.Eval(map[string]interface{}{
+		"devices":  devicesState,
+		"rules":    rules,
+		"previous": previousState,
 	})
 	if err != nil {
-		return false, err
+		return nil, details, err
 	}
 
-	if result.Type() != types.BoolType {
-		if result.Type() == types.ErrType {
-			return false, result.Value().(error)
-		}
-		return false, ErrExpressionNotBool
+	if result.Type() == types.ErrType {
+		return nil, details, result.Value().(error)
 	}
 
-	return result == types.True, nil
+	return result, details, nil
 }
 
 var ErrExpressionNotBool = fmt.Errorf("invalid result of expression. Only bool expressions are valid")
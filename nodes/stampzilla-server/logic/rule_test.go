@@ -169,9 +169,9 @@ func TestRunActions(t *testing.T) {
 	})
 
 	r := &Rule{
-		Actions_: []string{
-			"50ms",
-			"uuid",
+		Actions_: []Action{
+			ParseAction("50ms"),
+			ParseAction("uuid"),
 		},
 		Destinations_: []string{
 			"a",
@@ -186,7 +186,9 @@ func TestRunActions(t *testing.T) {
 		return nil
 	}
 
-	r.Run(savedState, syncer, triggerDestination)
+	l := New(savedState, syncer)
+	l.OnTriggerDestination(triggerDestination)
+	r.Run(l)
 	if time.Now().Sub(now) < time.Millisecond*25 {
 		t.Error("Expected to sleep in the action for at least 25ms")
 	}
@@ -207,9 +209,9 @@ func TestRunActionsCancelSleep(t *testing.T) {
 	savedState := NewSavedStateStore()
 
 	r := &Rule{
-		Actions_: []string{
-			"100ms",
-			"100ms",
+		Actions_: []Action{
+			ParseAction("100ms"),
+			ParseAction("100ms"),
 		},
 		Destinations_: []string{
 			"a",
@@ -230,7 +232,9 @@ func TestRunActionsCancelSleep(t *testing.T) {
 		return nil
 	}
 
-	r.Run(savedState, syncer, triggerDestination)
+	l := New(savedState, syncer)
+	l.OnTriggerDestination(triggerDestination)
+	r.Run(l)
 	dur := time.Now().Sub(now)
 	if dur < time.Millisecond*110 {
 		t.Error("Expected to sleep in the action for at least 200ms slept: ", dur)
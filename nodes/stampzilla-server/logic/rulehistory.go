@@ -0,0 +1,150 @@
+package logic
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+)
+
+/* rulehistory.json
+{
+	"e8092b86-1261-44cd-ab64-38121df58a79": [
+		{"time": "2023-10-18T03:00:00Z", "type": "pending"},
+		{"time": "2023-10-18T03:05:00Z", "type": "active"},
+		{"time": "2023-10-18T03:05:00Z", "type": "action", "step": 1, "action": "c7d352bb-23f4-468c-b476-f76599c09a0d"},
+		{"time": "2023-10-18T03:05:00Z", "type": "state-change", "node": "fd230f30-6d84-4507-8ace-c1ec715be51e"},
+		{"time": "2023-10-18T03:10:00Z", "type": "inactive"}
+	]
+}
+*/
+
+// RuleEventType is the kind of event in the rule history.
+type RuleEventType string
+
+const (
+	RuleEventPending     RuleEventType = "pending"
+	RuleEventActive      RuleEventType = "active"
+	RuleEventInactive    RuleEventType = "inactive"
+	RuleEventRelease     RuleEventType = "release"
+	RuleEventAction      RuleEventType = "action"
+	RuleEventStateChange RuleEventType = "state-change"
+	RuleEventDestination RuleEventType = "destination"
+	RuleEventError       RuleEventType = "error"
+	RuleEventConflict    RuleEventType = "conflict"
+)
+
+// DefaultRuleHistoryLength is the number of events kept per rule.
+const DefaultRuleHistoryLength = 50
+
+// DefaultRuleHistorySaveDelay is how long events are collected before rulehistory.json is written.
+const DefaultRuleHistorySaveDelay = 5 * time.Second
+
+// RuleEvent is one entry in the history of a rule.
+type RuleEvent struct {
+	Time time.Time     `json:"time"`
+	Type RuleEventType `json:"type"`
+	// Step is the action number starting from 1. Zero if the event is not related to an action.
+	Step        int    `json:"step,omitempty"`
+	Action      string `json:"action,omitempty"`
+	Node        string `json:"node,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// RuleHistory keeps the latest events of each rule.
+type RuleHistory struct {
+	events map[string][]RuleEvent
+	length int
+	// SaveDelay is how long SaveLater waits before saving.
+	SaveDelay time.Duration
+	timer     *time.Timer
+	sync.RWMutex
+}
+
+// NewRuleHistory returns a history that keeps length events per rule.
+func NewRuleHistory(length int) *RuleHistory {
+	return &RuleHistory{
+		events:    make(map[string][]RuleEvent),
+		length:    length,
+		SaveDelay: DefaultRuleHistorySaveDelay,
+	}
+}
+
+// Add adds an event to the rule and removes the oldest events if there are too many.
+func (rh *RuleHistory) Add(uuid string, e RuleEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	rh.Lock()
+	defer rh.Unlock()
+	events := append(rh.events[uuid], e)
+	if len(events) > rh.length {
+		events = append([]RuleEvent(nil), events[len(events)-rh.length:]...)
+	}
+	rh.events[uuid] = events
+}
+
+// Get returns the events of a rule.
+func (rh *RuleHistory) Get(uuid string) []RuleEvent {
+	rh.RLock()
+	defer rh.RUnlock()
+	return append([]RuleEvent(nil), rh.events[uuid]...)
+}
+
+// All returns the events of all rules.
+func (rh *RuleHistory) All() map[string][]RuleEvent {
+	rh.RLock()
+	defer rh.RUnlock()
+	all := make(map[string][]RuleEvent, len(rh.events))
+	for uuid, events := range rh.events {
+		all[uuid] = append([]RuleEvent(nil), events...)
+	}
+	return all
+}
+
+// Remove removes the events of rules that no longer exist.
+func (rh *RuleHistory) Remove(uuid string) {
+	rh.Lock()
+	delete(rh.events, uuid)
+	rh.Unlock()
+}
+
+// SaveLater saves the history after SaveDelay and then calls done. Events that are added until then are saved
+// together, so a rule that runs many actions does not write the file for each of them.
+func (rh *RuleHistory) SaveLater(done func(error)) {
+	rh.Lock()
+	defer rh.Unlock()
+	if rh.timer != nil {
+		return
+	}
+	rh.timer = time.AfterFunc(rh.SaveDelay, func() {
+		rh.Lock()
+		rh.timer = nil
+		rh.Unlock()
+		done(rh.Save())
+	})
+}
+
+func (rh *RuleHistory) Save() error {
+	rh.RLock()
+	defer rh.RUnlock()
+	if err := persist.Save("rulehistory.json", rh.events); err != nil {
+		return fmt.Errorf("rulehistory: error saving rulehistory.json: %s", err.Error())
+	}
+	return nil
+}
+
+func (rh *RuleHistory) Load() error {
+	rh.Lock()
+	defer rh.Unlock()
+	if err := persist.Load("rulehistory.json", &rh.events); err != nil {
+		if os.IsNotExist(err) {
+			return nil // We dont want to error our if the file does not exist when we start the server
+		}
+		return fmt.Errorf("rulehistory: error loading rulehistory.json: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleHistoryIsBounded(t *testing.T) {
+	rh := NewRuleHistory(3)
+	for i := 1; i <= 5; i++ {
+		rh.Add("rule", RuleEvent{Type: RuleEventAction, Step: i})
+	}
+
+	events := rh.Get("rule")
+	assert.Len(t, events, 3)
+	assert.Equal(t, 3, events[0].Step)
+	assert.Equal(t, 5, events[2].Step)
+	assert.False(t, events[0].Time.IsZero())
+}
+
+func TestRuleHistoryRecordsRun(t *testing.T) {
+	syncer := NewMockSender()
+	savedState := NewSavedStateStore()
+	savedState.State["uuid"] = &SavedState{
+		Name: "test",
+		UUID: "uuid",
+		State: map[devices.ID]devices.State{
+			{Node: "node", ID: "1"}: {"on": true},
+		},
+	}
+	l := New(savedState, syncer)
+	l.OnTriggerDestination(func(dest, body string) error {
+		return fmt.Errorf("sender not found")
+	})
+	callbacks := 0
+	l.OnRuleEvent(func(string, RuleEvent) {
+		callbacks++
+	})
+
+	r := l.AddRule("test")
+	r.Expression_ = `devices["node.id"].on == true`
+	r.Enabled = true
+	r.Actions_ = []Action{ParseAction("uuid"), ParseAction("missing")}
+	r.Destinations_ = []string{"dest"}
+	l.updateDevice(&devices.Device{
+		ID:    devices.ID{Node: "node", ID: "id"},
+		State: devices.State{"on": true},
+	})
+
+	l.EvaluateRules(context.Background())
+	l.Wait()
+
+	events := l.RuleHistory.Get(r.Uuid())
+	types := []RuleEventType{}
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []RuleEventType{
+		RuleEventActive,
+		RuleEventAction,
+		RuleEventStateChange,
+		RuleEventAction,
+		RuleEventError,
+	}, types)
+	assert.Equal(t, "node", events[2].Node)
+	assert.Equal(t, 2, events[4].Step)
+	assert.Equal(t, "SavedState missing does not exist", events[4].Error)
+	assert.Equal(t, len(events), callbacks)
+
+	r.Actions_ = []Action{ParseAction("uuid")}
+	l.updateDevice(&devices.Device{
+		ID:    devices.ID{Node: "node", ID: "id"},
+		State: devices.State{"on": false},
+	})
+	l.EvaluateRules(context.Background())
+	l.Wait()
+	l.updateDevice(&devices.Device{
+		ID:    devices.ID{Node: "node", ID: "id"},
+		State: devices.State{"on": true},
+	})
+	l.EvaluateRules(context.Background())
+	l.Wait()
+
+	events = l.RuleHistory.Get(r.Uuid())
+	assert.Equal(t, RuleEventInactive, events[5].Type)
+	assert.Equal(t, RuleEventRelease, events[6].Type)
+	assert.Equal(t, RuleEventDestination, events[7].Type)
+	last := events[len(events)-1]
+	assert.Equal(t, RuleEventDestination, last.Type)
+	assert.Equal(t, "dest", last.Destination)
+	assert.Equal(t, "sender not found", last.Error)
+}
+
+func TestRuleHistorySaveLater(t *testing.T) {
+	dir := t.TempDir()
+	prevDir, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(prevDir)
+
+	rh := NewRuleHistory(3)
+	rh.SaveDelay = 10 * time.Millisecond
+
+	saved := make(chan error, 10)
+	for i := 0; i < 5; i++ {
+		rh.Add("rule", RuleEvent{Type: RuleEventAction, Step: i + 1})
+		rh.SaveLater(func(err error) { saved <- err })
+	}
+
+	// All events are saved together
+	select {
+	case err := <-saved:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("history was not saved")
+	}
+	time.Sleep(30 * time.Millisecond)
+	assert.Len(t, saved, 0)
+
+	loaded := NewRuleHistory(3)
+	assert.NoError(t, loaded.Load())
+	assert.Len(t, loaded.Get("rule"), 3)
+}
@@ -1,12 +1,12 @@
 package logic
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"sync"
 
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
 )
 
 /* savedstate.json example
@@ -63,33 +63,20 @@ func (sss *SavedStateStore) SetState(s SavedStates) {
 func (sss *SavedStateStore) Save() error {
 	sss.Lock()
 	defer sss.Unlock()
-	configFile, err := os.Create("savedstate.json")
-	if err != nil {
-		return fmt.Errorf("savedstate: error saving savedstate.json: %s", err.Error())
-	}
-	encoder := json.NewEncoder(configFile)
-	encoder.SetIndent("", "\t")
-	err = encoder.Encode(sss.State)
-	if err != nil {
+	if err := persist.Save("savedstate.json", sss.State); err != nil {
 		return fmt.Errorf("savedstate: error saving savedstate.json: %s", err.Error())
 	}
 	return nil
 }
 
 func (sss *SavedStateStore) Load() error {
-	configFile, err := os.Open("savedstate.json")
-	if err != nil {
+	sss.Lock()
+	defer sss.Unlock()
+	if err := persist.Load("savedstate.json", &sss.State); err != nil {
 		if os.IsNotExist(err) {
 			return nil // We dont want to error our if the file does not exist when we start the server
 		}
 		return fmt.Errorf("savedstate: error loading savedstate.json: %s", err.Error())
 	}
-
-	sss.Lock()
-	defer sss.Unlock()
-	jsonParser := json.NewDecoder(configFile)
-	if err = jsonParser.Decode(&sss.State); err != nil {
-		return fmt.Errorf("savedstate: error loading savedstate.json: %s", err.Error())
-	}
 	return nil
 }
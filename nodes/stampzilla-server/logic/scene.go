@@ -0,0 +1,279 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+)
+
+/* scenes.json example
+{
+    "0b0e3c8a-8a5e-4b3c-9d4f-6c1c9f1f2a11": {
+        "name": "movie mode",
+        "uuid": "0b0e3c8a-8a5e-4b3c-9d4f-6c1c9f1f2a11",
+        "savedState": "6fbaea24-6b3f-4856-9194-735b349bbf4d",
+        "transition": "5s",
+        "delays": {
+            "nodeuuid.deviceid": "2s"
+        }
+    }
+}
+*/
+
+// sceneStepInterval is the time between each state-change during a transition.
+var sceneStepInterval = 250 * time.Millisecond
+
+type Scenes map[string]*Scene
+
+// Scene applies a saved state with an optional transition. The state of the affected devices is captured
+// before it is applied so it can be restored later.
+type Scene struct {
+	Name       string `json:"name"`
+	UUID       string `json:"uuid"`
+	SavedState string `json:"savedState"`
+	// Transition fades numeric values like brightness from the current value to the new one.
+	Transition stypes.Duration `json:"transition"`
+	// Delays is the time to wait before a device is changed. The key is the device id.
+	Delays map[string]stypes.Duration `json:"delays,omitempty"`
+}
+
+type SceneStore struct {
+	Scenes Scenes
+	// captured is the state of the devices before the scene was applied. It is kept until the scene is restored
+	// and saved in scenecaptures.json so the scene can be restored after a restart.
+	captured map[string]map[devices.ID]devices.State
+	sync.RWMutex
+}
+
+func NewSceneStore() *SceneStore {
+	return &SceneStore{
+		Scenes:   make(Scenes),
+		captured: make(map[string]map[devices.ID]devices.State),
+	}
+}
+
+func (ss *SceneStore) Get(uuid string) *Scene {
+	ss.RLock()
+	defer ss.RUnlock()
+	return ss.Scenes[uuid]
+}
+
+func (ss *SceneStore) All() Scenes {
+	ss.RLock()
+	defer ss.RUnlock()
+	return ss.Scenes
+}
+
+func (ss *SceneStore) SetScenes(s Scenes) {
+	ss.Lock()
+	ss.Scenes = s
+	ss.Unlock()
+}
+
+// Captured returns the state that was captured when the scene was applied or nil if it has been restored.
+func (ss *SceneStore) Captured(uuid string) map[devices.ID]devices.State {
+	ss.RLock()
+	defer ss.RUnlock()
+	return ss.captured[uuid]
+}
+
+// capture stores the state unless the scene already has a capture that has not been restored.
+// Returns true if the state was stored.
+func (ss *SceneStore) capture(uuid string, state map[devices.ID]devices.State) bool {
+	ss.Lock()
+	defer ss.Unlock()
+	if _, ok := ss.captured[uuid]; ok {
+		return false
+	}
+	ss.captured[uuid] = state
+	return true
+}
+
+func (ss *SceneStore) clearCaptured(uuid string) {
+	ss.Lock()
+	delete(ss.captured, uuid)
+	ss.Unlock()
+}
+
+// SaveCaptured saves the captured states to scenecaptures.json.
+func (ss *SceneStore) SaveCaptured() error {
+	ss.RLock()
+	defer ss.RUnlock()
+	if err := persist.Save("scenecaptures.json", ss.captured); err != nil {
+		return fmt.Errorf("scenes: error saving scenecaptures.json: %s", err.Error())
+	}
+	return nil
+}
+
+func (ss *SceneStore) Save() error {
+	ss.Lock()
+	defer ss.Unlock()
+	if err := persist.Save("scenes.json", ss.Scenes); err != nil {
+		return fmt.Errorf("scenes: error saving scenes.json: %s", err.Error())
+	}
+	return nil
+}
+
+func (ss *SceneStore) Load() error {
+	ss.Lock()
+	defer ss.Unlock()
+	// We dont want to error our if the files does not exist when we start the server
+	if err := persist.Load("scenes.json", &ss.Scenes); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("scenes: error loading scenes.json: %s", err.Error())
+	}
+	if err := persist.Load("scenecaptures.json", &ss.captured); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("scenes: error loading scenecaptures.json: %s", err.Error())
+	}
+	if ss.captured == nil {
+		ss.captured = make(map[string]map[devices.ID]devices.State)
+	}
+	return nil
+}
+
+// ApplyScene captures the current state of the devices in the scene and applies the scene.
+// The state is only captured if the scene has not been applied since it was last restored, so restore
+// always returns to the state before the scene.
+// It blocks until the transition is done. r is optional and used for the rule history.
+func (l *Logic) ApplyScene(ctx context.Context, uuid string, r *Rule) error {
+	scene := l.SceneStore.Get(uuid)
+	if scene == nil {
+		return fmt.Errorf("scene %s does not exist", uuid)
+	}
+	stateList := l.StateStore.Get(scene.SavedState)
+	if stateList == nil {
+		return fmt.Errorf("SavedState %s does not exist", scene.SavedState)
+	}
+
+	captured := make(map[devices.ID]devices.State)
+	for id, state := range stateList.State {
+		current := make(devices.State)
+		for k := range state {
+			if v := l.deviceValue(id, k); v != nil {
+				current[k] = v
+			}
+		}
+		if len(current) > 0 {
+			captured[id] = current
+		}
+	}
+	if l.SceneStore.capture(uuid, captured) {
+		l.onScenesCaptured()
+	}
+
+	return l.transition(ctx, scene, stateList.State, r)
+}
+
+// RestoreScene returns the devices to the state they had before the scene was applied.
+func (l *Logic) RestoreScene(ctx context.Context, uuid string, r *Rule) error {
+	scene := l.SceneStore.Get(uuid)
+	if scene == nil {
+		return fmt.Errorf("scene %s does not exist", uuid)
+	}
+	captured := l.SceneStore.Captured(uuid)
+	if captured == nil {
+		return fmt.Errorf("scene %s has not been applied", uuid)
+	}
+	if err := l.transition(ctx, scene, captured, r); err != nil {
+		return err
+	}
+	l.SceneStore.clearCaptured(uuid)
+	l.onScenesCaptured()
+	return nil
+}
+
+func (l *Logic) transition(ctx context.Context, scene *Scene, target map[devices.ID]devices.State, r *Rule) error {
+	wg := sync.WaitGroup{}
+	errs := make(chan error, len(target))
+	for id, state := range target {
+		wg.Add(1)
+		go func(id devices.ID, state devices.State) {
+			defer wg.Done()
+			errs <- l.transitionDevice(ctx, id, state, time.Duration(scene.Delays[id.String()]), time.Duration(scene.Transition), r)
+		}(id, state)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transitionDevice waits for delay and then fades numeric values to the target.
+// Other values are set directly except false values that are set when the fade is done. That way a light fades out before it turns off.
+func (l *Logic) transitionDevice(ctx context.Context, id devices.ID, target devices.State, delay, transition time.Duration, r *Rule) error {
+	if err := sleepContext(ctx, delay); err != nil {
+		return err
+	}
+
+	from := make(map[string]float64)
+	to := make(map[string]float64)
+	first := make(devices.State)
+	last := make(devices.State)
+	for k, v := range target {
+		if t, ok := toFloat(v); ok {
+			if f, ok := toFloat(l.deviceValue(id, k)); ok {
+				from[k] = f
+				to[k] = t
+				continue
+			}
+		}
+		if v == false {
+			last[k] = v
+			continue
+		}
+		first[k] = v
+	}
+
+	steps := int(transition / sceneStepInterval)
+	if steps < 1 || len(to) == 0 {
+		l.recordStateChange(r, l.changeState(r, map[devices.ID]devices.State{id: target}))
+		return nil
+	}
+
+	if len(first) > 0 {
+		l.recordStateChange(r, l.changeState(r, map[devices.ID]devices.State{id: first}))
+	}
+	for i := 1; i <= steps; i++ {
+		if err := sleepContext(ctx, sceneStepInterval); err != nil {
+			return err
+		}
+		state := make(devices.State)
+		for k := range to {
+			state[k] = from[k] + (to[k]-from[k])*float64(i)/float64(steps)
+		}
+		if i == steps {
+			state.MergeWith(last)
+		}
+		result := l.changeState(r, map[devices.ID]devices.State{id: state})
+		if i == steps {
+			l.recordStateChange(r, result)
+		}
+	}
+	return nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	delay := time.NewTimer(d)
+	select {
+	case <-delay.C:
+		return nil
+	case <-ctx.Done():
+		if !delay.Stop() {
+			<-delay.C
+		}
+		return ctx.Err()
+	}
+}
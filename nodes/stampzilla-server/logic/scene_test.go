@@ -0,0 +1,134 @@
+package logic
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyAndRestoreScene(t *testing.T) {
+	sceneStepInterval = 10 * time.Millisecond
+	defer func() { sceneStepInterval = 250 * time.Millisecond }()
+
+	light := devices.ID{Node: "node", ID: "light"}
+	tv := devices.ID{Node: "node", ID: "tv"}
+
+	syncer := NewMockSender()
+	savedState := NewSavedStateStore()
+	savedState.State["movie"] = &SavedState{
+		UUID: "movie",
+		State: map[devices.ID]devices.State{
+			light: {"on": false, "brightness": 0.0},
+			tv:    {"on": true},
+		},
+	}
+	l := New(savedState, syncer)
+	l.SceneStore.SetScenes(Scenes{
+		"scene": &Scene{
+			UUID:       "scene",
+			SavedState: "movie",
+			Transition: stypes.Duration(50 * time.Millisecond),
+			Delays: map[string]stypes.Duration{
+				"node.tv": stypes.Duration(20 * time.Millisecond),
+			},
+		},
+	})
+	l.updateDevice(&devices.Device{ID: light, State: devices.State{"on": true, "brightness": 1.0}})
+	l.updateDevice(&devices.Device{ID: tv, State: devices.State{"on": false}})
+
+	err := l.ApplyScene(context.Background(), "scene", nil)
+	assert.NoError(t, err)
+
+	// 5 fade steps for the light and one state-change for the tv
+	assert.Equal(t, int64(6), syncer.Count())
+	assert.Equal(t, devices.State{"on": false, "brightness": 0.0}, syncer.Devices.Get(light).State)
+	assert.Equal(t, devices.State{"on": true}, syncer.Devices.Get(tv).State)
+
+	assert.Equal(t, map[devices.ID]devices.State{
+		light: {"on": true, "brightness": 1.0},
+		tv:    {"on": false},
+	}, l.SceneStore.Captured("scene"))
+
+	// The nodes reports back the new state
+	l.updateDevice(&devices.Device{ID: light, State: devices.State{"on": false, "brightness": 0.0}})
+	l.updateDevice(&devices.Device{ID: tv, State: devices.State{"on": true}})
+
+	// Applying the scene again keeps the state from before the scene
+	err = l.ApplyScene(context.Background(), "scene", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, devices.State{"on": true, "brightness": 1.0}, l.SceneStore.Captured("scene")[light])
+	count := syncer.Count()
+
+	err = l.RestoreScene(context.Background(), "scene", nil)
+	assert.NoError(t, err)
+
+	// on is sent before the fade starts, then 5 fade steps for the light and one state-change for the tv
+	assert.Equal(t, count+7, syncer.Count())
+	assert.Equal(t, 1.0, syncer.Devices.Get(light).State["brightness"])
+	assert.Equal(t, false, syncer.Devices.Get(tv).State["on"])
+
+	// The capture is removed when restored
+	assert.Nil(t, l.SceneStore.Captured("scene"))
+	assert.EqualError(t, l.RestoreScene(context.Background(), "scene", nil), "scene scene has not been applied")
+}
+
+func TestSceneCapturesSaved(t *testing.T) {
+	dir := t.TempDir()
+	prevDir, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(prevDir)
+
+	light := devices.ID{Node: "node", ID: "light"}
+	ss := NewSceneStore()
+	assert.True(t, ss.capture("scene", map[devices.ID]devices.State{light: {"on": true}}))
+	assert.False(t, ss.capture("scene", map[devices.ID]devices.State{light: {"on": false}}))
+	assert.NoError(t, ss.SaveCaptured())
+
+	loaded := NewSceneStore()
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, devices.State{"on": true}, loaded.Captured("scene")[light])
+}
+
+func TestSceneErrors(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	l.SceneStore.SetScenes(Scenes{
+		"scene": &Scene{UUID: "scene", SavedState: "missing"},
+	})
+
+	assert.EqualError(t, l.ApplyScene(context.Background(), "other", nil), "scene other does not exist")
+	assert.EqualError(t, l.ApplyScene(context.Background(), "scene", nil), "SavedState missing does not exist")
+	assert.EqualError(t, l.RestoreScene(context.Background(), "scene", nil), "scene scene has not been applied")
+}
+
+func TestSceneCanceled(t *testing.T) {
+	syncer := NewMockSender()
+	savedState := NewSavedStateStore()
+	savedState.State["state"] = &SavedState{
+		UUID: "state",
+		State: map[devices.ID]devices.State{
+			{Node: "node", ID: "light"}: {"on": true},
+		},
+	}
+	l := New(savedState, syncer)
+	l.SceneStore.SetScenes(Scenes{
+		"scene": &Scene{
+			UUID:       "scene",
+			SavedState: "state",
+			Delays: map[string]stypes.Duration{
+				"node.light": stypes.Duration(time.Second),
+			},
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := l.ApplyScene(ctx, "scene", nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, int64(0), syncer.Count())
+}
@@ -2,14 +2,18 @@ package logic
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"math/rand"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jonaz/cron"
 	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
 )
 
@@ -18,7 +22,10 @@ import (
     "398d8a42-cb31-42ff-b4ae-99bdbb44d0ae": {
         "name": "test1",
         "uuid": "398d8a42-cb31-42ff-b4ae-99bdbb44d0ae",
-        "when": "0 * * * * *",
+        "when": "0 * * * * *", // or sunrise, sunset, sunset-15m, sunrise+30m
+        "timezone": "Europe/Stockholm",
+        "jitter": "15m",
+        "catchUp": true,
         "actions": [
             "6fbaea24-6b3f-4856-9194-735b349bbf4d"
         ]
@@ -28,6 +35,16 @@ import (
 
 type Tasks map[string]*Task
 
+// nextRunsPreview is the number of runs in Task.NextRuns.
+const nextRunsPreview = 5
+
+const (
+	// catchUpTimeout is how long a missed task waits for the devices it changes to come online after the server
+	// has started. It runs anyway after that.
+	catchUpTimeout = 5 * time.Minute
+	catchUpPoll    = time.Second
+)
+
 // Scheduler that schedule running saved state actions.
 type Scheduler struct {
 	tasks Tasks
@@ -38,6 +55,11 @@ type Scheduler struct {
 	sender          websocket.Sender
 	logic           *Logic
 	stop            context.CancelFunc
+	lastCronID      int64
+	onTaskRun       func(*Task)
+	isOnline        func(devices.ID) bool
+	catchUpTimeout  time.Duration
+	catchUpPoll     time.Duration
 }
 
 func NewScheduler(savedStateStore *SavedStateStore, sender websocket.Sender, logic *Logic) *Scheduler {
@@ -46,6 +68,9 @@ func NewScheduler(savedStateStore *SavedStateStore, sender websocket.Sender, log
 		sender:          sender,
 		tasks:           make(Tasks),
 		logic:           logic,
+		onTaskRun:       func(*Task) {},
+		catchUpTimeout:  catchUpTimeout,
+		catchUpPoll:     catchUpPoll,
 	}
 	scheduler.Cron = cron.New()
 	return scheduler
@@ -58,6 +83,97 @@ func (s *Scheduler) Start(parentCtx context.Context) {
 	s.Cron.Start(ctx)
 	s.Unlock()
 	logrus.Info("scheduler: started")
+	s.catchUp(ctx, time.Now())
+}
+
+// OnTaskRun is called after a task has run and LastRun is updated.
+func (s *Scheduler) OnTaskRun(callback func(*Task)) {
+	s.Lock()
+	s.onTaskRun = callback
+	s.Unlock()
+}
+
+// OnlineCheck sets how to check if a device is online. Missed tasks wait for their devices before they run.
+func (s *Scheduler) OnlineCheck(callback func(devices.ID) bool) {
+	s.Lock()
+	s.isOnline = callback
+	s.Unlock()
+}
+
+func (s *Scheduler) taskRun(t *Task) {
+	s.RLock()
+	callback := s.onTaskRun
+	s.RUnlock()
+	callback(t)
+}
+
+// catchUp runs the tasks with CatchUp that should have run between their LastRun and now.
+// Nodes have not reconnected when the server has just started, so each task waits for its devices to be online.
+func (s *Scheduler) catchUp(ctx context.Context, now time.Time) {
+	for _, task := range s.Tasks() {
+		task.RLock()
+		missed := task.CatchUp && task.Enabled && task.schedule != nil && !task.LastRun.IsZero() &&
+			task.schedule.Next(task.LastRun).Before(now)
+		task.RUnlock()
+		if !missed {
+			continue
+		}
+		go s.runMissed(ctx, task, now)
+	}
+}
+
+func (s *Scheduler) runMissed(ctx context.Context, task *Task, now time.Time) {
+	timeout := time.NewTimer(s.catchUpTimeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(s.catchUpPoll)
+	defer poll.Stop()
+
+wait:
+	for !s.devicesOnline(task) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timeout.C:
+			logrus.Warnf("scheduler: devices of missed task %s (%s) are not online", task.Name(), task.Uuid())
+			break wait
+		case <-poll.C:
+		}
+	}
+
+	task.RLock()
+	ranMeanwhile := task.LastRun.After(now)
+	task.RUnlock()
+	if ranMeanwhile {
+		return
+	}
+	logrus.Infof("scheduler: running missed task %s (%s)", task.Name(), task.Uuid())
+	task.Run()
+}
+
+// devicesOnline returns true if all devices in the saved states of the task are online.
+func (s *Scheduler) devicesOnline(task *Task) bool {
+	s.RLock()
+	isOnline := s.isOnline
+	s.RUnlock()
+	if isOnline == nil {
+		return true
+	}
+
+	task.RLock()
+	actions := append([]string(nil), task.Actions...)
+	task.RUnlock()
+	for _, id := range actions {
+		stateList := s.SavedStateStore.Get(id)
+		if stateList == nil {
+			continue
+		}
+		for devID := range stateList.State {
+			if !isOnline(devID) {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 func (s *Scheduler) Stop() {
@@ -89,6 +205,7 @@ func (s *Scheduler) AddTask(name string) *Task {
 		sender:          s.sender,
 		savedStateStore: s.SavedStateStore,
 		logic:           s.logic,
+		onRun:           s.taskRun,
 	}
 	s.Lock()
 	s.tasks[task.XUuid] = task
@@ -114,16 +231,9 @@ func (s *Scheduler) RemoveTask(uuid string) {
 }
 
 func (s *Scheduler) Save() error {
-	configFile, err := os.Create("schedule.json")
-	if err != nil {
-		return fmt.Errorf("scheduler: error saving tasks: %s", err)
-	}
-	encoder := json.NewEncoder(configFile)
-	encoder.SetIndent("", "\t")
 	s.Lock()
 	defer s.Unlock()
-	err = encoder.Encode(s.tasks)
-	if err != nil {
+	if err := persist.Save("schedule.json", s.tasks); err != nil {
 		return fmt.Errorf("scheduler: error saving tasks: %s", err)
 	}
 	return nil
@@ -132,19 +242,13 @@ func (s *Scheduler) Save() error {
 func (s *Scheduler) Load() error {
 	logrus.Info("Loading schedule from json file")
 
-	configFile, err := os.Open("schedule.json")
-	if err != nil {
+	s.Lock()
+	defer s.Unlock()
+	if err := persist.Load("schedule.json", &s.tasks); err != nil {
 		if os.IsNotExist(err) {
 			logrus.Warn(err)
 			return nil // We dont want to error our if the file does not exist when we start the server
 		}
-		return err
-	}
-
-	s.Lock()
-	defer s.Unlock()
-	jsonParser := json.NewDecoder(configFile)
-	if err = jsonParser.Decode(&s.tasks); err != nil {
 		return fmt.Errorf("scheduler: error loading tasks: %s", err)
 	}
 
@@ -164,6 +268,7 @@ func (s *Scheduler) syncTaskDependencies() {
 			task.savedStateStore = s.SavedStateStore
 		}
 		task.logic = s.logic
+		task.onRun = s.taskRun
 		task.Unlock()
 
 		// generate uuid if missing
@@ -175,11 +280,87 @@ func (s *Scheduler) syncTaskDependencies() {
 }
 
 func (s *Scheduler) ScheduleTask(t *Task) {
-	var err error
 	t.Lock()
-	t.cronID, err = s.Cron.AddJob(t.When, t)
+	defer t.Unlock()
+	schedule, err := s.parseSchedule(t.When, t.Timezone)
 	if err != nil {
+		t.cronID = -1
+		t.schedule = nil
+		t.NextRuns = nil
 		logrus.Error(err)
+		return
+	}
+	t.schedule = schedule
+	t.NextRuns = nextRuns(schedule, time.Now(), nextRunsPreview)
+	if t.Jitter > 0 {
+		schedule = &jitterSchedule{schedule: schedule, jitter: time.Duration(t.Jitter)}
+	}
+	t.cronID = atomic.AddInt64(&s.lastCronID, 1)
+	s.Cron.Schedule(schedule, t, t.cronID)
+}
+
+// parseSchedule parses sun schedules like sunset-15m or a cron spec in the timezone.
+func (s *Scheduler) parseSchedule(spec, timezone string) (cron.Schedule, error) {
+	location := time.Local
+	if timezone != "" {
+		var err error
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("scheduler: invalid timezone %s: %w", timezone, err)
+		}
+	}
+
+	var calendar *Calendar
+	if s.logic != nil {
+		calendar = s.logic.Calendar()
+	}
+	sun, ok, err := parseSunSchedule(spec, calendar)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return &locationSchedule{schedule: sun, location: location}, nil
+	}
+
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &locationSchedule{schedule: schedule, location: location}, nil
+}
+
+// locationSchedule calculates the next run in location so DST changes follows the timezone of the task.
+type locationSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+}
+
+func (s *locationSchedule) Next(t time.Time) time.Time {
+	return s.schedule.Next(t.In(s.location))
+}
+
+// jitterSchedule delays each run with a random duration up to jitter. The jitter should be shorter than the time between runs.
+type jitterSchedule struct {
+	schedule cron.Schedule
+	jitter   time.Duration
+}
+
+func (s *jitterSchedule) Next(t time.Time) time.Time {
+	next := s.schedule.Next(t)
+	if next.IsZero() {
+		return next
+	}
+	return next.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+}
+
+func nextRuns(schedule cron.Schedule, from time.Time, n int) []time.Time {
+	runs := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		from = schedule.Next(from)
+		if from.IsZero() {
+			break
+		}
+		runs = append(runs, from)
 	}
-	t.Unlock()
+	return runs
 }
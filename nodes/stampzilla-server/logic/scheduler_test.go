@@ -2,6 +2,7 @@ package logic
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -141,3 +142,144 @@ func TestSchedulerRunTaskWithExpression(t *testing.T) {
 	cancel()
 	l.Wait()
 }
+
+func TestSchedulerTimezone(t *testing.T) {
+	scheduler := NewScheduler(NewSavedStateStore(), NewMockSender(), nil)
+
+	task := scheduler.AddTask("Test1")
+	task.SetWhen("0 0 3 * * *")
+	task.Timezone = "America/New_York"
+	scheduler.ScheduleTask(task)
+
+	ny, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+	assert.Len(t, task.NextRuns, nextRunsPreview)
+	for _, run := range task.NextRuns {
+		run = run.In(ny)
+		assert.Equal(t, 3, run.Hour())
+		assert.Equal(t, 0, run.Minute())
+	}
+
+	task = scheduler.AddTask("Test2")
+	task.SetWhen("0 0 3 * * *")
+	task.Timezone = "Not/AZone"
+	scheduler.ScheduleTask(task)
+	assert.Equal(t, int64(-1), task.CronId())
+	assert.Empty(t, task.NextRuns)
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	base, err := (&Scheduler{}).parseSchedule("0 0 3 * * *", "")
+	assert.NoError(t, err)
+	s := &jitterSchedule{schedule: base, jitter: time.Hour}
+
+	now := time.Now()
+	expected := base.Next(now)
+	for i := 0; i < 20; i++ {
+		next := s.Next(now)
+		assert.False(t, next.Before(expected))
+		assert.True(t, next.Before(expected.Add(time.Hour)))
+	}
+}
+
+func TestSchedulerCatchUp(t *testing.T) {
+	syncer := NewMockSender()
+	savedState := NewSavedStateStore()
+	savedState.State["uuid"] = &SavedState{
+		Name: "testname",
+		UUID: "uuid",
+		State: map[devices.ID]devices.State{
+			{Node: "node", ID: "id1"}: {
+				"a": 1,
+			},
+		},
+	}
+	scheduler := NewScheduler(savedState, syncer, New(savedState, syncer))
+	ran := make(chan *Task, 2)
+	scheduler.OnTaskRun(func(t *Task) {
+		ran <- t
+	})
+
+	missed := scheduler.AddTask("missed")
+	missed.AddAction("uuid")
+	missed.SetWhen("0 0 3 * * *")
+	missed.Enabled = true
+	missed.CatchUp = true
+	missed.LastRun = time.Now().Add(-48 * time.Hour)
+	scheduler.ScheduleTask(missed)
+
+	// Did not miss anything
+	notMissed := scheduler.AddTask("not missed")
+	notMissed.AddAction("uuid")
+	notMissed.SetWhen("0 0 3 * * *")
+	notMissed.Enabled = true
+	notMissed.CatchUp = true
+	notMissed.LastRun = time.Now()
+	scheduler.ScheduleTask(notMissed)
+
+	// Missed but catch up is not enabled
+	noCatchUp := scheduler.AddTask("no catch up")
+	noCatchUp.AddAction("uuid")
+	noCatchUp.SetWhen("0 0 3 * * *")
+	noCatchUp.Enabled = true
+	noCatchUp.LastRun = time.Now().Add(-48 * time.Hour)
+	scheduler.ScheduleTask(noCatchUp)
+
+	// Missed tasks wait for their devices to be online
+	var online int32
+	scheduler.OnlineCheck(func(id devices.ID) bool {
+		return atomic.LoadInt32(&online) == 1
+	})
+	scheduler.catchUpPoll = 5 * time.Millisecond
+	scheduler.catchUp(context.Background(), time.Now())
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Len(t, ran, 0)
+	atomic.StoreInt32(&online, 1)
+
+	select {
+	case task := <-ran:
+		assert.Equal(t, missed, task)
+	case <-time.After(time.Second):
+		t.Fatal("missed task was not run")
+	}
+	assert.Equal(t, int64(1), syncer.Count())
+	assert.WithinDuration(t, time.Now(), missed.LastRun, time.Second)
+	assert.Len(t, ran, 0)
+}
+
+func TestTaskRunSkippedDoesNotUpdateLastRun(t *testing.T) {
+	syncer := NewMockSender()
+	savedState := NewSavedStateStore()
+	savedState.State["uuid"] = &SavedState{
+		UUID:  "uuid",
+		State: map[devices.ID]devices.State{{Node: "node", ID: "id1"}: {"a": 1}},
+	}
+	scheduler := NewScheduler(savedState, syncer, New(savedState, syncer))
+	runs := 0
+	scheduler.OnTaskRun(func(*Task) {
+		runs++
+	})
+
+	task := scheduler.AddTask("task")
+	task.SetWhen("0 0 3 * * *")
+	task.AddAction("uuid")
+	scheduler.ScheduleTask(task)
+
+	// Disabled
+	task.Run()
+	assert.True(t, task.LastRun.IsZero())
+
+	// Missing saved state
+	task.Enabled = true
+	task.Actions = []string{"missing"}
+	task.Run()
+	assert.True(t, task.LastRun.IsZero())
+	assert.Equal(t, 0, runs)
+
+	task.Actions = []string{"uuid"}
+	task.Run()
+	assert.False(t, task.LastRun.IsZero())
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, int64(1), syncer.Count())
+}
@@ -0,0 +1,377 @@
+package logic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+const (
+	// statsBufferSize is the max number of values kept for each device key.
+	statsBufferSize = 512
+	// statsMaxAge is the longest window the statistics functions can look back.
+	statsMaxAge = 24 * time.Hour
+)
+
+// statsFunctions are the cel functions that need recorded values. The first two arguments are the device and key.
+var statsFunctions = map[string]bool{
+	"avg":        true,
+	"min":        true,
+	"max":        true,
+	"delta":      true,
+	"count_true": true,
+	"time_true":  true,
+	"time_above": true,
+}
+
+// sample is a value that a device key got at a time. Bools are stored as 1 and 0.
+type sample struct {
+	t time.Time
+	v float64
+}
+
+// ringBuffer is a bounded list of samples ordered by time. The oldest sample is overwritten when it is full.
+type ringBuffer struct {
+	samples []sample
+	start   int
+	size    int
+}
+
+func newRingBuffer(n int) *ringBuffer {
+	return &ringBuffer{samples: make([]sample, n)}
+}
+
+func (rb *ringBuffer) at(i int) sample {
+	return rb.samples[(rb.start+i)%len(rb.samples)]
+}
+
+func (rb *ringBuffer) add(s sample) {
+	if rb.size < len(rb.samples) {
+		rb.samples[(rb.start+rb.size)%len(rb.samples)] = s
+		rb.size++
+		return
+	}
+	rb.samples[rb.start] = s
+	rb.start = (rb.start + 1) % len(rb.samples)
+}
+
+func (rb *ringBuffer) last() (sample, bool) {
+	if rb.size == 0 {
+		return sample{}, false
+	}
+	return rb.at(rb.size - 1), true
+}
+
+// prune removes samples older than before. The newest of them is kept since it is the value at before.
+func (rb *ringBuffer) prune(before time.Time) {
+	for rb.size > 1 && !rb.at(1).t.After(before) {
+		rb.start = (rb.start + 1) % len(rb.samples)
+		rb.size--
+	}
+}
+
+// window returns the samples that are in effect after from. The first one can be older than from.
+func (rb *ringBuffer) window(from time.Time) []sample {
+	first := 0
+	for i := 0; i < rb.size; i++ {
+		if rb.at(i).t.After(from) {
+			break
+		}
+		first = i
+	}
+	list := make([]sample, 0, rb.size-first)
+	for i := first; i < rb.size; i++ {
+		list = append(list, rb.at(i))
+	}
+	return list
+}
+
+type statsKey struct {
+	id  devices.ID
+	key string
+}
+
+// deviceStats records recent values of the device keys that are used by the statistics functions in the rules.
+type deviceStats struct {
+	buffers map[statsKey]*ringBuffer
+	// keys caches the keys used by an expression
+	keys map[string][]statsKey
+	sync.RWMutex
+}
+
+func newDeviceStats() *deviceStats {
+	return &deviceStats{
+		buffers: make(map[statsKey]*ringBuffer),
+		keys:    make(map[string][]statsKey),
+	}
+}
+
+// keysFor returns the device keys that the expression uses in statistics functions.
+func (ds *deviceStats) keysFor(exp string) []statsKey {
+	ds.RLock()
+	keys, ok := ds.keys[exp]
+	ds.RUnlock()
+	if ok {
+		return keys
+	}
+
+	keys = []statsKey{}
+	if ast, iss := celEnv.Parse(exp); iss.Err() == nil {
+		walkExpr(ast.Expr(), func(expr *exprpb.Expr) {
+			call := expr.GetCallExpr()
+			if call == nil || !statsFunctions[call.GetFunction()] || len(call.GetArgs()) < 2 {
+				return
+			}
+			dev := call.GetArgs()[0].GetConstExpr().GetStringValue()
+			key := call.GetArgs()[1].GetConstExpr().GetStringValue()
+			id, err := devices.NewIDFromString(dev)
+			if err != nil || key == "" {
+				return
+			}
+			keys = append(keys, statsKey{id: id, key: key})
+		})
+	}
+
+	ds.Lock()
+	ds.keys[exp] = keys
+	ds.Unlock()
+	return keys
+}
+
+// record adds the values in state for the keys in watched. Buffers of keys that are no longer watched are removed.
+func (ds *deviceStats) record(id devices.ID, state devices.State, now time.Time, watched map[statsKey]bool) {
+	ds.Lock()
+	defer ds.Unlock()
+
+	for k := range ds.buffers {
+		if !watched[k] {
+			delete(ds.buffers, k)
+		}
+	}
+
+	for k := range watched {
+		if k.id != id {
+			continue
+		}
+		v, ok := sampleValue(state[k.key])
+		if !ok {
+			continue
+		}
+		rb := ds.buffers[k]
+		if rb == nil {
+			rb = newRingBuffer(statsBufferSize)
+			ds.buffers[k] = rb
+		}
+		if last, ok := rb.last(); ok && last.v == v {
+			continue
+		}
+		rb.add(sample{t: now, v: v})
+		rb.prune(now.Add(-statsMaxAge))
+	}
+}
+
+func (ds *deviceStats) window(k statsKey, from time.Time) []sample {
+	ds.RLock()
+	defer ds.RUnlock()
+	if rb := ds.buffers[k]; rb != nil {
+		return rb.window(from)
+	}
+	return nil
+}
+
+func sampleValue(v interface{}) (float64, bool) {
+	if b, ok := v.(bool); ok {
+		if b {
+			return 1, true
+		}
+		return 0, true
+	}
+	return toFloat(v)
+}
+
+// statsKeys returns the device keys used by statistics functions in the enabled rules.
+func (l *Logic) statsKeys() map[statsKey]bool {
+	l.RLock()
+	defer l.RUnlock()
+	watched := make(map[statsKey]bool)
+	for _, r := range l.Rules {
+		r.RLock()
+		enabled, exp := r.Enabled, r.Expression_
+		r.RUnlock()
+		if !enabled {
+			continue
+		}
+		for _, k := range l.stats.keysFor(exp) {
+			watched[k] = true
+		}
+	}
+	return watched
+}
+
+// segment is the time a sample was in effect within a window.
+type segment struct {
+	v float64
+	d time.Duration
+}
+
+// segments splits the window from..now into the time each sample was in effect.
+func segments(samples []sample, from, now time.Time) []segment {
+	list := make([]segment, 0, len(samples))
+	for i, s := range samples {
+		start := s.t
+		if start.Before(from) {
+			start = from
+		}
+		end := now
+		if i+1 < len(samples) {
+			end = samples[i+1].t
+		}
+		list = append(list, segment{v: s.v, d: end.Sub(start)})
+	}
+	return list
+}
+
+// celFunctions returns the cel implementations of the statistics functions. ds can be nil if nothing is recorded.
+// If a key has no recorded values the current value of the device is used.
+func (ds *deviceStats) celFunctions(devs *devices.List) []*functions.Overload {
+	window := func(args []ref.Val) ([]sample, time.Time, time.Time, ref.Val) {
+		id, err := devices.NewIDFromString(fmt.Sprint(args[0].Value()))
+		if err != nil {
+			return nil, time.Time{}, time.Time{}, types.NewErr(err.Error())
+		}
+		key := fmt.Sprint(args[1].Value())
+		d, ok := args[len(args)-1].(types.Duration)
+		if !ok {
+			return nil, time.Time{}, time.Time{}, types.NewErr("window must be a duration")
+		}
+		now := time.Now()
+		from := now.Add(-d.Duration)
+
+		var samples []sample
+		if ds != nil {
+			samples = ds.window(statsKey{id: id, key: key}, from)
+		}
+		if len(samples) == 0 {
+			if dev := devs.Get(id); dev != nil {
+				dev.RLock()
+				v, ok := sampleValue(dev.State[key])
+				dev.RUnlock()
+				if ok {
+					samples = []sample{{t: from, v: v}}
+				}
+			}
+		}
+		if len(samples) == 0 {
+			return nil, from, now, types.NewErr("no values for %s.%s", id.String(), key)
+		}
+		return samples, from, now, nil
+	}
+
+	aggregate := func(fn func(samples []sample, from, now time.Time) ref.Val) func(args ...ref.Val) ref.Val {
+		return func(args ...ref.Val) ref.Val {
+			samples, from, now, err := window(args)
+			if err != nil {
+				return err
+			}
+			return fn(samples, from, now)
+		}
+	}
+
+	return []*functions.Overload{
+		{
+			Operator: "avg_string_string_duration",
+			Function: aggregate(func(samples []sample, from, now time.Time) ref.Val {
+				var sum float64
+				var total time.Duration
+				for _, s := range segments(samples, from, now) {
+					sum += s.v * float64(s.d)
+					total += s.d
+				}
+				if total <= 0 {
+					return types.Double(samples[len(samples)-1].v)
+				}
+				return types.Double(sum / float64(total))
+			}),
+		},
+		{
+			Operator: "min_string_string_duration",
+			Function: aggregate(func(samples []sample, from, now time.Time) ref.Val {
+				v := samples[0].v
+				for _, s := range samples {
+					if s.v < v {
+						v = s.v
+					}
+				}
+				return types.Double(v)
+			}),
+		},
+		{
+			Operator: "max_string_string_duration",
+			Function: aggregate(func(samples []sample, from, now time.Time) ref.Val {
+				v := samples[0].v
+				for _, s := range samples {
+					if s.v > v {
+						v = s.v
+					}
+				}
+				return types.Double(v)
+			}),
+		},
+		{
+			Operator: "delta_string_string_duration",
+			Function: aggregate(func(samples []sample, from, now time.Time) ref.Val {
+				return types.Double(samples[len(samples)-1].v - samples[0].v)
+			}),
+		},
+		{
+			Operator: "count_true_string_string_duration",
+			Function: aggregate(func(samples []sample, from, now time.Time) ref.Val {
+				count := 0
+				for _, s := range samples {
+					if s.t.After(from) && s.v != 0 {
+						count++
+					}
+				}
+				return types.Int(count)
+			}),
+		},
+		{
+			Operator: "time_true_string_string_duration",
+			Function: aggregate(func(samples []sample, from, now time.Time) ref.Val {
+				var d time.Duration
+				for _, s := range segments(samples, from, now) {
+					if s.v != 0 {
+						d += s.d
+					}
+				}
+				return types.Duration{Duration: d}
+			}),
+		},
+		{
+			Operator: "time_above_string_string_double_duration",
+			Function: func(args ...ref.Val) ref.Val {
+				samples, from, now, err := window(args)
+				if err != nil {
+					return err
+				}
+				threshold, ok := args[2].(types.Double)
+				if !ok {
+					return types.NewErr("threshold must be a double")
+				}
+				var d time.Duration
+				for _, s := range segments(samples, from, now) {
+					if s.v > float64(threshold) {
+						d += s.d
+					}
+				}
+				return types.Duration{Duration: d}
+			},
+		},
+	}
+}
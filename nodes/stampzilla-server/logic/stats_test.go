@@ -0,0 +1,98 @@
+package logic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingBufferIsBounded(t *testing.T) {
+	rb := newRingBuffer(3)
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		rb.add(sample{t: now.Add(time.Duration(i) * time.Minute), v: float64(i)})
+	}
+	assert.Equal(t, 3, rb.size)
+	assert.Equal(t, 2.0, rb.at(0).v)
+	last, _ := rb.last()
+	assert.Equal(t, 4.0, last.v)
+
+	// The value in effect at the start of the window is included
+	w := rb.window(now.Add(3*time.Minute + time.Second))
+	assert.Equal(t, []float64{3, 4}, []float64{w[0].v, w[1].v})
+
+	rb.prune(now.Add(4 * time.Minute))
+	assert.Equal(t, 1, rb.size)
+}
+
+func TestStatsKeysFromRules(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	r := l.AddRule("test")
+	r.Enabled = true
+	r.Expression_ = `avg("node.1", "temperature", duration("30m")) > 24.0 && devices["node.2"].on`
+	disabled := l.AddRule("disabled")
+	disabled.Expression_ = `max("node.3", "power", duration("1m")) > 1.0`
+
+	assert.Equal(t, map[statsKey]bool{
+		{id: devices.ID{Node: "node", ID: "1"}, key: "temperature"}: true,
+	}, l.statsKeys())
+}
+
+func TestStatsFunctions(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	r := l.AddRule("test")
+	r.Enabled = true
+	r.Expression_ = `avg("node.1", "power", duration("15m")) > 0.0 && count_true("node.1", "on", duration("15m")) > 0`
+	watched := l.statsKeys()
+	id := devices.ID{Node: "node", ID: "1"}
+
+	now := time.Now()
+	l.stats.record(id, devices.State{"power": 1000.0, "on": false}, now.Add(-20*time.Minute), watched)
+	l.stats.record(id, devices.State{"power": 3000.0, "on": true}, now.Add(-10*time.Minute), watched)
+	l.stats.record(id, devices.State{"power": 1000.0, "on": false}, now.Add(-5*time.Minute), watched)
+	l.devices.Add(&devices.Device{ID: id, State: devices.State{"power": 1000.0, "on": false, "temperature": 20.0}})
+
+	value := func(exp string) interface{} {
+		result, err := evalValue(exp, l.devices, nil, l.evalState(), nil)
+		assert.NoError(t, err)
+		return explainValue(result)
+	}
+
+	avg := value(`avg("node.1", "power", duration("15m"))`).(float64)
+	assert.InDelta(t, 1666.6, avg, 1)
+	assert.Equal(t, 1000.0, value(`min("node.1", "power", duration("15m"))`))
+	assert.Equal(t, 3000.0, value(`max("node.1", "power", duration("15m"))`))
+	assert.Equal(t, 0.0, value(`delta("node.1", "power", duration("15m"))`))
+	assert.Equal(t, -2000.0, value(`delta("node.1", "power", duration("7m"))`))
+	assert.Equal(t, int64(1), value(`count_true("node.1", "on", duration("15m"))`))
+	assert.Equal(t, true, value(`time_true("node.1", "on", duration("15m")) >= duration("5m")`))
+	assert.Equal(t, true, value(`time_above("node.1", "power", 2000.0, duration("15m")) < duration("6m")`))
+
+	// Keys that are not recorded uses the current value
+	assert.Equal(t, 20.0, value(`avg("node.1", "temperature", duration("15m"))`))
+	_, err := evalValue(`avg("node.2", "power", duration("15m")) > 0.0`, l.devices, nil, l.evalState(), nil)
+	assert.EqualError(t, err, "no values for node.2.power")
+}
+
+func TestStatsRuleEvaluatedOnTick(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	r := l.AddRule("test")
+	r.Enabled = true
+	r.Expression_ = `time_above("node.meter", "power", 2000.0, duration("15m")) > duration("100ms")`
+	assert.True(t, l.usesTime())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l.Start(ctx)
+	l.UpdateDevice(&devices.Device{
+		ID:    devices.ID{Node: "node", ID: "meter"},
+		State: devices.State{"power": 3000.0},
+	})
+
+	// The meter reports a constant value so only the tick can make the rule active
+	assert.Eventually(t, r.Active, 3*time.Second, 50*time.Millisecond)
+	cancel()
+	l.Wait()
+}
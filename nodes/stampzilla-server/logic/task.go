@@ -2,11 +2,14 @@ package logic
 
 import (
 	"sync"
+	"time"
 
 	"github.com/google/cel-go/cel"
+	"github.com/jonaz/cron"
 	"github.com/sirupsen/logrus"
-	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/audit"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
 )
 
 // Task is a task that can be scheduled using scheduler.
@@ -18,8 +21,19 @@ type Task struct {
 	When        string `json:"when"`
 	Enabled     bool   `json:"enabled"`
 	Expression_ string `json:"expression"`
-	logic       *Logic
-	ast         *cel.Ast
+	// Timezone is the IANA name of the timezone When is in. Defaults to the timezone of the server.
+	Timezone string `json:"timezone,omitempty"`
+	// Jitter delays each run with a random duration between 0 and Jitter.
+	Jitter stypes.Duration `json:"jitter,omitempty"`
+	// CatchUp runs the task when the server starts if it missed a run while the server was down.
+	CatchUp bool      `json:"catchUp,omitempty"`
+	LastRun time.Time `json:"lastRun,omitempty"`
+	// NextRuns is a preview of the next runs without jitter.
+	NextRuns []time.Time `json:"nextRuns,omitempty"`
+	logic    *Logic
+	ast      *cel.Ast
+	schedule cron.Schedule
+	onRun    func(*Task)
 	sync.RWMutex
 	savedStateStore *SavedStateStore
 	sender          websocket.Sender
@@ -32,7 +46,7 @@ func (t *Task) SetUuid(uuid string) {
 	t.Unlock()
 }
 
-// SetWhen sets when the task should be run in cron syntax.
+// SetWhen sets when the task should be run in cron syntax or as sunrise/sunset with an optional offset.
 func (t *Task) SetWhen(when string) {
 	t.Lock()
 	t.When = when
@@ -63,12 +77,36 @@ func (t *Task) CronId() int64 {
 	return t.cronID
 }
 
+// Run runs the task and updates LastRun and NextRuns if it ran.
 func (t *Task) Run() {
+	if !t.run() {
+		return
+	}
+
+	t.Lock()
+	t.LastRun = time.Now()
+	if t.schedule != nil {
+		t.NextRuns = nextRuns(t.schedule, t.LastRun, nextRunsPreview)
+	}
+	onRun := t.onRun
+	t.Unlock()
+
+	if onRun != nil {
+		onRun(t)
+	}
+}
+
+// run sends the state changes of the actions. It returns false if the task was skipped.
+func (t *Task) run() bool {
 	t.RLock()
 	defer t.RUnlock()
 	if !t.Enabled {
-		logrus.Debugf("logic: scheduledtask %s (%s) not enabled. skipping", t.Name(), t.Uuid())
-		return
+		logrus.Debugf("logic: scheduledtask %s (%s) not enabled. skipping", t.XName, t.XUuid)
+		return false
+	}
+	if t.logic != nil && t.logic.Overrides.TaskSuspended(t.XUuid, time.Now()) {
+		logrus.Debugf("logic: scheduledtask %s (%s) is suspended by an override. skipping", t.XName, t.XUuid)
+		return false
 	}
 
 	if exp := t.Expression(); exp != "" {
@@ -76,40 +114,31 @@ func (t *Task) Run() {
 		for _, v := range t.logic.Rules {
 			rules[v.Uuid()] = v.Active()
 		}
-		b, err := eval(exp, t.logic.devices, nil, t.ast)
+		b, err := eval(exp, t.logic.devices, nil, t.logic.evalState(), t.ast)
 		if err != nil {
 			logrus.Error(err)
-			return
+			return false
 		}
 		if !b {
-			return
+			return false
 		}
 	}
 
+	ran := false
 	for _, id := range t.Actions {
 		stateList := t.savedStateStore.Get(id)
 		if stateList == nil {
 			logrus.Errorf("SavedState %s does not exist", id)
-			return
-		}
-		devicesByNode := make(map[string]map[devices.ID]devices.State)
-		for id, state := range stateList.State {
-			if devicesByNode[id.Node] == nil {
-				devicesByNode[id.Node] = make(map[devices.ID]devices.State)
-			}
-			devicesByNode[id.Node][id] = state
+			return ran
 		}
-		for nodeID, devs := range devicesByNode {
-			logrus.WithFields(logrus.Fields{
-				"to": nodeID,
-			}).Debug("Send state change request to node")
-			err := t.sender.SendToID(nodeID, "state-change", devs)
-			if err != nil {
-				logrus.Error("logic: error sending state-change to node: ", err)
-				continue
-			}
+		ran = true
+		if t.logic != nil {
+			t.logic.changeStateFrom(audit.OriginSchedule, t.XUuid, nil, stateList.State)
+			continue
 		}
+		sendStateChange(t.sender, stateList.State)
 	}
+	return ran
 }
 
 func (t *Task) AddAction(uuid string) {
@@ -0,0 +1,214 @@
+package logic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// stateTracker keeps the previous value and the time of the last change for every device state key.
+type stateTracker struct {
+	previous  map[devices.ID]devices.State
+	changedAt map[devices.ID]map[string]time.Time
+	// changed contains the keys that changed in the latest update. Used for edge triggered expressions.
+	changed map[devices.ID]map[string]bool
+	// timed caches if the expressions of the enabled rules call a time function.
+	timed map[string]bool
+	sync.RWMutex
+}
+
+// timeFunctions are the cel functions that can return a new result without any device update.
+// The statistics functions are included as well since their window moves with time.
+var timeFunctions = map[string]bool{
+	"since": true,
+}
+
+func newStateTracker() *stateTracker {
+	return &stateTracker{
+		previous:  make(map[devices.ID]devices.State),
+		changedAt: make(map[devices.ID]map[string]time.Time),
+		changed:   make(map[devices.ID]map[string]bool),
+		timed:     make(map[string]bool),
+	}
+}
+
+// anyTimed returns true if any of the expressions calls a time function.
+// Only the given expressions are kept in the cache.
+func (st *stateTracker) anyTimed(expressions []string) bool {
+	st.Lock()
+	defer st.Unlock()
+	timed := make(map[string]bool, len(expressions))
+	result := false
+	for _, exp := range expressions {
+		v, ok := st.timed[exp]
+		if !ok {
+			v = callsTimeFunction(exp)
+		}
+		timed[exp] = v
+		result = result || v
+	}
+	st.timed = timed
+	return result
+}
+
+func callsTimeFunction(exp string) bool {
+	ast, iss := celEnv.Parse(exp)
+	if iss.Err() != nil {
+		return false
+	}
+	found := false
+	walkExpr(ast.Expr(), func(expr *exprpb.Expr) {
+		if call := expr.GetCallExpr(); call != nil && (timeFunctions[call.GetFunction()] || statsFunctions[call.GetFunction()]) {
+			found = true
+		}
+	})
+	return found
+}
+
+// update records the change from oldState to newState. oldState is nil for new devices.
+func (st *stateTracker) update(id devices.ID, oldState, newState devices.State, now time.Time) {
+	st.Lock()
+	defer st.Unlock()
+
+	st.changed = make(map[devices.ID]map[string]bool)
+	if st.changedAt[id] == nil {
+		st.changedAt[id] = make(map[string]time.Time)
+	}
+
+	if oldState == nil {
+		for k := range newState {
+			st.changedAt[id][k] = now
+		}
+		return
+	}
+
+	diff := oldState.Diff(newState)
+	if len(diff) == 0 {
+		return
+	}
+
+	if st.previous[id] == nil {
+		st.previous[id] = make(devices.State)
+	}
+	st.changed[id] = make(map[string]bool)
+	for k := range diff {
+		if v, ok := oldState[k]; ok {
+			st.previous[id][k] = v
+		}
+		st.changedAt[id][k] = now
+		st.changed[id][k] = true
+	}
+}
+
+// clearChanged resets the edge triggered changes after all rules have been evaluated.
+func (st *stateTracker) clearChanged() {
+	st.Lock()
+	st.changed = make(map[devices.ID]map[string]bool)
+	st.Unlock()
+}
+
+// previousState returns the previous values of all devices in the same format as the devices variable in cel.
+func (st *stateTracker) previousState() map[string]map[string]interface{} {
+	st.RLock()
+	defer st.RUnlock()
+	state := make(map[string]map[string]interface{})
+	for id, s := range st.previous {
+		state[id.String()] = s.Clone()
+	}
+	return state
+}
+
+func (st *stateTracker) isChanged(id devices.ID, key string) bool {
+	st.RLock()
+	defer st.RUnlock()
+	return st.changed[id][key]
+}
+
+func (st *stateTracker) previousValue(id devices.ID, key string) (interface{}, bool) {
+	st.RLock()
+	defer st.RUnlock()
+	v, ok := st.previous[id][key]
+	return v, ok
+}
+
+func (st *stateTracker) since(id devices.ID, key string, now time.Time) (time.Duration, bool) {
+	st.RLock()
+	defer st.RUnlock()
+	t, ok := st.changedAt[id][key]
+	if !ok {
+		return 0, false
+	}
+	return now.Sub(t), true
+}
+
+// celFunctions returns the cel implementations of changed, previous and since. st can be nil if no history is available.
+func (st *stateTracker) celFunctions(devs *devices.List) []*functions.Overload {
+	parse := func(dev, key ref.Val) (devices.ID, string, ref.Val) {
+		id, err := devices.NewIDFromString(fmt.Sprint(dev.Value()))
+		if err != nil {
+			return id, "", types.NewErr(err.Error())
+		}
+		return id, fmt.Sprint(key.Value()), nil
+	}
+
+	return []*functions.Overload{
+		{
+			Operator: "changed_string_string",
+			Binary: func(dev ref.Val, key ref.Val) ref.Val {
+				id, k, err := parse(dev, key)
+				if err != nil {
+					return err
+				}
+				return types.Bool(st != nil && st.isChanged(id, k))
+			},
+		},
+		{
+			Operator: "previous_string_string",
+			Binary: func(dev ref.Val, key ref.Val) ref.Val {
+				id, k, err := parse(dev, key)
+				if err != nil {
+					return err
+				}
+				if st != nil {
+					if v, ok := st.previousValue(id, k); ok {
+						return types.DefaultTypeAdapter.NativeToValue(v)
+					}
+				}
+
+				// Never changed, so the previous value is the current one
+				if d := devs.Get(id); d != nil {
+					d.RLock()
+					v, ok := d.State[k]
+					d.RUnlock()
+					if ok {
+						return types.DefaultTypeAdapter.NativeToValue(v)
+					}
+				}
+				return types.NewErr("no such key: %s", k)
+			},
+		},
+		{
+			Operator: "since_string_string",
+			Binary: func(dev ref.Val, key ref.Val) ref.Val {
+				id, k, err := parse(dev, key)
+				if err != nil {
+					return err
+				}
+				if st == nil {
+					return types.NewErr("no such key: %s", k)
+				}
+				d, ok := st.since(id, k, time.Now())
+				if !ok {
+					return types.NewErr("no such key: %s", k)
+				}
+				return types.Duration{Duration: d}
+			},
+		},
+	}
+}
@@ -0,0 +1,96 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateTrackerFunctions(t *testing.T) {
+	l := New(NewSavedStateStore(), NewMockSender())
+	id := devices.ID{Node: "node", ID: "id"}
+
+	l.updateDevice(&devices.Device{
+		ID: id,
+		State: devices.State{
+			"on":          false,
+			"temperature": 20.0,
+		},
+	})
+
+	tests := []struct {
+		Expression string
+		Expected   bool
+	}{
+		{`changed("node.id", "on")`, false},
+		{`previous("node.id", "temperature") == 20.0`, true},
+		{`since("node.id", "on") < duration("1m")`, true},
+	}
+	for _, v := range tests {
+		result, err := eval(v.Expression, l.devices, nil, l.evalState(), nil)
+		assert.NoError(t, err, v.Expression)
+		assert.Equal(t, v.Expected, result, v.Expression)
+	}
+
+	l.updateDevice(&devices.Device{
+		ID: id,
+		State: devices.State{
+			"on":          true,
+			"temperature": 22.5,
+		},
+	})
+
+	tests = []struct {
+		Expression string
+		Expected   bool
+	}{
+		{`changed("node.id", "on")`, true},
+		{`changed("node.id", "on") && devices["node.id"].on == true`, true},
+		{`devices["node.id"].temperature - previous("node.id", "temperature") >= 2.0`, true},
+		{`previous["node.id"].on == false`, true},
+	}
+	for _, v := range tests {
+		result, err := eval(v.Expression, l.devices, nil, l.evalState(), nil)
+		assert.NoError(t, err, v.Expression)
+		assert.Equal(t, v.Expected, result, v.Expression)
+	}
+
+	// Edge triggers are only true for the evaluation after the change
+	l.tracker.clearChanged()
+	result, err := eval(`changed("node.id", "on")`, l.devices, nil, l.evalState(), nil)
+	assert.NoError(t, err)
+	assert.False(t, result)
+
+	_, err = eval(`since("node.id", "missing") > duration("1s")`, l.devices, nil, l.evalState(), nil)
+	assert.Error(t, err)
+}
+
+func TestStateTrackerSince(t *testing.T) {
+	st := newStateTracker()
+	id := devices.ID{Node: "node", ID: "id"}
+	now := time.Now()
+
+	st.update(id, nil, devices.State{"on": false}, now.Add(-time.Hour))
+	st.update(id, devices.State{"on": false}, devices.State{"on": false}, now.Add(-time.Minute))
+
+	d, ok := st.since(id, "on", now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Hour, d)
+
+	st.update(id, devices.State{"on": false}, devices.State{"on": true}, now.Add(-time.Minute))
+	d, ok = st.since(id, "on", now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, d)
+}
+
+func TestStateTrackerAnyTimed(t *testing.T) {
+	st := newStateTracker()
+	assert.False(t, st.anyTimed([]string{`devices["node.id"].on`}))
+	assert.True(t, st.anyTimed([]string{`devices["node.id"].on`, `since("node.id", "on") > duration("1m")`}))
+
+	// Expressions of removed rules are not kept
+	assert.False(t, st.anyTimed([]string{`devices["node.id"].on`}))
+	assert.Len(t, st.timed, 1)
+}
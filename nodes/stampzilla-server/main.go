@@ -3,8 +3,13 @@ package main
 
 import (
 	"fmt"
+	"os"
 
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/backup"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist/boltdb"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/servermain"
 
 	// Statik for the webserver gui.
@@ -21,7 +26,52 @@ func main() {
 		return
 	}
 
+	b, err := openStorage(config.Storage, config.StoragePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer b.Close()
+	persist.SetBackend(b)
+
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		if err := backup.Command(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if n, err := backup.MigrateFiles(".", b); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	} else if n > 0 {
+		logrus.Infof("Migrated %d json files to %s storage", n, config.Storage)
+	}
+
+	// A backup imported while the server was running is applied before anything is loaded
+	applied, err := backup.ApplyPending()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if applied {
+		config = &models.Config{}
+		config.MustLoad()
+	}
+
 	server := servermain.New(config)
 	server.Init()
 	server.Run()
 }
+
+// openStorage returns the backend of a kind. kind is "file" or "bolt". path is the database file of the bolt backend.
+func openStorage(kind, path string) (persist.Backend, error) {
+	switch kind {
+	case "", "file":
+		return persist.NewFileBackend("."), nil
+	case "bolt":
+		return boltdb.New(path)
+	}
+	return nil, fmt.Errorf("unknown storage %s", kind)
+}
@@ -1,13 +1,12 @@
 package models
 
 import (
-	"bytes"
-	"encoding/json"
 	"os"
 
 	"github.com/google/uuid"
 	"github.com/koding/multiconfig"
 	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
 )
 
 // Config is the main server configuration.
@@ -27,23 +26,62 @@ type Config struct {
 
 	// ProxyTLSPort is used to signal the insecurewebsocket port to advertise a tlsport on a proxy
 	ProxyTLSPort string `json:"proxyTLSPort"`
+
+	// HistoryRetention is how long device state history is kept on disk. Empty or 0 disables the history.
+	HistoryRetention string `json:"historyRetention" default:"720h"`
+	// HistoryDownsampleAfter is the age when history values are aggregated into HistoryDownsampleInterval buckets.
+	HistoryDownsampleAfter    string `json:"historyDownsampleAfter" default:"168h"`
+	HistoryDownsampleInterval string `json:"historyDownsampleInterval" default:"5m"`
+
+	// Latitude and Longitude are used to calculate sunrise and sunset in rules and scheduled tasks.
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Holidays is a list of dates as 2006-01-02 or 01-02 for holidays that repeats every year. Used by isHoliday() in rules.
+	Holidays []string `json:"holidays"`
+
+	// AuditRetention is how long the audit log of user and node actions is kept. Empty or 0 keeps it forever.
+	AuditRetention string `json:"auditRetention" default:"8760h"`
+
+	// CertificateValidity is how long node and user certificates issued by the CA are valid.
+	CertificateValidity string `json:"certificateValidity" default:"87600h"`
+	// CertificateRenewBefore is how long before expiry connected nodes are asked to renew their certificate. Empty or 0 disables renewal.
+	CertificateRenewBefore string `json:"certificateRenewBefore" default:"720h"`
+	// CertificateExpiryWarning is how long before expiry a warning is sent to CertificateExpiryDestinations. Empty or 0 disables the warnings.
+	CertificateExpiryWarning      string   `json:"certificateExpiryWarning" default:"336h"`
+	CertificateExpiryDestinations []string `json:"certificateExpiryDestinations"`
+
+	// RequireAdminTOTP forces admins that login with a password to enable two-factor authentication before using the gui.
+	RequireAdminTOTP bool `json:"requireAdminTOTP"`
+
+	// LoginBackoffAfter is the number of failed logins from an ip address or for a username before each attempt has
+	// to wait longer. LoginLockoutAfter failures locks them out for LoginLockout and sends an alert to LoginLockoutDestinations.
+	LoginBackoffAfter        int      `json:"loginBackoffAfter" default:"3"`
+	LoginLockoutAfter        int      `json:"loginLockoutAfter" default:"10"`
+	LoginLockout             string   `json:"loginLockout" default:"15m"`
+	LoginLockoutDestinations []string `json:"loginLockoutDestinations"`
+	// MaxCertificateRequests is the number of certificate requests from new nodes that can wait for approval and
+	// MaxCertificateRequestsPerIP the number from one ip address. 0 is no limit.
+	MaxCertificateRequests      int `json:"maxCertificateRequests" default:"10"`
+	MaxCertificateRequestsPerIP int `json:"maxCertificateRequestsPerIP" default:"5"`
+	// TrustedProxies are the ip addresses or CIDR ranges of reverse proxies in front of the server. The address of
+	// the clients behind them is taken from the X-Forwarded-For or X-Real-IP header.
+	TrustedProxies []string `json:"trustedProxies"`
+
+	// BackupSnapshots is the number of automatic snapshots of the configuration to keep in the backups folder. 0 disables them.
+	BackupSnapshots int `json:"backupSnapshots" default:"20"`
+
+	// Storage is where rules, nodes and the other server data is stored. "file" stores json files in the working directory
+	// and "bolt" stores everything in the database file StoragePath. config.json is always a file.
+	Storage     string `json:"storage" default:"file"`
+	StoragePath string `json:"storagePath" default:"stampzilla.db"`
 }
 
 // Save writes the config as json to specified filename.
 func (c *Config) Save(filename string) {
-	configFile, err := os.Create(filename)
-	if err != nil {
-		logrus.Error("creating config file", err.Error())
-	}
-
 	logrus.Info("Save config: ", c)
-	var out bytes.Buffer
-	b, err := json.MarshalIndent(c, "", "\t")
-	if err != nil {
-		logrus.Error("error marshal json", err)
+	if err := persist.SaveFile(filename, c); err != nil {
+		logrus.Error("error saving config file: ", err)
 	}
-	json.Indent(&out, b, "", "\t")
-	out.WriteTo(configFile)
 }
 
 // MustLoad loads the config using multiconfig from json or environment or command line args.
@@ -74,6 +112,9 @@ func (c *Config) createMultiConfig() *multiconfig.DefaultLoader {
 	// Read default values defined via tag fields "default"
 	loaders = append(loaders, &multiconfig.TagLoader{})
 
+	if err := persist.Repair("config.json"); err != nil {
+		logrus.Error(err)
+	}
 	if _, err := os.Stat("config.json"); err == nil {
 		loaders = append(loaders, &multiconfig.JSONLoader{Path: "config.json"})
 	}
@@ -58,6 +58,8 @@ type Device struct {
 	Online bool     `json:"online"`
 	State  State    `json:"state"`
 	Traits []string `json:"traits"`
+	// Labels are set on the server and used to give persons access to groups of devices, like a room.
+	Labels map[string]string `json:"labels,omitempty"`
 	sync.RWMutex
 }
 
@@ -149,6 +151,7 @@ func (d *Device) Copy() *Device {
 		Online: d.Online,
 		State:  newState,
 		Traits: d.Traits,
+		Labels: d.Labels,
 	}
 	d.Unlock()
 	return newD
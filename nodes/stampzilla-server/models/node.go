@@ -17,6 +17,8 @@ type Node struct {
 	// Devices   Devices         `json:"devices,omitempty"`
 	Config  json.RawMessage       `json:"config,omitempty"`
 	Aliases map[devices.ID]string `json:"aliases,omitempty"`
+	// Labels are the labels of each device.
+	Labels map[devices.ID]map[string]string `json:"labels,omitempty"`
 	sync.Mutex
 }
 
@@ -49,3 +51,22 @@ func (n *Node) Alias(id devices.ID) string {
 	}
 	return ""
 }
+
+func (n *Node) SetLabels(id devices.ID, labels map[string]string) {
+	n.Lock()
+	if n.Labels == nil {
+		n.Labels = make(map[devices.ID]map[string]string)
+	}
+	if len(labels) == 0 {
+		delete(n.Labels, id)
+	} else {
+		n.Labels[id] = labels
+	}
+	n.Unlock()
+}
+
+func (n *Node) DeviceLabels(id devices.ID) map[string]string {
+	n.Lock()
+	defer n.Unlock()
+	return n.Labels[id]
+}
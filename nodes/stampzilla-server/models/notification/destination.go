@@ -1,13 +1,13 @@
 package notification
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"sync"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
 )
 
 type Destination struct {
@@ -99,17 +99,10 @@ func (d *Destinations) Remove(uuid string) {
 
 // Save saves the rules to rules.json.
 func (d *Destinations) Save(filename string) error {
-	configFile, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("destinations: error saving %s: %s", filename, err.Error())
-	}
-	encoder := json.NewEncoder(configFile)
-	encoder.SetIndent("", "\t")
 	d.Lock()
 	defer d.Unlock()
-	err = encoder.Encode(d.destinations)
-	if err != nil {
-		return fmt.Errorf("destinations: error encoding %s: %s", filename, err.Error())
+	if err := persist.Save(filename, d.destinations); err != nil {
+		return fmt.Errorf("destinations: error saving %s: %s", filename, err.Error())
 	}
 	return nil
 }
@@ -117,8 +110,9 @@ func (d *Destinations) Save(filename string) error {
 // Load loads the rules from rules.json.
 func (d *Destinations) Load(filename string) error {
 	logrus.Debugf("destinations: loading rules from %s", filename)
-	configFile, err := os.Open(filename)
-	if err != nil {
+	d.Lock()
+	defer d.Unlock()
+	if err := persist.Load(filename, &d.destinations); err != nil {
 		if os.IsNotExist(err) {
 			logrus.Warn(err)
 			return nil // We dont want to error our if the file does not exist when we start the server
@@ -126,12 +120,5 @@ func (d *Destinations) Load(filename string) error {
 		return fmt.Errorf("destinations: error loading %s: %s", filename, err.Error())
 	}
 
-	d.Lock()
-	defer d.Unlock()
-	jsonParser := json.NewDecoder(configFile)
-	if err = jsonParser.Decode(&d.destinations); err != nil {
-		return fmt.Errorf("destinations: error parsing %s: %s", filename, err.Error())
-	}
-
 	return nil
 }
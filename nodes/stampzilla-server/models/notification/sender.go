@@ -14,6 +14,7 @@ import (
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/notification/pushover"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/notification/webhook"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/notification/wirepusher"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
 )
 
 type Sender struct {
@@ -90,17 +91,10 @@ func NewSenders() *Senders {
 
 // Save saves the rules to rules.json.
 func (s *Senders) Save(filename string) error {
-	configFile, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("senders: error saving %s: %s", filename, err.Error())
-	}
-	encoder := json.NewEncoder(configFile)
-	encoder.SetIndent("", "\t")
 	s.Lock()
 	defer s.Unlock()
-	err = encoder.Encode(s.senders)
-	if err != nil {
-		return fmt.Errorf("senders: error encoding %s: %s", filename, err.Error())
+	if err := persist.Save(filename, s.senders); err != nil {
+		return fmt.Errorf("senders: error saving %s: %s", filename, err.Error())
 	}
 	return nil
 }
@@ -108,8 +102,9 @@ func (s *Senders) Save(filename string) error {
 // Load loads the rules from rules.json.
 func (s *Senders) Load(filename string) error {
 	logrus.Debugf("senders: loading from %s", filename)
-	configFile, err := os.Open(filename)
-	if err != nil {
+	s.Lock()
+	defer s.Unlock()
+	if err := persist.Load(filename, &s.senders); err != nil {
 		if os.IsNotExist(err) {
 			logrus.Warn(err)
 			return nil // We dont want to error our if the file does not exist when we start the server
@@ -117,13 +112,6 @@ func (s *Senders) Load(filename string) error {
 		return fmt.Errorf("senders: error loading %s: %s", filename, err.Error())
 	}
 
-	s.Lock()
-	defer s.Unlock()
-	jsonParser := json.NewDecoder(configFile)
-	if err = jsonParser.Decode(&s.senders); err != nil {
-		return fmt.Errorf("logic: error loading %s: %s", filename, err.Error())
-	}
-
 	return nil
 }
 
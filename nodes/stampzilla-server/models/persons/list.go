@@ -1,12 +1,12 @@
 package persons
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"sync"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
 )
 
 type (
@@ -31,8 +31,24 @@ func (l *List) Add(p PersonWithPasswords) error {
 	defer l.Unlock()
 
 	if previous, ok := l.persons[p.UUID]; ok {
-		// Keep the stored password
+		// Keep the stored password, tokens and two-factor authentication
 		p.Password = previous.Password
+		p.Tokens = previous.Tokens
+		p.TokenHashes = previous.TokenHashes
+		p.TOTPEnabled = previous.TOTPEnabled
+		p.TOTPSecret = previous.TOTPSecret
+		p.TOTPPending = previous.TOTPPending
+		p.TOTPLastStep = previous.TOTPLastStep
+		p.RecoveryCodes = previous.RecoveryCodes
+	} else {
+		// Tokens and two-factor authentication are only set up with their own messages
+		p.Tokens = nil
+		p.TokenHashes = nil
+		p.TOTPEnabled = false
+		p.TOTPSecret = ""
+		p.TOTPPending = ""
+		p.TOTPLastStep = 0
+		p.RecoveryCodes = nil
 	}
 
 	err := p.UpdatePassword()
@@ -95,17 +111,22 @@ func (l *List) GetByUsernameWithPassowrd(username string) *PersonWithPassword {
 }
 
 func (l *List) Save() error {
-	configFile, err := os.Create("persons.json")
-	if err != nil {
+	b := persist.Batch{}
+	if err := l.AddTo(b); err != nil {
+		return err
+	}
+	if err := b.Save(); err != nil {
 		return fmt.Errorf("persons: error saving: %s", err)
 	}
-	encoder := json.NewEncoder(configFile)
-	encoder.SetIndent("", "\t")
+	return nil
+}
+
+// AddTo adds persons.json to the batch so it can be saved together with other documents.
+func (l *List) AddTo(b persist.Batch) error {
 	l.Lock()
 	defer l.Unlock()
-	err = encoder.Encode(l.persons)
-	if err != nil {
-		return fmt.Errorf("persons: error saving: %s", err)
+	if err := b.Add("persons.json", l.persons); err != nil {
+		return fmt.Errorf("persons: error encoding: %s", err)
 	}
 	return nil
 }
@@ -113,19 +134,13 @@ func (l *List) Save() error {
 func (l *List) Load() error {
 	logrus.Info("Loading persons from json file")
 
-	configFile, err := os.Open("persons.json")
-	if err != nil {
+	l.Lock()
+	defer l.Unlock()
+	if err := persist.Load("persons.json", &l.persons); err != nil {
 		if os.IsNotExist(err) {
 			logrus.Warn(err)
 			return nil // We dont want to error our if the file does not exist when we start the server
 		}
-		return err
-	}
-
-	l.Lock()
-	defer l.Unlock()
-	jsonParser := json.NewDecoder(configFile)
-	if err = jsonParser.Decode(&l.persons); err != nil {
 		return fmt.Errorf("persons: error loading: %s", err)
 	}
 
@@ -0,0 +1,93 @@
+package persons
+
+import (
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+)
+
+// Role is the base set of permissions of a person that is not an admin. Admins can do everything.
+type Role string
+
+const (
+	// RoleUser can see and control devices. It is the default role.
+	RoleUser Role = "user"
+	// RoleReadOnly can only see devices.
+	RoleReadOnly Role = "readonly"
+)
+
+// Permission allows a person to do something in addition to what the role allows.
+type Permission string
+
+const (
+	PermissionControlDevices Permission = "control-devices"
+	// PermissionManageRules allows changing rules, scenes, saved states, schedules, computed devices and overrides.
+	PermissionManageRules Permission = "manage-rules"
+	// PermissionManageNodes allows setting up nodes and devices, accepting certificate requests and changing virtual devices.
+	PermissionManageNodes Permission = "manage-nodes"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleUser:     {PermissionControlDevices},
+	RoleReadOnly: {},
+}
+
+// GetRole returns the role of the person. Persons without a role are users.
+func (p *Person) GetRole() Role {
+	if p.Role == "" {
+		return RoleUser
+	}
+	return p.Role
+}
+
+// Can returns true if the person has the permission from its role or in Permissions.
+func (p *Person) Can(permission Permission) bool {
+	if p.IsAdmin {
+		return true
+	}
+	for _, v := range rolePermissions[p.GetRole()] {
+		if v == permission {
+			return true
+		}
+	}
+	for _, v := range p.Permissions {
+		if v == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted returns true if the person only has access to some devices.
+func (p *Person) Restricted() bool {
+	return !p.IsAdmin && (len(p.Devices) > 0 || len(p.DeviceLabels) > 0)
+}
+
+// CanAccessDevice returns true if the person can see the device. A device is accessible if it is in Devices
+// or has one of the DeviceLabels. An empty label value matches any value of that label.
+func (p *Person) CanAccessDevice(dev *devices.Device) bool {
+	if !p.Restricted() {
+		return true
+	}
+	if dev == nil {
+		return false
+	}
+
+	dev.RLock()
+	defer dev.RUnlock()
+	for _, id := range p.Devices {
+		if id == dev.ID.String() {
+			return true
+		}
+	}
+	for key, value := range p.DeviceLabels {
+		v, ok := dev.Labels[key]
+		if ok && (value == "" || value == v) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanControlDevice returns true if the person can send state changes to the device.
+func (p *Person) CanControlDevice(dev *devices.Device) bool {
+	return p.Can(PermissionControlDevices) && p.CanAccessDevice(dev)
+}
@@ -0,0 +1,50 @@
+package persons
+
+import (
+	"testing"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCan(t *testing.T) {
+	user := &Person{}
+	assert.Equal(t, RoleUser, user.GetRole())
+	assert.True(t, user.Can(PermissionControlDevices))
+	assert.False(t, user.Can(PermissionManageRules))
+
+	readonly := &Person{Role: RoleReadOnly, Permissions: []Permission{PermissionManageRules}}
+	assert.False(t, readonly.Can(PermissionControlDevices))
+	assert.True(t, readonly.Can(PermissionManageRules))
+	assert.False(t, readonly.Can(PermissionManageNodes))
+
+	admin := &Person{IsAdmin: true, Role: RoleReadOnly}
+	assert.True(t, admin.Can(PermissionManageNodes))
+}
+
+func TestCanAccessDevice(t *testing.T) {
+	kitchen := &devices.Device{ID: devices.ID{Node: "node", ID: "1"}, Labels: map[string]string{"room": "kitchen"}}
+	bedroom := &devices.Device{ID: devices.ID{Node: "node", ID: "2"}, Labels: map[string]string{"room": "bedroom"}}
+	hall := &devices.Device{ID: devices.ID{Node: "node", ID: "3"}}
+
+	all := &Person{}
+	assert.False(t, all.Restricted())
+	assert.True(t, all.CanControlDevice(hall))
+
+	child := &Person{Devices: []string{"node.3"}, DeviceLabels: map[string]string{"room": "bedroom"}}
+	assert.True(t, child.Restricted())
+	assert.False(t, child.CanAccessDevice(kitchen))
+	assert.True(t, child.CanAccessDevice(bedroom))
+	assert.True(t, child.CanControlDevice(hall))
+	assert.False(t, child.CanAccessDevice(nil))
+
+	// An empty label value matches all rooms
+	guest := &Person{Role: RoleReadOnly, DeviceLabels: map[string]string{"room": ""}}
+	assert.True(t, guest.CanAccessDevice(kitchen))
+	assert.False(t, guest.CanAccessDevice(hall))
+	assert.False(t, guest.CanControlDevice(kitchen))
+
+	admin := &Person{IsAdmin: true, Devices: []string{"node.3"}}
+	assert.False(t, admin.Restricted())
+	assert.True(t, admin.CanControlDevice(kitchen))
+}
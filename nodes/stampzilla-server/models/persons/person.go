@@ -2,6 +2,7 @@ package persons
 
 import (
 	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
@@ -16,7 +17,18 @@ type Person struct {
 	AllowLogin bool   `json:"allow_login"`
 	IsAdmin    bool   `json:"is_admin"`
 
+	// Role and Permissions are used for persons that are not admins.
+	Role        Role         `json:"role,omitempty"`
+	Permissions []Permission `json:"permissions,omitempty"`
+	// Devices and DeviceLabels limits which devices the person can see and control. Empty means all devices.
+	Devices      []string          `json:"devices,omitempty"`
+	DeviceLabels map[string]string `json:"device_labels,omitempty"`
+
 	LastSeen time.Time `json:"last_seen"`
+	// Tokens are the API tokens of the person. They are created and revoked with their own messages.
+	Tokens []Token `json:"tokens,omitempty"`
+	// TOTPEnabled is true if the person uses two-factor authentication to login.
+	TOTPEnabled bool `json:"totp_enabled"`
 
 	State devices.State `json:"state"`
 }
@@ -24,6 +36,16 @@ type Person struct {
 type PersonWithPassword struct {
 	Person
 	Password string `json:"password"`
+	// TokenHashes are the hashed secrets of the tokens by token id.
+	TokenHashes map[string]string `json:"token_hashes,omitempty"`
+
+	// TOTPSecret is the secret of two-factor authentication, and TOTPPending a new secret that has not been confirmed.
+	TOTPSecret  string `json:"totp_secret,omitempty"`
+	TOTPPending string `json:"totp_pending,omitempty"`
+	// TOTPLastStep is the time step of the last used code, so a code can not be used again.
+	TOTPLastStep int64 `json:"totp_last_step,omitempty"`
+	// RecoveryCodes are hashes of the unused recovery codes.
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
 }
 
 type PersonWithPasswords struct {
@@ -58,6 +80,12 @@ func (a Person) Equal(b PersonWithPasswords) bool {
 	if a.IsAdmin != b.IsAdmin {
 		return false
 	}
+	if a.Role != b.Role {
+		return false
+	}
+	if !reflect.DeepEqual(a.Permissions, b.Permissions) || !reflect.DeepEqual(a.Devices, b.Devices) || !reflect.DeepEqual(a.DeviceLabels, b.DeviceLabels) {
+		return false
+	}
 	if b.NewPassword != "" {
 		return false
 	}
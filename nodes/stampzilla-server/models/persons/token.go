@@ -0,0 +1,185 @@
+package persons
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Token is an API token of a person. Tokens are used by scripts and integrations that can not login or use a
+// certificate. Only a hash of the secret is stored, in PersonWithPassword.TokenHashes.
+type Token struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Scopes are the permissions the token has, if the person has them. Tokens never have admin access.
+	Scopes   []Permission `json:"scopes"`
+	Created  time.Time    `json:"created"`
+	LastUsed time.Time    `json:"last_used"`
+}
+
+// tokenLastUsedInterval is how often the last used time of a token is updated, so persons.json is not saved on
+// every request.
+const tokenLastUsedInterval = time.Minute
+
+var validScopes = map[Permission]bool{
+	PermissionControlDevices: true,
+	PermissionManageRules:    true,
+	PermissionManageNodes:    true,
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitToken splits a token in the id and the secret.
+func splitToken(token string) (string, string, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return "", "", fmt.Errorf("malformed token")
+	}
+	return id, secret, nil
+}
+
+// Token returns the token with the id, or nil if the person does not have it.
+func (p *Person) Token(id string) *Token {
+	for i := range p.Tokens {
+		if p.Tokens[i].ID == id {
+			return &p.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// WithToken returns a copy of the person that only has the permissions that are in the scopes of the token.
+func (p *Person) WithToken(t *Token) *Person {
+	c := *p
+	c.IsAdmin = false
+	c.Role = RoleReadOnly
+	c.Permissions = nil
+	for _, scope := range t.Scopes {
+		if p.Can(scope) {
+			c.Permissions = append(c.Permissions, scope)
+		}
+	}
+	if p.IsAdmin {
+		// Admins have access to all devices
+		c.Devices = nil
+		c.DeviceLabels = nil
+	}
+	return &c
+}
+
+// AddToken creates a new token for the person. It returns the token and the secret, which is only available now.
+func (l *List) AddToken(personUUID, name string, scopes []Permission) (*Token, string, error) {
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return nil, "", fmt.Errorf("unknown scope %s", scope)
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	t := Token{
+		ID:      uuid.New().String(),
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now(),
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	l.Lock()
+	defer l.Unlock()
+
+	err := l.update(personUUID, func(p *PersonWithPassword) error {
+		hashes := make(map[string]string)
+		for id, hash := range p.TokenHashes {
+			hashes[id] = hash
+		}
+		hashes[t.ID] = hashTokenSecret(secret)
+		p.Tokens = append(append([]Token{}, p.Tokens...), t)
+		p.TokenHashes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &t, t.ID + "." + secret, nil
+}
+
+// RevokeToken removes a token from the person.
+func (l *List) RevokeToken(personUUID, id string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.update(personUUID, func(p *PersonWithPassword) error {
+		if p.Token(id) == nil {
+			return fmt.Errorf("token %s not found", id)
+		}
+
+		tokens := []Token{}
+		for _, t := range p.Tokens {
+			if t.ID != id {
+				tokens = append(tokens, t)
+			}
+		}
+		hashes := make(map[string]string)
+		for tid, hash := range p.TokenHashes {
+			if tid != id {
+				hashes[tid] = hash
+			}
+		}
+		p.Tokens = tokens
+		p.TokenHashes = hashes
+		return nil
+	})
+}
+
+// CheckToken returns the person and the token if the token is valid and the person is allowed to login. The last
+// used time of the token is updated, and the returned bool is true if it was changed so the list should be saved.
+func (l *List) CheckToken(token string, now time.Time) (*Person, *Token, bool, error) {
+	id, secret, err := splitToken(token)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	hash := hashTokenSecret(secret)
+
+	l.Lock()
+	defer l.Unlock()
+
+	for personUUID, previous := range l.persons {
+		stored, ok := previous.TokenHashes[id]
+		if !ok {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) != 1 || previous.Token(id) == nil {
+			break
+		}
+		if !previous.AllowLogin {
+			return nil, nil, false, fmt.Errorf("%s is not allowed to login", personUUID)
+		}
+
+		if now.Sub(previous.Token(id).LastUsed) < tokenLastUsedInterval {
+			return &previous.Person, previous.Token(id), false, nil
+		}
+
+		p := *previous
+		p.Tokens = append([]Token{}, previous.Tokens...)
+		t := p.Token(id)
+		t.LastUsed = now
+		l.persons[personUUID] = &p
+		return &p.Person, t, true, nil
+	}
+
+	return nil, nil, false, fmt.Errorf("invalid token")
+}
@@ -0,0 +1,83 @@
+package persons
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokens(t *testing.T) {
+	l := NewList()
+	assert.NoError(t, l.Add(PersonWithPasswords{PersonWithPassword: PersonWithPassword{Person: Person{UUID: "a", IsAdmin: true, AllowLogin: true}}}))
+
+	_, _, err := l.AddToken("a", "bad", []Permission{"admin"})
+	assert.Error(t, err)
+	_, _, err = l.AddToken("missing", "script", nil)
+	assert.Error(t, err)
+
+	token, secret, err := l.AddToken("a", "script", []Permission{PermissionControlDevices})
+	assert.NoError(t, err)
+	assert.Len(t, l.Get("a").Tokens, 1)
+	assert.NotContains(t, l.persons["a"].TokenHashes[token.ID], secret)
+
+	now := time.Now()
+	p, tok, changed, err := l.CheckToken(secret, now)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "a", p.UUID)
+	assert.Equal(t, now, tok.LastUsed)
+	assert.Equal(t, now, l.Get("a").Token(token.ID).LastUsed)
+
+	// The last used time is only updated once a minute
+	_, _, changed, err = l.CheckToken(secret, now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	_, _, _, err = l.CheckToken(secret+"x", now)
+	assert.Error(t, err)
+	_, _, _, err = l.CheckToken("garbage", now)
+	assert.Error(t, err)
+
+	// Updating the person from the gui keeps the tokens
+	assert.NoError(t, l.Add(PersonWithPasswords{PersonWithPassword: PersonWithPassword{Person: Person{UUID: "a", Name: "A", IsAdmin: true, AllowLogin: true}}}))
+	_, _, _, err = l.CheckToken(secret, now)
+	assert.NoError(t, err)
+
+	// Tokens do not work for persons that are not allowed to login
+	assert.NoError(t, l.Add(PersonWithPasswords{PersonWithPassword: PersonWithPassword{Person: Person{UUID: "a", Name: "A", IsAdmin: true}}}))
+	_, _, _, err = l.CheckToken(secret, now)
+	assert.Error(t, err)
+	assert.NoError(t, l.Add(PersonWithPasswords{PersonWithPassword: PersonWithPassword{Person: Person{UUID: "a", Name: "A", IsAdmin: true, AllowLogin: true}}}))
+
+	assert.NoError(t, l.RevokeToken("a", token.ID))
+	assert.Error(t, l.RevokeToken("a", token.ID))
+	assert.Empty(t, l.Get("a").Tokens)
+	_, _, _, err = l.CheckToken(secret, now)
+	assert.Error(t, err)
+
+	// A new person can not be added with tokens
+	assert.NoError(t, l.Add(PersonWithPasswords{PersonWithPassword: PersonWithPassword{
+		Person:      Person{UUID: "b", Tokens: []Token{{ID: "forged"}}},
+		TokenHashes: map[string]string{"forged": "hash"},
+	}}))
+	assert.Empty(t, l.Get("b").Tokens)
+	assert.Empty(t, l.persons["b"].TokenHashes)
+}
+
+func TestWithToken(t *testing.T) {
+	admin := &Person{IsAdmin: true, Devices: []string{"node.1"}}
+	p := admin.WithToken(&Token{Scopes: []Permission{PermissionManageRules}})
+	assert.False(t, p.IsAdmin)
+	assert.False(t, p.Restricted())
+	assert.True(t, p.Can(PermissionManageRules))
+	assert.False(t, p.Can(PermissionControlDevices))
+	assert.True(t, admin.IsAdmin)
+
+	// Scopes the person does not have are ignored
+	user := &Person{Devices: []string{"node.1"}}
+	p = user.WithToken(&Token{Scopes: []Permission{PermissionControlDevices, PermissionManageNodes}})
+	assert.True(t, p.Can(PermissionControlDevices))
+	assert.False(t, p.Can(PermissionManageNodes))
+	assert.True(t, p.Restricted())
+}
@@ -0,0 +1,216 @@
+package persons
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// totpPeriod and totpDigits are the defaults of RFC 6238 that all authenticator apps support.
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of periods before and after now that are accepted, to allow for clock drift.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the code for the time step.
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// validateTOTP returns the time step of the code if it is valid at now and newer than lastStep, so each code
+// can only be used once.
+func validateTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth uri that authenticator apps use to add the secret, usually scanned as a QR code.
+func TOTPURI(secret, account, issuer string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// newRecoveryCodes returns new recovery codes and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := randomString(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashTokenSecret(code))
+	}
+	return codes, hashes, nil
+}
+
+// update replaces the person with a copy that is changed by fn, since others may have a reference to the old one.
+func (l *List) update(uuid string, fn func(p *PersonWithPassword) error) error {
+	previous, ok := l.persons[uuid]
+	if !ok {
+		return fmt.Errorf("person %s not found", uuid)
+	}
+	p := *previous
+	if err := fn(&p); err != nil {
+		return err
+	}
+	l.persons[uuid] = &p
+	return nil
+}
+
+// StartTOTP creates a new TOTP secret for the person. It is used after it has been confirmed with ConfirmTOTP.
+// It fails if two-factor authentication is already enabled, since that would replace the secret without a code.
+func (l *List) StartTOTP(uuid string) (string, error) {
+	secret, err := randomString(20)
+	if err != nil {
+		return "", err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return secret, l.update(uuid, func(p *PersonWithPassword) error {
+		if p.TOTPEnabled {
+			return fmt.Errorf("two-factor authentication is already enabled")
+		}
+		p.TOTPPending = secret
+		return nil
+	})
+}
+
+// ConfirmTOTP enables two-factor authentication if the code is valid for the secret from StartTOTP.
+// It returns the recovery codes, they are only available now.
+func (l *List) ConfirmTOTP(uuid, code string, now time.Time) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return codes, l.update(uuid, func(p *PersonWithPassword) error {
+		if p.TOTPEnabled {
+			return fmt.Errorf("two-factor authentication is already enabled")
+		}
+		if p.TOTPPending == "" {
+			return fmt.Errorf("two-factor authentication has not been started")
+		}
+		step, ok := validateTOTP(p.TOTPPending, code, now, 0)
+		if !ok {
+			return fmt.Errorf("wrong code")
+		}
+		p.TOTPSecret = p.TOTPPending
+		p.TOTPPending = ""
+		p.TOTPLastStep = step
+		p.RecoveryCodes = hashes
+		p.TOTPEnabled = true
+		return nil
+	})
+}
+
+// DisableTOTP turns off two-factor authentication for the person.
+func (l *List) DisableTOTP(uuid string) error {
+	l.Lock()
+	defer l.Unlock()
+	return l.update(uuid, func(p *PersonWithPassword) error {
+		p.TOTPSecret = ""
+		p.TOTPPending = ""
+		p.TOTPLastStep = 0
+		p.RecoveryCodes = nil
+		p.TOTPEnabled = false
+		return nil
+	})
+}
+
+// NewRecoveryCodes replaces the recovery codes of the person.
+func (l *List) NewRecoveryCodes(uuid string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return codes, l.update(uuid, func(p *PersonWithPassword) error {
+		if !p.TOTPEnabled {
+			return fmt.Errorf("two-factor authentication is not enabled")
+		}
+		p.RecoveryCodes = hashes
+		return nil
+	})
+}
+
+// CheckSecondFactor checks a TOTP code or a recovery code. Recovery codes can only be used once.
+// Persons without two-factor authentication always pass.
+func (l *List) CheckSecondFactor(uuid, code string, now time.Time) error {
+	l.Lock()
+	defer l.Unlock()
+	return l.update(uuid, func(p *PersonWithPassword) error {
+		if !p.TOTPEnabled {
+			return nil
+		}
+		if step, ok := validateTOTP(p.TOTPSecret, strings.TrimSpace(code), now, p.TOTPLastStep); ok {
+			p.TOTPLastStep = step
+			return nil
+		}
+
+		hash := hashTokenSecret(normalizeRecoveryCode(code))
+		for i, h := range p.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				p.RecoveryCodes = append(append([]string{}, p.RecoveryCodes[:i]...), p.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("wrong two-factor code")
+	})
+}
@@ -0,0 +1,107 @@
+package persons
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors for SHA1 from RFC 6238, truncated to 6 digits
+	key := []byte("12345678901234567890")
+	assert.Equal(t, "287082", totpCode(key, 59/totpPeriod))
+	assert.Equal(t, "081804", totpCode(key, 1111111109/totpPeriod))
+	assert.Equal(t, "005924", totpCode(key, 1234567890/totpPeriod))
+
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Unix(1111111109, 0)
+	step, ok := validateTOTP(secret, "081804", now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1111111109/totpPeriod), step)
+
+	// Codes from the previous period are accepted but not older ones
+	_, ok = validateTOTP(secret, "081804", now.Add(totpPeriod*time.Second), 0)
+	assert.True(t, ok)
+	_, ok = validateTOTP(secret, "081804", now.Add(2*totpPeriod*time.Second), 0)
+	assert.False(t, ok)
+
+	// A used code can not be used again
+	_, ok = validateTOTP(secret, "081804", now, step)
+	assert.False(t, ok)
+
+	assert.Contains(t, TOTPURI(secret, "admin", "home"), "otpauth://totp/home:admin?")
+}
+
+func TestTwoFactor(t *testing.T) {
+	l := NewList()
+	assert.NoError(t, l.Add(PersonWithPasswords{PersonWithPassword: PersonWithPassword{Person: Person{UUID: "a"}}}))
+
+	// Persons without two-factor authentication always pass
+	now := time.Now()
+	assert.NoError(t, l.CheckSecondFactor("a", "", now))
+
+	_, err := l.ConfirmTOTP("a", "123456", now)
+	assert.Error(t, err)
+
+	secret, err := l.StartTOTP("a")
+	assert.NoError(t, err)
+	assert.False(t, l.Get("a").TOTPEnabled)
+
+	key, err := totpEncoding.DecodeString(secret)
+	assert.NoError(t, err)
+	step := now.Unix() / totpPeriod
+
+	_, err = l.ConfirmTOTP("a", "00000x", now)
+	assert.Error(t, err)
+	codes, err := l.ConfirmTOTP("a", totpCode(key, step), now)
+	assert.NoError(t, err)
+	assert.Len(t, codes, recoveryCodeCount)
+	assert.True(t, l.Get("a").TOTPEnabled)
+
+	// The secret can not be replaced while two-factor authentication is enabled
+	_, err = l.StartTOTP("a")
+	assert.Error(t, err)
+	_, err = l.ConfirmTOTP("a", totpCode(key, step+1), now)
+	assert.Error(t, err)
+
+	// The code used to confirm can not be used to login
+	assert.Error(t, l.CheckSecondFactor("a", totpCode(key, step), now))
+	assert.Error(t, l.CheckSecondFactor("a", "", now))
+	assert.NoError(t, l.CheckSecondFactor("a", totpCode(key, step+1), now))
+
+	// Recovery codes work once, with or without the dash
+	assert.NoError(t, l.CheckSecondFactor("a", codes[0], now))
+	assert.Error(t, l.CheckSecondFactor("a", codes[0], now))
+	assert.NoError(t, l.CheckSecondFactor("a", " "+codes[1][:4]+codes[1][5:], now))
+	assert.Len(t, l.persons["a"].RecoveryCodes, recoveryCodeCount-2)
+
+	// Updating the person from the gui keeps two-factor authentication
+	assert.NoError(t, l.Add(PersonWithPasswords{PersonWithPassword: PersonWithPassword{Person: Person{UUID: "a", Name: "A"}}}))
+	assert.True(t, l.Get("a").TOTPEnabled)
+
+	newCodes, err := l.NewRecoveryCodes("a")
+	assert.NoError(t, err)
+	assert.Error(t, l.CheckSecondFactor("a", codes[2], now))
+	assert.NoError(t, l.CheckSecondFactor("a", newCodes[0], now))
+
+	assert.NoError(t, l.DisableTOTP("a"))
+	assert.False(t, l.Get("a").TOTPEnabled)
+	assert.NoError(t, l.CheckSecondFactor("a", "", now))
+	_, err = l.NewRecoveryCodes("a")
+	assert.Error(t, err)
+
+	// A new person can not be added with two-factor authentication
+	assert.NoError(t, l.Add(PersonWithPasswords{PersonWithPassword: PersonWithPassword{
+		Person:        Person{UUID: "b", TOTPEnabled: true},
+		TOTPSecret:    secret,
+		TOTPPending:   secret,
+		TOTPLastStep:  step,
+		RecoveryCodes: []string{"hash"},
+	}}))
+	assert.False(t, l.Get("b").TOTPEnabled)
+	assert.Empty(t, l.persons["b"].TOTPSecret)
+	assert.Empty(t, l.persons["b"].TOTPPending)
+	assert.Zero(t, l.persons["b"].TOTPLastStep)
+	assert.Empty(t, l.persons["b"].RecoveryCodes)
+}
@@ -5,4 +5,6 @@ import "github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/pe
 type ReadyInfo struct {
 	Method string          `json:"method"`
 	User   *persons.Person `json:"user"`
+	// TOTPEnrolment is true if the user must enable two-factor authentication before the gui can be used.
+	TOTPEnrolment bool `json:"totp_enrolment,omitempty"`
 }
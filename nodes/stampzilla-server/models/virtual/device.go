@@ -0,0 +1,194 @@
+package virtual
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+)
+
+// Type is the kind of virtual device.
+type Type string
+
+const (
+	// Boolean is a flag with the state key on.
+	Boolean Type = "boolean"
+	// Number is a number with the state key value. It is kept within Min and Max if they are set.
+	Number Type = "number"
+	// Select is one of Options with the state key value.
+	Select Type = "select"
+	// Timer is on for Duration after it is turned on. The time it turns off is in the state key ends.
+	Timer Type = "timer"
+)
+
+// Device is a device that is hosted by the server itself instead of a node.
+type Device struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Type    Type     `json:"type"`
+	Options []string `json:"options,omitempty"`
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
+	// Duration is the default duration of a timer. It can be changed when the timer is started with the state key duration.
+	Duration stypes.Duration `json:"duration,omitempty"`
+	State    devices.State   `json:"state"`
+	timer    *time.Timer
+}
+
+type Devices map[string]*Device
+
+func (d *Device) validate() error {
+	if d.ID == "" {
+		return fmt.Errorf("virtual device id is missing")
+	}
+	switch d.Type {
+	case Boolean, Number:
+	case Select:
+		if len(d.Options) == 0 {
+			return fmt.Errorf("virtual device %s has no options", d.ID)
+		}
+	case Timer:
+		if d.Duration <= 0 {
+			return fmt.Errorf("virtual device %s has no duration", d.ID)
+		}
+	default:
+		return fmt.Errorf("virtual device %s has unknown type: %s", d.ID, d.Type)
+	}
+	if d.Min != nil && d.Max != nil && *d.Min > *d.Max {
+		return fmt.Errorf("virtual device %s has min greater than max", d.ID)
+	}
+	return nil
+}
+
+func (d *Device) defaultState() devices.State {
+	switch d.Type {
+	case Number:
+		value := 0.0
+		if d.Min != nil && value < *d.Min {
+			value = *d.Min
+		}
+		if d.Max != nil && value > *d.Max {
+			value = *d.Max
+		}
+		return devices.State{"value": value}
+	case Select:
+		return devices.State{"value": d.Options[0]}
+	case Timer:
+		return devices.State{"on": false, "ends": ""}
+	}
+	return devices.State{"on": false}
+}
+
+// change validates a requested state and returns the new state of the device.
+func (d *Device) change(state devices.State, now time.Time) (devices.State, error) {
+	newState := d.State.Clone()
+	for k, v := range state {
+		switch {
+		case k == "on" && (d.Type == Boolean || d.Type == Timer):
+			on, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("virtual device %s: on must be a bool", d.ID)
+			}
+			newState["on"] = on
+		case k == "value" && d.Type == Number:
+			value, ok := toFloat(v)
+			if !ok {
+				return nil, fmt.Errorf("virtual device %s: value must be a number", d.ID)
+			}
+			if d.Min != nil && value < *d.Min {
+				value = *d.Min
+			}
+			if d.Max != nil && value > *d.Max {
+				value = *d.Max
+			}
+			newState["value"] = value
+		case k == "value" && d.Type == Select:
+			value, ok := v.(string)
+			if !ok || !hasOption(d.Options, value) {
+				return nil, fmt.Errorf("virtual device %s: %v is not one of %v", d.ID, v, d.Options)
+			}
+			newState["value"] = value
+		case k == "duration" && d.Type == Timer:
+		default:
+			return nil, fmt.Errorf("virtual device %s: unknown state key %s", d.ID, k)
+		}
+	}
+
+	if d.Type != Timer {
+		return newState, nil
+	}
+
+	on, _ := newState["on"].(bool)
+	if !on {
+		newState["ends"] = ""
+		return newState, nil
+	}
+	if _, ok := state["on"]; !ok {
+		return newState, nil
+	}
+	duration := time.Duration(d.Duration)
+	if v, ok := state["duration"]; ok {
+		var err error
+		duration, err = parseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("virtual device %s: %s", d.ID, err)
+		}
+		if duration <= 0 {
+			return nil, fmt.Errorf("virtual device %s: duration must be positive", d.ID)
+		}
+	}
+	newState["ends"] = now.Add(duration).Format(time.RFC3339)
+	return newState, nil
+}
+
+// ends returns when a running timer turns off.
+func (d *Device) ends() (time.Time, bool) {
+	if on, _ := d.State["on"].(bool); !on || d.Type != Timer {
+		return time.Time{}, false
+	}
+	s, _ := d.State["ends"].(string)
+	t, err := time.Parse(time.RFC3339, s)
+	return t, err == nil
+}
+
+func (d *Device) traits() []string {
+	if d.Type == Boolean || d.Type == Timer {
+		return []string{"OnOff"}
+	}
+	return nil
+}
+
+func hasOption(options []string, value string) bool {
+	for _, o := range options {
+		if o == value {
+			return true
+		}
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// parseDuration parses a duration string like 5m or a number of seconds.
+func parseDuration(v interface{}) (time.Duration, error) {
+	if s, ok := v.(string); ok {
+		return time.ParseDuration(s)
+	}
+	if f, ok := toFloat(v); ok {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf("duration must be a string or a number of seconds")
+}
@@ -0,0 +1,265 @@
+package virtual
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+)
+
+/* virtualdevices.json example
+{
+    "mode": {
+        "id": "mode",
+        "name": "House mode",
+        "type": "select",
+        "options": ["home", "away", "night"],
+        "state": {"value": "home"}
+    },
+    "guests": {
+        "id": "guests",
+        "name": "Guests",
+        "type": "number",
+        "min": 0,
+        "state": {"value": 2}
+    },
+    "motion-timer": {
+        "id": "motion-timer",
+        "name": "Hallway motion",
+        "type": "timer",
+        "duration": "5m",
+        "state": {"on": false, "ends": ""}
+    }
+}
+*/
+
+// List is the virtual devices hosted by the server. They have the uuid of the server as node.
+type List struct {
+	nodeUUID string
+	devices  Devices
+	onChange func(*devices.Device)
+	onRemove func(devices.ID)
+	sync.RWMutex
+}
+
+func NewList(nodeUUID string) *List {
+	return &List{
+		nodeUUID: nodeUUID,
+		devices:  make(Devices),
+		onChange: func(*devices.Device) {},
+		onRemove: func(devices.ID) {},
+	}
+}
+
+// NodeUUID returns the uuid the virtual devices are hosted under.
+func (l *List) NodeUUID() string {
+	return l.nodeUUID
+}
+
+// OnChange is called with the device when a virtual device is added or changes state.
+func (l *List) OnChange(callback func(*devices.Device)) {
+	l.onChange = callback
+}
+
+// OnRemove is called when a virtual device is removed.
+func (l *List) OnRemove(callback func(devices.ID)) {
+	l.onRemove = callback
+}
+
+// All returns all virtual devices.
+func (l *List) All() Devices {
+	l.RLock()
+	defer l.RUnlock()
+	all := make(Devices, len(l.devices))
+	for k, v := range l.devices {
+		d := *v
+		all[k] = &d
+	}
+	return all
+}
+
+// Get returns the virtual device as a device.
+func (l *List) Get(id string) *devices.Device {
+	l.RLock()
+	defer l.RUnlock()
+	if d, ok := l.devices[id]; ok {
+		return l.device(d)
+	}
+	return nil
+}
+
+// SetDevices replaces all virtual devices. Devices that keep their type also keep their state.
+func (l *List) SetDevices(list Devices) error {
+	for id, d := range list {
+		d.ID = id
+		if err := d.validate(); err != nil {
+			return err
+		}
+	}
+
+	l.Lock()
+	changed := make([]*devices.Device, 0, len(list))
+	removed := make([]devices.ID, 0)
+	for id, old := range l.devices {
+		if old.timer != nil {
+			old.timer.Stop()
+		}
+		if _, ok := list[id]; !ok {
+			removed = append(removed, devices.ID{Node: l.nodeUUID, ID: id})
+		}
+	}
+
+	now := time.Now()
+	devs := make(Devices, len(list))
+	for _, d := range list {
+		state := d.defaultState()
+		if old, ok := l.devices[d.ID]; ok && old.Type == d.Type {
+			state.MergeWith(old.State)
+		}
+		d.State = state
+		// Keep the current value if it is still valid with the new options and limits
+		if d.Type != Timer {
+			if s, err := d.change(state, now); err == nil {
+				d.State = s
+			} else {
+				d.State = d.defaultState()
+			}
+		}
+		devs[d.ID] = d
+		l.startTimer(d, now)
+		changed = append(changed, l.device(d))
+	}
+	l.devices = devs
+	l.Unlock()
+
+	for _, id := range removed {
+		l.onRemove(id)
+	}
+	for _, dev := range changed {
+		l.onChange(dev)
+	}
+	return nil
+}
+
+// SetState changes the state of a virtual device.
+func (l *List) SetState(id string, state devices.State) error {
+	l.Lock()
+	d, ok := l.devices[id]
+	if !ok {
+		l.Unlock()
+		return fmt.Errorf("virtual device %s does not exist", id)
+	}
+	now := time.Now()
+	newState, err := d.change(state, now)
+	if err != nil {
+		l.Unlock()
+		return err
+	}
+	d.State = newState
+	l.startTimer(d, now)
+	dev := l.device(d)
+	l.Unlock()
+
+	l.onChange(dev)
+	return nil
+}
+
+// Start starts the timers that were running when the server stopped and reports all virtual devices.
+func (l *List) Start() {
+	l.Lock()
+	now := time.Now()
+	changed := make([]*devices.Device, 0, len(l.devices))
+	for _, d := range l.devices {
+		l.startTimer(d, now)
+		changed = append(changed, l.device(d))
+	}
+	l.Unlock()
+
+	for _, dev := range changed {
+		l.onChange(dev)
+	}
+}
+
+// startTimer (re)starts or stops the timer of a timer device. Must be called with the lock held.
+func (l *List) startTimer(d *Device, now time.Time) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	ends, ok := d.ends()
+	if !ok {
+		return
+	}
+	d.timer = time.AfterFunc(ends.Sub(now), func() {
+		l.timerDone(d)
+	})
+}
+
+func (l *List) timerDone(d *Device) {
+	l.Lock()
+	if current, ok := l.devices[d.ID]; !ok || current != d {
+		l.Unlock()
+		return
+	}
+	ends, ok := d.ends()
+	if !ok || time.Now().Before(ends) {
+		// The timer was restarted while we waited for the lock
+		l.Unlock()
+		return
+	}
+	d.State = d.State.Merge(devices.State{"on": false, "ends": ""})
+	d.timer = nil
+	dev := l.device(d)
+	l.Unlock()
+
+	logrus.Debugf("virtual: timer %s is done", d.ID)
+	l.onChange(dev)
+}
+
+func (l *List) device(d *Device) *devices.Device {
+	return &devices.Device{
+		Type:   "virtual-" + string(d.Type),
+		ID:     devices.ID{Node: l.nodeUUID, ID: d.ID},
+		Name:   d.Name,
+		Online: true,
+		State:  d.State.Clone(),
+		Traits: d.traits(),
+	}
+}
+
+func (l *List) Save() error {
+	l.RLock()
+	defer l.RUnlock()
+	if err := persist.Save("virtualdevices.json", l.devices); err != nil {
+		return fmt.Errorf("virtual: error saving virtualdevices.json: %s", err.Error())
+	}
+	return nil
+}
+
+func (l *List) Load() error {
+	list := make(Devices)
+	if err := persist.Load("virtualdevices.json", &list); err != nil {
+		if os.IsNotExist(err) {
+			return nil // We dont want to error our if the file does not exist when we start the server
+		}
+		return fmt.Errorf("virtual: error loading virtualdevices.json: %s", err.Error())
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	for id, d := range list {
+		d.ID = id
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("virtual: error loading virtualdevices.json: %s", err.Error())
+		}
+		if d.State == nil {
+			d.State = d.defaultState()
+		}
+	}
+	l.devices = list
+	return nil
+}
@@ -0,0 +1,118 @@
+package virtual
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lesismal/melody"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	stypes "github.com/stampzilla/stampzilla-go/v2/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSender struct {
+	sent []string
+}
+
+func (ms *mockSender) SendToID(to string, msgType string, data interface{}) error {
+	ms.sent = append(ms.sent, to)
+	return nil
+}
+
+func (ms *mockSender) SendToProtocol(to string, msgType string, data interface{}) error {
+	return nil
+}
+
+func (ms *mockSender) BroadcastWithFilter(msgType string, data interface{}, fn func(*melody.Session) bool) error {
+	return nil
+}
+
+func TestSetDevices(t *testing.T) {
+	l := NewList("server")
+	changed := make(map[string]*devices.Device)
+	l.OnChange(func(dev *devices.Device) {
+		changed[dev.ID.ID] = dev
+	})
+	removed := []devices.ID{}
+	l.OnRemove(func(id devices.ID) {
+		removed = append(removed, id)
+	})
+
+	zero := 0.0
+	err := l.SetDevices(Devices{
+		"away":   {Name: "Away", Type: Boolean},
+		"guests": {Type: Number, Min: &zero},
+		"mode":   {Type: Select, Options: []string{"home", "night"}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, changed, 3)
+	assert.Equal(t, devices.ID{Node: "server", ID: "away"}, changed["away"].ID)
+	assert.Equal(t, devices.State{"on": false}, changed["away"].State)
+	assert.Equal(t, []string{"OnOff"}, changed["away"].Traits)
+	assert.Equal(t, devices.State{"value": "home"}, changed["mode"].State)
+
+	assert.NoError(t, l.SetState("mode", devices.State{"value": "night"}))
+	assert.Equal(t, devices.State{"value": "night"}, changed["mode"].State)
+	assert.NoError(t, l.SetState("guests", devices.State{"value": -2}))
+	assert.Equal(t, devices.State{"value": 0.0}, changed["guests"].State)
+
+	assert.EqualError(t, l.SetState("mode", devices.State{"value": "away"}), "virtual device mode: away is not one of [home night]")
+	assert.EqualError(t, l.SetState("away", devices.State{"value": 1}), "virtual device away: unknown state key value")
+	assert.EqualError(t, l.SetState("missing", devices.State{"on": true}), "virtual device missing does not exist")
+
+	// The state is kept if the value is still valid
+	err = l.SetDevices(Devices{
+		"mode": {Type: Select, Options: []string{"home", "night", "away"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "night", l.Get("mode").State["value"])
+	assert.Len(t, removed, 2)
+
+	assert.EqualError(t, l.SetDevices(Devices{"mode": {Type: Select}}), "virtual device mode has no options")
+	assert.EqualError(t, l.SetDevices(Devices{"x": {Type: "switch"}}), "virtual device x has unknown type: switch")
+}
+
+func TestTimer(t *testing.T) {
+	l := NewList("server")
+	done := make(chan devices.State, 10)
+	l.OnChange(func(dev *devices.Device) {
+		done <- dev.State
+	})
+
+	err := l.SetDevices(Devices{
+		"timer": {Type: Timer, Duration: stypes.Duration(time.Hour)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, devices.State{"on": false, "ends": ""}, <-done)
+
+	assert.NoError(t, l.SetState("timer", devices.State{"on": true, "duration": "20ms"}))
+	state := <-done
+	assert.Equal(t, true, state["on"])
+	assert.NotEmpty(t, state["ends"])
+
+	select {
+	case state = <-done:
+		assert.Equal(t, devices.State{"on": false, "ends": ""}, state)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timer did not turn off")
+	}
+}
+
+func TestSender(t *testing.T) {
+	l := NewList("server")
+	assert.NoError(t, l.SetDevices(Devices{"away": {Type: Boolean}}))
+	ms := &mockSender{}
+	s := NewSender(ms, l)
+
+	err := s.SendToID("server", "state-change", map[devices.ID]devices.State{
+		{Node: "server", ID: "away"}: {"on": true},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, true, l.Get("away").State["on"])
+
+	err = s.SendToID("node", "state-change", map[devices.ID]devices.State{
+		{Node: "node", ID: "1"}: {"on": true},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node"}, ms.sent)
+}
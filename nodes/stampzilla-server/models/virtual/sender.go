@@ -0,0 +1,39 @@
+package virtual
+
+import (
+	"fmt"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
+)
+
+type sender struct {
+	websocket.Sender
+	list *List
+}
+
+// NewSender returns a sender that changes the state of the virtual devices when a state-change is sent to the server
+// and sends everything else with s.
+func NewSender(s websocket.Sender, l *List) websocket.Sender {
+	return &sender{
+		Sender: s,
+		list:   l,
+	}
+}
+
+func (s *sender) SendToID(to string, msgType string, data interface{}) error {
+	if to != s.list.NodeUUID() || msgType != "state-change" {
+		return s.Sender.SendToID(to, msgType, data)
+	}
+
+	states, ok := data.(map[devices.ID]devices.State)
+	if !ok {
+		return fmt.Errorf("virtual: unexpected state-change of type %T", data)
+	}
+	for id, state := range states {
+		if err := s.list.SetState(id.ID, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
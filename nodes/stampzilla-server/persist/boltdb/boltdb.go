@@ -0,0 +1,108 @@
+// Package boltdb is a persist.Backend that stores all documents in one bbolt database file. It is a separate
+// package so the nodes that use the models of the server do not depend on bbolt.
+package boltdb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	documentsBucket = []byte("documents")
+	previousBucket  = []byte("previous")
+)
+
+// Backend stores all documents in one bbolt database file. Put is a single transaction.
+type Backend struct {
+	db *bolt.DB
+}
+
+// New opens or creates the database. It fails if another process has it open.
+func New(path string) (*Backend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("boltdb: error opening %s: %s", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{documentsBucket, previousBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("boltdb: error opening %s: %s", path, err)
+	}
+	return &Backend{db: db}, nil
+}
+
+func (bb *Backend) get(bucket []byte, name string) ([]byte, error) {
+	var data []byte
+	err := bb.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucket).Get([]byte(name))
+		if v == nil {
+			return &os.PathError{Op: "get", Path: name, Err: os.ErrNotExist}
+		}
+		// v is only valid during the transaction
+		data = append([]byte{}, v...)
+		return nil
+	})
+	return data, err
+}
+
+func (bb *Backend) Get(name string) ([]byte, error) {
+	return bb.get(documentsBucket, name)
+}
+
+// Previous returns the version of the document before the last Put.
+func (bb *Backend) Previous(name string) ([]byte, error) {
+	return bb.get(previousBucket, name)
+}
+
+func (bb *Backend) Put(docs map[string][]byte) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		documents := tx.Bucket(documentsBucket)
+		previous := tx.Bucket(previousBucket)
+		for name, data := range docs {
+			if old := documents.Get([]byte(name)); old != nil {
+				if err := previous.Put([]byte(name), append([]byte{}, old...)); err != nil {
+					return err
+				}
+			}
+			if err := documents.Put([]byte(name), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bb *Backend) List(folder string) ([]string, error) {
+	prefix := ""
+	if folder != "" {
+		prefix = strings.TrimSuffix(folder, "/") + "/"
+	}
+
+	list := []string{}
+	err := bb.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(documentsBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			if strings.Contains(strings.TrimPrefix(string(k), prefix), "/") {
+				continue
+			}
+			list = append(list, string(k))
+		}
+		return nil
+	})
+	return list, err
+}
+
+func (bb *Backend) Close() error {
+	return bb.db.Close()
+}
@@ -0,0 +1,72 @@
+package boltdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stampzilla.db")
+	b, err := New(path)
+	assert.NoError(t, err)
+	persist.SetBackend(b)
+	defer persist.SetBackend(persist.NewFileBackend("."))
+
+	v := map[string]int{}
+	assert.True(t, os.IsNotExist(persist.Load("rules.json", &v)))
+
+	assert.NoError(t, persist.SaveAll(map[string]interface{}{
+		"rules.json":     map[string]int{"a": 1},
+		"configs/a.json": 1,
+		"configs/b.json": 2,
+	}))
+	assert.NoError(t, persist.Save("rules.json", map[string]int{"a": 2}))
+
+	assert.NoError(t, persist.Load("rules.json", &v))
+	assert.Equal(t, map[string]int{"a": 2}, v)
+
+	list, err := persist.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rules.json"}, list)
+	list, err = persist.List("configs")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"configs/a.json", "configs/b.json"}, list)
+
+	// A broken document is replaced by the previous version
+	assert.NoError(t, b.Put(map[string][]byte{"rules.json": []byte("{")}))
+	v = map[string]int{}
+	assert.NoError(t, persist.Load("rules.json", &v))
+	assert.Equal(t, map[string]int{"a": 2}, v)
+
+	// The database can only be opened once
+	assert.NoError(t, b.Close())
+	b, err = New(path)
+	assert.NoError(t, err)
+	_, err = New(path)
+	assert.Error(t, err)
+	assert.NoError(t, b.Close())
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	from := persist.NewFileBackend(dir)
+	assert.NoError(t, from.Put(map[string][]byte{
+		"rules.json":     []byte("{}"),
+		"configs/a.json": []byte("1"),
+	}))
+
+	to, err := New(filepath.Join(dir, "stampzilla.db"))
+	assert.NoError(t, err)
+	defer to.Close()
+
+	assert.NoError(t, persist.Migrate(from, to, []string{"rules.json", "configs/a.json"}))
+	data, err := to.Get("configs/a.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(data))
+
+	assert.Error(t, persist.Migrate(from, to, []string{"missing.json"}))
+}
@@ -0,0 +1,142 @@
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BackupSuffix is added to the name of the previous version of a file.
+const BackupSuffix = ".bak"
+
+// TempPrefix starts the name of the temporary files that are written before they are renamed.
+const TempPrefix = ".tmp-"
+
+// FileBackend stores each document as a json file in a directory. The previous version is kept in name.bak.
+type FileBackend struct {
+	dir string
+}
+
+// NewFileBackend returns a backend that stores the documents in dir.
+func NewFileBackend(dir string) *FileBackend {
+	return &FileBackend{dir: dir}
+}
+
+// path returns the file of a document. Absolute names are used as they are.
+func (fb *FileBackend) path(name string) string {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(fb.dir, name)
+}
+
+func (fb *FileBackend) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(fb.path(name))
+}
+
+// Previous returns the version of the document before the last Put.
+func (fb *FileBackend) Previous(name string) ([]byte, error) {
+	return ioutil.ReadFile(fb.path(name) + BackupSuffix)
+}
+
+// Put writes each document atomically. The files are written one at a time so a crash can leave some of them updated.
+func (fb *FileBackend) Put(docs map[string][]byte) error {
+	for name, data := range docs {
+		p := fb.path(name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := WriteFile(p, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the json files in the folder. Hidden files and previous versions are left out.
+func (fb *FileBackend) List(folder string) ([]string, error) {
+	files, err := ioutil.ReadDir(fb.path(folder))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	list := []string{}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		list = append(list, path.Join(folder, f.Name()))
+	}
+	return list, nil
+}
+
+func (fb *FileBackend) Close() error {
+	return nil
+}
+
+// WriteFile atomically replaces filename with data and keeps the old content in filename.bak.
+// The data is written to a temporary file that is synced to disk and renamed over filename,
+// so filename always has either the old or the new content.
+func WriteFile(filename string, data []byte, perm os.FileMode) error {
+	return writeFile(filename, data, perm, true)
+}
+
+func writeFile(filename string, data []byte, perm os.FileMode, keepPrevious bool) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, TempPrefix+base)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	// Keep the previous version. A hard link leaves filename in place until the rename below.
+	if _, err := os.Stat(filename); err == nil && keepPrevious {
+		os.Remove(filename + BackupSuffix)
+		if err := os.Link(filename, filename+BackupSuffix); err != nil {
+			logrus.Warnf("persist: could not keep previous version of %s: %s", filename, err)
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes the rename durable. Not all platforms can sync a directory so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
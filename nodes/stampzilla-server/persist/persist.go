@@ -0,0 +1,217 @@
+// Package persist stores the json documents of the server, like rules.json and configs/<node>.json, in a Backend.
+// The file backend writes them atomically to disk so a crash or a full disk never leaves a broken file behind.
+package persist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Backend stores documents by name. Names are slash separated, like "rules.json" or "configs/uuid.json".
+type Backend interface {
+	// Get returns the document. The error satisfies os.IsNotExist if it does not exist.
+	Get(name string) ([]byte, error)
+	// Put stores the documents. Backends that support it store all of them in one transaction.
+	Put(docs map[string][]byte) error
+	// List returns the names of the documents in a folder. The root folder is "".
+	List(folder string) ([]string, error)
+	Close() error
+}
+
+// previousVersions is implemented by backends that keep the previous version of each document.
+type previousVersions interface {
+	Previous(name string) ([]byte, error)
+}
+
+// Recovery is a document that was broken and replaced by its previous version when it was loaded.
+type Recovery struct {
+	Filename string    `json:"filename"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+var (
+	backend    Backend = NewFileBackend(".")
+	recoveries []Recovery
+	mu         sync.Mutex
+)
+
+// SetBackend sets the backend used by Save, SaveAll, Load and List. The default is a file backend in the working directory.
+func SetBackend(b Backend) {
+	mu.Lock()
+	backend = b
+	mu.Unlock()
+}
+
+// CurrentBackend returns the backend used by Save, SaveAll, Load and List.
+func CurrentBackend() Backend {
+	mu.Lock()
+	defer mu.Unlock()
+	return backend
+}
+
+// Recoveries returns all documents that have been recovered since the server started.
+func Recoveries() []Recovery {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]Recovery, len(recoveries))
+	copy(list, recoveries)
+	return list
+}
+
+func recovered(name string, err error) {
+	logrus.Errorf("persist: %s is broken (%s). Loaded the previous version instead", name, err)
+	mu.Lock()
+	recoveries = append(recoveries, Recovery{Filename: name, Error: err.Error(), Time: time.Now()})
+	mu.Unlock()
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Save stores v as indented json in the document name.
+func Save(name string, v interface{}) error {
+	return SaveAll(map[string]interface{}{name: v})
+}
+
+// SaveAll stores several documents. They are written in one transaction if the backend supports it.
+func SaveAll(docs map[string]interface{}) error {
+	b := Batch{}
+	for name, v := range docs {
+		if err := b.Add(name, v); err != nil {
+			return err
+		}
+	}
+	return b.Save()
+}
+
+// Batch collects documents that are saved together in one transaction if the backend supports it.
+// The documents are encoded when they are added so the caller can release its locks before Save.
+type Batch map[string][]byte
+
+// Add encodes v as indented json and adds it to the batch as the document name.
+func (b Batch) Add(name string, v interface{}) error {
+	data, err := encode(v)
+	if err != nil {
+		return err
+	}
+	b[name] = data
+	return nil
+}
+
+// Save stores all documents in the batch.
+func (b Batch) Save() error {
+	return CurrentBackend().Put(b)
+}
+
+// SaveFile writes v as indented json directly to a file on disk, whatever the backend is. Used for config.json.
+func SaveFile(filename string, v interface{}) error {
+	data, err := encode(v)
+	if err != nil {
+		return err
+	}
+	return WriteFile(filename, data, 0644)
+}
+
+// List returns the names of the documents in a folder.
+func List(folder string) ([]string, error) {
+	return CurrentBackend().List(folder)
+}
+
+// Load decodes the json in the document name into v. If the document is empty or broken the previous version
+// is used if the backend keeps one. The error satisfies os.IsNotExist if the document does not exist.
+func Load(name string, v interface{}) error {
+	b := CurrentBackend()
+	data, err := b.Get(name)
+	if err == nil {
+		err = decode(name, data, v)
+	}
+	if err == nil || os.IsNotExist(err) {
+		return err
+	}
+
+	pv, ok := b.(previousVersions)
+	if !ok {
+		return err
+	}
+	previous, perr := pv.Previous(name)
+	if perr == nil {
+		perr = decode(name, previous, v)
+	}
+	if perr != nil {
+		if os.IsNotExist(perr) {
+			return err
+		}
+		return fmt.Errorf("%s (previous version: %s)", err, perr)
+	}
+	recovered(name, err)
+	return nil
+}
+
+// decode checks that the whole document can be decoded before v is touched so a broken document never leaves v half loaded.
+func decode(name string, data []byte, v interface{}) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return fmt.Errorf("%s is empty", name)
+	}
+
+	check := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+	if err := json.Unmarshal(data, check); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Repair replaces the file with its previous version if it is empty or broken.
+// It is used for files on disk that are read by other libraries, like config.json.
+func Repair(filename string) error {
+	var v interface{}
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = decode(filename, data, &v)
+	}
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+
+	previous, berr := ioutil.ReadFile(filename + BackupSuffix)
+	if berr == nil {
+		berr = decode(filename, previous, &v)
+	}
+	if berr != nil {
+		return err
+	}
+	if werr := writeFile(filename, previous, 0644, false); werr != nil {
+		return werr
+	}
+	recovered(filepath.ToSlash(filename), err)
+	return nil
+}
+
+// Migrate copies the documents from one backend to another in one Put.
+func Migrate(from, to Backend, names []string) error {
+	docs := make(map[string][]byte, len(names))
+	for _, name := range names {
+		data, err := from.Get(name)
+		if err != nil {
+			return fmt.Errorf("persist: error migrating %s: %s", name, err)
+		}
+		docs[name] = data
+	}
+	return to.Put(docs)
+}
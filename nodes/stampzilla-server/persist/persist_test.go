@@ -0,0 +1,105 @@
+package persist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useFileBackend stores the documents in a temporary directory during the test.
+func useFileBackend(t *testing.T) string {
+	dir := t.TempDir()
+	SetBackend(NewFileBackend(dir))
+	t.Cleanup(func() {
+		SetBackend(NewFileBackend("."))
+	})
+	return dir
+}
+
+func TestSaveKeepsPreviousVersion(t *testing.T) {
+	dir := useFileBackend(t)
+
+	assert.NoError(t, Save("rules.json", map[string]int{"a": 1}))
+	_, err := os.Stat(filepath.Join(dir, "rules.json"+BackupSuffix))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, Save("rules.json", map[string]int{"a": 2}))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "rules.json"+BackupSuffix))
+	assert.NoError(t, err)
+	assert.Equal(t, "{\n\t\"a\": 1\n}\n", string(data))
+
+	v := map[string]int{}
+	assert.NoError(t, Load("rules.json", &v))
+	assert.Equal(t, map[string]int{"a": 2}, v)
+
+	// No temporary files are left
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestLoadRecoversPreviousVersion(t *testing.T) {
+	dir := useFileBackend(t)
+
+	assert.NoError(t, Save("rules.json", map[string]int{"a": 1}))
+	assert.NoError(t, Save("rules.json", map[string]int{"a": 2}))
+
+	for _, broken := range []string{"", "{\"a\": 3, \"b\"", "[1, 2]"} {
+		before := len(Recoveries())
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rules.json"), []byte(broken), 0644))
+		v := map[string]int{}
+		assert.NoError(t, Load("rules.json", &v), fmt.Sprintf("content %q", broken))
+		assert.Equal(t, map[string]int{"a": 1}, v)
+		assert.Len(t, Recoveries(), before+1)
+		assert.Equal(t, "rules.json", Recoveries()[before].Filename)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := useFileBackend(t)
+
+	v := map[string]int{}
+	assert.True(t, os.IsNotExist(Load("rules.json", &v)))
+
+	// Without a previous version the error is returned and v is untouched
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rules.json"), []byte(`{"a": 1, "b": "x"}`), 0644))
+	assert.Error(t, Load("rules.json", &v))
+	assert.Len(t, v, 0)
+}
+
+func TestFileBackendList(t *testing.T) {
+	dir := useFileBackend(t)
+
+	assert.NoError(t, SaveAll(map[string]interface{}{
+		"configs/a.json": 1,
+		"configs/b.json": 2,
+	}))
+	assert.NoError(t, Save("configs/a.json", 3))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "configs", ".hidden.json"), []byte("1"), 0644))
+
+	list, err := List("configs")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"configs/a.json", "configs/b.json"}, list)
+
+	list, err = List("missing")
+	assert.NoError(t, err)
+	assert.Len(t, list, 0)
+}
+
+func TestRepair(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, Repair(filename))
+
+	assert.NoError(t, SaveFile(filename, map[string]string{"port": "8080"}))
+	assert.NoError(t, SaveFile(filename, map[string]string{"port": "8081"}))
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("{\"port\": "), 0644))
+
+	assert.NoError(t, Repair(filename))
+	data, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\n\t\"port\": \"8080\"\n}\n", string(data))
+}
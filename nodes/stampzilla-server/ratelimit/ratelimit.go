@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// pruneInterval is how often keys without recent failures are forgotten.
+const pruneInterval = time.Minute
+
+// Settings controls how failed attempts are throttled.
+type Settings struct {
+	// Free is the number of failures that are allowed before the backoff starts.
+	Free int
+	// Delay is the wait after the first failure past Free. It doubles with each failure, up to Lockout.
+	Delay time.Duration
+	// LockoutAfter is the number of failures that locks the key out for Lockout. 0 never locks out.
+	LockoutAfter int
+	// Lockout is how long a key is locked out. Failures are forgotten when there has been none for this long.
+	Lockout time.Duration
+}
+
+type entry struct {
+	failures int
+	last     time.Time
+	blocked  time.Time
+}
+
+// Limiter throttles failed attempts per key, like an ip address or a username.
+type Limiter struct {
+	settings  Settings
+	entries   map[string]*entry
+	lastPrune time.Time
+	sync.Mutex
+}
+
+// New returns a limiter with the settings.
+func New(settings Settings) *Limiter {
+	return &Limiter{
+		settings: settings,
+		entries:  make(map[string]*entry),
+	}
+}
+
+// Allow returns 0 if the key may make an attempt now, otherwise how long it has to wait.
+func (l *Limiter) Allow(key string, now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok || !now.Before(e.blocked) {
+		return 0
+	}
+	return e.blocked.Sub(now)
+}
+
+// Fail records a failed attempt. It returns true if the key was locked out by this failure.
+func (l *Limiter) Fail(key string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	l.prune(now)
+
+	e, ok := l.entries[key]
+	if !ok || (now.Sub(e.last) > l.settings.Lockout && !now.Before(e.blocked)) {
+		e = &entry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+
+	if l.settings.LockoutAfter > 0 && e.failures >= l.settings.LockoutAfter {
+		e.blocked = now.Add(l.settings.Lockout)
+		// The backoff starts over after the lockout, so the next lockout needs as many failures again
+		e.failures = l.settings.Free
+		return true
+	}
+
+	if e.failures > l.settings.Free {
+		delay := l.settings.Delay
+		for i := l.settings.Free + 1; i < e.failures; i++ {
+			delay *= 2
+			if l.settings.Lockout > 0 && delay >= l.settings.Lockout {
+				delay = l.settings.Lockout
+				break
+			}
+		}
+		e.blocked = now.Add(delay)
+	}
+	return false
+}
+
+// Reset forgets the failures of the key, used after a successful attempt.
+func (l *Limiter) Reset(key string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.entries, key)
+}
+
+// prune forgets keys that are not blocked and have not failed within Lockout.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+
+	for key, e := range l.entries {
+		if now.After(e.blocked) && now.Sub(e.last) > l.settings.Lockout {
+			delete(l.entries, key)
+		}
+	}
+}
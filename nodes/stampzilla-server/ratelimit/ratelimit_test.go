@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffAndLockout(t *testing.T) {
+	l := New(Settings{Free: 2, Delay: time.Second, LockoutAfter: 6, Lockout: time.Minute})
+	now := time.Now()
+
+	// The free failures are not throttled
+	assert.False(t, l.Fail("a", now))
+	assert.False(t, l.Fail("a", now))
+	assert.Equal(t, time.Duration(0), l.Allow("a", now))
+
+	// Then the wait doubles with each failure
+	assert.False(t, l.Fail("a", now))
+	assert.Equal(t, time.Second, l.Allow("a", now))
+	assert.False(t, l.Fail("a", now))
+	assert.Equal(t, 2*time.Second, l.Allow("a", now))
+	assert.False(t, l.Fail("a", now))
+	assert.Equal(t, 4*time.Second, l.Allow("a", now))
+	assert.Equal(t, time.Duration(0), l.Allow("a", now.Add(4*time.Second)))
+
+	// Other keys are not affected
+	assert.Equal(t, time.Duration(0), l.Allow("b", now))
+
+	assert.True(t, l.Fail("a", now))
+	assert.Equal(t, time.Minute, l.Allow("a", now))
+	assert.Equal(t, time.Duration(0), l.Allow("a", now.Add(time.Minute)))
+
+	// The backoff starts over after the lockout
+	assert.False(t, l.Fail("a", now.Add(time.Minute)))
+	assert.Equal(t, time.Second, l.Allow("a", now.Add(time.Minute)))
+
+	l.Reset("a")
+	assert.Equal(t, time.Duration(0), l.Allow("a", now.Add(time.Minute)))
+}
+
+func TestForget(t *testing.T) {
+	l := New(Settings{Free: 0, Delay: time.Second, Lockout: time.Minute})
+	now := time.Now()
+
+	assert.False(t, l.Fail("a", now))
+	assert.False(t, l.Fail("a", now))
+	assert.Equal(t, 2*time.Second, l.Allow("a", now))
+
+	// The delay never grows past the lockout time
+	for i := 0; i < 10; i++ {
+		l.Fail("a", now)
+	}
+	assert.Equal(t, time.Minute, l.Allow("a", now))
+
+	// Failures are forgotten after the lockout time without failures
+	later := now.Add(2 * time.Minute)
+	assert.False(t, l.Fail("a", later))
+	assert.Equal(t, time.Second, l.Allow("a", later))
+
+	assert.False(t, l.Fail("b", later.Add(2*time.Minute)))
+	assert.NotContains(t, l.entries, "a")
+}
@@ -10,15 +10,23 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"time"
 
 	"github.com/lesismal/melody"
 	"github.com/onrik/logrus/filename"
 	"github.com/sirupsen/logrus"
 	"github.com/stamp/mdns"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/audit"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/backup"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/ca"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/handlers"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/history"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/logic"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/virtual"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/ratelimit"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/store"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/webserver"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
@@ -58,11 +66,23 @@ func (c *Main) Run() {
 	ctx, cancel := context.WithCancel(context.Background())
 	c.Store.Logic.Start(ctx)
 	c.Store.Scheduler.Start(ctx)
+	c.Store.VirtualDevices.Start()
+	if c.Store.History != nil {
+		c.Store.History.Start(ctx)
+	}
+	if c.Store.Audit != nil {
+		c.Store.Audit.Start(ctx)
+	}
+	c.CA.Start(ctx, websocket.NewWebsocketSender(c.TLSServer.Melody))
 
 	<-done
 	<-tlsDone
 	cancel() // stop logic
 	c.Store.Logic.Wait()
+	// Events that are waiting to be saved
+	if err := c.Store.Logic.RuleHistory.Save(); err != nil {
+		logrus.Error(err)
+	}
 	c.Config.Save("config.json")
 }
 
@@ -81,6 +101,8 @@ func (m *Main) TLSConfig() *tls.Config {
 		ClientCAs: caCertPool,
 		// Certificates: []tls.Certificate{*c.CA.TLS},
 		ClientAuth: tls.VerifyClientCertIfGiven,
+		// Reject revoked client certificates
+		VerifyConnection: m.CA.VerifyConnection,
 	}
 }
 
@@ -104,6 +126,14 @@ func (m *Main) Init() {
 	if err != nil {
 		logrus.Fatal(err)
 	}
+	if m.Config.CertificateValidity != "" {
+		m.CA.Validity = parseDuration("certificateValidity", m.Config.CertificateValidity)
+	}
+	m.CA.RenewBefore = parseDuration("certificateRenewBefore", m.Config.CertificateRenewBefore)
+	m.CA.WarnBefore = parseDuration("certificateExpiryWarning", m.Config.CertificateExpiryWarning)
+	m.CA.WarnDestinations = m.Config.CertificateExpiryDestinations
+	m.CA.MaxPendingRequests = m.Config.MaxCertificateRequests
+	m.CA.MaxPendingRequestsPerIP = m.Config.MaxCertificateRequestsPerIP
 
 	insecureMelody := melody.New()
 	// TODO i dont like melody anymore.. raw gorilla seems fine?
@@ -113,21 +143,49 @@ func (m *Main) Init() {
 	secureMelody.Config.MaxMessageSize = 0
 
 	insecureSender := websocket.NewWebsocketSender(insecureMelody)
-	secureSender := websocket.NewWebsocketSender(secureMelody)
+	// Virtual devices are hosted under the uuid of the server and state-changes to them never reach a node
+	virtualDevices := virtual.NewList(m.Config.UUID)
+	secureSender := virtual.NewSender(websocket.NewWebsocketSender(secureMelody), virtualDevices)
 
 	sss := logic.NewSavedStateStore()
 	l := logic.New(sss, secureSender)
+	calendar, err := logic.NewCalendar(m.Config.Latitude, m.Config.Longitude, m.Config.Holidays)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	l.SetCalendar(calendar)
+	l.SetNodeUUID(m.Config.UUID)
 	scheduler := logic.NewScheduler(sss, secureSender, l)
 	m.Store = store.New(l, scheduler, sss)
+	m.Store.SetVirtualDevices(virtualDevices)
+	m.Store.SetSnapshots(backup.NewSnapshots(backup.DefaultDir, ".", persist.CurrentBackend(), m.Config.BackupSnapshots))
 	m.CA.SetStore(m.Store)
 
+	historySettings, err := history.ParseSettings(m.Config.HistoryRetention, m.Config.HistoryDownsampleAfter, m.Config.HistoryDownsampleInterval)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	m.Store.History = history.New("devicehistory", historySettings)
+
+	auditRetention := parseDuration("auditRetention", m.Config.AuditRetention)
+	m.Store.Audit = audit.New("auditlog", auditRetention, audit.DefaultLength)
+	m.Store.RequireAdminTOTP = m.Config.RequireAdminTOTP
+
 	if err = m.Store.Load(); err != nil {
 		log.Fatalf("Failed to load state from disk: %s", err)
 	}
+	// Tell the admin in the gui about broken files that were replaced by their previous version
+	for _, r := range persist.Recoveries() {
+		m.Store.AddOrUpdateServer("recovered", r.Filename, devices.State{
+			"error": r.Error,
+			"time":  r.Time,
+		})
+	}
 	m.HTTPServer = webserver.New(
 		m.Store,
 		m.Config,
 		handlers.NewInSecureWebsockerHandler(m.Store, m.Config, insecureSender, m.CA),
+		insecureSender,
 		insecureMelody,
 		nil,
 	)
@@ -135,12 +193,37 @@ func (m *Main) Init() {
 		m.Store,
 		m.Config,
 		handlers.NewSecureWebsockerHandler(m.Store, m.Config, secureSender, m.CA),
+		secureSender,
 		secureMelody,
 		m.CA,
 	)
 
+	m.TLSServer.SetLoginLimits(ratelimit.Settings{
+		Free:         m.Config.LoginBackoffAfter,
+		Delay:        time.Second,
+		LockoutAfter: m.Config.LoginLockoutAfter,
+		Lockout:      parseDuration("loginLockout", m.Config.LoginLockout),
+	}, m.Config.LoginLockoutDestinations)
+	for _, server := range []*webserver.Webserver{m.HTTPServer, m.TLSServer} {
+		if err := server.SetTrustedProxies(m.Config.TrustedProxies); err != nil {
+			logrus.Error(err)
+		}
+	}
+
 	m.Config.Save("config.json")
 
 	m.Store.OnUpdate(handlers.BroadcastUpdate(secureSender))
 	m.Store.OnUserDemote(m.TLSServer.Logout)
 }
+
+// parseDuration parses a duration setting from the config. Empty is 0.
+func parseDuration(name, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logrus.Fatalf("Invalid %s: %s", name, err)
+	}
+	return d
+}
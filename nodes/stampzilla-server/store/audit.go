@@ -0,0 +1,68 @@
+package store
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/audit"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+)
+
+// AddAuditEntry appends an entry to the audit log if there is one.
+func (store *Store) AddAuditEntry(e audit.Entry) {
+	if store.Audit == nil {
+		return
+	}
+	if err := store.Audit.Add(e); err != nil {
+		logrus.Error(err)
+	}
+	store.runCallbacks("auditlog")
+}
+
+// AuditStateChange adds a state-change to the audit log. The diff is between the current and the requested state of each device.
+func (store *Store) AuditStateChange(e audit.Entry, states map[devices.ID]devices.State) {
+	if store.Audit == nil {
+		return
+	}
+
+	current := make(map[string]devices.State)
+	requested := make(map[string]devices.State)
+	for id, state := range states {
+		cur := make(devices.State)
+		if dev := store.Devices.Get(id); dev != nil {
+			dev.RLock()
+			for k := range state {
+				if v, ok := dev.State[k]; ok {
+					cur[k] = v
+				}
+			}
+			dev.RUnlock()
+		}
+		current[id.String()] = cur
+		requested[id.String()] = state
+	}
+
+	diff, err := audit.Diff(current, requested)
+	if err != nil {
+		logrus.Error("audit: ", err)
+	}
+	e.Type = "state-change"
+	e.Diff = diff
+	store.AddAuditEntry(e)
+}
+
+// GetAuditLog returns the latest entries in the audit log.
+func (store *Store) GetAuditLog() []audit.Entry {
+	if store.Audit == nil {
+		return []audit.Entry{}
+	}
+	return store.Audit.Recent()
+}
+
+// QueryAuditLog returns the entries in the audit log between from and to.
+func (store *Store) QueryAuditLog(from, to time.Time) ([]audit.Entry, error) {
+	if store.Audit == nil {
+		return []audit.Entry{}, nil
+	}
+	return store.Audit.Query(from, to)
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/backup"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+)
+
+// SetSnapshots sets the snapshots that are taken when the configuration is saved.
+func (store *Store) SetSnapshots(s *backup.Snapshots) {
+	s.OnNew(func() {
+		store.runCallbacks("snapshots")
+	})
+
+	store.Lock()
+	store.Snapshots = s
+	store.Unlock()
+}
+
+// configSaved runs the callbacks of an area after its configuration has been saved, and takes a snapshot.
+// Updates of runtime state in the same areas, like the last run of a task, use runCallbacks so they do not
+// rotate out the snapshots of real configuration changes.
+func (store *Store) configSaved(area string) {
+	store.runCallbacks(area)
+
+	store.RLock()
+	s := store.Snapshots
+	store.RUnlock()
+	if s != nil {
+		s.Trigger()
+	}
+}
+
+// saveConfig saves the configuration of the areas in one transaction and then calls configSaved for each of them.
+// Updates that change several areas, like a blueprint and the rules generated from it, are saved with one call.
+func (store *Store) saveConfig(areas ...string) error {
+	b := persist.Batch{}
+	for _, area := range areas {
+		var err error
+		switch area {
+		case "rules":
+			err = store.Logic.AddTo(b)
+		case "blueprints":
+			err = store.Logic.BlueprintStore.AddTo(b)
+		case "persons":
+			err = store.Persons.AddTo(b)
+		default:
+			err = fmt.Errorf("store: saving %s is not supported", area)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := b.Save(); err != nil {
+		return fmt.Errorf("store: error saving %s: %s", strings.Join(areas, ", "), err)
+	}
+
+	for _, area := range areas {
+		store.configSaved(area)
+	}
+	return nil
+}
+
+func (store *Store) GetSnapshots() ([]backup.Snapshot, error) {
+	if store.Snapshots == nil {
+		return []backup.Snapshot{}, nil
+	}
+	return store.Snapshots.List()
+}
+
+// ExportBackup writes an archive with all configuration to w.
+func (store *Store) ExportBackup(w io.Writer) (*backup.Manifest, error) {
+	return backup.Export(w, persist.CurrentBackend(), ".")
+}
+
+// ImportBackup verifies the archive and imports it on the next start of the server.
+func (store *Store) ImportBackup(data []byte) (*backup.Manifest, error) {
+	if store.Snapshots == nil {
+		return nil, fmt.Errorf("backups are not enabled")
+	}
+	return store.Snapshots.SetPending(data)
+}
+
+// RestoreSnapshot restores a snapshot on the next start of the server.
+func (store *Store) RestoreSnapshot(name string) (*backup.Manifest, error) {
+	if store.Snapshots == nil {
+		return nil, fmt.Errorf("backups are not enabled")
+	}
+	return store.Snapshots.SetPendingSnapshot(name)
+}
@@ -1,6 +1,9 @@
 package store
 
-import "time"
+import (
+	"reflect"
+	"time"
+)
 
 type Certificate struct {
 	Serial     string         `json:"serial"`
@@ -21,10 +24,17 @@ func (store *Store) GetCertificates() []Certificate {
 	return store.Certificates
 }
 
+// UpdateCertificates sets the certificates in the CA. A snapshot is taken when a certificate has been issued or revoked.
 func (store *Store) UpdateCertificates(certs []Certificate) {
 	store.Lock()
+	changed := !reflect.DeepEqual(store.Certificates, certs)
+	initial := len(store.Certificates) == 0
 	store.Certificates = certs
 	store.Unlock()
 
+	if changed && !initial {
+		store.configSaved("certificates")
+		return
+	}
 	store.runCallbacks("certificates")
 }
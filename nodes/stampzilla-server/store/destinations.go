@@ -29,7 +29,7 @@ func (store *Store) AddOrUpdateDestination(dest *notification.Destination) {
 		logrus.Error(err)
 		return
 	}
-	store.runCallbacks("destinations")
+	store.configSaved("destinations")
 }
 
 func (store *Store) TriggerDestination(dest string, body string) error {
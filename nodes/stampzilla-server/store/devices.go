@@ -1,6 +1,13 @@
 package store
 
-import "github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/history"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+)
 
 func (store *Store) GetDevices() *devices.List {
 	store.RLock()
@@ -9,25 +16,70 @@ func (store *Store) GetDevices() *devices.List {
 }
 
 func (store *Store) AddOrUpdateDevice(dev *devices.Device) {
-	if dev == nil {
+	if !store.addOrUpdateDevice(dev) {
 		return
 	}
 
+	store.Logic.UpdateDevice(dev)
+	store.runCallbacks("devices")
+}
+
+// addOrUpdateComputedDevice adds a device that is computed by logic. Logic already has the new state.
+func (store *Store) addOrUpdateComputedDevice(dev *devices.Device) {
+	if store.addOrUpdateDevice(dev) {
+		store.runCallbacks("devices")
+	}
+}
+
+// addOrUpdateDevice adds the device to the store and returns true if it has changed.
+func (store *Store) addOrUpdateDevice(dev *devices.Device) bool {
+	if dev == nil {
+		return false
+	}
+
 	oldDev := store.Devices.Get(dev.ID)
 	if oldDev != nil && oldDev.Equal(dev) {
-		return
+		return false
 	}
 
+	store.recordHistory(oldDev, dev)
 	store.Devices.Add(dev)
-	node := store.GetNode(dev.ID.Node)
-
-	alias := node.Alias(dev.ID)
-	if alias != dev.Alias {
+	// Virtual and computed devices are hosted by the server and has no node
+	if node := store.GetNode(dev.ID.Node); node != nil {
+		alias := node.Alias(dev.ID)
+		labels := node.DeviceLabels(dev.ID)
 		dev.Lock()
 		dev.Alias = alias
+		dev.Labels = labels
 		dev.Unlock()
 	}
+	return true
+}
 
-	store.Logic.UpdateDevice(dev)
-	store.runCallbacks("devices")
+func (store *Store) recordHistory(oldDev, dev *devices.Device) {
+	if store.History == nil {
+		return
+	}
+
+	dev.RLock()
+	changed := dev.State.Clone()
+	dev.RUnlock()
+
+	if oldDev != nil {
+		oldDev.RLock()
+		changed = oldDev.State.Diff(changed)
+		oldDev.RUnlock()
+	}
+
+	if err := store.History.Add(dev.ID, changed); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// GetDeviceHistory returns the recorded values of a state key for a device.
+func (store *Store) GetDeviceHistory(id devices.ID, key string, from, to time.Time) ([]history.Point, error) {
+	if store.History == nil || !store.History.Enabled() {
+		return nil, fmt.Errorf("device history is disabled")
+	}
+	return store.History.Query(id, key, from, to)
 }
@@ -1,7 +1,13 @@
 package store
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/logic"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
 )
 
 func (store *Store) GetRules() logic.Rules {
@@ -12,8 +18,28 @@ func (store *Store) GetRules() logic.Rules {
 
 func (store *Store) AddOrUpdateRules(rules logic.Rules) {
 	store.Logic.SetRules(rules)
-	store.Logic.Save()
-	store.runCallbacks("rules")
+	if err := store.saveConfig("rules"); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (store *Store) GetBlueprints() logic.Blueprints {
+	return store.Logic.BlueprintStore.All()
+}
+
+// AddOrUpdateBlueprints regenerates all rules that use the blueprints and saves the blueprints and the rules together.
+func (store *Store) AddOrUpdateBlueprints(b logic.Blueprints) {
+	store.Logic.BlueprintStore.SetBlueprints(b)
+	store.Logic.ApplyBlueprints()
+	if err := store.saveConfig("blueprints", "rules"); err != nil {
+		logrus.Error(err)
+	}
+	store.Logic.Evaluate()
+}
+
+// GetRuleHistory returns the latest events of all rules.
+func (store *Store) GetRuleHistory() map[string][]logic.RuleEvent {
+	return store.Logic.RuleHistory.All()
 }
 
 func (store *Store) GetSavedStates() logic.SavedStates {
@@ -23,7 +49,109 @@ func (store *Store) GetSavedStates() logic.SavedStates {
 func (store *Store) AddOrUpdateSavedStates(s logic.SavedStates) {
 	store.SavedState.SetState(s)
 	store.SavedState.Save()
-	store.runCallbacks("savedstates")
+	store.configSaved("savedstates")
+}
+
+func (store *Store) GetScenes() logic.Scenes {
+	return store.Logic.SceneStore.All()
+}
+
+func (store *Store) AddOrUpdateScenes(s logic.Scenes) {
+	store.Logic.SceneStore.SetScenes(s)
+	store.Logic.SceneStore.Save()
+	store.configSaved("scenes")
+}
+
+// ApplyScene applies the scene in the background since a transition can take a while.
+func (store *Store) ApplyScene(uuid string) error {
+	return store.runScene(uuid, store.Logic.ApplyScene)
+}
+
+// RestoreScene restores the state captured when the scene was applied in the background.
+func (store *Store) RestoreScene(uuid string) error {
+	if store.Logic.SceneStore.Get(uuid) != nil && store.Logic.SceneStore.Captured(uuid) == nil {
+		return fmt.Errorf("scene %s has not been applied", uuid)
+	}
+	return store.runScene(uuid, store.Logic.RestoreScene)
+}
+
+func (store *Store) runScene(uuid string, fn func(context.Context, string, *logic.Rule) error) error {
+	if store.Logic.SceneStore.Get(uuid) == nil {
+		return fmt.Errorf("scene %s does not exist", uuid)
+	}
+	go func() {
+		if err := fn(context.Background(), uuid, nil); err != nil {
+			logrus.Error(err)
+		}
+	}()
+	return nil
+}
+
+// GetKeyOwners returns the uuid of the rule that owns each device key.
+func (store *Store) GetKeyOwners() map[string]map[string]string {
+	return store.Logic.KeyOwners()
+}
+
+// GetOverrides returns all active overrides.
+func (store *Store) GetOverrides() logic.Overrides {
+	return store.Logic.Overrides.All()
+}
+
+// WithoutOverridden returns the states without the keys that are forced by a device override.
+func (store *Store) WithoutOverridden(states map[devices.ID]devices.State) map[devices.ID]devices.State {
+	return store.Logic.Overrides.WithoutForced(states, time.Now())
+}
+
+func (store *Store) AddOverride(o *logic.Override) error {
+	return store.Logic.AddOverride(o)
+}
+
+// RemoveOverride removes the override and evaluates the rules again since they might have been suspended.
+func (store *Store) RemoveOverride(uuid string) error {
+	if err := store.Logic.RemoveOverride(uuid); err != nil {
+		return err
+	}
+	store.Logic.Evaluate()
+	return nil
+}
+
+func (store *Store) GetComputedDevices() logic.ComputedDevices {
+	return store.Logic.Computed.All()
+}
+
+// AddOrUpdateComputedDevices replaces the computed devices and removes the devices that no longer exists.
+func (store *Store) AddOrUpdateComputedDevices(c logic.ComputedDevices) error {
+	// Computed and virtual devices are both hosted under the uuid of the server
+	virtualDevices := store.GetVirtualDevices()
+	for id := range c {
+		if _, ok := virtualDevices[id]; ok {
+			return fmt.Errorf("computed device %s: id is used by a virtual device", id)
+		}
+	}
+
+	previous := store.Logic.Computed.All()
+	if err := store.Logic.SetComputedDevices(c); err != nil {
+		return err
+	}
+	if err := store.Logic.Computed.Save(); err != nil {
+		return err
+	}
+	store.configSaved("computeddevices")
+
+	removed := false
+	for id := range previous {
+		if _, ok := c[id]; !ok {
+			store.Devices.Remove(devices.ID{Node: store.Logic.NodeUUID(), ID: id})
+			removed = true
+		}
+	}
+	if removed {
+		store.runCallbacks("devices")
+	}
+
+	// Calculate the new devices
+	store.Logic.Evaluate()
+	return nil
 }
 
 func (store *Store) GetScheduledTasks() logic.Tasks {
@@ -33,5 +161,12 @@ func (store *Store) GetScheduledTasks() logic.Tasks {
 func (store *Store) AddOrUpdateScheduledTasks(tasks logic.Tasks) {
 	store.Scheduler.SetTasks(tasks)
 	store.Scheduler.Save()
-	store.runCallbacks("schedules")
+	store.configSaved("schedules")
+}
+
+// ExplainRule compiles and evaluates the rule without running it and lists missing references.
+func (store *Store) ExplainRule(rule *logic.Rule) *logic.Explanation {
+	return store.Logic.Explain(rule, func(uuid string) bool {
+		return store.Destinations.Get(uuid) != nil
+	})
 }
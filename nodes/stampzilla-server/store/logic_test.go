@@ -0,0 +1,61 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/logic"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/virtual"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputedAndVirtualDeviceIDsAreUnique(t *testing.T) {
+	store := &Store{Logic: logic.New(logic.NewSavedStateStore(), nil)}
+	store.VirtualDevices = virtual.NewList("server")
+	assert.NoError(t, store.VirtualDevices.SetDevices(virtual.Devices{
+		"switch": {Type: virtual.Boolean},
+	}))
+	assert.NoError(t, store.Logic.SetComputedDevices(logic.ComputedDevices{
+		"sum": {State: map[string]string{"value": "1.0"}},
+	}))
+
+	err := store.AddOrUpdateComputedDevices(logic.ComputedDevices{
+		"switch": {State: map[string]string{"on": "true"}},
+	})
+	assert.EqualError(t, err, "computed device switch: id is used by a virtual device")
+
+	err = store.AddOrUpdateVirtualDevices(virtual.Devices{
+		"sum": {Type: virtual.Boolean},
+	})
+	assert.EqualError(t, err, "virtual device sum: id is used by a computed device")
+}
+
+// putRecorder records the documents of each Put instead of storing them.
+type putRecorder struct {
+	persist.Backend
+	puts []map[string][]byte
+}
+
+func (pr *putRecorder) Put(docs map[string][]byte) error {
+	pr.puts = append(pr.puts, docs)
+	return nil
+}
+
+func TestSaveConfigIsOneTransaction(t *testing.T) {
+	previous := persist.CurrentBackend()
+	defer persist.SetBackend(previous)
+	recorder := &putRecorder{Backend: persist.NewFileBackend(t.TempDir())}
+	persist.SetBackend(recorder)
+
+	store := &Store{Logic: logic.New(logic.NewSavedStateStore(), nil)}
+	store.Logic.AddRule("rule")
+	assert.NoError(t, store.saveConfig("blueprints", "rules"))
+
+	if assert.Len(t, recorder.puts, 1) {
+		assert.Contains(t, recorder.puts[0], "blueprints.json")
+		assert.Contains(t, recorder.puts[0], "rules.json")
+	}
+
+	assert.EqualError(t, store.saveConfig("rules", "devices"), "store: saving devices is not supported")
+	assert.Len(t, recorder.puts, 1)
+}
@@ -1,14 +1,11 @@
 package store
 
 import (
-	"bytes"
-	"encoding/json"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"path"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/persist"
 )
 
 func (store *Store) GetNodes() Nodes {
@@ -58,60 +55,33 @@ func (store *Store) AddOrUpdateNode(node *models.Node) {
 	}
 }
 
-func (store *Store) SaveNode(node *models.Node) error {
-	path := "configs/"
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		os.MkdirAll(path, 0755)
-	}
+// nodeConfigFolder is where the config of each node is stored.
+const nodeConfigFolder = "configs"
 
-	configFile, err := os.Create(path + node.UUID + ".json")
-	if err != nil {
-		return err
-	}
-
-	var out bytes.Buffer
+func (store *Store) SaveNode(node *models.Node) error {
 	node.Lock()
-	b, err := json.MarshalIndent(node, "", "\t")
+	err := persist.Save(nodeConfigName(node.UUID), node)
 	node.Unlock()
-
 	if err != nil {
 		return err
 	}
-	json.Indent(&out, b, "", "\t")
-	_, err = out.WriteTo(configFile)
-	return err
-}
-
-func (store *Store) SaveNodes() error {
-	nodes := store.GetNodes()
-
-	for _, node := range nodes {
-		err := store.SaveNode(node)
-		if err != nil {
-			return err
-		}
-	}
 
+	store.configSaved("nodes")
 	return nil
 }
 
-func (store *Store) LoadNodes() error {
-	path := "configs"
+func nodeConfigName(uuid string) string {
+	return path.Join(nodeConfigFolder, uuid+".json")
+}
 
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return nil
-	}
-	files, err := ioutil.ReadDir(path)
+func (store *Store) LoadNodes() error {
+	names, err := persist.List(nodeConfigFolder)
 	if err != nil {
 		return err
 	}
 
-	for _, f := range files {
-		if f.Name()[0] == '.' {
-			continue
-		}
-
-		node, err := loadNodeConfigFromFile(filepath.Join(path, f.Name()))
+	for _, name := range names {
+		node, err := loadNodeConfig(name)
 		if err != nil {
 			return err
 		}
@@ -120,17 +90,8 @@ func (store *Store) LoadNodes() error {
 	return nil
 }
 
-func loadNodeConfigFromFile(file string) (*models.Node, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
+func loadNodeConfig(name string) (*models.Node, error) {
 	var node *models.Node
-
-	decoder := json.NewDecoder(f)
-	err = decoder.Decode(&node)
-
+	err := persist.Load(name, &node)
 	return node, err
 }
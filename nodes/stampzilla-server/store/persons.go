@@ -2,6 +2,7 @@ package store
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/persons"
@@ -54,8 +55,9 @@ func (store *Store) AddOrUpdatePerson(p persons.PersonWithPasswords) error {
 		return err
 	}
 
-	store.Persons.Save()
-	store.runCallbacks("persons")
+	if err := store.saveConfig("persons"); err != nil {
+		logrus.Error(err)
+	}
 
 	// Logout the demoted user from our server
 	if a != nil && a.IsAdmin && !p.IsAdmin {
@@ -103,8 +105,9 @@ func (store *Store) AddOrUpdatePersons(persons map[string]persons.PersonWithPass
 			}
 		}
 
-		store.Persons.Save()
-		store.runCallbacks("persons")
+		if err := store.saveConfig("persons"); err != nil {
+			logrus.Error(err)
+		}
 	}
 
 	return nil
@@ -130,3 +133,104 @@ func (store *Store) ValidateLogin(username, password string) (*persons.Person, e
 
 	return &p.Person, nil
 }
+
+// CreateToken creates an API token for the person. The returned secret is not stored and can not be shown again.
+func (store *Store) CreateToken(personUUID, name string, scopes []persons.Permission) (*persons.Token, string, error) {
+	t, secret, err := store.Persons.AddToken(personUUID, name, scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := store.saveConfig("persons"); err != nil {
+		logrus.Error(err)
+	}
+	return t, secret, nil
+}
+
+// RevokeToken removes an API token. Connections that use the token lose access on their next message.
+func (store *Store) RevokeToken(personUUID, id string) error {
+	if err := store.Persons.RevokeToken(personUUID, id); err != nil {
+		return err
+	}
+
+	if err := store.saveConfig("persons"); err != nil {
+		logrus.Error(err)
+	}
+	return nil
+}
+
+// ValidateToken returns the person and the token if the token is valid, and updates the last used time of the token.
+func (store *Store) ValidateToken(token string) (*persons.Person, *persons.Token, error) {
+	p, t, changed, err := store.Persons.CheckToken(token, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if changed {
+		store.Persons.Save()
+		store.runCallbacks("persons")
+	}
+	return p, t, nil
+}
+
+// TOTPEnrolmentRequired returns true if the person must enable two-factor authentication before using the gui.
+func (store *Store) TOTPEnrolmentRequired(p *persons.Person) bool {
+	return store.RequireAdminTOTP && p != nil && p.IsAdmin && !p.TOTPEnabled
+}
+
+// StartTOTP creates a new TOTP secret for the person that is enabled with ConfirmTOTP.
+func (store *Store) StartTOTP(personUUID string) (string, error) {
+	secret, err := store.Persons.StartTOTP(personUUID)
+	if err != nil {
+		return "", err
+	}
+
+	store.Persons.Save()
+	return secret, nil
+}
+
+// ConfirmTOTP enables two-factor authentication for the person and returns the recovery codes.
+func (store *Store) ConfirmTOTP(personUUID, code string) ([]string, error) {
+	codes, err := store.Persons.ConfirmTOTP(personUUID, code, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.saveConfig("persons"); err != nil {
+		logrus.Error(err)
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication for the person.
+func (store *Store) DisableTOTP(personUUID string) error {
+	if err := store.Persons.DisableTOTP(personUUID); err != nil {
+		return err
+	}
+
+	if err := store.saveConfig("persons"); err != nil {
+		logrus.Error(err)
+	}
+	return nil
+}
+
+// NewRecoveryCodes replaces the recovery codes of the person.
+func (store *Store) NewRecoveryCodes(personUUID string) ([]string, error) {
+	codes, err := store.Persons.NewRecoveryCodes(personUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	store.Persons.Save()
+	return codes, nil
+}
+
+// CheckSecondFactor checks the TOTP or recovery code of a person that has two-factor authentication enabled.
+func (store *Store) CheckSecondFactor(personUUID, code string) error {
+	if err := store.Persons.CheckSecondFactor(personUUID, code, time.Now()); err != nil {
+		return err
+	}
+
+	store.Persons.Save()
+	return nil
+}
@@ -1,9 +1,16 @@
 package store
 
+import (
+	"fmt"
+
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/helpers"
+)
+
 type Request struct {
 	Identity   string         `json:"identity"`
 	Subject    RequestSubject `json:"subject"`
 	Connection string         `json:"connection"`
+	RemoteAddr string         `json:"remoteAddr"`
 	Type       string         `json:"type"`
 	Version    string         `json:"version"`
 
@@ -30,12 +37,36 @@ func (store *Store) GetRequests() []Request {
 	return store.Requests
 }
 
-func (store *Store) AddRequest(r Request) {
+// AddRequest adds a certificate request that waits for approval. Each connection can have one pending request,
+// no more than max requests are pending at the same time and no more than maxPerIP from the same ip address.
+// A limit of 0 is no limit.
+func (store *Store) AddRequest(r Request, max, maxPerIP int) error {
+	ip := helpers.RemoteIP(r.RemoteAddr)
+	fromIP := 0
+
 	store.Lock()
+	for _, pending := range store.Requests {
+		if pending.Connection == r.Connection {
+			store.Unlock()
+			return fmt.Errorf("connection %s already has a pending certificate request", r.Connection)
+		}
+		if helpers.RemoteIP(pending.RemoteAddr) == ip {
+			fromIP++
+		}
+	}
+	if maxPerIP > 0 && fromIP >= maxPerIP {
+		store.Unlock()
+		return fmt.Errorf("too many pending certificate requests from %s, %d are waiting for approval", ip, fromIP)
+	}
+	if max > 0 && len(store.Requests) >= max {
+		store.Unlock()
+		return fmt.Errorf("too many pending certificate requests, %d are waiting for approval", len(store.Requests))
+	}
 	store.Requests = append(store.Requests, r)
 	store.Unlock()
 
 	store.runCallbacks("requests")
+	return nil
 }
 
 func (store *Store) RemoveRequest(c string, approved bool) {
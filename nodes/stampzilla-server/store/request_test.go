@@ -0,0 +1,36 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddRequest(t *testing.T) {
+	store := &Store{}
+
+	assert.NoError(t, store.AddRequest(Request{Connection: "1"}, 2, 0))
+	assert.Error(t, store.AddRequest(Request{Connection: "1"}, 2, 0))
+	assert.NoError(t, store.AddRequest(Request{Connection: "2"}, 2, 0))
+	assert.Error(t, store.AddRequest(Request{Connection: "3"}, 2, 0))
+	assert.Len(t, store.GetRequests(), 2)
+
+	// Room for a new request when one is handled
+	store.RemoveRequest("1", false)
+	assert.NoError(t, store.AddRequest(Request{Connection: "3"}, 2, 0))
+
+	// 0 is no limit
+	assert.NoError(t, store.AddRequest(Request{Connection: "4"}, 0, 0))
+}
+
+func TestAddRequestPerIP(t *testing.T) {
+	store := &Store{}
+
+	assert.NoError(t, store.AddRequest(Request{Connection: "1", RemoteAddr: "10.0.0.1:1234"}, 10, 2))
+	assert.NoError(t, store.AddRequest(Request{Connection: "2", RemoteAddr: "10.0.0.1:1235"}, 10, 2))
+	assert.Error(t, store.AddRequest(Request{Connection: "3", RemoteAddr: "10.0.0.1:1236"}, 10, 2))
+
+	// Other addresses are not affected
+	assert.NoError(t, store.AddRequest(Request{Connection: "4", RemoteAddr: "10.0.0.2:1234"}, 10, 2))
+	assert.Len(t, store.GetRequests(), 3)
+}
@@ -15,5 +15,5 @@ func (store *Store) AddOrUpdateSender(sender notification.Sender) {
 
 	store.Senders.Add(sender)
 	store.Senders.Save("senders.json")
-	store.runCallbacks("senders")
+	store.configSaved("senders")
 }
@@ -4,11 +4,16 @@ import (
 	"sync"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/audit"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/backup"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/history"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/logic"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/notification"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/persons"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/virtual"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/ratelimit"
 )
 
 type (
@@ -33,6 +38,19 @@ type Store struct {
 	Destinations *notification.Destinations
 	Senders      *notification.Senders
 
+	// History is optional and records all device state changes on disk.
+	History *history.History
+	// VirtualDevices are devices hosted by the server itself.
+	VirtualDevices *virtual.List
+	// Snapshots are taken of the configuration when it is saved.
+	Snapshots *backup.Snapshots
+	// Audit is optional and records who changed what.
+	Audit *audit.Log
+	// RequireAdminTOTP forces admins to enable two-factor authentication before they can use the gui.
+	RequireAdminTOTP bool
+	// LoginUsers is optional and throttles failed logins and two-factor codes per username.
+	LoginUsers *ratelimit.Limiter
+
 	onUpdate     []UpdateCallback
 	onUserDemote []UserDemoteCallback
 	sync.RWMutex
@@ -59,6 +77,53 @@ func New(l *logic.Logic, s *logic.Scheduler, sss *logic.SavedStateStore) *Store
 	})
 
 	l.OnTriggerDestination(store.TriggerDestination)
+	l.OnReleaseDestination(store.ReleaseDestination)
+	l.OnRulesChanged(func() {
+		if err := store.saveConfig("rules"); err != nil {
+			logrus.Error(err)
+		}
+	})
+	s.OnlineCheck(func(id devices.ID) bool {
+		dev := store.Devices.Get(id)
+		if dev == nil {
+			return false
+		}
+		dev.RLock()
+		defer dev.RUnlock()
+		return dev.Online
+	})
+	s.OnTaskRun(func(*logic.Task) {
+		if err := s.Save(); err != nil {
+			logrus.Error(err)
+		}
+		store.runCallbacks("schedules")
+	})
+	l.OnRuleEvent(func(string, logic.RuleEvent) {
+		l.RuleHistory.SaveLater(func(err error) {
+			if err != nil {
+				logrus.Error(err)
+			}
+			store.runCallbacks("rulehistory")
+		})
+	})
+	l.OnComputedDevice(store.addOrUpdateComputedDevice)
+	l.OnOverridesChanged(func() {
+		if err := l.Overrides.Save(); err != nil {
+			logrus.Error(err)
+		}
+		store.runCallbacks("overrides")
+	})
+	l.OnScenesCaptured(func() {
+		if err := l.SceneStore.SaveCaptured(); err != nil {
+			logrus.Error(err)
+		}
+	})
+	l.OnKeyOwnersChanged(func() {
+		store.runCallbacks("keyowners")
+	})
+	l.OnStateChange(func(origin audit.Origin, source string, states map[devices.ID]devices.State) {
+		store.AuditStateChange(audit.Entry{Origin: origin, Source: source}, states)
+	})
 
 	return store
 }
@@ -90,9 +155,42 @@ func (store *Store) Load() error {
 		return err
 	}
 
+	if err := store.Logic.BlueprintStore.Load(); err != nil {
+		return err
+	}
+
 	if err := store.Logic.Load(); err != nil {
 		return err
 	}
+	store.Logic.ApplyBlueprints()
+
+	if err := store.Logic.RuleHistory.Load(); err != nil {
+		return err
+	}
+
+	if err := store.Logic.SceneStore.Load(); err != nil {
+		return err
+	}
+
+	if err := store.Logic.Overrides.Load(); err != nil {
+		return err
+	}
+
+	if err := store.Logic.Computed.Load(); err != nil {
+		return err
+	}
+
+	if store.VirtualDevices != nil {
+		if err := store.VirtualDevices.Load(); err != nil {
+			return err
+		}
+	}
+
+	if store.Audit != nil {
+		if err := store.Audit.Load(); err != nil {
+			return err
+		}
+	}
 
 	if err := store.Scheduler.Load(); err != nil {
 		return err
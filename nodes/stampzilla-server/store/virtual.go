@@ -0,0 +1,52 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/virtual"
+)
+
+// SetVirtualDevices sets the virtual devices hosted by the server and publishes them as normal devices when they change.
+func (store *Store) SetVirtualDevices(l *virtual.List) {
+	l.OnChange(func(dev *devices.Device) {
+		if err := l.Save(); err != nil {
+			logrus.Error(err)
+		}
+		store.AddOrUpdateDevice(dev)
+	})
+	l.OnRemove(func(id devices.ID) {
+		store.Devices.Remove(id)
+		store.runCallbacks("devices")
+	})
+
+	store.Lock()
+	store.VirtualDevices = l
+	store.Unlock()
+}
+
+func (store *Store) GetVirtualDevices() virtual.Devices {
+	if store.VirtualDevices == nil {
+		return virtual.Devices{}
+	}
+	return store.VirtualDevices.All()
+}
+
+func (store *Store) AddOrUpdateVirtualDevices(d virtual.Devices) error {
+	// Computed and virtual devices are both hosted under the uuid of the server
+	computed := store.GetComputedDevices()
+	for id := range d {
+		if _, ok := computed[id]; ok {
+			return fmt.Errorf("virtual device %s: id is used by a computed device", id)
+		}
+	}
+	if err := store.VirtualDevices.SetDevices(d); err != nil {
+		return err
+	}
+	if err := store.VirtualDevices.Save(); err != nil {
+		return err
+	}
+	store.configSaved("virtualdevices")
+	return nil
+}
@@ -182,7 +182,8 @@ class Landing extends Component {
                   {server.get('allowLogin') && !server.get('init') && (
                     <Login
                       error={this.state.error}
-                      onSubmit={(username, password) => {
+                      needCode={this.state.needCode}
+                      onSubmit={(username, password, code) => {
                         const serverUrl = Url.parse(app.get('url'));
                         const u = `https://${serverUrl.hostname}:${server.get(
                           'tlsPort',
@@ -191,8 +192,10 @@ class Landing extends Component {
                         const formData = new FormData();
                         formData.append('username', username);
                         formData.append('password', password);
+                        formData.append('code', code);
                         post(u, formData, { withCredentials: true })
                           .then(() => {
+                            this.setState({ error: null, needCode: false });
                             this.props.dispatch(update({ url: '' }));
                             this.props.dispatch(
                               update({ url: app.get('url') }),
@@ -200,7 +203,10 @@ class Landing extends Component {
                           })
                           .catch((error) => {
                             if (error.response) {
+                              const needCode = this.state.needCode
+                                || error.response.data === 'two-factor code required';
                               this.setState({
+                                needCode,
                                 error: {
                                   status: error.response.status,
                                   message: error.response.data,
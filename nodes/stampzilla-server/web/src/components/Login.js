@@ -7,6 +7,7 @@ class Login extends Component {
   state = {
     username: '',
     password: '',
+    code: '',
   };
 
   constructor(props) {
@@ -29,12 +30,12 @@ class Login extends Component {
   onSubmit = (e) => {
     e.preventDefault();
 
-    this.props.onSubmit(this.state.username, this.state.password);
+    this.props.onSubmit(this.state.username, this.state.password, this.state.code);
   };
 
   render() {
-    const { username, password } = this.state;
-    const { error } = this.props;
+    const { username, password, code } = this.state;
+    const { error, needCode } = this.props;
 
     return (
       <form onSubmit={this.onSubmit}>
@@ -61,8 +62,26 @@ class Login extends Component {
             onFocus={(e) => e.currentTarget.select()}
             value={password}
           />
-          {error && <div className="invalid-feedback">{error.message}</div>}
+          {error && !needCode && <div className="invalid-feedback">{error.message}</div>}
         </div>
+        {needCode && (
+          <div className="form-group">
+            <label htmlFor="code">Two-factor code</label>
+            <input
+              type="text"
+              className={classnames('form-control', error && 'is-invalid')}
+              id="code"
+              autoComplete="one-time-code"
+              onChange={(e) => this.onChange('code', e.target.value)}
+              value={code}
+              autoFocus
+            />
+            <small className="form-text text-muted">
+              The code from your authenticator app or a recovery code
+            </small>
+            {error && <div className="invalid-feedback">{error.message}</div>}
+          </div>
+        )}
         <button type="submit" className="btn btn-primary">
           Login
         </button>
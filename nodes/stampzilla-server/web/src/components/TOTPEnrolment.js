@@ -0,0 +1,39 @@
+import React from 'react';
+import { connect } from 'react-redux';
+
+import { update } from '../ducks/app';
+import TwoFactor from './TwoFactor';
+
+// TOTPEnrolment is shown instead of the gui to admins that must enable two-factor authentication first.
+const TOTPEnrolment = (props) => {
+  const { app, user, dispatch } = props;
+
+  // Reconnect so the server gives the session full access
+  const onDone = () => {
+    dispatch(update({ url: '' }));
+    dispatch(update({ url: app.get('url') }));
+  };
+
+  return (
+    <div className="landing-container">
+      <div className="background">
+        <div className="content d-flex flex-column justify-content-center align-items-center">
+          <div className="alert alert-warning" style={{ maxWidth: '500px' }}>
+            Administrators must enable two-factor authentication before they
+            can use this server.
+          </div>
+          <div style={{ maxWidth: '500px' }}>
+            <TwoFactor user={user} onDone={onDone} />
+          </div>
+        </div>
+      </div>
+    </div>
+  );
+};
+
+const mapToProps = (state) => ({
+  app: state.get('app'),
+  user: state.getIn(['connection', 'user']),
+});
+
+export default connect(mapToProps)(TOTPEnrolment);
@@ -0,0 +1,146 @@
+import React, { Component } from 'react';
+import { Button } from 'reactstrap';
+
+import { request } from './Websocket';
+import Card from './Card';
+
+// TwoFactor lets the logged in person enable and disable two-factor authentication with an authenticator app.
+class TwoFactor extends Component {
+  state = {
+    enabled: false,
+    enrolment: null,
+    recoveryCodes: null,
+    code: '',
+    error: null,
+  };
+
+  componentDidMount() {
+    const { user } = this.props;
+    this.setState({ enabled: !!(user && user.totp_enabled) });
+  }
+
+  onError = (error) => this.setState({ error: String(error) });
+
+  onEnrol = () => {
+    request({ type: 'totp-enrol' })
+      .then((enrolment) => this.setState({
+        enrolment, recoveryCodes: null, code: '', error: null,
+      }))
+      .catch(this.onError);
+  };
+
+  onConfirm = (e) => {
+    e.preventDefault();
+    const { code } = this.state;
+    request({ type: 'totp-confirm', body: { code } })
+      .then(({ recovery_codes: recoveryCodes }) => this.setState({
+        enabled: true, enrolment: null, recoveryCodes, code: '', error: null,
+      }))
+      .catch(this.onError);
+  };
+
+  onRecoveryCodes = () => {
+    const { code } = this.state;
+    request({ type: 'totp-recovery-codes', body: { code } })
+      .then(({ recovery_codes: recoveryCodes }) => this.setState({ recoveryCodes, code: '', error: null }))
+      .catch(this.onError);
+  };
+
+  onDisable = () => {
+    const { code } = this.state;
+    request({ type: 'totp-disable', body: { code } })
+      .then(() => this.setState({
+        enabled: false, recoveryCodes: null, code: '', error: null,
+      }))
+      .catch(this.onError);
+  };
+
+  renderCodeInput() {
+    const { code } = this.state;
+    return (
+      <input
+        type="text"
+        className="form-control d-inline-block mr-2"
+        style={{ width: '12em' }}
+        placeholder="Code"
+        autoComplete="one-time-code"
+        value={code}
+        onChange={(e) => this.setState({ code: e.target.value })}
+      />
+    );
+  }
+
+  render() {
+    const { onDone } = this.props;
+    const {
+      enabled, enrolment, recoveryCodes, error,
+    } = this.state;
+
+    return (
+      <Card title="Two-factor authentication">
+        {error && <div className="alert alert-danger">{error}</div>}
+        {recoveryCodes && (
+          <div className="alert alert-success">
+            Save these recovery codes somewhere safe. Each of them can be used
+            once instead of a code if you lose your authenticator. They will
+            not be shown again.
+            <pre className="mb-0 mt-2">{recoveryCodes.join('\n')}</pre>
+            {onDone && (
+              <Button color="primary" className="mt-2" onClick={onDone}>
+                Continue
+              </Button>
+            )}
+          </div>
+        )}
+
+        {!enabled && !enrolment && (
+          <>
+            <p>
+              Two-factor authentication is not enabled. When it is enabled a
+              code from an authenticator app is needed to login with a
+              password.
+            </p>
+            <Button color="primary" onClick={this.onEnrol}>
+              Enable
+            </Button>
+          </>
+        )}
+
+        {!enabled && enrolment && (
+          <form onSubmit={this.onConfirm}>
+            <p>
+              Add this secret to your authenticator app, or open the link on
+              the phone, and enter the code it shows to confirm.
+            </p>
+            <pre>{enrolment.secret}</pre>
+            <p>
+              <a href={enrolment.uri}>{enrolment.uri}</a>
+            </p>
+            {this.renderCodeInput()}
+            <Button color="primary" type="submit">
+              Confirm
+            </Button>
+          </form>
+        )}
+
+        {enabled && !recoveryCodes && (
+          <>
+            <p>
+              Two-factor authentication is enabled. Enter a code to create new
+              recovery codes or to disable it.
+            </p>
+            {this.renderCodeInput()}
+            <Button color="secondary" className="mr-2" onClick={this.onRecoveryCodes}>
+              New recovery codes
+            </Button>
+            <Button color="danger" onClick={this.onDisable}>
+              Disable
+            </Button>
+          </>
+        )}
+      </Card>
+    );
+  }
+}
+
+export default TwoFactor;
@@ -71,9 +71,9 @@ class Websocket extends Component {
     }
   }
 
-  onOpen = ({ method, user }) => {
+  onOpen = ({ method, user, totp_enrolment: totpEnrolment }) => {
     const url = Url.parse(this.props.url);
-    this.props.dispatch(connected(url.port, method, user));
+    this.props.dispatch(connected(url.port, method, user, totpEnrolment));
 
     if (url.protocol === 'wss:') {
       this.props.dispatch(updateServer({ secure: true }));
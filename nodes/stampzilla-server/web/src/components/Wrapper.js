@@ -5,10 +5,11 @@ import React from 'react';
 import App from './App';
 import Landing from './Landing';
 import Routes from '../routes';
+import TOTPEnrolment from './TOTPEnrolment';
 import Websocket from './Websocket';
 
 const Wrapper = (props) => {
-  const { server, connection } = props;
+  const { server, connection, totpEnrolment } = props;
 
   const secure = (window.location.protocol.match(/^https/) || server.get('secure'))
     && connection !== 4001;
@@ -17,7 +18,8 @@ const Wrapper = (props) => {
     <React.Fragment>
       <Websocket />
       {!secure && <Landing />}
-      {secure && (
+      {secure && totpEnrolment && <TOTPEnrolment />}
+      {secure && !totpEnrolment && (
         <Router>
           <App>
             <Routes />
@@ -31,6 +33,7 @@ const Wrapper = (props) => {
 const mapToProps = state => ({
   server: state.get('server'),
   connection: state.getIn(['connection', 'code']),
+  totpEnrolment: state.getIn(['connection', 'totpEnrolment']),
 });
 
 export default connect(mapToProps)(Wrapper);
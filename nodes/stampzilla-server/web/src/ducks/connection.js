@@ -19,15 +19,16 @@ const defaultState = Map({
   error: null,
   messages: List(),
   user: null,
+  totpEnrolment: false,
 });
 
 // Actions
 export function connecting(port) {
   return { type: c.CONNECTING, port };
 }
-export function connected(port, method, user) {
+export function connected(port, method, user, totpEnrolment) {
   return {
-    type: c.CONNECTED, port, method, user,
+    type: c.CONNECTED, port, method, user, totpEnrolment,
   };
 }
 
@@ -68,6 +69,7 @@ export default function reducer(state = defaultState, action) {
         .set('connected', true)
         .set('method', action.method)
         .set('user', action.user)
+        .set('totpEnrolment', !!action.totpEnrolment)
         .set('code', 0)
         .set('port', action.port)
         .set('reason', '');
@@ -77,6 +79,7 @@ export default function reducer(state = defaultState, action) {
         .set('connected', false)
         .set('method', null)
         .set('user', null)
+        .set('totpEnrolment', false)
         .set('code', action.code)
         .set('connecting', action.retrying)
         .set('reason', action.reason);
@@ -4,9 +4,10 @@ import { connect } from 'react-redux';
 import Form from 'react-jsonschema-form';
 
 import { add, save, remove } from '../../ducks/persons';
-import { write } from '../../components/Websocket';
+import { write, request } from '../../components/Websocket';
 import Card from '../../components/Card';
 import CustomCheckbox from '../../components/CustomCheckbox';
+import Tokens from './Tokens';
 
 const schema = {
   type: 'object',
@@ -142,6 +143,16 @@ class Person extends Component {
     }
   };
 
+  onResetTOTP = () => {
+    if (confirm('Disable two-factor authentication for this person?')) {
+      const { match } = this.props;
+      request({
+        type: 'totp-disable',
+        body: { person: match.params.uuid },
+      }).catch((error) => alert(error));
+    }
+  };
+
   onBackClick = () => {
     const { history } = this.props;
     history.push('/persons');
@@ -208,6 +219,16 @@ class Person extends Component {
                   Remove
                 </Button>
 
+                {person && person.get('totp_enabled') && (
+                  <Button
+                    color="warning"
+                    onClick={this.onResetTOTP}
+                    className="ml-2 btn-sm"
+                  >
+                    Reset two-factor authentication
+                  </Button>
+                )}
+
                 <Button
                   color="primary"
                   disabled={!this.state.isValid || this.props.disabled}
@@ -220,6 +241,13 @@ class Person extends Component {
             </Card>
           </div>
         </div>
+        {person && (
+          <div className="row">
+            <div className="col-md-12">
+              <Tokens person={person} />
+            </div>
+          </div>
+        )}
       </>
     );
   }
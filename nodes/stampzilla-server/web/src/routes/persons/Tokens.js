@@ -0,0 +1,145 @@
+import React, { Component } from 'react';
+import { Button } from 'reactstrap';
+import Moment from 'react-moment';
+
+import { request } from '../../components/Websocket';
+import Card from '../../components/Card';
+import FormModal from '../../components/FormModal';
+
+const schema = {
+  type: 'object',
+  required: ['name'],
+  properties: {
+    name: {
+      type: 'string',
+      title: 'Name',
+    },
+    scopes: {
+      type: 'array',
+      title: 'Scopes',
+      items: {
+        type: 'string',
+        enum: ['control-devices', 'manage-rules', 'manage-nodes'],
+      },
+      uniqueItems: true,
+    },
+  },
+};
+const uiSchema = {
+  scopes: {
+    'ui:widget': 'checkboxes',
+  },
+};
+
+class Tokens extends Component {
+  state = {
+    modalOpen: false,
+    created: null,
+    error: null,
+  };
+
+  onCreate = ({ formData }) => {
+    const { person } = this.props;
+    request({
+      type: 'create-token',
+      body: {
+        ...formData,
+        person: person.get('uuid'),
+      },
+    })
+      .then((created) => this.setState({ modalOpen: false, created, error: null }))
+      .catch((error) => this.setState({ modalOpen: false, error }));
+  };
+
+  onRevoke = (id) => () => {
+    if (confirm('Are you sure?')) {
+      const { person } = this.props;
+      request({
+        type: 'revoke-token',
+        body: {
+          person: person.get('uuid'),
+          id,
+        },
+      }).catch((error) => this.setState({ error }));
+    }
+  };
+
+  render() {
+    const { person } = this.props;
+    const { modalOpen, created, error } = this.state;
+    const tokens = person.get('tokens');
+
+    return (
+      <Card
+        title="API tokens"
+        bodyClassName="p-0"
+        toolbar={[
+          {
+            icon: 'fa fa-plus',
+            className: 'btn-secondary',
+            onClick: () => this.setState({ modalOpen: true, created: null }),
+          },
+        ]}
+      >
+        {created && (
+          <div className="alert alert-success m-2">
+            Token
+            {' '}
+            <strong>{created.name}</strong>
+            {' '}
+            was created. Copy it now, it will not be shown again.
+            <pre className="mb-0 mt-2">{created.token}</pre>
+          </div>
+        )}
+        {error && <div className="alert alert-danger m-2">{String(error)}</div>}
+        <table className="table table-striped table-valign-middle">
+          <thead>
+            <tr>
+              <th>Name</th>
+              <th>Scopes</th>
+              <th>Created</th>
+              <th>Last used</th>
+              <th />
+            </tr>
+          </thead>
+          <tbody>
+            {tokens
+              && tokens
+                .map((t) => (
+                  <tr key={t.get('id')}>
+                    <td>{t.get('name')}</td>
+                    <td>{(t.get('scopes') || []).join(', ')}</td>
+                    <td>
+                      <Moment fromNow>{t.get('created')}</Moment>
+                    </td>
+                    <td>
+                      {t.get('last_used') && !t.get('last_used').startsWith('0001-') ? (
+                        <Moment fromNow>{t.get('last_used')}</Moment>
+                      ) : (
+                        'never'
+                      )}
+                    </td>
+                    <td className="text-right">
+                      <Button color="danger" className="btn-sm" onClick={this.onRevoke(t.get('id'))}>
+                        Revoke
+                      </Button>
+                    </td>
+                  </tr>
+                ))
+                .toArray()}
+          </tbody>
+        </table>
+        <FormModal
+          title="Create API token"
+          schema={schema}
+          uiSchema={uiSchema}
+          isOpen={modalOpen}
+          onClose={() => this.setState({ modalOpen: false })}
+          onSubmit={this.onCreate}
+        />
+      </Card>
+    );
+  }
+}
+
+export default Tokens;
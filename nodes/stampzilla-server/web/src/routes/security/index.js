@@ -4,6 +4,7 @@ import Moment from 'react-moment';
 
 import { write } from '../../components/Websocket';
 import Card from '../../components/Card';
+import TwoFactor from '../../components/TwoFactor';
 
 const typeOrder = ['ca', 'server', 'client'];
 
@@ -33,7 +34,9 @@ class Security extends Component {
   };
 
   render() {
-    const { certificates, requests, connections } = this.props;
+    const {
+      certificates, requests, connections, user, method,
+    } = this.props;
 
     return (
       <React.Fragment>
@@ -107,6 +110,7 @@ class Security extends Component {
                     <th>Common name</th>
                     <th>Type</th>
                     <th>Issued</th>
+                    <th>Expires</th>
                     <th>Fingerprint (sha1)</th>
                     <th />
                   </tr>
@@ -143,15 +147,26 @@ class Security extends Component {
                             {n.get('issued')}
                           </Moment>
                         </td>
+                        <td>
+                          <Moment fromNow withTitle>
+                            {n.get('expires')}
+                          </Moment>
+                        </td>
                         <td>{n.getIn(['fingerprints', 'sha1'])}</td>
                         <td className="text-right">
-                          <button
-                            type="button"
-                            className="btn btn-danger"
-                            onClick={this.onClickRevoke(n.get('serial'))}
-                          >
-                            Revoke
-                          </button>
+                          {n.get('revoked') && (
+                            <span className="badge badge-danger">Revoked</span>
+                          )}
+                          {!n.get('revoked')
+                            && n.get('usage').includes('client') && (
+                            <button
+                              type="button"
+                              className="btn btn-danger"
+                              onClick={this.onClickRevoke(n.get('serial'))}
+                            >
+                              Revoke
+                            </button>
+                          )}
                         </td>
                       </tr>
                     ))
@@ -162,6 +177,13 @@ class Security extends Component {
             </Card>
           </div>
         </div>
+        {user && method !== 'token' && (
+          <div className="row">
+            <div className="col-md-12">
+              <TwoFactor user={user} />
+            </div>
+          </div>
+        )}
       </React.Fragment>
     );
   }
@@ -171,6 +193,8 @@ const mapToProps = state => ({
   certificates: state.getIn(['certificates', 'list']),
   requests: state.getIn(['requests', 'list']),
   connections: state.getIn(['connections', 'list']),
+  user: state.getIn(['connection', 'user']),
+  method: state.getIn(['connection', 'method']),
 });
 
 export default connect(mapToProps)(Security);
@@ -0,0 +1,249 @@
+package webserver
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/audit"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/handlers"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/helpers"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/devices"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/persons"
+)
+
+// openapi describes the REST API.
+//
+//go:embed openapi.yaml
+var openapi []byte
+
+// apiClient is who made the request. Person is nil for trusted clients, like nodes with a certificate.
+// Token is the id of the API token, if one was used. The person is then limited to the scopes of the token.
+type apiClient struct {
+	Person   *persons.Person
+	Identity string
+	Token    string
+}
+
+// can returns true if the client has the permission. Trusted clients can do everything.
+func (a *apiClient) can(permission persons.Permission) bool {
+	return a.Person == nil || a.Person.Can(permission)
+}
+
+func (a *apiClient) canAccessDevice(dev *devices.Device) bool {
+	return a.Person == nil || a.Person.CanAccessDevice(dev)
+}
+
+func (a *apiClient) auditEntry(c *gin.Context) audit.Entry {
+	e := audit.Entry{
+		Origin:     audit.OriginUser,
+		Connection: "api " + c.Request.RemoteAddr,
+	}
+	if a.Person != nil {
+		e.Person = a.Person.UUID
+		if a.Token != "" {
+			e.Source = "token " + a.Token
+		}
+	} else {
+		e.Origin = audit.OriginIntegration
+		e.Source = a.Identity
+	}
+	return e
+}
+
+func apiError(c *gin.Context, status int, err error) {
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
+
+// initAPI adds the REST API in /api/v1. It uses the same authentication as the websocket, an API token, a client
+// certificate or a session cookie from a local address, and the same permissions.
+func (ws *Webserver) initAPI(r *gin.Engine) {
+	r.GET("/api/v1/openapi.yaml", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/yaml", openapi)
+	})
+
+	api := r.Group("/api/v1", ws.apiAuth())
+
+	api.GET("/devices", ws.handleAPIDevices())
+	api.GET("/devices/:id", ws.handleAPIDevice())
+	api.PATCH("/devices/:id", ws.handleAPIDeviceState())
+
+	nodes := api.Group("", requirePermission(persons.PermissionManageNodes))
+	nodes.GET("/nodes", func(c *gin.Context) {
+		c.JSON(http.StatusOK, ws.Store.GetNodes())
+	})
+	nodes.GET("/nodes/:uuid", func(c *gin.Context) {
+		n := ws.Store.GetNode(c.Param("uuid"))
+		if n == nil {
+			apiError(c, http.StatusNotFound, fmt.Errorf("node %s not found", c.Param("uuid")))
+			return
+		}
+		c.JSON(http.StatusOK, n)
+	})
+
+	rules := api.Group("", requirePermission(persons.PermissionManageRules))
+	rules.GET("/rules", func(c *gin.Context) {
+		c.JSON(http.StatusOK, ws.Store.GetRules())
+	})
+	rules.GET("/rules/:uuid", func(c *gin.Context) {
+		r, ok := ws.Store.GetRules()[c.Param("uuid")]
+		item(c, r, ok, "rule")
+	})
+	rules.GET("/savedstates", func(c *gin.Context) {
+		c.JSON(http.StatusOK, ws.Store.GetSavedStates())
+	})
+	rules.GET("/savedstates/:uuid", func(c *gin.Context) {
+		s, ok := ws.Store.GetSavedStates()[c.Param("uuid")]
+		item(c, s, ok, "saved state")
+	})
+	rules.GET("/schedules", func(c *gin.Context) {
+		c.JSON(http.StatusOK, ws.Store.GetScheduledTasks())
+	})
+	rules.GET("/schedules/:uuid", func(c *gin.Context) {
+		t, ok := ws.Store.GetScheduledTasks()[c.Param("uuid")]
+		item(c, t, ok, "schedule")
+	})
+}
+
+func item(c *gin.Context, v interface{}, ok bool, kind string) {
+	if !ok {
+		apiError(c, http.StatusNotFound, fmt.Errorf("%s %s not found", kind, c.Param("uuid")))
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
+
+// apiAuth identifies the client and aborts with 401 if it is unknown.
+func (ws *Webserver) apiAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := bearerToken(c.Request); token != "" {
+			p, t, err := ws.Store.ValidateToken(token)
+			if err != nil {
+				apiError(c, http.StatusUnauthorized, err)
+				return
+			}
+			c.Set("client", &apiClient{Person: p.WithToken(t), Identity: p.UUID, Token: t.ID})
+			c.Next()
+			return
+		}
+
+		if c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0 {
+			identity := c.Request.TLS.PeerCertificates[0].Subject.CommonName
+			// Persons can download a certificate with their uuid. Other certificates belong to nodes.
+			c.Set("client", &apiClient{Person: ws.Store.GetPerson(identity), Identity: identity})
+			c.Next()
+			return
+		}
+
+		if helpers.IsPrivateIP(c.Request.RemoteAddr) {
+			if id, ok := sessions.Default(c).Get("id").(string); ok {
+				p := ws.Store.GetPerson(id)
+				if ws.Store.TOTPEnrolmentRequired(p) {
+					apiError(c, http.StatusForbidden, fmt.Errorf("two-factor authentication must be enabled first"))
+					return
+				}
+				if p != nil && p.AllowLogin {
+					c.Set("client", &apiClient{Person: p, Identity: id})
+					c.Next()
+					return
+				}
+			}
+		}
+
+		apiError(c, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+	}
+}
+
+// bearerToken returns the API token in the Authorization header, if any.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+func client(c *gin.Context) *apiClient {
+	return c.MustGet("client").(*apiClient)
+}
+
+func requirePermission(permission persons.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !client(c).can(permission) {
+			apiError(c, http.StatusForbidden, fmt.Errorf("access denied"))
+			return
+		}
+		c.Next()
+	}
+}
+
+func (ws *Webserver) handleAPIDevices() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		a := client(c)
+		list := devices.NewList()
+		for _, dev := range ws.Store.GetDevices().All() {
+			if a.canAccessDevice(dev) {
+				list.Add(dev)
+			}
+		}
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// apiDevice returns the device in the id parameter or aborts with 404. Devices the client can not access are not found.
+func (ws *Webserver) apiDevice(c *gin.Context) *devices.Device {
+	id, err := devices.NewIDFromString(c.Param("id"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return nil
+	}
+	dev := ws.Store.GetDevices().Get(id)
+	if dev == nil || !client(c).canAccessDevice(dev) {
+		apiError(c, http.StatusNotFound, fmt.Errorf("device %s not found", id))
+		return nil
+	}
+	return dev
+}
+
+func (ws *Webserver) handleAPIDevice() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if dev := ws.apiDevice(c); dev != nil {
+			c.JSON(http.StatusOK, dev)
+		}
+	}
+}
+
+// handleAPIDeviceState sends a state-change to the node of the device. The body is the keys to change.
+// The node reports the new state back, so the response is 202 with the requested state.
+func (ws *Webserver) handleAPIDeviceState() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		dev := ws.apiDevice(c)
+		if dev == nil {
+			return
+		}
+
+		a := client(c)
+		if a.Person != nil && !a.Person.CanControlDevice(dev) {
+			apiError(c, http.StatusForbidden, fmt.Errorf("access denied to device %s", dev.ID))
+			return
+		}
+
+		state := make(devices.State)
+		if err := c.ShouldBindJSON(&state); err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		if len(state) == 0 {
+			apiError(c, http.StatusBadRequest, fmt.Errorf("state is empty"))
+			return
+		}
+
+		devs := devices.NewList()
+		devs.Add(&devices.Device{ID: dev.ID, State: state})
+		handlers.SendStateChange(ws.Store, ws.Sender, devs, a.auditEntry(c))
+
+		c.JSON(http.StatusAccepted, state)
+	}
+}
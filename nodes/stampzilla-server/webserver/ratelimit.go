@@ -0,0 +1,100 @@
+package webserver
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/helpers"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/ratelimit"
+)
+
+// SetLoginLimits throttles failed logins and registrations per ip address and username. An alert is sent to the
+// destinations when an ip address or a username is locked out. The limits per username are shared with the
+// websocket handler, which checks two-factor codes.
+func (ws *Webserver) SetLoginLimits(settings ratelimit.Settings, destinations []string) {
+	ws.loginIPs = ratelimit.New(settings)
+	ws.Store.LoginUsers = ratelimit.New(settings)
+	ws.lockoutDestinations = destinations
+}
+
+// SetTrustedProxies sets the ip addresses and CIDR ranges of reverse proxies in front of the server. The client
+// address of their requests is taken from the X-Forwarded-For or X-Real-IP header.
+func (ws *Webserver) SetTrustedProxies(proxies []string) error {
+	nets, err := helpers.ParseProxies(proxies)
+	if err != nil {
+		return fmt.Errorf("webserver: invalid trusted proxy: %s", err)
+	}
+	ws.trustedProxies = nets
+	return nil
+}
+
+// clientAddr returns the address of the client, also when it connects through a trusted proxy.
+func (ws *Webserver) clientAddr(r *http.Request) string {
+	return helpers.ClientAddr(r, ws.trustedProxies)
+}
+
+// loginAllowed responds with 429 and returns false if the ip address or the username has to wait before the next attempt.
+func (ws *Webserver) loginAllowed(c *gin.Context, username string) bool {
+	if ws.loginIPs == nil {
+		return true
+	}
+
+	now := time.Now()
+	wait := ws.loginIPs.Allow(helpers.RemoteIP(ws.clientAddr(c.Request)), now)
+	if username != "" {
+		if w := ws.Store.LoginUsers.Allow(strings.ToLower(username), now); w > wait {
+			wait = w
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.String(http.StatusTooManyRequests, fmt.Sprintf("too many failed attempts, try again in %d seconds", seconds))
+	return false
+}
+
+// loginFailed records a failed attempt from the ip address for the username.
+func (ws *Webserver) loginFailed(c *gin.Context, username string) {
+	if ws.loginIPs == nil {
+		return
+	}
+
+	now := time.Now()
+	ip := helpers.RemoteIP(ws.clientAddr(c.Request))
+	if ws.loginIPs.Fail(ip, now) {
+		ws.lockoutAlert(fmt.Sprintf("Logins from %s are locked out after too many failed attempts", ip))
+	}
+	if username != "" && ws.Store.LoginUsers.Fail(strings.ToLower(username), now) {
+		ws.lockoutAlert(fmt.Sprintf("Logins for user %s are locked out after too many failed attempts, the last from %s", username, ip))
+	}
+}
+
+// loginSucceeded forgets the failures of the username. Failures from the ip address are kept so a known password
+// can not be used to keep guessing the passwords of others.
+func (ws *Webserver) loginSucceeded(username string) {
+	if ws.Store.LoginUsers == nil {
+		return
+	}
+	ws.Store.LoginUsers.Reset(strings.ToLower(username))
+}
+
+func (ws *Webserver) lockoutAlert(body string) {
+	logrus.Warn(body)
+	destinations := ws.lockoutDestinations
+	go func() {
+		for _, dest := range destinations {
+			if err := ws.Store.TriggerDestination(dest, body); err != nil {
+				logrus.Errorf("webserver: error sending lockout alert to %s: %s", dest, err)
+			}
+		}
+	}()
+}
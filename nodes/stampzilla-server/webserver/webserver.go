@@ -5,6 +5,8 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -26,6 +28,7 @@ import (
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/helpers"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/models/persons"
+	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/ratelimit"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/store"
 	"github.com/stampzilla/stampzilla-go/v2/nodes/stampzilla-server/websocket"
 )
@@ -35,15 +38,23 @@ type Webserver struct {
 	Melody           *melody.Melody
 	Config           *models.Config
 	WebsocketHandler handlers.WebsocketHandler
+	Sender           websocket.Sender
 	router           http.Handler
 	CA               *ca.CA
+
+	// loginIPs is optional and throttles failed logins, see SetLoginLimits.
+	loginIPs            *ratelimit.Limiter
+	lockoutDestinations []string
+	// trustedProxies are the reverse proxies whose forwarded headers are used, see SetTrustedProxies.
+	trustedProxies []*net.IPNet
 }
 
-func New(s *store.Store, conf *models.Config, wsh handlers.WebsocketHandler, m *melody.Melody, ca *ca.CA) *Webserver {
+func New(s *store.Store, conf *models.Config, wsh handlers.WebsocketHandler, sender websocket.Sender, m *melody.Melody, ca *ca.CA) *Webserver {
 	return &Webserver{
 		Store:            s,
 		Config:           conf,
 		WebsocketHandler: wsh,
+		Sender:           sender,
 		Melody:           m,
 		CA:               ca,
 	}
@@ -82,6 +93,7 @@ func (ws *Webserver) Init(requireAuth bool) *gin.Engine {
 		r.POST("/register", ws.handleRegister())
 		r.GET("/cert", ws.handleDownloadCert())
 		r.GET("/logout", ws.handleLogout())
+		ws.initAPI(r)
 	}
 
 	var statikFS http.FileSystem
@@ -103,6 +115,7 @@ func (ws *Webserver) Init(requireAuth bool) *gin.Engine {
 
 	// Setup gin
 	r.GET("/ca.crt", ws.handleDownloadCA())
+	r.GET("/ca.crl", ws.handleDownloadCRL())
 	r.GET("/ws", ws.handleWs(ws.Melody))
 
 	ws.router = r
@@ -182,7 +195,7 @@ func (ws *Webserver) handleConnect(requireAuth bool) func(s *melody.Session) {
 		// Add the connection to our list of connections
 		ws.Store.AddOrUpdateConnection(id.(string), &models.Connection{
 			Type:       proto.(string),
-			RemoteAddr: s.Request.RemoteAddr,
+			RemoteAddr: ws.clientAddr(s.Request),
 			Attributes: s.Keys,
 			Session:    s,
 		})
@@ -206,6 +219,7 @@ func (ws *Webserver) handleConnect(requireAuth bool) func(s *melody.Session) {
 		if i, exists := s.Get("identity"); exists {
 			// Try to add info about the logged in user
 			readyInfo.User = ws.Store.GetPerson(i.(string))
+			readyInfo.TOTPEnrolment = secure == "session" && ws.Store.TOTPEnrolmentRequired(readyInfo.User)
 		}
 
 		msg, err = models.NewMessage("ready", readyInfo)
@@ -315,6 +329,18 @@ func (ws *Webserver) handleDownloadCA() func(c *gin.Context) {
 	}
 }
 
+// handleDownloadCRL serves the list of revoked certificates.
+func (ws *Webserver) handleDownloadCRL() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		crl, err := ioutil.ReadFile(path.Join("certificates", "ca.crl"))
+		if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.Data(http.StatusOK, "application/pkix-crl", crl)
+	}
+}
+
 func (ws *Webserver) handleDownloadCert() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		// Only allowed with local addresses
@@ -360,8 +386,19 @@ func (ws *Webserver) handleWs(m *melody.Melody) func(c *gin.Context) {
 		// Try to identify the client
 		if c.Request.TLS != nil {
 			certs := c.Request.TLS.PeerCertificates
-			if len(certs) > 0 {
+			if token := bearerToken(c.Request); token != "" {
+				p, t, err := ws.Store.ValidateToken(token)
+				if err != nil {
+					logrus.Warnf("webserver: %s from %s", err, c.Request.RemoteAddr)
+					c.AbortWithStatus(http.StatusUnauthorized)
+					return
+				}
+				keys["identity"] = p.UUID
+				keys["token"] = t.ID
+				keys["secure"] = "token"
+			} else if len(certs) > 0 {
 				keys["identity"] = certs[0].Subject.CommonName
+				keys["serial"] = certs[0].SerialNumber.String()
 				keys["secure"] = "cert"
 
 				// Only accept X- headers from clients with a certificate
@@ -420,8 +457,14 @@ func (ws *Webserver) handleLogin() func(c *gin.Context) {
 			return
 		}
 
-		user, err := ws.Store.ValidateLogin(c.PostForm("username"), c.PostForm("password"))
+		username := c.PostForm("username")
+		if !ws.loginAllowed(c, username) {
+			return
+		}
+
+		user, err := ws.Store.ValidateLogin(username, c.PostForm("password"))
 		if err != nil {
+			ws.loginFailed(c, username)
 			c.String(http.StatusUnauthorized, err.Error())
 			return
 		}
@@ -431,6 +474,20 @@ func (ws *Webserver) handleLogin() func(c *gin.Context) {
 			return
 		}
 
+		if user.TOTPEnabled {
+			code := c.PostForm("code")
+			if code == "" {
+				c.String(http.StatusUnauthorized, "two-factor code required")
+				return
+			}
+			if err := ws.Store.CheckSecondFactor(user.UUID, code); err != nil {
+				ws.loginFailed(c, username)
+				c.String(http.StatusUnauthorized, err.Error())
+				return
+			}
+		}
+		ws.loginSucceeded(username)
+
 		err = ws.login(c, user)
 		if err != nil {
 			c.String(http.StatusInternalServerError, err.Error())
@@ -475,19 +532,26 @@ func (ws *Webserver) handleRegister() func(c *gin.Context) {
 			return
 		}
 
+		if !ws.loginAllowed(c, "") {
+			return
+		}
+
 		// Only allow register if no admin exists
 		if ws.Store.CountAdmins() > 0 {
+			ws.loginFailed(c, "")
 			c.AbortWithStatus(403)
 			return
 		}
 
 		if len(c.PostForm("username")) < 1 {
+			ws.loginFailed(c, "")
 			c.String(http.StatusBadRequest, "username is to short, min 1 character")
 			c.Abort()
 			return
 		}
 
 		if len(c.PostForm("password")) < 8 {
+			ws.loginFailed(c, "")
 			c.String(http.StatusBadRequest, "password is to short, min 8 characters")
 			c.Abort()
 			return
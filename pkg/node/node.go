@@ -244,11 +244,16 @@ func (n *Node) Connect() error {
 		}
 	}
 
-	// If we have certificate we can connect to TLS immediately
+	// If we have certificate we can connect to TLS immediately. The certificate is read on every connect since
+	// it can be renewed while we are connected.
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{*n.TLS},
-		RootCAs:      n.CA,
-		ServerName:   "localhost",
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			return n.TLS, nil
+		},
+		RootCAs:    n.CA,
+		ServerName: "localhost",
 	}
 
 	n.Client.SetTLSConfig(tlsConfig)
@@ -302,6 +307,21 @@ func (n *Node) reader(ctx context.Context) {
 				logrus.Error("node:", err)
 				continue
 			}
+
+			// Certificate renewal is handled by the node itself
+			switch msg.Type {
+			case "renew-certificate":
+				if err := n.renewCertificate(); err != nil {
+					logrus.Error("node: error renewing certificate: ", err)
+				}
+				continue
+			case "approved-certificate-signing-request":
+				if err := n.saveRenewedCertificate(msg.Body); err != nil {
+					logrus.Error("node: error saving renewed certificate: ", err)
+				}
+				continue
+			}
+
 			cbs := n.getCallbacks()
 			for _, cb := range cbs[msg.Type] {
 				err := cb(msg.Body)
@@ -341,8 +361,10 @@ func (n *Node) loadCertificateKeyPair(name string) error {
 		return err
 	}
 
+	n.mutex.Lock()
 	n.TLS = &certTLS
 	n.X509 = certX509
+	n.mutex.Unlock()
 	n.UUID = certX509.Subject.CommonName
 
 	// Load CA cert
@@ -381,13 +403,26 @@ func (n *Node) generateKey() (*rsa.PrivateKey, error) {
 }
 
 func (n *Node) generateCSR() ([]byte, error) {
+	id := uuid.New().String()
+	d, err := n.createCSR(id)
+	if err != nil {
+		return nil, err
+	}
+
+	n.UUID = id
+
+	return d, nil
+}
+
+// createCSR creates a CSR for the common name with the key in crt.key.
+func (n *Node) createCSR(commonName string) ([]byte, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
 
 	subj := pkix.Name{
-		CommonName:         uuid.New().String(),
+		CommonName:         commonName,
 		Organization:       []string{"stampzilla-go"},
 		OrganizationalUnit: []string{hostname, n.Type},
 	}
@@ -403,11 +438,67 @@ func (n *Node) generateCSR() ([]byte, error) {
 	}
 
 	csrBytes, _ := x509.CreateCertificateRequest(rand.Reader, &template, priv)
-	d := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes}), nil
+}
 
-	n.UUID = template.Subject.CommonName
+// renewCertificate sends a new CSR for our identity to the server over the secure connection. The server asks for
+// it when our certificate expires soon.
+func (n *Node) renewCertificate() error {
+	csr, err := n.createCSR(n.UUID)
+	if err != nil {
+		return err
+	}
 
-	return d, nil
+	logrus.Info("Renewing certificate")
+	return n.WriteMessage("certificate-signing-request", models.Request{
+		Type:    n.Type,
+		Version: n.Version,
+		CSR:     string(csr),
+	})
+}
+
+// saveRenewedCertificate verifies the renewed certificate from the server and replaces crt.crt with it.
+// It is used the next time we connect.
+func (n *Node) saveRenewedCertificate(body json.RawMessage) error {
+	var rawCert string
+	if err := json.Unmarshal(body, &rawCert); err != nil {
+		return err
+	}
+
+	key, err := ioutil.ReadFile("crt.key")
+	if err != nil {
+		return err
+	}
+	certTLS, err := tls.X509KeyPair([]byte(rawCert), key)
+	if err != nil {
+		return err
+	}
+	certX509, err := x509.ParseCertificate(certTLS.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if certX509.Subject.CommonName != n.UUID {
+		return fmt.Errorf("certificate is for %s and not for us", certX509.Subject.CommonName)
+	}
+	_, err = certX509.Verify(x509.VerifyOptions{
+		Roots:     n.CA,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic("crt.crt", []byte(rawCert), 0644); err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	n.TLS = &certTLS
+	n.X509 = certX509
+	n.mutex.Unlock()
+
+	logrus.Infof("Renewed certificate, valid until %s", certX509.NotAfter)
+	return nil
 }
 
 // On sets up a callback that is run when a message received with type what.